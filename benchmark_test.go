@@ -7,8 +7,12 @@
 package zoom
 
 import (
+	"encoding/json"
 	"math/rand"
+	"strconv"
 	"testing"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 // BenchmarkConnection just gets a connection and then closes it
@@ -93,6 +97,68 @@ func BenchmarkSave100(b *testing.B) {
 	}
 }
 
+// BenchmarkSaveGzip saves a model with a large JSON field, with and without
+// the gzip struct tag. In addition to the time per save, it reports the number
+// of bytes used to store the field in redis.
+func BenchmarkSaveGzip(b *testing.B) {
+	type uncompressedModel struct {
+		JSON string
+		RandomId
+	}
+	type gzipModel struct {
+		JSON string `zoom:"gzip"`
+		RandomId
+	}
+	records := []map[string]string{}
+	for i := 0; i < 100; i++ {
+		records = append(records, map[string]string{
+			"id":     strconv.Itoa(i),
+			"name":   "record " + strconv.Itoa(i),
+			"status": "active",
+		})
+	}
+	blob, err := json.Marshal(records)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("Uncompressed", func(b *testing.B) {
+		benchmarkSaveJSONField(b, &uncompressedModel{JSON: string(blob)})
+	})
+	b.Run("Gzip", func(b *testing.B) {
+		benchmarkSaveJSONField(b, &gzipModel{JSON: string(blob)})
+	})
+}
+
+// benchmarkSaveJSONField saves model repeatedly and then reports the size of
+// its JSON field as stored in redis. model should have a field named JSON.
+func benchmarkSaveJSONField(b *testing.B, model Model) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use a new pool so the model type can be registered every time the
+	// benchmark is run.
+	pool := NewPoolWithOptions(testPool.options)
+	defer pool.Close()
+	collection, err := pool.NewCollection(model)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := collection.Save(model); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	conn := pool.NewConn()
+	defer conn.Close()
+	size, err := redis.Int(conn.Do("HSTRLEN", collection.ModelKey(model.ModelId()), "JSON"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(size), "stored-bytes")
+}
+
 // BenchmarkFind finds one model at a time randomly from
 // a set of 1,000 models
 func BenchmarkFind(b *testing.B) {
@@ -449,6 +515,31 @@ func BenchmarkComplexQuery(b *testing.B) {
 	benchmarkQuery(b, q)
 }
 
+// BenchmarkQueryThreeFilters runs a query with a numeric range filter, a string
+// "!=" filter, and a boolean filter on 1,000 models. 100 models fit the query
+// criteria, and the query limits the number of results to 10.
+func BenchmarkQueryThreeFilters(b *testing.B) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createIndexedTestModels(1000)
+	t := testPool.NewTransaction()
+	for i, m := range models {
+		m.Int = i % 10
+		m.String = "string" + strconv.Itoa(i%5)
+		m.Bool = i%2 == 0
+		t.Save(indexedTestModels, m)
+	}
+	if err := t.Exec(); err != nil {
+		b.Fatal(err)
+	}
+
+	// Int >= 5 matches half of the models, String != "string0" matches 4/5 of
+	// those, and Bool = true matches half of the rest.
+	q := indexedTestModels.NewQuery().Filter("Int >=", 5).Filter("String !=", "string0").Filter("Bool =", true).Limit(10)
+	benchmarkQuery(b, q)
+}
+
 func benchmarkQuery(b *testing.B, q *Query) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -545,3 +636,82 @@ func selectUnique(num int, ids []string) []string {
 	}
 	return results
 }
+
+// BenchmarkQueryPlan adds the commands for a query with a filter, an order,
+// and a limit to a transaction without executing it, with and without reusing
+// the cached query plan. The query is constructed with a different filter
+// value each time. It measures the CPU cost of preparing the query, which does
+// not depend on the database.
+func BenchmarkQueryPlan(b *testing.B) {
+	testingSetUp()
+	defer testingTearDown()
+
+	run := func(b *testing.B, resetCache bool) {
+		for i := 0; i < b.N; i++ {
+			if resetCache {
+				indexedTestModels.plansMut.Lock()
+				indexedTestModels.plans = nil
+				indexedTestModels.plansMut.Unlock()
+			}
+			tx := &Transaction{}
+			tx.Query(indexedTestModels).Filter("Int >", i).Order("-String").Limit(10).Run(&[]*indexedTestModel{})
+			if tx.err != nil {
+				b.Fatal(tx.err)
+			}
+		}
+	}
+	b.Run("Uncached", func(b *testing.B) {
+		run(b, true)
+	})
+	b.Run("Cached", func(b *testing.B) {
+		run(b, false)
+	})
+}
+
+// BenchmarkImport10000 saves 10,000 indexed models in an empty collection with
+// Import, which builds the field indexes after all of the models have been
+// written.
+func BenchmarkImport10000(b *testing.B) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := Models(createIndexedTestModels(10000))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if _, err := indexedTestModels.DeleteAll(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		if _, err := indexedTestModels.Import(models); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSave10000 saves 10,000 indexed models in an empty collection with
+// Save in transactions of 1,000 models each, for comparison with
+// BenchmarkImport10000.
+func BenchmarkSave10000(b *testing.B) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := createIndexedTestModels(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if _, err := indexedTestModels.DeleteAll(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		for start := 0; start < len(models); start += 1000 {
+			t := testPool.NewTransaction()
+			for _, model := range models[start : start+1000] {
+				t.Save(indexedTestModels, model)
+			}
+			if err := t.Exec(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File change_log.go contains code related to the change log, a Redis stream
+// which records every save and delete for a collection.
+
+package zoom
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ChangeOp is the kind of operation recorded by an entry in the change log.
+type ChangeOp string
+
+const (
+	// ChangeSave means that a model was saved with Save or SaveFields.
+	ChangeSave ChangeOp = "save"
+	// ChangeDelete means that a model was deleted with Delete or
+	// DeleteAllByIds. The entry is added even if the model did not exist.
+	ChangeDelete ChangeOp = "delete"
+	// ChangeDeleteAll means that all the models in the collection were deleted
+	// with DeleteAll. The ModelId for the entry is empty.
+	ChangeDeleteAll ChangeOp = "deleteAll"
+	// ChangeTruncate means that all the models in the collection were deleted
+	// with Truncate. The ModelId for the entry is empty.
+	ChangeTruncate ChangeOp = "truncate"
+)
+
+// Change is a single entry in the change log for a collection.
+type Change struct {
+	// Id is the id of the entry in the Redis stream. It can be passed to
+	// ReadChanges to read only the entries which were added after this one.
+	Id string
+	// Collection is the name of the collection.
+	Collection string
+	// ModelId is the id of the model that was changed. It is empty for
+	// operations that affect the whole collection.
+	ModelId string
+	// Op is the kind of operation.
+	Op ChangeOp
+	// Fields contains the names of the fields that were saved. It is empty for
+	// delete operations.
+	Fields []string
+}
+
+// changeArgs returns the arguments for an XADD command which adds a change
+// entry to the change log for c.
+func changeArgs(c *Collection, op ChangeOp, modelId string, fieldNames []string) redis.Args {
+	return redis.Args{
+		c.ChangeLogKey(), "*",
+		"collection", c.Name(),
+		"id", modelId,
+		"op", string(op),
+		"fields", strings.Join(fieldNames, ","),
+	}
+}
+
+// addChange adds a command to the transaction which adds an entry to the
+// change log for c. It does nothing if the change log is not enabled for c.
+// It also records the change so that the hooks for the pool are called after
+// the transaction is executed (see Pool.OnSave).
+func (t *Transaction) addChange(c *Collection, op ChangeOp, modelId string, fieldNames []string) {
+	t.addWriteEvent(c, op, modelId)
+	if !c.changeLog {
+		return
+	}
+	t.Command("XADD", changeArgs(c, op, modelId, fieldNames), nil)
+}
+
+// ReadChanges returns all the entries in the change log for the collection
+// which were added after the entry identified by lastId, in the order they
+// were added. If lastId is an empty string, all of the entries are returned.
+// To read only new changes, pass in the Id of the last Change returned by the
+// previous call. ReadChanges does not block if there are no new entries.
+// Instead it returns an empty slice. It returns an error if the change log is
+// not enabled for the collection. Note that the change log is never trimmed by
+// Zoom, so you may want to use XTRIM on the key returned by ChangeLogKey
+// periodically.
+func (c *Collection) ReadChanges(lastId string) ([]Change, error) {
+	if c == nil {
+		return nil, newNilCollectionError("ReadChanges")
+	}
+	if !c.changeLog {
+		return nil, fmt.Errorf("zoom: ReadChanges only works for collections with a change log. To enable it, set the ChangeLog property to true in CollectionOptions when calling Pool.NewCollection")
+	}
+	if lastId == "" {
+		lastId = "0-0"
+	}
+	conn := c.pool.NewConn()
+	defer conn.Close()
+	reply, err := conn.Do("XREAD", "STREAMS", c.ChangeLogKey(), lastId)
+	if err != nil {
+		return nil, err
+	}
+	changes := []Change{}
+	if reply == nil {
+		// There are no new entries.
+		return changes, nil
+	}
+	// The reply is a list of streams, each of which is a two-element list
+	// consisting of the key and the entries. We only read one stream.
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, stream := range streams {
+		streamValues, err := redis.Values(stream, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(streamValues) != 2 {
+			return nil, fmt.Errorf("zoom: Error in ReadChanges: unexpected reply from XREAD: %v", streamValues)
+		}
+		entries, err := redis.Values(streamValues[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			change, err := scanChange(entry)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// scanChange converts a single stream entry from an XREAD reply to a Change.
+func scanChange(entry interface{}) (Change, error) {
+	entryValues, err := redis.Values(entry, nil)
+	if err != nil {
+		return Change{}, err
+	}
+	if len(entryValues) != 2 {
+		return Change{}, fmt.Errorf("zoom: Error in ReadChanges: unexpected stream entry: %v", entryValues)
+	}
+	id, err := redis.String(entryValues[0], nil)
+	if err != nil {
+		return Change{}, err
+	}
+	fields, err := redis.StringMap(entryValues[1], nil)
+	if err != nil {
+		return Change{}, err
+	}
+	change := Change{
+		Id:         id,
+		Collection: fields["collection"],
+		ModelId:    fields["id"],
+		Op:         ChangeOp(fields["op"]),
+	}
+	if fields["fields"] != "" {
+		change.Fields = strings.Split(fields["fields"], ",")
+	}
+	return change, nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File change_log_test.go tests the change log (change_log.go).
+
+package zoom
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangeLog(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use a separate pool so that the change log does not affect other tests.
+	pool := NewPoolWithOptions(testPool.options)
+	defer pool.Close()
+	options := DefaultCollectionOptions.WithIndex(true).WithChangeLog(true).WithName("changeLogTestModel")
+	collection, err := pool.NewCollectionWithOptions(&indexedTestModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// There should not be any changes before anything is saved.
+	changes, err := collection.ReadChanges("")
+	if err != nil {
+		t.Fatalf("Unexpected error in ReadChanges: %s", err.Error())
+	}
+	if len(changes) != 0 {
+		t.Errorf("Expected 0 changes but got %d: %v", len(changes), changes)
+	}
+
+	model := &indexedTestModel{Int: 1, String: "foo"}
+	if err := collection.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	model.Int = 2
+	if err := collection.SaveFields([]string{"Int"}, model); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collection.Delete(model.ModelId()); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = collection.ReadChanges("")
+	if err != nil {
+		t.Fatalf("Unexpected error in ReadChanges: %s", err.Error())
+	}
+	expected := []Change{
+		{Collection: "changeLogTestModel", ModelId: model.ModelId(), Op: ChangeSave, Fields: collection.FieldNames()},
+		{Collection: "changeLogTestModel", ModelId: model.ModelId(), Op: ChangeSave, Fields: []string{"Int"}},
+		{Collection: "changeLogTestModel", ModelId: model.ModelId(), Op: ChangeDelete},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes but got %d: %v", len(expected), len(changes), changes)
+	}
+	for i, change := range changes {
+		if change.Id == "" {
+			t.Errorf("Expected change %d to have an id but it did not", i)
+		}
+		change.Id = ""
+		if !reflect.DeepEqual(change, expected[i]) {
+			t.Errorf("Change %d was incorrect.\nExpected: %#v\nBut got:  %#v", i, expected[i], change)
+		}
+	}
+
+	// Only changes after lastId should be returned.
+	if err := collection.Save(&indexedTestModel{}); err != nil {
+		t.Fatal(err)
+	}
+	newChanges, err := collection.ReadChanges(changes[len(changes)-1].Id)
+	if err != nil {
+		t.Fatalf("Unexpected error in ReadChanges: %s", err.Error())
+	}
+	if len(newChanges) != 1 {
+		t.Fatalf("Expected 1 new change but got %d: %v", len(newChanges), newChanges)
+	}
+	if newChanges[0].Op != ChangeSave {
+		t.Errorf("Expected Op to be %s but got %s", ChangeSave, newChanges[0].Op)
+	}
+
+	// Collections without a change log should not have a stream and should
+	// return an error from ReadChanges.
+	if err := testModels.Save(createTestModels(1)[0]); err != nil {
+		t.Fatal(err)
+	}
+	expectKeyDoesNotExist(t, testModels.ChangeLogKey())
+	if _, err := testModels.ReadChanges(""); err == nil {
+		t.Error("Expected an error for a collection without a change log but got none")
+	}
+}
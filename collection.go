@@ -12,20 +12,44 @@ import (
 	"container/list"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
-var collections = list.New()
+// collections is a list of every Collection that has been created for any
+// pool. It is protected by collectionsMut.
+var (
+	collections    = list.New()
+	collectionsMut sync.RWMutex
+)
 
 // Collection represents a specific registered type of model. It has methods
 // for saving, finding, and deleting models of a specific type. Use the
 // NewCollection method to create a new collection.
 type Collection struct {
-	spec  *modelSpec
-	pool  *Pool
-	index bool
+	spec       *modelSpec
+	pool       *Pool
+	index      bool
+	changeLog  bool
+	strictScan bool
+	// idLength and idAlphabet control how ids are generated for new models.
+	// If idLength is 0, the default scheme used by RandomId is used instead.
+	// See CollectionOptions.IdLength.
+	idLength   int
+	idAlphabet string
+	// keepHistory is the number of previous versions of each model which are
+	// kept in the history. If it is 0, no history is kept. See
+	// CollectionOptions.KeepHistory.
+	keepHistory int
+	// plans caches the compiled plans for queries on the collection, keyed by
+	// the structure of the query. It is protected by plansMut. See queryPlan.
+	plans    map[string]*queryPlan
+	plansMut sync.RWMutex
 }
 
 // CollectionOptions contains various options for a pool.
@@ -51,13 +75,117 @@ type CollectionOptions struct {
 	// name corresponding to *models.User would be "User". If a custom name is
 	// provided, it cannot contain a colon.
 	Name string
+	// If ChangeLog is true, every save or delete of a model in the collection
+	// will add an entry to a Redis stream in the same transaction as the write.
+	// The key for the stream is exposed via the ChangeLogKey method, and the
+	// entries can be read with the ReadChanges method. Requires Redis 5.0 or
+	// later.
+	ChangeLog bool
+	// TimeFormat controls how time.Time fields (and pointers to time.Time) are
+	// stored in the database. It must be one of TimeFormatUnixNano,
+	// TimeFormatUnixMilli, or TimeFormatRFC3339. If TimeFormat is an empty
+	// string, time.Time fields are treated like any other inconvertible type
+	// and encoded with the FallbackMarshalerUnmarshaler, in which case they
+	// cannot be indexed. Times are always scanned back into models in UTC. See
+	// the documentation for each format for more information. Changing the
+	// TimeFormat for an existing collection will make any models already saved
+	// in the database unreadable.
+	TimeFormat string
+	// If StrictScan is true, Find will return an error if the main hash for the
+	// model contains any fields which do not correspond to a field in the model
+	// type. The error lists the names of the unknown fields. This is useful for
+	// catching schema drift (e.g. a field that was renamed or removed from the
+	// struct without migrating the data) in tests. If StrictScan is false, which
+	// is the default, unknown fields are silently ignored. StrictScan only
+	// affects Find and Transaction.Find. It requires an additional HKEYS command
+	// for each call.
+	StrictScan bool
+	// Pool, if not nil, is used to get connections for all of the operations
+	// on the collection (e.g. Save, Find, and queries) instead of the pool used
+	// to create the collection. It can be used to give a busy collection its
+	// own set of connections (e.g. with a higher MaxActive) so that it does not
+	// starve other collections. Pool should connect to the same database as the
+	// pool used to create the collection, which is still the one that the
+	// collection is registered with. Zoom will not close Pool, so you are
+	// responsible for closing it when it is no longer needed. Note that
+	// operations added to a Transaction use the connection for that
+	// Transaction, regardless of Pool.
+	Pool *Pool
+	// IdLength, if greater than 0, is the number of characters in the ids
+	// which Zoom generates for new models in the collection, instead of the
+	// default scheme used by RandomId. The ids are made of characters chosen
+	// uniformly at random from IdAlphabet with crypto/rand. An id is generated
+	// when a model is saved without an id, and by Transaction.ReserveId. This
+	// only works for models which embed RandomId or have a field with the
+	// `zoom:"id"` struct tag, since Zoom needs to check whether the model
+	// already has an id without calling ModelId. See IdAlphabetBase62 for the
+	// probability of collisions for different lengths.
+	IdLength int
+	// IdAlphabet is the set of characters used for the ids which Zoom
+	// generates if IdLength is greater than 0. It must contain at least 2 and
+	// no more than 256 distinct bytes. If IdAlphabet is an empty string,
+	// IdAlphabetBase62 is used.
+	IdAlphabet string
+	// KeepHistory, if greater than 0, is the number of previous versions of
+	// each model to keep for auditing. Every time a model which already exists
+	// is saved (with Save, SaveFields, or SaveIf), a snapshot of its main hash
+	// is pushed onto a capped list for the model in the same transaction as the
+	// save. The snapshots can be read with the History method. They are raw
+	// hash snapshots, i.e. the fields and values exactly as they are stored in
+	// Redis, not typed models. Keeping history costs up to KeepHistory extra
+	// copies of the main hash for every model, so it can multiply the memory
+	// used by the collection. List fields are not included in the snapshots.
+	KeepHistory int
+	// IndexKeyFuncs maps the names of fields with a string index (as they
+	// appear in the struct definition) to custom key functions, for values
+	// which do not sort lexicographically, e.g. semantic versions where "1.10"
+	// should come after "1.9". The index stores the key returned by the
+	// function for each value instead of the value itself, so orders and range
+	// filters (and Upsert) compare keys byte by byte, and the values passed to
+	// Filter are converted with the same function. The main hash still stores
+	// the original value. A key function must be pure and stable: it must
+	// always return the same key for the same value, and changing it requires
+	// calling ReindexField for the field. It must also be order-preserving,
+	// i.e. values which are equal must have equal keys. The key for each model
+	// is also stored in an extra hash per index, so that the old key can be
+	// removed when the model is saved again or deleted. Use WithIndexKeyFunc to
+	// add a key function.
+	IndexKeyFuncs map[string]func(string) string
 }
 
+const (
+	// TimeFormatUnixNano stores times as the number of nanoseconds since the
+	// unix epoch. It only supports times between the years 1678 and 2262, with
+	// the exception of the zero time, which is stored as an empty string.
+	// Indexed fields use a numeric index and can be used with any filter and
+	// order. Note that numeric indexes store scores as float64, so the index is
+	// only precise to within about a microsecond.
+	TimeFormatUnixNano = "unixnano"
+	// TimeFormatUnixMilli stores times as the number of milliseconds since the
+	// unix epoch, discarding any smaller units. Indexed fields use a numeric
+	// index and can be used with any filter and order.
+	TimeFormatUnixMilli = "unixmilli"
+	// TimeFormatRFC3339 stores times as RFC 3339 strings in UTC with
+	// nanosecond precision (e.g. "2006-01-02T15:04:05.000000000Z"), which can
+	// easily be read by other clients. The time zone of the original time is
+	// not preserved. Indexed fields use a string index. Since every time is
+	// formatted in UTC with the same number of digits, the string index is still
+	// ordered chronologically and can be used with any filter and order.
+	TimeFormatRFC3339 = "rfc3339"
+)
+
 // DefaultCollectionOptions is the default set of options for a collection.
 var DefaultCollectionOptions = CollectionOptions{
 	FallbackMarshalerUnmarshaler: GobMarshalerUnmarshaler,
-	Index: false,
-	Name:  "",
+	Index:                        false,
+	Name:                         "",
+	ChangeLog:                    false,
+	TimeFormat:                   "",
+	StrictScan:                   false,
+	Pool:                         nil,
+	IdLength:                     0,
+	IdAlphabet:                   "",
+	KeepHistory:                  0,
 }
 
 // WithFallbackMarshalerUnmarshaler returns a new copy of the options with the
@@ -75,6 +203,68 @@ func (options CollectionOptions) WithIndex(index bool) CollectionOptions {
 	return options
 }
 
+// WithChangeLog returns a new copy of the options with the ChangeLog property
+// set to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithChangeLog(changeLog bool) CollectionOptions {
+	options.ChangeLog = changeLog
+	return options
+}
+
+// WithStrictScan returns a new copy of the options with the StrictScan
+// property set to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithStrictScan(strictScan bool) CollectionOptions {
+	options.StrictScan = strictScan
+	return options
+}
+
+// WithPool returns a new copy of the options with the Pool property set to the
+// given value. It does not mutate the original options.
+func (options CollectionOptions) WithPool(pool *Pool) CollectionOptions {
+	options.Pool = pool
+	return options
+}
+
+// WithTimeFormat returns a new copy of the options with the TimeFormat property
+// set to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithTimeFormat(timeFormat string) CollectionOptions {
+	options.TimeFormat = timeFormat
+	return options
+}
+
+// WithIdLength returns a new copy of the options with the IdLength property set
+// to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithIdLength(length int) CollectionOptions {
+	options.IdLength = length
+	return options
+}
+
+// WithIdAlphabet returns a new copy of the options with the IdAlphabet property
+// set to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithIdAlphabet(alphabet string) CollectionOptions {
+	options.IdAlphabet = alphabet
+	return options
+}
+
+// WithKeepHistory returns a new copy of the options with the KeepHistory
+// property set to the given value. It does not mutate the original options.
+func (options CollectionOptions) WithKeepHistory(keep int) CollectionOptions {
+	options.KeepHistory = keep
+	return options
+}
+
+// WithIndexKeyFunc returns a new copy of the options with the key function for
+// the string index on the given field set to keyFunc (see IndexKeyFuncs). It
+// does not mutate the original options, including the IndexKeyFuncs map.
+func (options CollectionOptions) WithIndexKeyFunc(fieldName string, keyFunc func(string) string) CollectionOptions {
+	keyFuncs := make(map[string]func(string) string, len(options.IndexKeyFuncs)+1)
+	for name, fn := range options.IndexKeyFuncs {
+		keyFuncs[name] = fn
+	}
+	keyFuncs[fieldName] = keyFunc
+	options.IndexKeyFuncs = keyFuncs
+	return options
+}
+
 // WithName returns a new copy of the options with the Name property set to the
 // given value. It does not mutate the original options.
 func (options CollectionOptions) WithName(name string) CollectionOptions {
@@ -84,10 +274,11 @@ func (options CollectionOptions) WithName(name string) CollectionOptions {
 
 // NewCollection registers and returns a new collection of the given model type.
 // You must create a collection for each model type you want to save. The type
-// of model must be unique, i.e., not already registered, and must be a pointer
-// to a struct. NewCollection will use all the default options for the
-// collection, which are specified in DefaultCollectionOptions. If you want to
-// specify different options, use the NewCollectionWithOptions method.
+// of model must be unique, i.e., not already registered (see
+// UnregisterCollection), and must be a pointer to a struct. NewCollection will
+// use all the default options for the collection, which are specified in
+// DefaultCollectionOptions. If you want to specify different options, use the
+// NewCollectionWithOptions method.
 func (p *Pool) NewCollection(model Model) (*Collection, error) {
 	return p.NewCollectionWithOptions(model, DefaultCollectionOptions)
 }
@@ -104,31 +295,92 @@ func (p *Pool) NewCollectionWithOptions(model Model, options CollectionOptions)
 		return nil, fmt.Errorf("zoom: CollectionOptions.Name cannot contain a colon. Got: %s", options.Name)
 	}
 
-	// Make sure the name and type have not been previously registered
-	switch {
-	case p.typeIsRegistered(typ):
-		return nil, fmt.Errorf("zoom: Error in NewCollection: The type %T has already been registered", model)
-	case p.nameIsRegistered(options.Name):
-		return nil, fmt.Errorf("zoom: Error in NewCollection: The name %s has already been registered", options.Name)
-	case !typeIsPointerToStruct(typ):
+	if !typeIsPointerToStruct(typ) {
 		return nil, fmt.Errorf("zoom: NewCollection requires a pointer to a struct as an argument. Got type %T", model)
 	}
 
-	// Compile the spec for this model and store it in the maps
-	spec, err := compileModelSpec(typ)
+	if options.IdLength < 0 {
+		return nil, fmt.Errorf("zoom: Error in NewCollection: CollectionOptions.IdLength cannot be negative. Got: %d", options.IdLength)
+	}
+	if options.IdLength > 0 {
+		if options.IdAlphabet == "" {
+			options.IdAlphabet = IdAlphabetBase62
+		}
+		if err := checkIdAlphabet(options.IdAlphabet); err != nil {
+			return nil, fmt.Errorf("zoom: Error in NewCollection: %s", err.Error())
+		}
+	}
+
+	if options.KeepHistory < 0 {
+		return nil, fmt.Errorf("zoom: Error in NewCollection: CollectionOptions.KeepHistory cannot be negative. Got: %d", options.KeepHistory)
+	}
+
+	// Compile the spec for this model
+	switch options.TimeFormat {
+	case "", TimeFormatUnixNano, TimeFormatUnixMilli, TimeFormatRFC3339:
+	default:
+		return nil, fmt.Errorf("zoom: Error in NewCollection: Unknown CollectionOptions.TimeFormat: %q", options.TimeFormat)
+	}
+	spec, err := compileModelSpec(typ, options.TimeFormat)
 	if err != nil {
 		return nil, err
 	}
 	spec.name = options.Name
 	spec.fallback = options.FallbackMarshalerUnmarshaler
+	if options.KeepHistory > 0 {
+		// The history list for a model would have the same key as a list
+		// field with the same name.
+		for _, fs := range spec.lists {
+			if fs.redisName == historyKeySuffix {
+				return nil, fmt.Errorf("zoom: Error in NewCollection: CollectionOptions.KeepHistory cannot be used with a list field named %s", historyKeySuffix)
+			}
+		}
+	}
+
+	for fieldName, keyFunc := range options.IndexKeyFuncs {
+		fs, found := spec.fieldsByName[fieldName]
+		if !found {
+			return nil, fmt.Errorf("zoom: Error in NewCollection: CollectionOptions.IndexKeyFuncs contains %s, which is not a field of %s", fieldName, typ.String())
+		}
+		if fs.indexKind != stringIndex {
+			return nil, fmt.Errorf("zoom: Error in NewCollection: CollectionOptions.IndexKeyFuncs contains %s, which does not have a string index", fieldName)
+		}
+		if keyFunc == nil {
+			return nil, fmt.Errorf("zoom: Error in NewCollection: the key function for %s in CollectionOptions.IndexKeyFuncs is nil", fieldName)
+		}
+		fs.indexKeyFunc = keyFunc
+	}
+
+	// Make sure the name and type have not been previously registered, and
+	// store the spec in the maps. The lock is held for both so that concurrent
+	// calls cannot register the same name or type twice.
+	p.registryMut.Lock()
+	defer p.registryMut.Unlock()
+	if _, found := p.modelTypeToSpec[typ]; found {
+		return nil, fmt.Errorf("zoom: Error in NewCollection: The type %T has already been registered", model)
+	}
+	if _, found := p.modelNameToSpec[options.Name]; found {
+		return nil, fmt.Errorf("zoom: Error in NewCollection: The name %s has already been registered", options.Name)
+	}
 	p.modelTypeToSpec[typ] = spec
 	p.modelNameToSpec[options.Name] = spec
 
+	// Use the dedicated pool for connections if there is one.
+	connPool := p
+	if options.Pool != nil {
+		connPool = options.Pool
+	}
 	collection := &Collection{
-		spec:  spec,
-		pool:  p,
-		index: options.Index,
+		spec:        spec,
+		pool:        connPool,
+		index:       options.Index,
+		changeLog:   options.ChangeLog,
+		strictScan:  options.StrictScan,
+		idLength:    options.IdLength,
+		idAlphabet:  options.IdAlphabet,
+		keepHistory: options.KeepHistory,
 	}
+	p.modelNameToCollection[options.Name] = collection
 	addCollection(collection)
 	return collection, nil
 }
@@ -140,9 +392,34 @@ func (c *Collection) Name() string {
 	return c.spec.name
 }
 
+// UnregisterCollection removes the collection with the given name from the
+// pool, so that the same type or name can be registered again with
+// NewCollection or NewCollectionWithOptions (e.g. with different options).
+// It is mostly useful for tests which register collections repeatedly. It does
+// not change any data in the database. Any existing references to the
+// collection can still be used to read and write its models, but they should
+// not be used once the type or name has been registered again. It returns an
+// error if no collection with the given name has been registered. It is safe
+// to call UnregisterCollection concurrently with NewCollection.
+func (p *Pool) UnregisterCollection(name string) error {
+	p.registryMut.Lock()
+	defer p.registryMut.Unlock()
+	collection, found := p.modelNameToCollection[name]
+	if !found {
+		return fmt.Errorf("zoom: Error in UnregisterCollection: No collection named %s has been registered", name)
+	}
+	delete(p.modelNameToCollection, name)
+	delete(p.modelNameToSpec, name)
+	delete(p.modelTypeToSpec, collection.spec.typ)
+	removeCollection(collection)
+	return nil
+}
+
 // addCollection adds the given spec to the list of collections iff it has not
 // already been added.
 func addCollection(collection *Collection) {
+	collectionsMut.Lock()
+	defer collectionsMut.Unlock()
 	for e := collections.Front(); e != nil; e = e.Next() {
 		otherCollection := e.Value.(*Collection)
 		if collection.spec.typ == otherCollection.spec.typ {
@@ -154,25 +431,44 @@ func addCollection(collection *Collection) {
 	collections.PushFront(collection)
 }
 
+// removeCollection removes the given collection from the list of collections
+// if it is there.
+func removeCollection(collection *Collection) {
+	collectionsMut.Lock()
+	defer collectionsMut.Unlock()
+	for e := collections.Front(); e != nil; e = e.Next() {
+		if e.Value.(*Collection) == collection {
+			collections.Remove(e)
+			return
+		}
+	}
+}
+
 // getCollectionForModel returns the Collection corresponding to the type of
 // model.
 func getCollectionForModel(model Model) (*Collection, error) {
 	typ := reflect.TypeOf(model)
+	collectionsMut.RLock()
+	defer collectionsMut.RUnlock()
 	for e := collections.Front(); e != nil; e = e.Next() {
 		col := e.Value.(*Collection)
 		if col.spec.typ == typ {
 			return col, nil
 		}
 	}
-	return nil, fmt.Errorf("Could not find Collection for type %T", model)
+	return nil, CollectionNotRegisteredError{Type: typ}
 }
 
 func (p *Pool) typeIsRegistered(typ reflect.Type) bool {
+	p.registryMut.RLock()
+	defer p.registryMut.RUnlock()
 	_, found := p.modelTypeToSpec[typ]
 	return found
 }
 
 func (p *Pool) nameIsRegistered(name string) bool {
+	p.registryMut.RLock()
+	defer p.registryMut.RUnlock()
 	_, found := p.modelNameToSpec[name]
 	return found
 }
@@ -197,6 +493,12 @@ func (c *Collection) IndexKey() string {
 	return c.spec.indexKey()
 }
 
+// ChangeLogKey returns the key that identifies the stream in the database that
+// stores the change log for the collection. See CollectionOptions.ChangeLog.
+func (c *Collection) ChangeLogKey() string {
+	return c.spec.changeLogKey()
+}
+
 // FieldIndexKey returns the key for the sorted set used to index the field
 // identified by fieldName. It returns an error if fieldName does not identify a
 // field in the spec or if the field it identifies is not an indexed field.
@@ -246,6 +548,83 @@ func (c *Collection) Save(model Model) error {
 	return nil
 }
 
+// SaveStats describes the work done by SaveWithStats. The counts describe the
+// commands which were queued, not their effect in the database. E.g. a string
+// index is always counted as removed, even if the model was not in it before.
+type SaveStats struct {
+	// IndexesAdded is the number of field index sets (including the sets for
+	// enum values and buckets) which the model was added to.
+	IndexesAdded int
+	// IndexesRemoved is the number of field index sets which the model was
+	// removed from, e.g. the old value of a string index or a field which no
+	// longer matches the condition for a partial index.
+	IndexesRemoved int
+	// Commands is the total number of commands and scripts which were queued
+	// for saving the model, including the ones for the indexes.
+	Commands int
+}
+
+// SaveWithStats works exactly like Save, but also returns the number of index
+// sets which were added to and removed from and the number of commands which
+// were queued. It is useful for debugging write amplification, e.g. to check
+// how many commands a model with many indexed fields costs. The stats are
+// empty if there was an error.
+func (c *Collection) SaveWithStats(model Model) (SaveStats, error) {
+	if c == nil {
+		return SaveStats{}, newNilCollectionError("SaveWithStats")
+	}
+	t := c.pool.NewTransaction()
+	t.Save(c, model)
+	if t.err != nil {
+		// Exec returns the error and releases the connection.
+		return SaveStats{}, t.Exec()
+	}
+	stats := SaveStats{Commands: len(t.actions)}
+	// Build up the commands for the field indexes in a separate transaction
+	// without a connection so that they can be told apart from the rest.
+	indexes := &Transaction{}
+	indexes.saveFieldIndexes(&modelRef{
+		collection: c,
+		model:      model,
+		spec:       c.spec,
+	})
+	for _, a := range indexes.actions {
+		switch {
+		case a.kind == ScriptAction && (a.script == deleteStringIndexScript || a.script == deleteEnumIndexScript):
+			stats.IndexesRemoved++
+		case a.kind == CommandAction && (a.name == "ZREM" || a.name == "SREM"):
+			stats.IndexesRemoved++
+		case a.kind == CommandAction && (a.name == "ZADD" || a.name == "SADD"):
+			stats.IndexesAdded++
+		}
+	}
+	if err := t.Exec(); err != nil {
+		return SaveStats{}, err
+	}
+	return stats, nil
+}
+
+// ReserveId returns a new id for a model in the given collection without
+// touching the database. The id is available immediately, before the
+// transaction is executed, which makes it possible to cross-reference several
+// models that are saved in the same transaction (e.g. by storing the id of one
+// model in a field of another). To use the reserved id, pass it to the
+// SetModelId method of the model before adding the model to the transaction
+// with Save. Ids are generated exactly the same way as they are for models
+// which embed RandomId (or as configured by CollectionOptions.IdLength), so the
+// reserved id is the same kind of id that Save would otherwise have assigned.
+// Since the ids are generated on the client, reserving an id never requires a
+// round trip and an id that is never used does not need to be released.
+// ReserveId will add an error to the transaction and return an empty string if
+// c is nil.
+func (t *Transaction) ReserveId(c *Collection) string {
+	if c == nil {
+		t.setError(newNilCollectionError("ReserveId"))
+		return ""
+	}
+	return c.newId()
+}
+
 // Save writes a model (a struct which satisfies the Model interface) to the
 // redis database inside an existing transaction. save will set the err property
 // of the transaction if the type of model does not match the registered
@@ -255,6 +634,29 @@ func (c *Collection) Save(model Model) error {
 // will be added to the transaction and returned as an error when the
 // transaction is executed.
 func (t *Transaction) Save(c *Collection, model Model) {
+	if c != nil && !c.index {
+		// Without the set of all ids and the field indexes, saving a model only
+		// writes the main hash and adds the name of the collection to the set
+		// of collection names (plus the history and change log, if enabled).
+		// Run those commands in a single script so that Exec can skip
+		// MULTI/EXEC when the model is the only thing in the transaction.
+		save := &Transaction{}
+		save.save(c, model)
+		if save.err != nil {
+			t.setError(save.err)
+			return
+		}
+		t.execCommands(save.actions)
+		t.writes = append(t.writes, save.writes...)
+		return
+	}
+	t.save(c, model)
+}
+
+// save does the actual work for Save. Unlike Save, it always adds the
+// commands for saving the model to the transaction separately, so it is used
+// to build up the commands for scripts which run them (e.g. SaveIfNotExists).
+func (t *Transaction) save(c *Collection, model Model) {
 	if c == nil {
 		t.setError(newNilCollectionError("Save"))
 		return
@@ -263,6 +665,14 @@ func (t *Transaction) Save(c *Collection, model Model) {
 		t.setError(fmt.Errorf("zoom: Error in Save or Transaction.Save: %s", err.Error()))
 		return
 	}
+	c.assignId(model)
+	t.saveModel(c, model, true)
+}
+
+// saveModel adds commands to the transaction for saving model, which must have
+// the registered type for c and an id. If indexFields is false, the indexes for
+// the fields of the model are not updated (see Collection.Import).
+func (t *Transaction) saveModel(c *Collection, model Model, indexFields bool) {
 	// Create a modelRef and start a transaction
 	mr := &modelRef{
 		collection: c,
@@ -272,11 +682,41 @@ func (t *Transaction) Save(c *Collection, model Model) {
 	// Save indexes
 	// This must happen first, because it relies on reading the old field values
 	// from the hash for string indexes (if any)
-	t.saveFieldIndexes(mr)
+	if indexFields {
+		t.saveFieldIndexes(mr)
+	}
+	t.saveHistory(c, model.ModelId())
 	// Save the model fields in a hash in the database
-	hashArgs, err := mr.mainHashArgs()
+	t.saveMainHash(mr, mr.spec.fieldNames())
+	t.saveDistinctValues(mr, mr.spec.fieldNames())
+	// Add the model id to the set of all models for this collection
+	if c.index {
+		t.Command("SADD", redis.Args{c.IndexKey(), model.ModelId()}, nil)
+		t.incrWriteCount(c)
+	}
+	t.addCollectionName(c)
+	t.addChange(c, ChangeSave, model.ModelId(), mr.spec.fieldNames())
+}
+
+// saveMainHash adds commands to the transaction for saving the given fields
+// in the main hash for the model. Fields with nil values are removed from the
+// hash instead of being saved.
+func (t *Transaction) saveMainHash(mr *modelRef, fieldNames []string) {
+	hashArgs, err := mr.mainHashArgsForFields(fieldNames)
 	if err != nil {
 		t.setError(err)
+		return
+	}
+	nilFields := mr.nilFieldRedisNames(fieldNames)
+	if len(hashArgs) == 1 && len(nilFields) > 0 {
+		// Redis does not allow empty hashes, so if all of the fields are nil
+		// we need to fall back to storing "NULL" for the nil fields. Otherwise
+		// the model would not exist.
+		for _, name := range nilFields {
+			hashArgs = hashArgs.Add(name, "NULL")
+		}
+		t.Command("HMSET", hashArgs, nil)
+		return
 	}
 	if len(hashArgs) > 1 {
 		// Only save the main hash if there are any fields
@@ -285,9 +725,8 @@ func (t *Transaction) Save(c *Collection, model Model) {
 		// 1.
 		t.Command("HMSET", hashArgs, nil)
 	}
-	// Add the model id to the set of all models for this collection
-	if c.index {
-		t.Command("SADD", redis.Args{c.IndexKey(), model.ModelId()}, nil)
+	if len(nilFields) > 0 {
+		t.Command("HDEL", redis.Args{mr.key()}.AddFlat(nilFields), nil)
 	}
 }
 
@@ -305,6 +744,12 @@ func (t *Transaction) saveFieldIndexesForFields(fieldNames []string, mr *modelRe
 		if !stringSliceContains(fieldNames, fs.name) {
 			continue
 		}
+		if fs.where != nil && !fs.where.holds(mr) {
+			// The model does not match the condition for the partial index.
+			// Remove the old index (if any).
+			t.deleteFieldIndex(mr, fs)
+			continue
+		}
 		switch fs.indexKind {
 		case noIndex:
 			continue
@@ -314,18 +759,43 @@ func (t *Transaction) saveFieldIndexesForFields(fieldNames []string, mr *modelRe
 			t.saveBooleanIndex(mr, fs)
 		case stringIndex:
 			t.saveStringIndex(mr, fs)
+		case enumIndex:
+			t.saveEnumIndex(mr, fs)
+		case sparseBoolIndex:
+			t.saveSparseBoolIndex(mr, fs)
 		}
 	}
 }
 
+// deleteFieldIndex adds commands to the transaction for removing the model
+// from the index on the given field, if it is in the index.
+func (t *Transaction) deleteFieldIndex(mr *modelRef, fs *fieldSpec) {
+	switch fs.indexKind {
+	case numericIndex, booleanIndex:
+		t.deleteNumericOrBooleanIndex(fs, mr.spec, mr.model.ModelId())
+	case stringIndex:
+		t.deleteStringIndex(mr.spec.name, mr.model.ModelId(), fs.redisName)
+	case enumIndex:
+		t.deleteEnumIndex(mr.spec.name, mr.model.ModelId(), fs.redisName)
+	case sparseBoolIndex:
+		t.deleteSparseBoolIndex(fs, mr.spec, mr.model.ModelId())
+	}
+}
+
 // saveNumericIndex adds commands to the transaction for saving a numeric
 // index on the given field.
 func (t *Transaction) saveNumericIndex(mr *modelRef, fs *fieldSpec) {
 	fieldValue := mr.fieldValue(fs.name)
 	if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+		// Nil values are not indexed. Remove the old index (if any).
+		t.deleteNumericOrBooleanIndex(fs, mr.spec, mr.model.ModelId())
+		return
+	}
+	if err := checkExactScore(fieldValue); err != nil {
+		t.setError(fmt.Errorf("zoom: error saving index for %s.%s: %s", mr.spec.typ.String(), fs.name, err.Error()))
 		return
 	}
-	score := numericScore(fieldValue)
+	score := fs.numericIndexScore(fieldValue)
 	indexKey, err := mr.spec.fieldIndexKey(fs.name)
 	if err != nil {
 		t.setError(err)
@@ -338,6 +808,8 @@ func (t *Transaction) saveNumericIndex(mr *modelRef, fs *fieldSpec) {
 func (t *Transaction) saveBooleanIndex(mr *modelRef, fs *fieldSpec) {
 	fieldValue := mr.fieldValue(fs.name)
 	if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+		// Nil values are not indexed. Remove the old index (if any).
+		t.deleteNumericOrBooleanIndex(fs, mr.spec, mr.model.ModelId())
 		return
 	}
 	score := boolScore(fieldValue)
@@ -360,12 +832,64 @@ func (t *Transaction) saveStringIndex(mr *modelRef, fs *fieldSpec) {
 		}
 		fieldValue = fieldValue.Elem()
 	}
-	member := fieldValue.String() + nullString + mr.model.ModelId()
+	value, err := fs.stringIndexValue(fieldValue)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	member := value + nullString + mr.model.ModelId()
 	indexKey, err := mr.spec.fieldIndexKey(fs.name)
 	if err != nil {
 		t.setError(err)
 	}
 	t.Command("ZADD", redis.Args{indexKey, 0, member}, nil)
+	if fs.indexKeyFunc != nil {
+		t.Command("HSET", redis.Args{indexKeysKey(indexKey), mr.model.ModelId(), value}, nil)
+	}
+}
+
+// saveEnumIndex adds commands to the transaction for saving an enum index on
+// the given field. This includes removing the old index (if any). The model id
+// is added to the set for its value and to the set of all models in the index,
+// and the value is added to the set of distinct values.
+func (t *Transaction) saveEnumIndex(mr *modelRef, fs *fieldSpec) {
+	// Remove the old index (if any)
+	t.deleteEnumIndex(mr.spec.name, mr.model.ModelId(), fs.redisName)
+	fieldValue := mr.fieldValue(fs.name)
+	for fieldValue.Kind() == reflect.Ptr {
+		if fieldValue.IsNil() {
+			return
+		}
+		fieldValue = fieldValue.Elem()
+	}
+	value, err := fs.stringIndexValue(fieldValue)
+	if err != nil {
+		t.setError(err)
+		return
+	}
+	indexKey, err := mr.spec.fieldIndexKey(fs.name)
+	if err != nil {
+		t.setError(err)
+	}
+	t.Command("SADD", redis.Args{enumBucketKey(indexKey, value), mr.model.ModelId()}, nil)
+	t.Command("SADD", redis.Args{enumValuesKey(indexKey), value}, nil)
+	t.Command("SADD", redis.Args{indexKey, mr.model.ModelId()}, nil)
+}
+
+// saveSparseBoolIndex adds commands to the transaction for saving a sparse
+// boolean index on the given field. The model id is added to the index if the
+// value is true and removed from it if the value is false or nil.
+func (t *Transaction) saveSparseBoolIndex(mr *modelRef, fs *fieldSpec) {
+	fieldValue := mr.fieldValue(fs.name)
+	if (fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil()) || boolScore(fieldValue) == 0 {
+		t.deleteSparseBoolIndex(fs, mr.spec, mr.model.ModelId())
+		return
+	}
+	indexKey, err := mr.spec.fieldIndexKey(fs.name)
+	if err != nil {
+		t.setError(err)
+	}
+	t.Command("SADD", redis.Args{indexKey, mr.model.ModelId()}, nil)
 }
 
 // SaveFields saves only the given fields of the model. SaveFields uses
@@ -400,6 +924,7 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 		t.setError(fmt.Errorf("zoom: Error in SaveFields or Transaction.SaveFields: %s", err.Error()))
 		return
 	}
+	c.assignId(model)
 	// Check the given field names
 	for _, fieldName := range fieldNames {
 		if !stringSliceContains(c.spec.fieldNames(), fieldName) {
@@ -407,6 +932,18 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 			return
 		}
 	}
+	// The condition for a partial index is checked against the values being
+	// saved, so the indexed field and the field in its condition must be saved
+	// together.
+	for _, fs := range c.spec.fields {
+		if fs.where == nil || fs.where.field == fs {
+			continue
+		}
+		if stringSliceContains(fieldNames, fs.name) != stringSliceContains(fieldNames, fs.where.field.name) {
+			t.setError(fmt.Errorf("zoom: Error in SaveFields or Transaction.SaveFields: %s has a partial index (where:%s), so %s and %s must be saved together", fs.name, fs.where, fs.name, fs.where.field.name))
+			return
+		}
+	}
 	// Create a modelRef and start a transaction
 	mr := &modelRef{
 		collection: c,
@@ -417,23 +954,337 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 	// This must happen first, because it relies on reading the old field values
 	// from the hash for string indexes (if any)
 	t.saveFieldIndexesForFields(fieldNames, mr)
-	// Get the main hash args.
-	hashArgs, err := mr.mainHashArgsForFields(fieldNames)
-	if err != nil {
-		t.setError(err)
-	}
-	//
-	if len(hashArgs) > 1 {
-		// Only save the main hash if there are any fields
-		// The first element in hashArgs is the model key,
-		// so there are fields if the length is greater than
-		// 1.
-		t.Command("HMSET", hashArgs, nil)
-	}
+	t.saveHistory(c, model.ModelId())
+	// Save the given fields in the main hash
+	t.saveMainHash(mr, fieldNames)
+	t.saveDistinctValues(mr, fieldNames)
 	// Add the model id to the set of all models for this collection
 	if c.index {
 		t.Command("SADD", redis.Args{c.IndexKey(), model.ModelId()}, nil)
+		t.incrWriteCount(c)
+	}
+	t.addCollectionName(c)
+	t.addChange(c, ChangeSave, model.ModelId(), fieldNames)
+}
+
+// SaveIfNotExists works like Save, but only saves model if there is not
+// already a model with the same id in the database. It never overwrites an
+// existing model. The first return value is true if model was saved and false
+// if it already existed, in which case the database (including the indexes for
+// the collection) is left unchanged. The check and the save happen atomically
+// in a single Lua script, so SaveIfNotExists is safe to use for "create only"
+// operations even if there are concurrent callers.
+func (c *Collection) SaveIfNotExists(model Model) (bool, error) {
+	t := c.pool.NewTransaction()
+	var saved bool
+	t.SaveIfNotExists(c, model, &saved)
+	if err := t.Exec(); err != nil {
+		return false, err
 	}
+	return saved, nil
+}
+
+// SaveIfNotExists works like Save, but only saves model if there is not
+// already a model with the same id in the database. If saved is not nil, it
+// will be set to true if model was saved and false if it already existed when
+// the transaction is executed. See Collection.SaveIfNotExists for more
+// information. Any errors encountered will be added to the transaction and
+// returned as an error when the transaction is executed.
+func (t *Transaction) SaveIfNotExists(c *Collection, model Model, saved *bool) {
+	if c == nil {
+		t.setError(newNilCollectionError("SaveIfNotExists"))
+		return
+	}
+	// Build up the commands that Save would use in a separate transaction
+	// without a connection. They will be run by the script instead.
+	save := &Transaction{}
+	save.save(c, model)
+	if save.err != nil {
+		t.setError(save.err)
+		return
+	}
+	commands := []*Action{}
+	for _, a := range save.actions {
+		if a.kind == ScriptAction && (a.script == deleteStringIndexScript || a.script == deleteEnumIndexScript || a.script == saveHistoryScript) {
+			// The only scripts used by Save remove the old string and enum
+			// indexes for the model and save the old version in the history.
+			// If the model does not exist, there is nothing to remove or save
+			// so we can skip them.
+			continue
+		}
+		commands = append(commands, a)
+	}
+	handler := t.addConditionalWriteEvents(save, saved)
+	t.execCommandsIfNotExists(c.ModelKey(model.ModelId()), commands, handler)
+}
+
+// SaveIf works like Save, but only saves model if the value currently stored
+// in the database for the given field satisfies a condition. The condition is
+// "<stored value> <op> <value>", where op must be one of "=", "!=", ">", "<",
+// ">=", or "<=", the same as the operators for Query.Filter. For example,
+// SaveIf(model, "Version", "<", model.Version) only saves model if the version
+// in the database is older than the new one, which is useful for
+// last-write-wins replication. field should be the name of a field with a
+// numeric, string, or bool type (or a time.Time if the collection has a
+// TimeFormat) and value should have the same type as the field. The field does
+// not need to be indexed. Numbers (including bools and unix times) are compared
+// numerically and strings (including RFC 3339 times) are compared byte by byte.
+// If model does not exist yet, or the stored value for field is nil, the model
+// is always saved.
+//
+// The first return value is true if model was saved and false if the
+// condition did not hold, in which case the database (including the indexes for
+// the collection) is left unchanged. The comparison and the save happen
+// atomically in a single Lua script, so SaveIf is safe to use even if there are
+// concurrent callers.
+func (c *Collection) SaveIf(model Model, field string, op string, value interface{}) (bool, error) {
+	t := c.pool.NewTransaction()
+	var saved bool
+	t.SaveIf(c, model, field, op, value, &saved)
+	if err := t.Exec(); err != nil {
+		return false, err
+	}
+	return saved, nil
+}
+
+// SaveIf works like Save, but only saves model if the value currently stored
+// in the database for the given field satisfies the condition
+// "<stored value> <op> <value>". If saved is not nil, it will be set to true if
+// model was saved and false if the condition did not hold when the transaction
+// is executed. See Collection.SaveIf for more information. Any errors
+// encountered will be added to the transaction and returned as an error when
+// the transaction is executed.
+func (t *Transaction) SaveIf(c *Collection, model Model, field string, op string, value interface{}, saved *bool) {
+	if c == nil {
+		t.setError(newNilCollectionError("SaveIf"))
+		return
+	}
+	if err := c.checkModelType(model); err != nil {
+		t.setError(fmt.Errorf("zoom: Error in SaveIf or Transaction.SaveIf: %s", err.Error()))
+		return
+	}
+	fs, found := c.spec.fieldsByName[field]
+	if !found {
+		t.setError(fmt.Errorf("zoom: Error in SaveIf or Transaction.SaveIf: Collection %s does not have field named %s", c.Name(), field))
+		return
+	}
+	filterOp, found := filterOps[op]
+	if !found {
+		t.setError(fmt.Errorf("zoom: Error in SaveIf or Transaction.SaveIf: %s is not a valid operator. Must be one of =, !=, >, <, >=, or <=", op))
+		return
+	}
+	kind, compareValue, err := fs.compareValue(value)
+	if err != nil {
+		t.setError(fmt.Errorf("zoom: Error in SaveIf or Transaction.SaveIf: %s", err.Error()))
+		return
+	}
+	// Build up the commands that Save would use in a separate transaction
+	// without a connection. They will be run by the script instead, which also
+	// takes care of removing the old string and enum indexes and saving the
+	// old version in the history.
+	save := &Transaction{}
+	save.save(c, model)
+	if save.err != nil {
+		t.setError(save.err)
+		return
+	}
+	commands := []*Action{}
+	stringIndexes := []string{}
+	enumIndexes := []string{}
+	for _, a := range save.actions {
+		if a.kind == ScriptAction {
+			// The args for deleteStringIndex and deleteEnumIndex are the
+			// collection name, the model id, and the name of the field.
+			switch a.script {
+			case deleteStringIndexScript:
+				stringIndexes = append(stringIndexes, a.args[2].(string))
+				continue
+			case deleteEnumIndexScript:
+				enumIndexes = append(enumIndexes, a.args[2].(string))
+				continue
+			case saveHistoryScript:
+				continue
+			}
+		}
+		commands = append(commands, a)
+	}
+	handler := t.addConditionalWriteEvents(save, saved)
+	historyKey := ""
+	if c.keepHistory > 0 {
+		historyKey = c.HistoryKey(model.ModelId())
+	}
+	t.execCommandsIf(c.Name(), model.ModelId(), fs.redisName, kind, filterOp, compareValue, stringIndexes, enumIndexes, historyKey, c.keepHistory, commands, handler)
+}
+
+// compareValue checks that value can be compared to the values stored for fs
+// by the exec_commands_if script and returns the kind of comparison to use
+// ("numeric" or "string") along with value encoded the same way it would be
+// stored in the model hash.
+func (fs *fieldSpec) compareValue(value interface{}) (kind string, encoded interface{}, err error) {
+	if fs.kind != primativeField && fs.kind != pointerField || fs.marshaler != noMarshaler {
+		return "", nil, fmt.Errorf("cannot compare values of field %s because its type (%s) is not a number, string, or bool", fs.name, fs.typ.String())
+	}
+	if fs.gzip {
+		return "", nil, fmt.Errorf("cannot compare values of field %s because it is compressed with gzip", fs.name)
+	}
+	val := reflect.ValueOf(value)
+	for val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	fieldType := fs.typ
+	for fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	if !val.IsValid() || val.Type() != fieldType {
+		return "", nil, fmt.Errorf("Type of value (%T) does not match type of field %s (%s)", value, fs.name, fieldType.String())
+	}
+	switch {
+	case fs.timeFormat != "":
+		timeVal, err := encodeTime(fs.timeFormat, val.Interface().(time.Time))
+		if err != nil {
+			return "", nil, err
+		}
+		if timeVal == "" {
+			return "", nil, fmt.Errorf("cannot compare field %s to the zero time because it is stored as an empty string with the %s time format", fs.name, fs.timeFormat)
+		}
+		if fs.timeFormat == TimeFormatRFC3339 {
+			return "string", timeVal, nil
+		}
+		return "numeric", timeVal, nil
+	case fieldType == reflect.TypeOf(time.Duration(0)):
+		return "numeric", int64(val.Interface().(time.Duration)), nil
+	case typeIsNumeric(fieldType), typeIsBool(fieldType):
+		return "numeric", val.Interface(), nil
+	default:
+		return "string", val.Interface(), nil
+	}
+}
+
+// maxUpsertAttempts is the number of times Upsert will retry if the index for
+// the unique field is modified concurrently.
+const maxUpsertAttempts = 10
+
+// Upsert saves model using uniqueField as a unique key. uniqueField should be
+// the name of an indexed field and value should have the same type as the
+// field. If a model with the given value for uniqueField already exists, Upsert
+// will assign its id to model and then update it (i.e. overwrite all of its
+// fields). Otherwise model is inserted as a new model. The first return value
+// is true if model was inserted and false if an existing model was updated.
+// The fields of model are saved exactly as they are, so in most cases
+// model.uniqueField should be equal to value.
+//
+// The index for uniqueField is checked inside a watched transaction, so if
+// another client modifies the index (e.g. two concurrent upserts for the same
+// value) the lookup is retried with the new state of the index. That way only
+// one model will be inserted for any given value, as long as all the models
+// with that value are saved with Upsert. Upsert returns an error if the index
+// was modified concurrently too many times in a row.
+func (c *Collection) Upsert(uniqueField string, value interface{}, model Model) (inserted bool, err error) {
+	if c == nil {
+		return false, newNilCollectionError("Upsert")
+	}
+	if err := c.checkModelType(model); err != nil {
+		return false, fmt.Errorf("zoom: Error in Upsert: %s", err.Error())
+	}
+	fs, found := c.spec.fieldsByName[uniqueField]
+	if !found {
+		return false, fmt.Errorf("zoom: Error in Upsert: Collection %s does not have field named %s", c.Name(), uniqueField)
+	}
+	if fs.indexKind == noIndex {
+		return false, fmt.Errorf("zoom: Error in Upsert: %s is not an indexed field", uniqueField)
+	}
+	if fs.where != nil {
+		return false, fmt.Errorf("zoom: Error in Upsert: %s has a partial index (where:%s), which cannot be used to find existing models", uniqueField, fs.where)
+	}
+	if fs.indexKind == sparseBoolIndex {
+		return false, fmt.Errorf("zoom: Error in Upsert: %s has a sparse index, which cannot be used to find existing models", uniqueField)
+	}
+	val := reflect.ValueOf(value)
+	for val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	fieldType := fs.typ
+	for fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	if !val.IsValid() || val.Type() != fieldType {
+		return false, fmt.Errorf("zoom: Error in Upsert: Type of value (%T) does not match type of field %s (%s)", value, uniqueField, fieldType.String())
+	}
+	indexKey, err := c.spec.fieldIndexKey(uniqueField)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < maxUpsertAttempts; i++ {
+		if i > 0 {
+			atomic.AddUint64(&c.pool.transactionRetries, 1)
+		}
+		t := c.pool.NewTransaction()
+		if err := t.Watch(indexKey); err != nil {
+			t.conn.Close()
+			return false, err
+		}
+		existingId, err := findIdByIndexValue(t.conn, fs, indexKey, val)
+		if err != nil {
+			t.conn.Close()
+			return false, err
+		}
+		inserted = existingId == ""
+		if !inserted {
+			model.SetModelId(existingId)
+		}
+		t.Save(c, model)
+		if err := t.Exec(); err != nil {
+			if err == ErrOptimisticLock {
+				continue
+			}
+			return false, err
+		}
+		return inserted, nil
+	}
+	return false, fmt.Errorf("zoom: Error in Upsert: the index for %s was modified concurrently %d times in a row", uniqueField, maxUpsertAttempts)
+}
+
+// findIdByIndexValue uses conn to immediately look up the id of the first
+// model which has the given value for the indexed field identified by fs. It
+// returns an empty string if there is no such model.
+func findIdByIndexValue(conn redis.Conn, fs *fieldSpec, indexKey string, val reflect.Value) (string, error) {
+	var reply interface{}
+	var err error
+	var memberPrefix string
+	switch fs.indexKind {
+	case numericIndex:
+		if err := checkExactScore(val); err != nil {
+			return "", err
+		}
+		score := fs.numericIndexScore(val)
+		reply, err = conn.Do("ZRANGEBYSCORE", indexKey, score, score, "LIMIT", 0, 1)
+	case booleanIndex:
+		score := boolScore(val)
+		reply, err = conn.Do("ZRANGEBYSCORE", indexKey, score, score, "LIMIT", 0, 1)
+	case stringIndex:
+		var valString string
+		valString, err = fs.stringIndexValue(val)
+		if err != nil {
+			return "", err
+		}
+		memberPrefix = valString + nullString
+		reply, err = conn.Do("ZRANGEBYLEX", indexKey, "["+memberPrefix, "("+memberPrefix+delString, "LIMIT", 0, 1)
+	case enumIndex:
+		var valString string
+		valString, err = fs.stringIndexValue(val)
+		if err != nil {
+			return "", err
+		}
+		reply, err = conn.Do("SRANDMEMBER", enumBucketKey(indexKey, valString), 1)
+	}
+	members, err := redis.Strings(reply, err)
+	if err != nil {
+		return "", err
+	}
+	if len(members) == 0 {
+		return "", nil
+	}
+	return strings.TrimPrefix(members[0], memberPrefix), nil
 }
 
 // Find retrieves a model with the given id from redis and scans its values
@@ -441,7 +1292,13 @@ func (t *Transaction) SaveFields(c *Collection, fieldNames []string, model Model
 // corresponding to the Collection. Find will mutate the struct, filling in its
 // fields and overwriting any previous values. It returns an error if a model
 // with the given id does not exist, if the given model was the wrong type, or
-// if there was a problem connecting to the database.
+// if there was a problem connecting to the database. If the StrictScan option
+// was set for the collection, Find also returns an error if the stored model
+// contains fields which are not in the model type. Find also reads any list
+// fields (see Collection.Append). If the model does not exist, the error is a
+// ModelNotFoundError, which can be detected with errors.Is(err,
+// ErrModelNotFound), and model is left with only its id set. Use FindOrZero if
+// you would rather not treat a missing model as an error.
 func (c *Collection) Find(id string, model Model) error {
 	t := c.pool.NewTransaction()
 	t.Find(c, id, model)
@@ -451,6 +1308,22 @@ func (c *Collection) Find(id string, model Model) error {
 	return nil
 }
 
+// FindOrZero works like Find, except that a model which does not exist is not
+// an error. Instead, FindOrZero sets model to its zero value and returns false
+// and a nil error. It returns true if the model was found. Any other error
+// (e.g. if model is the wrong type or there was a problem connecting to the
+// database) is still returned. Note that the zero value has an empty id, so
+// calling ModelId on a model which embeds RandomId will generate a new id.
+func (c *Collection) FindOrZero(id string, model Model) (bool, error) {
+	t := c.pool.NewTransaction()
+	var found bool
+	t.FindOrZero(c, id, model, &found)
+	if err := t.Exec(); err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
 // Find retrieves a model with the given id from redis and scans its values
 // into model in an existing transaction. model should be a pointer to a struct
 // of a registered type corresponding to the Collection. find will mutate the struct,
@@ -458,12 +1331,34 @@ func (c *Collection) Find(id string, model Model) error {
 // will be added to the transaction and returned as an error when the transaction is
 // executed.
 func (t *Transaction) Find(c *Collection, id string, model Model) {
+	t.find("Find", c, id, model, nil)
+}
+
+// FindOrZero works like Find, except that if the model with the given id does
+// not exist, model is set to its zero value (including an empty id) instead of
+// adding a ModelNotFoundError to the transaction. When the transaction is
+// executed, found will be set to whether the model exists. You may pass in nil
+// for found if you do not care. See Collection.FindOrZero for more
+// information. Any other errors encountered will be added to the transaction
+// and returned as an error when the transaction is executed.
+func (t *Transaction) FindOrZero(c *Collection, id string, model Model, found *bool) {
+	if found == nil {
+		found = new(bool)
+	}
+	t.find("FindOrZero", c, id, model, found)
+}
+
+// find does the actual work for Find and FindOrZero. method is the name of the
+// exported method, which is used in error messages. If found is nil, a model
+// which does not exist is an error. Otherwise found is set to whether the model
+// exists, and if it does not, model is set to its zero value.
+func (t *Transaction) find(method string, c *Collection, id string, model Model, found *bool) {
 	if c == nil {
-		t.setError(newNilCollectionError("Find"))
+		t.setError(newNilCollectionError(method))
 		return
 	}
 	if err := c.checkModelType(model); err != nil {
-		t.setError(fmt.Errorf("zoom: Error in Find or Transaction.Find: %s", err.Error()))
+		t.setError(fmt.Errorf("zoom: Error in %s or Transaction.%s: %s", method, method, err.Error()))
 		return
 	}
 	model.SetModelId(id)
@@ -473,13 +1368,34 @@ func (t *Transaction) Find(c *Collection, id string, model Model) {
 		spec:       c.spec,
 	}
 	// Check if the model actually exists
-	t.Command("EXISTS", redis.Args{mr.key()}, newModelExistsHandler(c, id))
+	exists := found
+	existsHandler := NewScanBoolHandler(found)
+	if found == nil {
+		exists = new(bool)
+		(*exists) = true
+		existsHandler = newModelExistsHandler(c, id)
+	}
+	t.Command("EXISTS", redis.Args{mr.key()}, existsHandler)
+	if c.strictScan {
+		// Check that the stored model does not have any unknown fields
+		t.Command("HKEYS", redis.Args{mr.key()}, newUnknownFieldsHandler(c, id))
+	}
 	// Get the fields from the main hash for this model
 	args := redis.Args{mr.key()}
 	for _, fieldName := range mr.spec.fieldRedisNames() {
 		args = append(args, fieldName)
 	}
-	t.Command("HMGET", args, newScanModelRefHandler(mr.spec.fieldNames(), mr))
+	scanModel := newScanModelRefHandler(mr.spec.fieldNames(), mr)
+	t.Command("HMGET", args, func(reply interface{}) error {
+		if !*exists {
+			modelVal := reflect.ValueOf(model).Elem()
+			modelVal.Set(reflect.Zero(modelVal.Type()))
+			return nil
+		}
+		return scanModel(reply)
+	})
+	// Get the list fields (if any), which are stored separately
+	t.findListFields(mr, exists)
 }
 
 // FindFields is like Find but finds and sets only the specified fields. Any
@@ -530,9 +1446,52 @@ func (t *Transaction) FindFields(c *Collection, id string, fieldNames []string,
 	t.Command("HMGET", args, newScanModelRefHandler(fieldNames, mr))
 }
 
+// FindRawHash returns the main hash for the model with the given id exactly as
+// it is stored in Redis (i.e. the reply from HGETALL), without any type
+// conversion. The keys of the map are the names of the fields as they are
+// stored in Redis. FindRawHash is intended for debugging encoding issues. It
+// does not use the struct definition for the collection, so it works even if
+// the stored data no longer matches the struct. Note that some values (e.g.
+// gob-encoded or compressed fields) are binary data. FindRawHash returns a
+// ModelNotFoundError if the model does not exist.
+func (c *Collection) FindRawHash(id string) (map[string]string, error) {
+	t := c.pool.NewTransaction()
+	hash := map[string]string{}
+	t.FindRawHash(c, id, &hash)
+	if err := t.Exec(); err != nil {
+		return nil, err
+	}
+	return hash, nil
+}
+
+// FindRawHash sets the value of hash to the main hash for the model with the
+// given id exactly as it is stored in Redis when the transaction is executed.
+// See Collection.FindRawHash for more information. Any errors encountered will
+// be added to the transaction and returned as an error when the transaction is
+// executed.
+func (t *Transaction) FindRawHash(c *Collection, id string, hash *map[string]string) {
+	if c == nil {
+		t.setError(newNilCollectionError("FindRawHash"))
+		return
+	}
+	t.Command("HGETALL", redis.Args{c.ModelKey(id)}, func(reply interface{}) error {
+		values, err := redis.StringMap(reply, nil)
+		if err != nil {
+			return err
+		}
+		if len(values) == 0 {
+			msg := fmt.Sprintf("Could not find %s with id = %s", c.Name(), id)
+			return ModelNotFoundError{Collection: c, Msg: msg}
+		}
+		*hash = values
+		return nil
+	})
+}
+
 // FindAll finds all the models of the given type. It executes the commands needed
 // to retrieve the models in a single transaction. See http://redis.io/topics/transactions.
-// models must be a pointer to a slice of models with a type corresponding to the Collection.
+// models must be a pointer to a slice of models with a type corresponding to the Collection,
+// or a pointer to a slice of the structs they point to (e.g. *[]Person instead of *[]*Person).
 // FindAll will grow or shrink the models slice as needed and if any of the models in the
 // models slice are nil, FindAll will use reflection to allocate memory for them.
 // FindAll returns an error if models is the wrong type or if there was a problem connecting
@@ -603,6 +1562,50 @@ func (t *Transaction) Count(c *Collection, count *int) {
 	t.Command("SCARD", redis.Args{c.IndexKey()}, NewScanIntHandler(count))
 }
 
+// ExistsAll checks which of the models with the given ids exist in the
+// database. It returns a map of each id to true if the corresponding model
+// exists and false if it does not. All the checks are sent as a single batch of
+// EXISTS commands in one transaction, so ExistsAll requires only one round trip
+// regardless of the number of ids. It returns an error if there was a problem
+// connecting to the database.
+func (c *Collection) ExistsAll(ids []string) (map[string]bool, error) {
+	t := c.pool.NewTransaction()
+	exists := make(map[string]bool, len(ids))
+	t.ExistsAll(c, ids, exists)
+	if err := t.Exec(); err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
+
+// ExistsAll checks which of the models with the given ids exist in the database
+// in an existing transaction. When the transaction is executed, exists will
+// map each id to true if the corresponding model exists and false if it does
+// not. See Collection.ExistsAll for more information. Any errors encountered
+// will be added to the transaction and returned as an error when the
+// transaction is executed.
+func (t *Transaction) ExistsAll(c *Collection, ids []string, exists map[string]bool) {
+	if c == nil {
+		t.setError(newNilCollectionError("ExistsAll"))
+		return
+	}
+	if exists == nil {
+		t.setError(fmt.Errorf("zoom: Error in ExistsAll or Transaction.ExistsAll: exists map cannot be nil"))
+		return
+	}
+	for _, id := range ids {
+		id := id
+		t.Command("EXISTS", redis.Args{c.ModelKey(id)}, func(reply interface{}) error {
+			found, err := redis.Bool(reply, nil)
+			if err != nil {
+				return err
+			}
+			exists[id] = found
+			return nil
+		})
+	}
+}
+
 // Delete removes the model with the given type and id from the database. It will
 // not return an error if the model corresponding to the given id was not
 // found in the database. Instead, it will return a boolean representing whether
@@ -642,8 +1645,62 @@ func (t *Transaction) Delete(c *Collection, id string, deleted *bool) {
 	}
 	// Delete the main hash
 	t.Command("DEL", redis.Args{c.Name() + ":" + id}, handler)
+	t.deleteListFields(c, id)
 	// Remvoe the id from the index of all models for the given type
 	t.Command("SREM", redis.Args{c.IndexKey(), id}, nil)
+	if c.index {
+		t.incrWriteCount(c)
+	}
+	t.addChange(c, ChangeDelete, id, nil)
+}
+
+// Touch sets the time to live for the model with the given id to ttl, without
+// reading or rewriting any of its fields. It issues PEXPIRE on the main hash
+// for the model and on any list fields (see Collection.Append). Touch is
+// typically used to extend the expiry of a session each time it is used. It
+// returns a ModelNotFoundError if the model does not exist (e.g. because it has
+// already expired), and an error if ttl is less than one millisecond. Note that
+// when a model expires, Redis only removes its main hash and list fields. Its
+// id is not removed from the set of all ids or from any field indexes, so you
+// should only use Touch for collections which are not indexed or do not have
+// indexed fields, or clean up the indexes yourself.
+func (c *Collection) Touch(id string, ttl time.Duration) error {
+	t := c.pool.NewTransaction()
+	t.Touch(c, id, ttl)
+	if err := t.Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Touch sets the time to live for the model with the given id to ttl in an
+// existing transaction. See Collection.Touch for more information. Any errors
+// encountered will be added to the transaction and returned as an error when
+// the transaction is executed.
+func (t *Transaction) Touch(c *Collection, id string, ttl time.Duration) {
+	if c == nil {
+		t.setError(newNilCollectionError("Touch"))
+		return
+	}
+	if ttl < time.Millisecond {
+		t.setError(fmt.Errorf("zoom: Error in Touch or Transaction.Touch: ttl must be at least one millisecond but got %s", ttl))
+		return
+	}
+	ms := int64(ttl / time.Millisecond)
+	t.Command("PEXPIRE", redis.Args{c.ModelKey(id), ms}, func(reply interface{}) error {
+		updated, err := redis.Bool(reply, nil)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			msg := fmt.Sprintf("Could not find %s with id = %s", c.Name(), id)
+			return ModelNotFoundError{Collection: c, Msg: msg}
+		}
+		return nil
+	})
+	for _, key := range c.spec.listKeys(id) {
+		t.Command("PEXPIRE", redis.Args{key, ms}, nil)
+	}
 }
 
 // deleteFieldIndexes adds commands to the transaction for deleting the field
@@ -658,6 +1715,11 @@ func (t *Transaction) deleteFieldIndexes(c *Collection, id string) {
 		case stringIndex:
 			// NOTE: this invokes a lua script which is defined in scripts/delete_string_index.lua
 			t.deleteStringIndex(c.Name(), id, fs.redisName)
+		case enumIndex:
+			// NOTE: this invokes a lua script which is defined in scripts/delete_enum_index.lua
+			t.deleteEnumIndex(c.Name(), id, fs.redisName)
+		case sparseBoolIndex:
+			t.deleteSparseBoolIndex(fs, c.spec, id)
 		}
 	}
 }
@@ -672,6 +1734,16 @@ func (t *Transaction) deleteNumericOrBooleanIndex(fs *fieldSpec, ms *modelSpec,
 	t.Command("ZREM", redis.Args{indexKey, modelId}, nil)
 }
 
+// deleteSparseBoolIndex removes the model from a sparse boolean index for the
+// given field. I.e. it removes the model id from a set.
+func (t *Transaction) deleteSparseBoolIndex(fs *fieldSpec, ms *modelSpec, modelId string) {
+	indexKey, err := ms.fieldIndexKey(fs.name)
+	if err != nil {
+		t.setError(err)
+	}
+	t.Command("SREM", redis.Args{indexKey, modelId}, nil)
+}
+
 // DeleteAll deletes all the models of the given type in a single transaction. See
 // http://redis.io/topics/transactions. It returns the number of models deleted
 // and an error if there was a problem connecting to the database.
@@ -705,7 +1777,271 @@ func (t *Transaction) DeleteAll(c *Collection, count *int) {
 	} else {
 		handler = NewScanIntHandler(count)
 	}
-	t.DeleteModelsBySetIds(c.IndexKey(), c.Name(), handler)
+	t.deleteModelsBySetIds(c.IndexKey(), c.Name(), c.spec.lists, handler)
+	if distinctKeys := c.spec.distinctKeys(); len(distinctKeys) > 0 {
+		t.Command("DEL", redis.Args{}.AddFlat(distinctKeys), nil)
+	}
+	t.incrWriteCount(c)
+	t.addChange(c, ChangeDeleteAll, "", nil)
+}
+
+// maxIndexStatsBuckets is the maximum number of buckets that will be included
+// in IndexStats for a single string index.
+const maxIndexStatsBuckets = 100
+
+// IndexStats contains statistics about the index for a single field. It is
+// returned by Collection.IndexStats.
+type IndexStats struct {
+	// FieldName is the name of the indexed field, as it appears in the struct
+	// definition.
+	FieldName string
+	// Count is the number of models in the index. For sparse boolean indexes,
+	// it is the number of models with a true value.
+	Count int
+	// DistinctValues is the number of distinct values in the index.
+	DistinctValues int
+	// Min and Max are the lowest and highest values in a numeric index. They
+	// are always 0 for string, boolean, and enum indexes or if the index is
+	// empty.
+	Min float64
+	Max float64
+	// Buckets maps each distinct value in a string, boolean, or enum index to
+	// the number of models with that value. For boolean indexes, the keys are
+	// "true" and "false", and sparse boolean indexes only have a "true"
+	// bucket. For string and enum indexes, only the largest 100
+	// buckets are included. Buckets is nil for numeric indexes.
+	Buckets map[string]int
+}
+
+// IndexStats returns statistics about the index for each indexed field in the
+// collection, in the order that the fields appear in the struct definition.
+// The statistics can be used to reason about the selectivity of queries. For
+// example, a filter on a field with very few distinct values is not very
+// selective. IndexStats runs a Lua script which reads every member of every
+// index, so it is O(N) where N is the total size of the indexes and should not
+// be used on a hot path. It returns an error if there was a problem connecting
+// to the database.
+func (c *Collection) IndexStats() ([]IndexStats, error) {
+	// Allocate enough capacity up front so that the pointers passed to the
+	// reply handlers remain valid as stats grows.
+	stats := make([]IndexStats, 0, len(c.spec.fields))
+	tx := c.pool.NewTransaction()
+	for _, fs := range c.spec.fields {
+		if fs.indexKind == noIndex {
+			continue
+		}
+		indexKey, err := c.spec.fieldIndexKey(fs.name)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, IndexStats{FieldName: fs.name})
+		fieldStats := &stats[len(stats)-1]
+		tx.Script(getIndexStatsScript, redis.Args{indexKey, fs.indexKind.scriptName(), maxIndexStatsBuckets}, newScanIndexStatsHandler(fs.indexKind, fieldStats))
+	}
+	if len(stats) == 0 {
+		return stats, nil
+	}
+	if err := tx.Exec(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// newScanIndexStatsHandler returns a ReplyHandler which will scan the reply
+// from the get_index_stats script into stats.
+func newScanIndexStatsHandler(kind indexKind, stats *IndexStats) ReplyHandler {
+	return func(reply interface{}) error {
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		var min, max string
+		values, err = redis.Scan(values, &stats.Count, &stats.DistinctValues, &min, &max)
+		if err != nil {
+			return err
+		}
+		if kind == numericIndex {
+			if stats.Count == 0 {
+				return nil
+			}
+			if stats.Min, err = strconv.ParseFloat(min, 64); err != nil {
+				return err
+			}
+			if stats.Max, err = strconv.ParseFloat(max, 64); err != nil {
+				return err
+			}
+			return nil
+		}
+		stats.Buckets = map[string]int{}
+		for len(values) > 0 {
+			var value string
+			var count int
+			if values, err = redis.Scan(values, &value, &count); err != nil {
+				return err
+			}
+			if kind == booleanIndex || kind == sparseBoolIndex {
+				// Boolean values are stored as scores of 0 (false) or 1 (true).
+				// Sparse indexes only have a bucket for true, which the script
+				// reports as 1.
+				value = strconv.FormatBool(value == "1")
+			}
+			stats.Buckets[value] = count
+		}
+		return nil
+	}
+}
+
+// Truncate removes all the models in the collection, along with the set of all
+// ids and every field index, without the per-model overhead of DeleteAll. The
+// ids are read in batches with SSCAN (see PoolOptions.ScanCount) and the
+// corresponding keys are removed with UNLINK instead of DEL. UNLINK only
+// removes the keys from the keyspace and reclaims the memory in a background
+// thread, so it will not block Redis when the collection or its indexes are
+// very large. As a consequence, Truncate is not transactional. Models which are
+// saved while Truncate is running may or may not be removed, and other clients
+// may observe a partially truncated collection. Truncate requires Redis version
+// 4.0 or higher and only works for indexed collections.
+func (c *Collection) Truncate() error {
+	if !c.index {
+		return newUnindexedCollectionError("Truncate")
+	}
+	conn := c.pool.NewConn()
+	defer conn.Close()
+	// Unlink the main hash for each model in batches.
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SSCAN", c.IndexKey(), cursor, "COUNT", c.pool.scanCount()))
+		if err != nil {
+			return err
+		}
+		var ids []string
+		if _, err := redis.Scan(values, &cursor, &ids); err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			keys := redis.Args{}
+			for _, id := range ids {
+				keys = append(keys, c.ModelKey(id))
+				keys = keys.AddFlat(c.spec.listKeys(id))
+			}
+			if _, err := conn.Do("UNLINK", keys...); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	// Unlink the set of all ids, all the field indexes, and the HyperLogLogs
+	// for approximate distinct counts.
+	keys := redis.Args{c.IndexKey()}
+	for _, fs := range c.spec.fields {
+		if fs.indexKind == noIndex {
+			continue
+		}
+		indexKey, err := c.spec.fieldIndexKey(fs.name)
+		if err != nil {
+			return err
+		}
+		if fs.indexKind == enumIndex {
+			// The keys for the values in an enum index are only known to Redis,
+			// so they are deleted by a script.
+			if _, err := deleteEnumBucketsScript.Do(conn, indexKey); err != nil {
+				return err
+			}
+			continue
+		}
+		keys = append(keys, indexKey)
+		if fs.indexKeyFunc != nil {
+			keys = append(keys, indexKeysKey(indexKey))
+		}
+	}
+	keys = keys.AddFlat(c.spec.distinctKeys())
+	if _, err := conn.Do("UNLINK", keys...); err != nil {
+		return err
+	}
+	// Invalidate any cached query counts.
+	if _, err := conn.Do("INCR", c.spec.writeCountKey()); err != nil {
+		return err
+	}
+	// The collection no longer has any data, so remove it from the set of
+	// collection names. See Pool.CollectionNames.
+	if _, err := conn.Do("SREM", collectionNamesKey, c.Name()); err != nil {
+		return err
+	}
+	if c.changeLog {
+		if _, err := conn.Do("XADD", changeArgs(c, ChangeTruncate, "", nil)...); err != nil {
+			return err
+		}
+	}
+	c.pool.callWriteHook(true, c.Name(), "")
+	return nil
+}
+
+// DeleteAllByIds deletes the models with the given ids in a single transaction.
+// Any ids which do not correspond to an existing model are ignored. It returns
+// the number of models that were actually deleted and an error if there was a
+// problem connecting to the database. DeleteAllByIds is much more efficient
+// than calling Delete for each id separately.
+func (c *Collection) DeleteAllByIds(ids []string) (int, error) {
+	t := c.pool.NewTransaction()
+	count := 0
+	t.DeleteAllByIds(c, ids, &count)
+	if err := t.Exec(); err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+// DeleteAllByIds deletes the models with the given ids in an existing
+// transaction. The value of count will be set to the number of models that were
+// successfully deleted when the transaction is executed. Any errors encountered
+// will be added to the transaction and returned as an error when the
+// transaction is executed. You may pass in nil for count if you do not care
+// about the number of models that were deleted.
+func (t *Transaction) DeleteAllByIds(c *Collection, ids []string, count *int) {
+	if c == nil {
+		t.setError(newNilCollectionError("DeleteAllByIds"))
+		return
+	}
+	if len(ids) == 0 {
+		if count != nil {
+			(*count) = 0
+		}
+		return
+	}
+	// Delete any field indexes. As in Delete, this must happen first because it
+	// relies on reading the old field values from the hash for string indexes.
+	for _, id := range ids {
+		t.deleteFieldIndexes(c, id)
+		t.deleteListFields(c, id)
+	}
+	var handler ReplyHandler
+	if count == nil {
+		handler = nil
+	} else {
+		handler = NewScanIntHandler(count)
+	}
+	// Put the ids in a temporary set so that the models can be deleted with a
+	// single script.
+	idsKey := generateRandomKey("tmp:deleteAllByIds:" + c.Name())
+	t.Command("SADD", redis.Args{idsKey}.AddFlat(ids), nil)
+	t.DeleteModelsBySetIds(idsKey, c.Name(), handler)
+	t.Command("UNLINK", redis.Args{idsKey}, nil)
+	if c.index {
+		t.incrWriteCount(c)
+	}
+	for _, id := range ids {
+		t.addChange(c, ChangeDelete, id, nil)
+	}
+}
+
+// incrWriteCount adds a command to the transaction which increments the write
+// count for the given collection. It should be called for every operation that
+// saves or deletes models in an indexed collection. Cached query counts include
+// the write count in their keys, so incrementing it invalidates all of them.
+func (t *Transaction) incrWriteCount(c *Collection) {
+	t.Command("INCR", redis.Args{c.spec.writeCountKey()}, nil)
 }
 
 // checkModelType returns an error iff model is not of the registered type that
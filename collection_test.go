@@ -8,8 +8,16 @@
 package zoom
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 // collectionTestModel is a model type that is only used for testing
@@ -33,9 +41,9 @@ func TestNewCollection(t *testing.T) {
 	expectedType := reflect.TypeOf(&collectionTestModel{})
 	testRegisteredCollectionType(t, col, expectedName, expectedType)
 
-	// Effectively unregister the type by removing it from the map
-	delete(testPool.modelNameToSpec, col.Name())
-	delete(testPool.modelTypeToSpec, col.spec.typ)
+	if err := testPool.UnregisterCollection(col.Name()); err != nil {
+		t.Errorf("Unexpected error in UnregisterCollection: %s", err.Error())
+	}
 }
 
 func TestNewCollectionWithName(t *testing.T) {
@@ -51,9 +59,52 @@ func TestNewCollectionWithName(t *testing.T) {
 	expectedType := reflect.TypeOf(&collectionTestModel{})
 	testRegisteredCollectionType(t, col, expectedName, expectedType)
 
-	// Effectively unregister the type by removing it from the map
-	delete(testPool.modelNameToSpec, col.Name())
-	delete(testPool.modelTypeToSpec, col.spec.typ)
+	if err := testPool.UnregisterCollection(col.Name()); err != nil {
+		t.Errorf("Unexpected error in UnregisterCollection: %s", err.Error())
+	}
+}
+
+func TestUnregisterCollection(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Register the same type concurrently. Exactly one call should succeed.
+	const numRegistrations = 10
+	errs := make(chan error, numRegistrations)
+	for i := 0; i < numRegistrations; i++ {
+		go func() {
+			_, err := testPool.NewCollection(&collectionTestModel{})
+			errs <- err
+		}()
+	}
+	successes := 0
+	for i := 0; i < numRegistrations; i++ {
+		if err := <-errs; err == nil {
+			successes++
+		}
+	}
+	if successes != 1 {
+		t.Fatalf("Expected exactly 1 successful registration but got %d", successes)
+	}
+
+	// After unregistering, the type and name should be available again.
+	if err := testPool.UnregisterCollection("collectionTestModel"); err != nil {
+		t.Fatalf("Unexpected error in UnregisterCollection: %s", err.Error())
+	}
+	if _, found := testPool.CollectionForName("collectionTestModel"); found {
+		t.Error("Expected the collection to be removed but it was still found")
+	}
+	if err := testPool.UnregisterCollection("collectionTestModel"); err == nil {
+		t.Error("Expected an error when unregistering a collection twice but got none")
+	}
+	col, err := testPool.NewCollectionWithOptions(&collectionTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error registering the type again: %s", err.Error())
+	}
+	testRegisteredCollectionType(t, col, "collectionTestModel", reflect.TypeOf(&collectionTestModel{}))
+	if err := testPool.UnregisterCollection(col.Name()); err != nil {
+		t.Errorf("Unexpected error in UnregisterCollection: %s", err.Error())
+	}
 }
 
 func testRegisteredCollectionType(t *testing.T, collection *Collection, expectedName string, expectedType reflect.Type) {
@@ -134,6 +185,43 @@ func TestSave(t *testing.T) {
 	expectFieldEquals(t, key, "Bool", mu, model.Bool)
 }
 
+func TestSaveWithStats(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := createIndexedTestModels(1)[0]
+	stats, err := indexedTestModels.SaveWithStats(model)
+	if err != nil {
+		t.Fatalf("Unexpected error in SaveWithStats: %s", err.Error())
+	}
+	expectModelsExist(t, indexedTestModels, []Model{model})
+	for _, fieldName := range []string{"Int", "String", "Bool"} {
+		expectIndexExists(t, indexedTestModels, model, fieldName)
+	}
+	// Each of the three indexes is added to, and the old value of the string
+	// index is removed first.
+	if stats.IndexesAdded != 3 {
+		t.Errorf("Expected IndexesAdded to be 3 but got %d", stats.IndexesAdded)
+	}
+	if stats.IndexesRemoved != 1 {
+		t.Errorf("Expected IndexesRemoved to be 1 but got %d", stats.IndexesRemoved)
+	}
+	save := &Transaction{}
+	save.Save(indexedTestModels, model)
+	if stats.Commands != len(save.actions) {
+		t.Errorf("Expected Commands to be %d but got %d", len(save.actions), stats.Commands)
+	}
+
+	// The stats should be empty if there was an error.
+	stats, err = indexedTestModels.SaveWithStats(createTestModels(1)[0])
+	if err == nil {
+		t.Error("Expected an error in SaveWithStats for a model of the wrong type but got none")
+	}
+	if stats != (SaveStats{}) {
+		t.Errorf("Expected empty stats after an error but got %+v", stats)
+	}
+}
+
 func TestSaveFields(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
@@ -270,6 +358,45 @@ func TestFindModelNotFound(t *testing.T) {
 		t.Errorf("Expected error in testModels.Find but got none")
 	} else if _, ok := err.(ModelNotFoundError); !ok {
 		t.Errorf("Expected error to be a ModelNotFoundError but got: %T: %s", err, err.Error())
+	} else if !errors.Is(err, ErrModelNotFound) {
+		t.Errorf("Expected errors.Is(err, ErrModelNotFound) to be true for %s", err.Error())
+	}
+}
+
+func TestFindOrZero(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// A model which does not exist should be set to its zero value without an
+	// error, even if the struct already had values.
+	model := &testModel{Int: 42, String: "foo", Bool: true}
+	if found, err := testModels.FindOrZero("fake-id", model); err != nil {
+		t.Fatalf("Unexpected error in FindOrZero: %s", err.Error())
+	} else if found {
+		t.Error("Expected FindOrZero to return false for a model that does not exist")
+	}
+	if !reflect.DeepEqual(&testModel{}, model) {
+		t.Errorf("Expected FindOrZero to set the model to its zero value but got %+v", model)
+	}
+
+	// A model which exists should be found as usual.
+	models, err := createAndSaveTestModels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &testModel{}
+	if found, err := testModels.FindOrZero(models[0].ModelId(), got); err != nil {
+		t.Fatalf("Unexpected error in FindOrZero: %s", err.Error())
+	} else if !found {
+		t.Error("Expected FindOrZero to return true for a model that exists")
+	}
+	if !reflect.DeepEqual(models[0], got) {
+		t.Errorf("Found model was incorrect.\n\tExpected: %+v\n\tBut got:  %+v", models[0], got)
+	}
+
+	// Other errors should still be returned.
+	if _, err := testModels.FindOrZero(models[0].ModelId(), &indexedTestModel{}); err == nil {
+		t.Error("Expected an error for a model of the wrong type but got none")
 	}
 }
 
@@ -349,6 +476,38 @@ func TestCount(t *testing.T) {
 
 }
 
+func TestExistsAll(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveTestModels(3)
+	if err != nil {
+		t.Fatalf("Unexpected error saving test models: %s", err.Error())
+	}
+	ids := []string{models[0].ModelId(), "missing", models[2].ModelId(), models[1].ModelId()}
+	if _, err := testModels.Delete(models[1].ModelId()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := testModels.ExistsAll(ids)
+	if err != nil {
+		t.Fatalf("Unexpected error in ExistsAll: %s", err.Error())
+	}
+	expected := map[string]bool{
+		models[0].ModelId(): true,
+		"missing":           false,
+		models[2].ModelId(): true,
+		models[1].ModelId(): false,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("ExistsAll was incorrect.\nExpected: %v\nGot:      %v", expected, got)
+	}
+	if got, err := testModels.ExistsAll(nil); err != nil {
+		t.Errorf("Unexpected error in ExistsAll: %s", err.Error())
+	} else if len(got) != 0 {
+		t.Errorf("Expected an empty map for no ids but got %v", got)
+	}
+}
+
 func TestDelete(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
@@ -382,6 +541,47 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestTouch(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveTestModels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := models[0]
+	if err := testModels.Touch(model.ModelId(), time.Minute); err != nil {
+		t.Fatalf("Unexpected error in Touch: %s", err.Error())
+	}
+	conn := testPool.NewConn()
+	defer conn.Close()
+	ttl, err := redis.Int64(conn.Do("PTTL", testModels.ModelKey(model.ModelId())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= 0 || ttl > time.Minute.Milliseconds() {
+		t.Errorf("Expected the ttl to be set to at most one minute but got %dms", ttl)
+	}
+	// The fields should not have been changed.
+	got := &testModel{}
+	if err := testModels.Find(model.ModelId(), got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(model, got) {
+		t.Errorf("Found model was incorrect.\n\tExpected: %+v\n\tBut got:  %+v", model, got)
+	}
+
+	// Touching a model which does not exist should cause a ModelNotFoundError.
+	if err := testModels.Touch("invalidId", time.Minute); err == nil {
+		t.Error("Expected an error for a model that does not exist but got none")
+	} else if _, ok := err.(ModelNotFoundError); !ok {
+		t.Errorf("Expected a ModelNotFoundError but got: %T: %s", err, err.Error())
+	}
+	if err := testModels.Touch(model.ModelId(), time.Microsecond); err == nil {
+		t.Error("Expected an error for a ttl less than one millisecond but got none")
+	}
+}
+
 func TestDeleteAll(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
@@ -414,3 +614,877 @@ func TestDeleteAll(t *testing.T) {
 	// Make sure the models were deleted
 	expectModelsDoNotExist(t, testModels, Models(models))
 }
+
+func TestIndexStats(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// The indexes should be empty at first
+	stats, err := indexedTestModels.IndexStats()
+	if err != nil {
+		t.Fatalf("Unexpected error in IndexStats: %s", err.Error())
+	}
+	if len(stats) != 3 {
+		t.Fatalf("Expected stats for 3 fields but got %d", len(stats))
+	}
+	for _, fieldStats := range stats {
+		if fieldStats.Count != 0 || fieldStats.DistinctValues != 0 {
+			t.Errorf("Expected empty stats for %s but got %+v", fieldStats.FieldName, fieldStats)
+		}
+	}
+
+	tx := testPool.NewTransaction()
+	for i, str := range []string{"a", "b", "b", "c", "c", "c"} {
+		tx.Save(indexedTestModels, &indexedTestModel{
+			Int:    i - 2,
+			String: str,
+			Bool:   i < 2,
+		})
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = indexedTestModels.IndexStats()
+	if err != nil {
+		t.Fatalf("Unexpected error in IndexStats: %s", err.Error())
+	}
+	expected := []IndexStats{
+		{
+			FieldName:      "Int",
+			Count:          6,
+			DistinctValues: 6,
+			Min:            -2,
+			Max:            3,
+		},
+		{
+			FieldName:      "String",
+			Count:          6,
+			DistinctValues: 3,
+			Buckets:        map[string]int{"a": 1, "b": 2, "c": 3},
+		},
+		{
+			FieldName:      "Bool",
+			Count:          6,
+			DistinctValues: 2,
+			Buckets:        map[string]int{"true": 2, "false": 4},
+		},
+	}
+	if !reflect.DeepEqual(expected, stats) {
+		t.Errorf("IndexStats was incorrect.\nExpected: %+v\nGot:      %+v", expected, stats)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(5)
+	if err != nil {
+		t.Fatalf("Unexpected error saving test models: %s", err.Error())
+	}
+	if err := indexedTestModels.Truncate(); err != nil {
+		t.Fatalf("Unexpected error in indexedTestModels.Truncate: %s", err.Error())
+	}
+
+	// Make sure the models, the set of all ids, and the field indexes were
+	// removed.
+	expectModelsDoNotExist(t, indexedTestModels, Models(models))
+	expectKeyDoesNotExist(t, indexedTestModels.IndexKey())
+	for _, fieldName := range []string{"Int", "String", "Bool"} {
+		indexKey, err := indexedTestModels.FieldIndexKey(fieldName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectKeyDoesNotExist(t, indexKey)
+	}
+	count, err := indexedTestModels.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("Expected count to be 0 after Truncate but got %d", count)
+	}
+
+	// Truncating an empty collection should not cause an error
+	if err := indexedTestModels.Truncate(); err != nil {
+		t.Errorf("Unexpected error in indexedTestModels.Truncate: %s", err.Error())
+	}
+}
+
+func TestFindRawHash(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := &indexedTestModel{Int: 42, String: "foo", Bool: true}
+	if err := indexedTestModels.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	// Add a field which is not in the struct definition. It should still be
+	// returned.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", indexedTestModels.ModelKey(model.ModelId()), "Removed", "old value"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := indexedTestModels.FindRawHash(model.ModelId())
+	if err != nil {
+		t.Fatalf("Unexpected error in FindRawHash: %s", err.Error())
+	}
+	expected := map[string]string{
+		"Int":     "42",
+		"String":  "foo",
+		"Bool":    "1",
+		"Removed": "old value",
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("FindRawHash returned the wrong hash.\nExpected: %v\nGot:      %v", expected, got)
+	}
+
+	// A model which does not exist should cause a ModelNotFoundError.
+	if _, err := indexedTestModels.FindRawHash("invalidId"); err == nil {
+		t.Error("Expected an error for a model that does not exist but got none")
+	} else if _, ok := err.(ModelNotFoundError); !ok {
+		t.Errorf("Expected a ModelNotFoundError but got: %T: %s", err, err.Error())
+	}
+}
+
+func TestStrictScan(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use a separate pool so that the strict collection does not affect other
+	// tests.
+	pool := NewPoolWithOptions(testPool.options)
+	defer pool.Close()
+	options := DefaultCollectionOptions.WithIndex(true).WithStrictScan(true).WithName("strictScanTestModel")
+	collection, err := pool.NewCollectionWithOptions(&indexedTestModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := &indexedTestModel{Int: 42, String: "foo", Bool: true}
+	if err := collection.Save(model); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find should work as usual if there are no unknown fields.
+	got := &indexedTestModel{}
+	if err := collection.Find(model.ModelId(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if !reflect.DeepEqual(model, got) {
+		t.Errorf("Found model was incorrect.\n\tExpected: %+v\n\tBut got:  %+v", model, got)
+	}
+
+	// Add some fields which are not in the struct definition.
+	conn := pool.NewConn()
+	defer conn.Close()
+	if _, err := conn.Do("HMSET", collection.ModelKey(model.ModelId()), "Removed", "old value", "Renamed", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := collection.Find(model.ModelId(), &indexedTestModel{}); err == nil {
+		t.Error("Expected an error for a model with unknown fields but got none")
+	} else if !strings.Contains(err.Error(), "Removed, Renamed") {
+		t.Errorf("Expected the error to list the unknown fields but got: %s", err.Error())
+	}
+
+	// The default collection should still ignore unknown fields.
+	if err := indexedTestModels.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("HSET", indexedTestModels.ModelKey(model.ModelId()), "Removed", "old value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := indexedTestModels.Find(model.ModelId(), &indexedTestModel{}); err != nil {
+		t.Errorf("Unexpected error in Find for a lenient collection: %s", err.Error())
+	}
+}
+
+func TestReserveId(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Reserve ids for two models and use them to make the models reference each
+	// other before the transaction is executed.
+	tx := testPool.NewTransaction()
+	parentId := tx.ReserveId(indexedTestModels)
+	childId := tx.ReserveId(indexedTestModels)
+	if parentId == "" || childId == "" || parentId == childId {
+		t.Fatalf("Expected two unique, non-empty ids but got %q and %q", parentId, childId)
+	}
+	parent := &indexedTestModel{String: childId}
+	parent.SetModelId(parentId)
+	child := &indexedTestModel{String: parentId}
+	child.SetModelId(childId)
+	tx.Save(indexedTestModels, parent)
+	tx.Save(indexedTestModels, child)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+	expectModelsExist(t, indexedTestModels, []Model{parent, child})
+	found := &indexedTestModel{}
+	if err := indexedTestModels.Find(parentId, found); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if found.String != childId {
+		t.Errorf("Expected parent to reference %q but got %q", childId, found.String)
+	}
+
+	// A nil collection should cause an error.
+	tx = testPool.NewTransaction()
+	if id := tx.ReserveId(nil); id != "" {
+		t.Errorf("Expected an empty id for a nil collection but got %q", id)
+	}
+	if err := tx.Exec(); err == nil {
+		t.Error("Expected an error for a nil collection but got none")
+	}
+}
+
+func TestSaveIfNotExists(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// A new model should be saved along with its indexes.
+	model := &indexedTestModel{Int: 1, String: "foo", Bool: true}
+	saved, err := indexedTestModels.SaveIfNotExists(model)
+	if err != nil {
+		t.Fatalf("Unexpected error in SaveIfNotExists: %s", err.Error())
+	}
+	if !saved {
+		t.Error("Expected SaveIfNotExists to save a new model but it did not")
+	}
+	expectModelsExist(t, indexedTestModels, []Model{model})
+	for _, fieldName := range []string{"Int", "String", "Bool"} {
+		expectIndexExists(t, indexedTestModels, model, fieldName)
+	}
+
+	// A model with the same id should not be saved, and neither the model nor
+	// its indexes should change.
+	original := *model
+	model.Int = 2
+	model.String = "bar"
+	saved, err = indexedTestModels.SaveIfNotExists(model)
+	if err != nil {
+		t.Fatalf("Unexpected error in SaveIfNotExists: %s", err.Error())
+	}
+	if saved {
+		t.Error("Expected SaveIfNotExists to not save an existing model but it did")
+	}
+	expectModelsExist(t, indexedTestModels, []Model{&original})
+	for _, fieldName := range []string{"Int", "String", "Bool"} {
+		expectIndexExists(t, indexedTestModels, &original, fieldName)
+	}
+	for _, fieldName := range []string{"Int", "String"} {
+		expectIndexDoesNotExist(t, indexedTestModels, model, fieldName)
+	}
+
+	// The wrong model type should cause an error.
+	if _, err := indexedTestModels.SaveIfNotExists(&testModel{}); err == nil {
+		t.Error("Expected an error for the wrong model type but got none")
+	}
+}
+
+func TestSaveIf(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// A new model should always be saved, regardless of the condition.
+	model := &indexedTestModel{Int: 5, String: "foo", Bool: true}
+	saved, err := indexedTestModels.SaveIf(model, "Int", ">", 100)
+	if err != nil {
+		t.Fatalf("Unexpected error in SaveIf: %s", err.Error())
+	}
+	if !saved {
+		t.Error("Expected SaveIf to save a new model but it did not")
+	}
+	expectModelsExist(t, indexedTestModels, []Model{model})
+
+	// If the condition does not hold, neither the model nor its indexes should
+	// change.
+	original := *model
+	model.Int = 3
+	model.String = "bar"
+	saved, err = indexedTestModels.SaveIf(model, "Int", "<", model.Int)
+	if err != nil {
+		t.Fatalf("Unexpected error in SaveIf: %s", err.Error())
+	}
+	if saved {
+		t.Error("Expected SaveIf to not save the model because 5 < 3 is false but it did")
+	}
+	expectModelsExist(t, indexedTestModels, []Model{&original})
+	for _, fieldName := range []string{"Int", "String", "Bool"} {
+		expectIndexExists(t, indexedTestModels, &original, fieldName)
+	}
+	for _, fieldName := range []string{"Int", "String"} {
+		expectIndexDoesNotExist(t, indexedTestModels, model, fieldName)
+	}
+
+	// If the condition holds, the model and its indexes should be updated and
+	// the old indexes should be removed.
+	model.Int = 10
+	saved, err = indexedTestModels.SaveIf(model, "Int", "<", model.Int)
+	if err != nil {
+		t.Fatalf("Unexpected error in SaveIf: %s", err.Error())
+	}
+	if !saved {
+		t.Error("Expected SaveIf to save the model because 5 < 10 is true but it did not")
+	}
+	expectModelsExist(t, indexedTestModels, []Model{model})
+	for _, fieldName := range []string{"Int", "String", "Bool"} {
+		expectIndexExists(t, indexedTestModels, model, fieldName)
+	}
+	for _, fieldName := range []string{"Int", "String"} {
+		expectIndexDoesNotExist(t, indexedTestModels, &original, fieldName)
+	}
+
+	// Test each of the operators with both numeric and string comparisons. The
+	// stored values are Int = 10, String = "bar", and Bool = true.
+	conditions := []struct {
+		field    string
+		op       string
+		value    interface{}
+		expected bool
+	}{
+		{"Int", "=", 10, true},
+		{"Int", "=", 9, false},
+		{"Int", "!=", 9, true},
+		{"Int", ">", 9, true},
+		{"Int", ">", 11, false},
+		{"Int", ">=", 10, true},
+		{"Int", "<=", 9, false},
+		{"Int", "<", 100, true},
+		{"String", "=", "bar", true},
+		{"String", "<", "baz", true},
+		{"String", "<", "ba", false},
+		{"String", ">=", "Zoo", true},
+		{"Bool", "=", true, true},
+		{"Bool", "!=", true, false},
+	}
+	for _, c := range conditions {
+		saved, err := indexedTestModels.SaveIf(model, c.field, c.op, c.value)
+		if err != nil {
+			t.Errorf("Unexpected error in SaveIf with %s %s %v: %s", c.field, c.op, c.value, err.Error())
+			continue
+		}
+		if saved != c.expected {
+			t.Errorf("Expected SaveIf with %s %s %v to return %v but got %v", c.field, c.op, c.value, c.expected, saved)
+		}
+	}
+
+	// Invalid arguments should cause an error.
+	if _, err := indexedTestModels.SaveIf(model, "Int", "~", 10); err == nil {
+		t.Error("Expected an error for an invalid operator but got none")
+	}
+	if _, err := indexedTestModels.SaveIf(model, "Int", "=", "10"); err == nil {
+		t.Error("Expected an error for a value with the wrong type but got none")
+	}
+	if _, err := indexedTestModels.SaveIf(model, "Foo", "=", 10); err == nil {
+		t.Error("Expected an error for a field that does not exist but got none")
+	}
+	if _, err := indexedTestModels.SaveIf(&testModel{}, "Int", "=", 10); err == nil {
+		t.Error("Expected an error for the wrong model type but got none")
+	}
+}
+
+func TestCollectionPool(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// newCountingPool returns a pool which counts the number of connections it
+	// dials.
+	newCountingPool := func(dialCount *int) *Pool {
+		return NewPoolWithOptions(testPool.options.WithDialFunc(func(ctx context.Context) (redis.Conn, error) {
+			(*dialCount)++
+			conn, err := redis.Dial(*network, *address)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := conn.Do("SELECT", *database); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}))
+	}
+	sharedDials, dedicatedDials := 0, 0
+	sharedPool := newCountingPool(&sharedDials)
+	defer sharedPool.Close()
+	dedicatedPool := newCountingPool(&dedicatedDials)
+	defer dedicatedPool.Close()
+	options := DefaultCollectionOptions.WithIndex(true).WithPool(dedicatedPool)
+	collection, err := sharedPool.NewCollectionWithOptions(&indexedTestModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Operations on the collection should only use the dedicated pool.
+	model := createIndexedTestModels(1)[0]
+	if err := collection.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	if err := collection.Find(model.ModelId(), &indexedTestModel{}); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	count, err := collection.NewQuery().Filter("Int =", model.Int).Count()
+	if err != nil {
+		t.Fatalf("Unexpected error in Query.Count: %s", err.Error())
+	}
+	if count != 1 {
+		t.Errorf("Expected count to be 1 but got %d", count)
+	}
+	if dedicatedDials == 0 {
+		t.Error("Expected the dedicated pool to be used but it was not")
+	}
+	if sharedDials != 0 {
+		t.Errorf("Expected the shared pool to not be used but it dialed %d connections", sharedDials)
+	}
+
+	// The collection should still be registered with the shared pool.
+	if got, found := sharedPool.CollectionForName(collection.Name()); !found || got != collection {
+		t.Errorf("Expected collection to be registered with the shared pool but it was not")
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// The first upsert for a value should insert a new model
+	first := &indexedTestModel{Int: 1, String: "foo", Bool: true}
+	inserted, err := indexedTestModels.Upsert("String", "foo", first)
+	if err != nil {
+		t.Fatalf("Unexpected error in Upsert: %s", err.Error())
+	}
+	if !inserted {
+		t.Error("Expected first Upsert to insert a new model but it did not")
+	}
+	expectModelsExist(t, indexedTestModels, []Model{first})
+
+	// The second upsert for the same value should update the existing model
+	second := &indexedTestModel{Int: 2, String: "foo", Bool: false}
+	inserted, err = indexedTestModels.Upsert("String", "foo", second)
+	if err != nil {
+		t.Fatalf("Unexpected error in Upsert: %s", err.Error())
+	}
+	if inserted {
+		t.Error("Expected second Upsert to update the existing model but it inserted a new one")
+	}
+	if second.ModelId() != first.ModelId() {
+		t.Errorf("Expected id to be %s but got %s", first.ModelId(), second.ModelId())
+	}
+	expectModelsExist(t, indexedTestModels, []Model{second})
+	expectIndexExists(t, indexedTestModels, second, "Int")
+	expectIndexDoesNotExist(t, indexedTestModels, first, "Int")
+
+	// Numeric fields can also be used as the unique field
+	third := &indexedTestModel{Int: 2, String: "bar"}
+	inserted, err = indexedTestModels.Upsert("Int", 2, third)
+	if err != nil {
+		t.Fatalf("Unexpected error in Upsert: %s", err.Error())
+	}
+	if inserted {
+		t.Error("Expected Upsert on Int to update the existing model but it inserted a new one")
+	}
+	if third.ModelId() != first.ModelId() {
+		t.Errorf("Expected id to be %s but got %s", first.ModelId(), third.ModelId())
+	}
+	count, err := indexedTestModels.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected count to be 1 but got %d", count)
+	}
+
+	// Invalid fields and values should cause an error
+	if _, err := indexedTestModels.Upsert("Invalid", "foo", &indexedTestModel{}); err == nil {
+		t.Error("Expected an error for an invalid field name but got none")
+	}
+	if _, err := indexedTestModels.Upsert("String", 1, &indexedTestModel{}); err == nil {
+		t.Error("Expected an error for a value of the wrong type but got none")
+	}
+	if _, err := testModels.Upsert("Int", 1, &testModel{}); err == nil {
+		t.Error("Expected an error for an unindexed field but got none")
+	}
+}
+
+func TestUpsertConcurrent(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	const numUpserts = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, numUpserts)
+	insertedCount := make(chan bool, numUpserts)
+	for i := 0; i < numUpserts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			model := &indexedTestModel{Int: i, String: "concurrent"}
+			inserted, err := indexedTestModels.Upsert("String", "concurrent", model)
+			if err != nil {
+				errs <- err
+				return
+			}
+			insertedCount <- inserted
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	close(insertedCount)
+	for err := range errs {
+		t.Errorf("Unexpected error in Upsert: %s", err.Error())
+	}
+	numInserted := 0
+	for inserted := range insertedCount {
+		if inserted {
+			numInserted++
+		}
+	}
+	if numInserted != 1 {
+		t.Errorf("Expected exactly 1 model to be inserted but got %d", numInserted)
+	}
+	count, err := indexedTestModels.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Expected count to be 1 but got %d", count)
+	}
+}
+
+func TestDeleteAllByIds(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Create and save some test models
+	models, err := createAndSaveIndexedTestModels(5)
+	if err != nil {
+		t.Fatalf("Unexpected error saving test models: %s", err.Error())
+	}
+
+	// Delete some of the models along with an id which does not exist
+	ids := []string{models[0].ModelId(), models[1].ModelId(), models[2].ModelId(), "fakeId"}
+	count, err := indexedTestModels.DeleteAllByIds(ids)
+	if err != nil {
+		t.Errorf("Unexpected error in indexedTestModels.DeleteAllByIds: %s", err.Error())
+	}
+	if count != 3 {
+		t.Errorf("Expected count to be 3 but got %d", count)
+	}
+
+	// Make sure the models and their indexes were deleted
+	expectModelsDoNotExist(t, indexedTestModels, Models(models[:3]))
+	for _, model := range models[:3] {
+		for _, fieldName := range []string{"Int", "String", "Bool"} {
+			expectIndexDoesNotExist(t, indexedTestModels, model, fieldName)
+		}
+	}
+
+	// Make sure the other models still exist
+	expectModelsExist(t, indexedTestModels, Models(models[3:]))
+
+	// Calling DeleteAllByIds with no ids should not do anything
+	count, err = indexedTestModels.DeleteAllByIds(nil)
+	if err != nil {
+		t.Errorf("Unexpected error in indexedTestModels.DeleteAllByIds: %s", err.Error())
+	}
+	if count != 0 {
+		t.Errorf("Expected count to be 0 but got %d", count)
+	}
+}
+
+func TestTransactionAcrossCollections(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type archivedModel struct {
+		Int    int    `zoom:"index"`
+		String string `zoom:"index"`
+		Bool   bool   `zoom:"index"`
+		RandomId
+	}
+	archives, err := testPool.NewCollectionWithOptions(&archivedModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+	models, err := createAndSaveIndexedTestModels(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the first model to the archive in a single transaction.
+	source := models[0]
+	archived := &archivedModel{
+		Int:      source.Int,
+		String:   source.String,
+		Bool:     source.Bool,
+		RandomId: source.RandomId,
+	}
+	tx := testPool.NewTransaction()
+	deleted := false
+	tx.Delete(indexedTestModels, source.ModelId(), &deleted)
+	tx.Save(archives, archived)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Transaction.Exec: %s", err.Error())
+	}
+	if !deleted {
+		t.Error("Expected the model to be deleted from the source collection but it was not")
+	}
+
+	// The model and its indexes should only exist in the archive.
+	expectModelsDoNotExist(t, indexedTestModels, Models(models[:1]))
+	expectModelsExist(t, indexedTestModels, Models(models[1:]))
+	expectModelsExist(t, archives, []Model{archived})
+	for _, fieldName := range []string{"Int", "String", "Bool"} {
+		expectIndexDoesNotExist(t, indexedTestModels, source, fieldName)
+		expectIndexExists(t, archives, archived, fieldName)
+	}
+	gotIds, err := archives.NewQuery().Filter("String =", source.String).Ids()
+	if err != nil {
+		t.Fatalf("Unexpected error in Query.Ids: %s", err.Error())
+	}
+	if len(gotIds) != 1 || gotIds[0] != source.ModelId() {
+		t.Errorf("Expected the archive query to return [%s] but got %v", source.ModelId(), gotIds)
+	}
+}
+
+func TestSingleActionTransaction(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// A transaction with a single action should not use MULTI/EXEC but should
+	// return the same reply.
+	buf := &bytes.Buffer{}
+	tx := testPool.NewTransaction()
+	tx.debug = buf
+	got := ""
+	tx.Command("SET", redis.Args{"singleActionKey", "value"}, nil)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Transaction.Exec: %s", err.Error())
+	}
+	tx = testPool.NewTransaction()
+	tx.debug = buf
+	tx.Command("GET", redis.Args{"singleActionKey"}, NewScanStringHandler(&got))
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Transaction.Exec: %s", err.Error())
+	}
+	if got != "value" {
+		t.Errorf("Expected GET to return %q but got %q", "value", got)
+	}
+	if output := buf.String(); strings.Contains(output, "MULTI") {
+		t.Errorf("Expected single action transactions not to use MULTI but got:\n%s", output)
+	}
+	// Errors should be returned the same way.
+	tx = testPool.NewTransaction()
+	tx.Command("HGET", redis.Args{"singleActionKey", "field"}, nil)
+	if err := tx.Exec(); err == nil {
+		t.Error("Expected a WRONGTYPE error but got none")
+	}
+
+	// Saving an unindexed model writes the main hash and the set of collection
+	// names in a single script, so it should not use MULTI/EXEC.
+	type unindexedSingleActionModel struct {
+		Name string
+		RandomId
+	}
+	unindexedModels, err := testPool.NewCollectionWithOptions(&unindexedSingleActionModel{}, DefaultCollectionOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := testPool.NewConn()
+	defer conn.Close()
+	unindexed := []*unindexedSingleActionModel{{Name: "a"}, {Name: "b"}}
+	for _, model := range unindexed {
+		// Remove the name of the collection as if another process had
+		// truncated it. Every save should add it again.
+		if _, err := conn.Do("SREM", collectionNamesKey, unindexedModels.Name()); err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		tx = testPool.NewTransaction()
+		tx.debug = buf
+		tx.Save(unindexedModels, model)
+		if len(tx.actions) != 1 {
+			t.Errorf("Expected saving an unindexed model to use 1 action but got %d", len(tx.actions))
+		}
+		if err := tx.Exec(); err != nil {
+			t.Fatalf("Unexpected error in Transaction.Exec: %s", err.Error())
+		}
+		if output := buf.String(); strings.Contains(output, "MULTI") {
+			t.Errorf("Expected saving an unindexed model not to use MULTI but got:\n%s", output)
+		}
+		if err := unindexedModels.Find(model.ModelId(), &unindexedSingleActionModel{}); err != nil {
+			t.Errorf("Unexpected error in Find: %s", err.Error())
+		}
+		if isMember, err := redis.Bool(conn.Do("SISMEMBER", collectionNamesKey, unindexedModels.Name())); err != nil {
+			t.Fatal(err)
+		} else if !isMember {
+			t.Errorf("Expected saving an unindexed model to add %s to the set of collection names", unindexedModels.Name())
+		}
+	}
+
+	// Saving an indexed model needs several commands, so it should use
+	// MULTI/EXEC.
+	buf.Reset()
+	models := createIndexedTestModels(1)
+	tx = testPool.NewTransaction()
+	tx.debug = buf
+	tx.Save(indexedTestModels, models[0])
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Transaction.Exec: %s", err.Error())
+	}
+	if output := buf.String(); !strings.Contains(output, "MULTI") {
+		t.Errorf("Expected saving an indexed model to use MULTI but got:\n%s", output)
+	}
+	expectModelsExist(t, indexedTestModels, Models(models))
+}
+
+func TestIndexKeyFunc(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type versionModel struct {
+		Version string `zoom:"index"`
+		Name    string
+		RandomId
+	}
+	// semverKey zero-pads each part of a version so that the keys sort in
+	// version order.
+	semverKey := func(version string) string {
+		parts := strings.Split(version, ".")
+		for i, part := range parts {
+			parts[i] = strings.Repeat("0", 8-len(part)) + part
+		}
+		return strings.Join(parts, ".")
+	}
+	options := DefaultCollectionOptions.WithIndex(true).WithIndexKeyFunc("Version", semverKey)
+	collection, err := testPool.NewCollectionWithOptions(&versionModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := []string{"1.10.0", "1.9.0", "2.0.0", "1.2.3", "1.9.10"}
+	models := make([]*versionModel, len(versions))
+	for i, version := range versions {
+		models[i] = &versionModel{Version: version, Name: version}
+		if err := collection.Save(models[i]); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	// expectVersions checks that q returns the models with the given versions,
+	// in order.
+	expectVersions := func(q *Query, expected ...string) {
+		t.Helper()
+		got := []*versionModel{}
+		if err := q.Run(&got); err != nil {
+			t.Fatalf("Unexpected error in %s: %s", q, err.Error())
+		}
+		gotVersions := []string{}
+		for _, model := range got {
+			gotVersions = append(gotVersions, model.Version)
+		}
+		if len(expected) == 0 && len(gotVersions) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(expected, gotVersions) {
+			t.Errorf("Wrong results for %s.\nExpected: %v\nGot:      %v", q, expected, gotVersions)
+		}
+	}
+	// expectConsistent checks that the index and its hash of keys only contain
+	// an entry for each model that exists.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	indexKey, err := collection.FieldIndexKey("Version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectConsistent := func(count int) {
+		t.Helper()
+		reports, err := collection.VerifyIndexes()
+		if err != nil {
+			t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+		}
+		if !reports[0].OK() {
+			t.Errorf("Expected the index to be consistent but got %+v", reports[0])
+		}
+		if n, err := redis.Int(conn.Do("ZCARD", indexKey)); err != nil {
+			t.Fatal(err)
+		} else if n != count {
+			t.Errorf("Expected %d members in the index but got %d", count, n)
+		}
+		if n, err := redis.Int(conn.Do("HLEN", indexKeysKey(indexKey))); err != nil {
+			t.Fatal(err)
+		} else if n != count {
+			t.Errorf("Expected %d keys in the hash of keys but got %d", count, n)
+		}
+	}
+
+	// Orders and range filters should use the keys, but the main hash should
+	// still store the original values.
+	expectVersions(collection.NewQuery().Order("Version"), "1.2.3", "1.9.0", "1.9.10", "1.10.0", "2.0.0")
+	expectVersions(collection.NewQuery().Order("-Version").Filter("Version >", "1.9.0"), "2.0.0", "1.10.0", "1.9.10")
+	expectVersions(collection.NewQuery().Filter("Version =", "1.10.0"), "1.10.0")
+	if value, err := redis.String(conn.Do("HGET", collection.ModelKey(models[0].ModelId()), "Version")); err != nil {
+		t.Fatal(err)
+	} else if value != "1.10.0" {
+		t.Errorf("Expected the main hash to store the original value but got %s", value)
+	}
+	if values, err := collection.NewQuery().Distinct("Version"); err != nil {
+		t.Fatalf("Unexpected error in Distinct: %s", err.Error())
+	} else if !reflect.DeepEqual([]string{"1.10.0", "1.2.3", "1.9.0", "1.9.10", "2.0.0"}, values) {
+		t.Errorf("Expected Distinct to return the original values but got %v", values)
+	}
+	expectConsistent(len(models))
+
+	// Saving, conditional saves, swapping, and deleting should replace or
+	// remove the old keys.
+	models[1].Version = "3.0.0"
+	if err := collection.Save(models[1]); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	models[2].Version = "0.1.0"
+	if saved, err := collection.SaveIf(models[2], "Name", "=", "2.0.0"); err != nil {
+		t.Fatalf("Unexpected error in SaveIf: %s", err.Error())
+	} else if !saved {
+		t.Error("Expected SaveIf to save the model but it did not")
+	}
+	if err := collection.SwapIds(models[0].ModelId(), models[3].ModelId()); err != nil {
+		t.Fatalf("Unexpected error in SwapIds: %s", err.Error())
+	}
+	if _, err := collection.Delete(models[4].ModelId()); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	}
+	expectVersions(collection.NewQuery().Order("Version"), "0.1.0", "1.2.3", "1.10.0", "3.0.0")
+	expectVersions(collection.NewQuery().Filter("Version <", "1.10.0").Order("Version"), "0.1.0", "1.2.3")
+	expectConsistent(len(models) - 1)
+	swapped := &versionModel{}
+	if err := collection.NewQuery().Filter("Version =", "1.2.3").RunOne(swapped); err != nil {
+		t.Fatalf("Unexpected error in RunOne: %s", err.Error())
+	} else if swapped.ModelId() != models[0].ModelId() {
+		t.Errorf("Expected the swapped model to have id %s but got %s", models[0].ModelId(), swapped.ModelId())
+	}
+
+	// Rebuilding the index should produce the same keys.
+	if _, err := collection.ReindexField("Version"); err != nil {
+		t.Fatalf("Unexpected error in ReindexField: %s", err.Error())
+	}
+	expectVersions(collection.NewQuery().Order("-Version"), "3.0.0", "1.10.0", "1.2.3", "0.1.0")
+	expectConsistent(len(models) - 1)
+
+	// Key functions are only allowed for string indexes.
+	type otherVersionModel struct {
+		Version string `zoom:"index"`
+		Count   int    `zoom:"index"`
+		Name    string
+		RandomId
+	}
+	for _, options := range []CollectionOptions{
+		DefaultCollectionOptions.WithIndexKeyFunc("Missing", semverKey),
+		DefaultCollectionOptions.WithIndexKeyFunc("Count", semverKey),
+		DefaultCollectionOptions.WithIndexKeyFunc("Name", semverKey),
+		DefaultCollectionOptions.WithIndexKeyFunc("Version", nil),
+	} {
+		if _, err := testPool.NewCollectionWithOptions(&otherVersionModel{}, options); err == nil {
+			t.Errorf("Expected an error for IndexKeyFuncs %v but got none", options.IndexKeyFuncs)
+		}
+	}
+}
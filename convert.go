@@ -8,9 +8,13 @@
 package zoom
 
 import (
+	"encoding"
 	"fmt"
+	"math"
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -28,10 +32,17 @@ func scanModel(fieldNames []string, fieldValues []interface{}, mr *modelRef) err
 		return newModelNotFoundError(mr)
 	}
 	for i, reply := range fieldValues {
+		fieldName := fieldNames[i]
 		if reply == nil {
+			// A missing field means the value was nil when the model was saved.
+			// Set nilable fields back to nil and leave any others untouched.
+			if fieldName != "-" {
+				if _, found := ms.fieldsByName[fieldName]; found {
+					setNilIfNilable(mr.fieldValue(fieldName))
+				}
+			}
 			continue
 		}
-		fieldName := fieldNames[i]
 		replyBytes, err := redis.Bytes(reply, nil)
 		if err != nil {
 			return err
@@ -46,55 +57,73 @@ func scanModel(fieldNames []string, fieldValues []interface{}, mr *modelRef) err
 		if !found {
 			return fmt.Errorf("zoom: Error in scanModel: Could not find field %s in %T", fieldName, mr.model)
 		}
-		fieldVal := mr.fieldValue(fieldName)
-		switch fs.kind {
-		case primativeField:
-			if err := scanPrimativeVal(replyBytes, fieldVal); err != nil {
-				return err
-			}
-		case pointerField:
-			if err := scanPointerVal(replyBytes, fieldVal); err != nil {
-				return err
-			}
-		default:
-			if err := scanInconvertibleVal(mr.spec.fallback, replyBytes, fieldVal); err != nil {
+		if fs.gzip {
+			if replyBytes, err = gunzipValue(replyBytes); err != nil {
 				return err
 			}
 		}
+		if err := scanFieldVal(fs, mr.spec.fallback, replyBytes, mr.fieldValue(fieldName)); err != nil {
+			return fmt.Errorf("zoom: could not scan field %s of %s: %s", fs.name, ms.name, err.Error())
+		}
 	}
 	return nil
 }
 
+// scanFieldVal converts src, the value stored in the main hash for the field
+// identified by fs, into the type of the field and sets dest to the result.
+func scanFieldVal(fs *fieldSpec, fallback MarshalerUnmarshaler, src []byte, dest reflect.Value) error {
+	switch fs.kind {
+	case primativeField:
+		if fs.timeFormat != "" {
+			return scanTimeVal(fs.timeFormat, src, dest)
+		} else if fs.marshaler != noMarshaler {
+			return scanMarshalerVal(fs.marshaler, src, dest)
+		}
+		return scanPrimativeVal(src, dest)
+	case pointerField:
+		if fs.timeFormat != "" {
+			return scanTimePointerVal(fs.timeFormat, src, dest)
+		} else if fs.marshaler != noMarshaler {
+			return scanMarshalerPointerVal(fs.marshaler, src, dest)
+		}
+		return scanPointerVal(src, dest)
+	default:
+		return scanInconvertibleVal(fallback, src, dest)
+	}
+}
+
 // scanPrimativeVal converts a slice of bytes response from redis into the type of dest
-// and then sets dest to that value
+// and then sets dest to that value. Numbers are parsed with parseIntString,
+// parseUintString, and parseFloatString, which only accept the forms that Zoom
+// itself writes.
 func scanPrimativeVal(src []byte, dest reflect.Value) error {
 	if len(src) == 0 {
 		return nil // skip blanks
 	}
 	switch dest.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		srcInt, err := strconv.ParseInt(string(src), 10, 0)
+		srcInt, err := parseIntString(string(src), dest.Type().Bits())
 		if err != nil {
-			return fmt.Errorf("zoom: could not convert %s to int.", string(src))
+			return fmt.Errorf("could not convert %q to %s: %s", string(src), dest.Type().String(), err.Error())
 		}
 		dest.SetInt(srcInt)
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		srcUint, err := strconv.ParseUint(string(src), 10, 0)
+		srcUint, err := parseUintString(string(src), dest.Type().Bits())
 		if err != nil {
-			return fmt.Errorf("zoom: could not convert %s to uint.", string(src))
+			return fmt.Errorf("could not convert %q to %s: %s", string(src), dest.Type().String(), err.Error())
 		}
 		dest.SetUint(srcUint)
 
 	case reflect.Float32, reflect.Float64:
-		srcFloat, err := strconv.ParseFloat(string(src), 64)
+		srcFloat, err := parseFloatString(string(src), dest.Type().Bits())
 		if err != nil {
-			return fmt.Errorf("zoom: could not convert %s to float.", string(src))
+			return fmt.Errorf("could not convert %q to %s: %s", string(src), dest.Type().String(), err.Error())
 		}
 		dest.SetFloat(srcFloat)
 	case reflect.Bool:
 		srcBool, err := strconv.ParseBool(string(src))
 		if err != nil {
-			return fmt.Errorf("zoom: could not convert %s to bool.", string(src))
+			return fmt.Errorf("could not convert %q to %s", string(src), dest.Type().String())
 		}
 		dest.SetBool(srcBool)
 	case reflect.String:
@@ -103,27 +132,269 @@ func scanPrimativeVal(src []byte, dest reflect.Value) error {
 		// Slice or array of bytes
 		dest.SetBytes(src)
 	default:
-		return fmt.Errorf("zoom: don't know how to scan primative type: %T.\n", src)
+		return fmt.Errorf("don't know how to scan primative type: %s", dest.Type().String())
 	}
 	return nil
 }
 
+// parseIntString parses s, which should be a signed integer as written by Zoom
+// (i.e. by strconv.FormatInt), into an integer with the given bit size. Unlike
+// strconv.ParseInt, it only accepts an optional minus sign followed by decimal
+// digits, so a leading plus sign, whitespace, underscores, and scientific
+// notation all cause an error.
+func parseIntString(s string, bitSize int) (int64, error) {
+	if !isDecimalDigits(strings.TrimPrefix(s, "-")) {
+		return 0, fmt.Errorf("not a base 10 integer")
+	}
+	i, err := strconv.ParseInt(s, 10, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("out of range for a %d-bit integer", bitSize)
+	}
+	return i, nil
+}
+
+// parseUintString works like parseIntString for unsigned integers, so only
+// decimal digits are accepted.
+func parseUintString(s string, bitSize int) (uint64, error) {
+	if !isDecimalDigits(s) {
+		return 0, fmt.Errorf("not a base 10 unsigned integer")
+	}
+	u, err := strconv.ParseUint(s, 10, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("out of range for a %d-bit unsigned integer", bitSize)
+	}
+	return u, nil
+}
+
+// parseFloatString parses s, which should be a float as written by Zoom (i.e.
+// by strconv.FormatFloat with the 'g' format), into a float with the given bit
+// size. It accepts an optional minus sign, decimal digits with an optional
+// fraction and exponent (e.g. "1.5e+21"), and the special values "+Inf",
+// "-Inf", and "NaN". Unlike strconv.ParseFloat, it rejects whitespace,
+// underscores, hexadecimal floats, and other spellings of infinity.
+func parseFloatString(s string, bitSize int) (float64, error) {
+	if s != "+Inf" && s != "-Inf" && s != "NaN" && !isDecimalFloat(strings.TrimPrefix(s, "-")) {
+		return 0, fmt.Errorf("not a base 10 float")
+	}
+	f, err := strconv.ParseFloat(s, bitSize)
+	if err != nil {
+		return 0, fmt.Errorf("out of range for a %d-bit float", bitSize)
+	}
+	return f, nil
+}
+
+// isDecimalDigits returns true iff s is not empty and consists only of the
+// ASCII digits 0-9.
+func isDecimalDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// isDecimalFloat returns true iff s consists of decimal digits with an
+// optional fraction (e.g. "1.5") and an optional exponent (e.g. "e+21" or
+// "E-7") whose sign is optional.
+func isDecimalFloat(s string) bool {
+	if exp := strings.IndexAny(s, "eE"); exp != -1 {
+		exponent := s[exp+1:]
+		if len(exponent) > 0 && (exponent[0] == '+' || exponent[0] == '-') {
+			exponent = exponent[1:]
+		}
+		if !isDecimalDigits(exponent) {
+			return false
+		}
+		s = s[:exp]
+	}
+	if dot := strings.IndexByte(s, '.'); dot != -1 {
+		if !isDecimalDigits(s[dot+1:]) {
+			return false
+		}
+		s = s[:dot]
+	}
+	return isDecimalDigits(s)
+}
+
 // scanPointerVal works like scanVal but expects dest to be a pointer to some primative
 // type
 func scanPointerVal(src []byte, dest reflect.Value) error {
-	// Skip empty or nil fields
+	// Older versions of Zoom stored nil values as "NULL"
 	if string(src) == "NULL" {
+		setNilIfNilable(dest)
 		return nil
 	}
 	dest.Set(reflect.New(dest.Type().Elem()))
 	return scanPrimativeVal(src, dest.Elem())
 }
 
+// scanMarshalerVal decodes src into dest using the marshaler identified by
+// kind. dest must be addressable.
+func scanMarshalerVal(kind marshalerKind, src []byte, dest reflect.Value) error {
+	switch kind {
+	case binaryMarshaler:
+		return dest.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(src)
+	case textMarshaler:
+		return dest.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(src)
+	}
+	return fmt.Errorf("zoom: don't know how to unmarshal type: %s", dest.Type().String())
+}
+
+// scanMarshalerPointerVal works like scanMarshalerVal but expects dest to be a
+// pointer to some type which implements a marshaler.
+func scanMarshalerPointerVal(kind marshalerKind, src []byte, dest reflect.Value) error {
+	// Older versions of Zoom stored nil values as "NULL"
+	if string(src) == "NULL" {
+		setNilIfNilable(dest)
+		return nil
+	}
+	dest.Set(reflect.New(dest.Type().Elem()))
+	return scanMarshalerVal(kind, src, dest.Elem())
+}
+
+// rfc3339Layout is the layout used to store times with TimeFormatRFC3339. It is
+// a valid RFC 3339 timestamp, but unlike time.RFC3339Nano it always includes
+// all nine digits of the fractional seconds. Since times are also converted to
+// UTC before they are formatted, the lexicographical order of the formatted
+// strings is the same as the chronological order of the times.
+const rfc3339Layout = "2006-01-02T15:04:05.000000000Z07:00"
+
+var (
+	// minUnixNanoTime and maxUnixNanoTime are the earliest and latest times
+	// which can be represented in nanoseconds by an int64.
+	minUnixNanoTime = time.Unix(0, math.MinInt64)
+	maxUnixNanoTime = time.Unix(0, math.MaxInt64)
+)
+
+// formatTime formats t according to TimeFormatRFC3339.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(rfc3339Layout)
+}
+
+// unixMilli returns t as the number of milliseconds since the unix epoch.
+func unixMilli(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+}
+
+// encodeTime returns the value that represents t in the main hash according
+// to format. With TimeFormatUnixNano, the zero time is stored as an empty
+// string since it cannot be represented in nanoseconds by an int64. encodeTime
+// returns an error if t cannot be represented with the given format.
+func encodeTime(format string, t time.Time) (interface{}, error) {
+	switch format {
+	case TimeFormatUnixNano:
+		if t.IsZero() {
+			return "", nil
+		}
+		if t.Before(minUnixNanoTime) || t.After(maxUnixNanoTime) {
+			return nil, fmt.Errorf("zoom: cannot store time %s with TimeFormatUnixNano. Only times between the years 1678 and 2262 are supported.", t)
+		}
+		return t.UnixNano(), nil
+	case TimeFormatUnixMilli:
+		return unixMilli(t), nil
+	case TimeFormatRFC3339:
+		return formatTime(t), nil
+	}
+	return nil, fmt.Errorf("zoom: unknown time format: %q", format)
+}
+
+// timeScore returns the score which represents t in a numeric index according
+// to format. With TimeFormatUnixNano, times which cannot be represented in
+// nanoseconds by an int64 (including the zero time) are given a score of
+// negative or positive infinity.
+func timeScore(format string, t time.Time) float64 {
+	switch format {
+	case TimeFormatUnixNano:
+		if t.IsZero() || t.Before(minUnixNanoTime) {
+			return math.Inf(-1)
+		} else if t.After(maxUnixNanoTime) {
+			return math.Inf(1)
+		}
+		return float64(t.UnixNano())
+	case TimeFormatUnixMilli:
+		return float64(unixMilli(t))
+	}
+	msg := fmt.Sprintf("zoom: attempt to call timeScore with non-numeric time format %q", format)
+	panic(msg)
+}
+
+// scanTimeVal decodes src, which should be a time stored according to format,
+// and sets dest to the resulting time (in UTC). An empty src is decoded as the
+// zero time.
+func scanTimeVal(format string, src []byte, dest reflect.Value) error {
+	if len(src) == 0 {
+		dest.Set(reflect.ValueOf(time.Time{}))
+		return nil
+	}
+	var t time.Time
+	switch format {
+	case TimeFormatUnixNano, TimeFormatUnixMilli:
+		srcInt, err := parseIntString(string(src), 64)
+		if err != nil {
+			return fmt.Errorf("could not convert %q to time.Time: %s", string(src), err.Error())
+		}
+		if format == TimeFormatUnixNano {
+			t = time.Unix(0, srcInt)
+		} else {
+			t = time.Unix(srcInt/1000, (srcInt%1000)*int64(time.Millisecond))
+		}
+	case TimeFormatRFC3339:
+		var err error
+		t, err = time.Parse(time.RFC3339Nano, string(src))
+		if err != nil {
+			return fmt.Errorf("could not convert %q to time.Time: %s", string(src), err.Error())
+		}
+	default:
+		return fmt.Errorf("unknown time format: %q", format)
+	}
+	dest.Set(reflect.ValueOf(t.UTC()))
+	return nil
+}
+
+// scanTimePointerVal works like scanTimeVal but expects dest to be a pointer to
+// a time.Time.
+func scanTimePointerVal(format string, src []byte, dest reflect.Value) error {
+	// Older versions of Zoom stored nil values as "NULL"
+	if string(src) == "NULL" {
+		setNilIfNilable(dest)
+		return nil
+	}
+	dest.Set(reflect.New(dest.Type().Elem()))
+	return scanTimeVal(format, src, dest.Elem())
+}
+
+// marshalVal encodes val using the marshaler identified by kind. If val is not
+// addressable, a copy is made so that marshalers with pointer receivers can
+// still be used.
+func marshalVal(kind marshalerKind, val reflect.Value) ([]byte, error) {
+	if !val.CanAddr() {
+		valCopy := reflect.New(val.Type()).Elem()
+		valCopy.Set(val)
+		val = valCopy
+	}
+	switch kind {
+	case binaryMarshaler:
+		return val.Addr().Interface().(encoding.BinaryMarshaler).MarshalBinary()
+	case textMarshaler:
+		return val.Addr().Interface().(encoding.TextMarshaler).MarshalText()
+	}
+	return nil, fmt.Errorf("zoom: don't know how to marshal type: %s", val.Type().String())
+}
+
 // scanIncovertibleVal unmarshals src into dest using the given
 // MarshalerUnmarshaler
 func scanInconvertibleVal(marshalerUnmarshaler MarshalerUnmarshaler, src []byte, dest reflect.Value) error {
-	// Skip empty or nil fields
-	if len(src) == 0 || string(src) == "NULL" {
+	// Skip empty fields
+	if len(src) == 0 {
+		return nil
+	}
+	// Older versions of Zoom stored nil values as "NULL"
+	if string(src) == "NULL" {
+		setNilIfNilable(dest)
 		return nil
 	}
 	// TODO: account for json, msgpack or other custom fallbacks
@@ -132,3 +403,12 @@ func scanInconvertibleVal(marshalerUnmarshaler MarshalerUnmarshaler, src []byte,
 	}
 	return nil
 }
+
+// setNilIfNilable sets dest to nil if it is a nilable kind (i.e. a pointer,
+// slice, map, or interface). Otherwise it does nothing.
+func setNilIfNilable(dest reflect.Value) {
+	switch dest.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		dest.Set(reflect.Zero(dest.Type()))
+	}
+}
@@ -8,9 +8,15 @@
 package zoom
 
 import (
+	"fmt"
+	"math"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/garyburd/redigo/redis"
 )
 
 func TestConvertPrimatives(t *testing.T) {
@@ -103,6 +109,174 @@ func TestJSONFallback(t *testing.T) {
 	testConvertType(t, jsonModels, model)
 }
 
+// binaryEnum is a custom int-based type which implements
+// encoding.BinaryMarshaler and encoding.BinaryUnmarshaler. It also implements
+// fmt.Stringer, which should not affect how it is stored or indexed.
+type binaryEnum int
+
+const (
+	binaryEnumZero binaryEnum = iota
+	binaryEnumOne
+	binaryEnumTwo
+)
+
+func (e binaryEnum) String() string {
+	return [...]string{"zero", "one", "two"}[e]
+}
+
+func (e binaryEnum) MarshalBinary() ([]byte, error) {
+	return []byte("binary:" + strconv.Itoa(int(e))), nil
+}
+
+func (e *binaryEnum) UnmarshalBinary(data []byte) error {
+	i, err := strconv.Atoi(strings.TrimPrefix(string(data), "binary:"))
+	if err != nil {
+		return err
+	}
+	*e = binaryEnum(i)
+	return nil
+}
+
+// textEnum is a custom string-based type which implements
+// encoding.TextMarshaler and encoding.TextUnmarshaler.
+type textEnum string
+
+const (
+	textEnumRed   textEnum = "r"
+	textEnumGreen textEnum = "g"
+)
+
+func (e textEnum) MarshalText() ([]byte, error) {
+	switch e {
+	case "":
+		return []byte("none"), nil
+	case textEnumRed:
+		return []byte("red"), nil
+	case textEnumGreen:
+		return []byte("green"), nil
+	}
+	return nil, fmt.Errorf("invalid textEnum: %s", string(e))
+}
+
+func (e *textEnum) UnmarshalText(data []byte) error {
+	switch string(data) {
+	case "none":
+		*e = ""
+	case "red":
+		*e = textEnumRed
+	case "green":
+		*e = textEnumGreen
+	default:
+		return fmt.Errorf("invalid textEnum: %s", string(data))
+	}
+	return nil
+}
+
+func TestMarshalerFields(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type marshalerModel struct {
+		Binary        binaryEnum
+		Text          textEnum
+		BinaryPointer *binaryEnum
+		TextPointer   *textEnum
+		RandomId
+	}
+	marshalerModels, err := testPool.NewCollection(&marshalerModel{})
+	if err != nil {
+		t.Fatalf("Unexpected error in testPool.NewCollection: %s", err.Error())
+	}
+	binary := binaryEnumTwo
+	text := textEnumGreen
+	model := &marshalerModel{
+		Binary:        binaryEnumOne,
+		Text:          textEnumRed,
+		BinaryPointer: &binary,
+		TextPointer:   &text,
+	}
+	testConvertType(t, marshalerModels, model)
+
+	// Make sure the values were encoded with the marshalers.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	expected := map[string]string{
+		"Binary":        "binary:1",
+		"Text":          "red",
+		"BinaryPointer": "binary:2",
+		"TextPointer":   "green",
+	}
+	for fieldName, expectedValue := range expected {
+		got, err := redis.String(conn.Do("HGET", marshalerModels.ModelKey(model.ModelId()), fieldName))
+		if err != nil {
+			t.Fatalf("Unexpected error in HGET: %s", err.Error())
+		}
+		if got != expectedValue {
+			t.Errorf("Field %s was not encoded correctly. Expected %s but got %s", fieldName, expectedValue, got)
+		}
+	}
+}
+
+func TestIndexedMarshalerFields(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type indexedMarshalerModel struct {
+		Binary binaryEnum `zoom:"index"`
+		Text   textEnum   `zoom:"index"`
+		RandomId
+	}
+	options := DefaultCollectionOptions.WithIndex(true)
+	indexedMarshalerModels, err := testPool.NewCollectionWithOptions(&indexedMarshalerModel{}, options)
+	if err != nil {
+		t.Fatalf("Unexpected error in testPool.NewCollection: %s", err.Error())
+	}
+	models := []*indexedMarshalerModel{
+		{Binary: binaryEnumZero, Text: textEnumRed},
+		{Binary: binaryEnumOne, Text: textEnumGreen},
+		{Binary: binaryEnumTwo, Text: textEnumRed},
+	}
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedMarshalerModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error saving models: %s", err.Error())
+	}
+
+	// Filter by the numeric index on Binary.
+	gotIds, err := indexedMarshalerModels.NewQuery().Filter("Binary >=", binaryEnumOne).Ids()
+	if err != nil {
+		t.Fatalf("Unexpected error in Query.Ids: %s", err.Error())
+	}
+	if equal, msg := compareAsStringSet(modelIds(Models(models[1:])), gotIds); !equal {
+		t.Errorf("Filter on Binary returned the wrong ids: %s", msg)
+	}
+
+	// Filter by the string index on Text.
+	gotIds, err = indexedMarshalerModels.NewQuery().Filter("Text =", textEnumRed).Ids()
+	if err != nil {
+		t.Fatalf("Unexpected error in Query.Ids: %s", err.Error())
+	}
+	expectedIds := []string{models[0].ModelId(), models[2].ModelId()}
+	if equal, msg := compareAsStringSet(expectedIds, gotIds); !equal {
+		t.Errorf("Filter on Text returned the wrong ids: %s", msg)
+	}
+
+	// Update one of the models and make sure the old string index was removed.
+	models[0].Text = textEnumGreen
+	if err := indexedMarshalerModels.Save(models[0]); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	gotIds, err = indexedMarshalerModels.NewQuery().Filter("Text =", textEnumRed).Ids()
+	if err != nil {
+		t.Fatalf("Unexpected error in Query.Ids: %s", err.Error())
+	}
+	if equal, msg := compareAsStringSet([]string{models[2].ModelId()}, gotIds); !equal {
+		t.Errorf("Filter on Text returned the wrong ids after update: %s", msg)
+	}
+}
+
 type Embeddable struct {
 	Int    int
 	String string
@@ -190,3 +364,302 @@ func testConvertType(t *testing.T, collection *Collection, model Model) {
 		t.Errorf("Model of type %T was not saved/retrieved correctly.\nExpected: %+v\nGot:      %+v", emptyModel, emptyModel, emptyModelCopy)
 	}
 }
+
+func TestNilPointerFields(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type nilableModel struct {
+		Name    string
+		String  *string
+		Int     *int
+		Bool    *bool
+		Time    *time.Time
+		Strings []string
+		RandomId
+	}
+	nilableModels, err := testPool.NewCollection(&nilableModel{})
+	if err != nil {
+		t.Fatalf("Unexpected error in testPool.NewCollection: %s", err.Error())
+	}
+	conn := testPool.NewConn()
+	defer conn.Close()
+	nilFields := []string{"String", "Int", "Bool", "Time", "Strings"}
+
+	// Nil fields should not be stored in the hash and should be set back to nil
+	// when the model is found, even if the destination has non-nil values.
+	model := &nilableModel{Name: "nil"}
+	testConvertType(t, nilableModels, model)
+	for _, fieldName := range nilFields {
+		if exists, err := redis.Bool(conn.Do("HEXISTS", nilableModels.ModelKey(model.ModelId()), fieldName)); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected nil field %s to not be stored in the hash", fieldName)
+		}
+	}
+	str, i, b, now := "foo", 42, true, time.Now().UTC()
+	got := &nilableModel{String: &str, Int: &i, Bool: &b, Time: &now, Strings: []string{"foo"}}
+	if err := nilableModels.Find(model.ModelId(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if !reflect.DeepEqual(model, got) {
+		t.Errorf("Expected nil fields to be nil after Find.\nExpected: %+v\nGot:      %+v", model, got)
+	}
+
+	// Pointers to zero values should be distinct from nil pointers
+	emptyStr, zeroInt, falseBool, zeroTime := "", 0, false, time.Time{}
+	zeroModel := &nilableModel{
+		Name:   "zero",
+		String: &emptyStr,
+		Int:    &zeroInt,
+		Bool:   &falseBool,
+		Time:   &zeroTime,
+	}
+	testConvertType(t, nilableModels, zeroModel)
+
+	// Setting a field to nil should remove it from the hash
+	zeroModel.String = nil
+	zeroModel.Int = nil
+	if err := nilableModels.Save(zeroModel); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	for _, fieldName := range []string{"String", "Int"} {
+		if exists, err := redis.Bool(conn.Do("HEXISTS", nilableModels.ModelKey(zeroModel.ModelId()), fieldName)); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected field %s to be removed from the hash after it was set to nil", fieldName)
+		}
+	}
+	gotZero := &nilableModel{}
+	if err := nilableModels.Find(zeroModel.ModelId(), gotZero); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if !reflect.DeepEqual(zeroModel, gotZero) {
+		t.Errorf("Model was not saved/retrieved correctly.\nExpected: %+v\nGot:      %+v", zeroModel, gotZero)
+	}
+}
+
+func TestTimeFormats(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type timeModel struct {
+		Time    time.Time `zoom:"index"`
+		TimePtr *time.Time
+		RandomId
+	}
+	base := time.Date(2016, time.March, 4, 5, 6, 7, 891000000, time.FixedZone("EST", -5*60*60))
+	testCases := []struct {
+		format   string
+		expected string
+	}{
+		{
+			format:   TimeFormatUnixNano,
+			expected: strconv.FormatInt(base.UnixNano(), 10),
+		},
+		{
+			format:   TimeFormatUnixMilli,
+			expected: strconv.FormatInt(base.UnixNano()/int64(time.Millisecond), 10),
+		},
+		{
+			format:   TimeFormatRFC3339,
+			expected: "2016-03-04T10:06:07.891000000Z",
+		},
+	}
+	for _, tc := range testCases {
+		// Use a separate pool for each format so the type can be registered
+		// more than once.
+		pool := NewPoolWithOptions(testPool.options)
+		options := DefaultCollectionOptions.WithIndex(true).WithTimeFormat(tc.format).WithName("timeModel" + tc.format)
+		timeModels, err := pool.NewCollectionWithOptions(&timeModel{}, options)
+		if err != nil {
+			t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+		}
+
+		// Times should be stored in the given format and scanned back in UTC.
+		model := &timeModel{Time: base, TimePtr: &base}
+		if err := timeModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		conn := pool.NewConn()
+		got, err := redis.String(conn.Do("HGET", timeModels.ModelKey(model.ModelId()), "Time"))
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.expected {
+			t.Errorf("Time was stored incorrectly with format %s. Expected %q but got %q", tc.format, tc.expected, got)
+		}
+		modelCopy := &timeModel{}
+		if err := timeModels.Find(model.ModelId(), modelCopy); err != nil {
+			t.Fatalf("Unexpected error in Find: %s", err.Error())
+		}
+		if !modelCopy.Time.Equal(base) || modelCopy.Time.Location() != time.UTC {
+			t.Errorf("Time was not scanned correctly with format %s. Expected %s in UTC but got %s", tc.format, base, modelCopy.Time)
+		}
+		if modelCopy.TimePtr == nil || !modelCopy.TimePtr.Equal(base) {
+			t.Errorf("TimePtr was not scanned correctly with format %s. Expected %s but got %v", tc.format, base, modelCopy.TimePtr)
+		}
+
+		// Zero times should survive a round trip.
+		zeroModel := &timeModel{}
+		testConvertType(t, timeModels, zeroModel)
+
+		// Indexed times should be usable in filters and orders.
+		later := &timeModel{Time: base.Add(time.Hour)}
+		if err := timeModels.Save(later); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		ids, err := timeModels.NewQuery().Filter("Time >", base).Ids()
+		if err != nil {
+			t.Fatalf("Unexpected error in Query.Ids: %s", err.Error())
+		}
+		if !reflect.DeepEqual(ids, []string{later.ModelId()}) {
+			t.Errorf("Filter was incorrect with format %s. Expected %v but got %v", tc.format, []string{later.ModelId()}, ids)
+		}
+		ids, err = timeModels.NewQuery().Filter("Time >=", base).Order("-Time").Ids()
+		if err != nil {
+			t.Fatalf("Unexpected error in Query.Ids: %s", err.Error())
+		}
+		expectedIds := []string{later.ModelId(), model.ModelId()}
+		if !reflect.DeepEqual(ids, expectedIds) {
+			t.Errorf("Order was incorrect with format %s. Expected %v but got %v", tc.format, expectedIds, ids)
+		}
+		pool.Close()
+	}
+
+	// An unknown format should cause an error.
+	pool := NewPoolWithOptions(testPool.options)
+	defer pool.Close()
+	if _, err := pool.NewCollectionWithOptions(&timeModel{}, DefaultCollectionOptions.WithTimeFormat("unix")); err == nil {
+		t.Error("Expected an error for an unknown time format but got none")
+	}
+}
+
+func TestNilPointerIndexes(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := createIndexedPointersModel()
+	if err := indexedPointersModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	// Setting indexed fields to nil should remove them from the index
+	model.Int = nil
+	model.Bool = nil
+	model.String = nil
+	if err := indexedPointersModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	conn := testPool.NewConn()
+	defer conn.Close()
+	for _, fieldName := range []string{"Int", "Bool", "String"} {
+		indexKey, err := indexedPointersModels.FieldIndexKey(fieldName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count, err := redis.Int(conn.Do("ZCARD", indexKey)); err != nil {
+			t.Fatal(err)
+		} else if count != 0 {
+			t.Errorf("Expected index for %s to be empty after setting it to nil but got %d members", fieldName, count)
+		}
+	}
+}
+
+func TestScanNumericStrings(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type numericModel struct {
+		Int8    int8
+		Int64   int64
+		Uint64  uint64
+		Float32 float32
+		Float64 float64
+		Ptr     *float64
+		RandomId
+	}
+	numericModels, err := testPool.NewCollection(&numericModel{})
+	if err != nil {
+		t.Fatalf("Unexpected error in testPool.NewCollection: %s", err.Error())
+	}
+
+	// Edge values should survive a round trip, including the ones which Zoom
+	// writes in scientific notation.
+	inf := math.Inf(1)
+	for _, model := range []*numericModel{
+		{Int8: math.MinInt8, Int64: math.MinInt64, Uint64: math.MaxUint64, Float32: math.MaxFloat32, Float64: math.SmallestNonzeroFloat64, Ptr: &inf},
+		{Int8: math.MaxInt8, Int64: math.MaxInt64, Float32: 1e-7, Float64: -1.5e21},
+	} {
+		testConvertType(t, numericModels, model)
+	}
+
+	testCases := []struct {
+		src   string
+		dest  interface{}
+		valid bool
+	}{
+		{src: "-0", dest: int64(0), valid: true},
+		{src: "127", dest: int8(0), valid: true},
+		{src: "128", dest: int8(0)},
+		{src: "+1", dest: int64(0)},
+		{src: "1e3", dest: int64(0)},
+		{src: "1.0", dest: int64(0)},
+		{src: " 1", dest: int64(0)},
+		{src: "1 ", dest: int64(0)},
+		{src: "1_000", dest: int64(0)},
+		{src: "0x10", dest: int64(0)},
+		{src: "-", dest: int64(0)},
+		{src: "18446744073709551615", dest: uint64(0), valid: true},
+		{src: "-1", dest: uint64(0)},
+		{src: "+1", dest: uint64(0)},
+		{src: "1.5", dest: float64(0), valid: true},
+		{src: "-2", dest: float64(0), valid: true},
+		{src: "1e+21", dest: float64(0), valid: true},
+		{src: "1e-07", dest: float32(0), valid: true},
+		{src: "1E5", dest: float64(0), valid: true},
+		{src: "+Inf", dest: float64(0), valid: true},
+		{src: "-Inf", dest: float64(0), valid: true},
+		{src: "NaN", dest: float64(0), valid: true},
+		{src: "1e39", dest: float32(0)},
+		{src: "1e", dest: float64(0)},
+		{src: "1.", dest: float64(0)},
+		{src: ".5", dest: float64(0)},
+		{src: "+1.5", dest: float64(0)},
+		{src: "1.5 ", dest: float64(0)},
+		{src: "0x1p-2", dest: float64(0)},
+		{src: "1_0.5", dest: float64(0)},
+		{src: "inf", dest: float64(0)},
+		{src: "Infinity", dest: float64(0)},
+	}
+	for _, tc := range testCases {
+		dest := reflect.New(reflect.TypeOf(tc.dest)).Elem()
+		err := scanPrimativeVal([]byte(tc.src), dest)
+		if tc.valid && err != nil {
+			t.Errorf("Unexpected error scanning %q into %T: %s", tc.src, tc.dest, err.Error())
+		} else if !tc.valid && err == nil {
+			t.Errorf("Expected an error scanning %q into %T but got %v", tc.src, tc.dest, dest.Interface())
+		}
+	}
+
+	// The error for a value which was not written by Zoom should name the
+	// field and include the raw value.
+	model := &numericModel{}
+	if err := numericModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	conn := testPool.NewConn()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", numericModels.ModelKey(model.ModelId()), "Int64", "1e3"); err != nil {
+		t.Fatal(err)
+	}
+	err = numericModels.Find(model.ModelId(), &numericModel{})
+	if err == nil {
+		t.Fatal("Expected an error for an integer in scientific notation but got none")
+	}
+	for _, expected := range []string{"Int64", `"1e3"`} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected the error to contain %s but got: %s", expected, err.Error())
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File copy.go contains code for copying all the models in a collection to a
+// new collection name.
+
+package zoom
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// CopyTo copies every model in the collection, along with the set of all ids
+// and every field index, to the keys for a collection with the given name. It
+// is intended for things like blue-green migrations, where you want to keep a
+// snapshot of a collection before changing it. The copy is made by a single
+// Lua script with the COPY command, so it is a consistent point-in-time
+// snapshot: other clients never see a partial copy, and changes made to the
+// collection afterwards are not reflected in the copy. Since the script copies
+// every key for the collection, it is O(N) and can block Redis for a while on
+// large collections. To read the copy, create a collection with the new name
+// (see CollectionOptions.Name) for a type with the same fields. Since a type
+// can only be registered once per pool, that is either a different type or the
+// same type in a different pool. The change log and any cached counts or query
+// results are not copied. CopyTo returns an error, and copies nothing, if the
+// new name is invalid (e.g. if it contains a colon) or if the collection with
+// the new name already has any models or indexes. It only works for indexed
+// collections and requires Redis version 6.2 or higher.
+func (c *Collection) CopyTo(newName string) error {
+	t := c.pool.NewTransaction()
+	t.CopyTo(c, newName, nil)
+	return t.Exec()
+}
+
+// CopyTo copies every model in the collection to the keys for a collection
+// with the given name in an existing transaction. When the transaction is
+// executed, count will be set to the number of models which were copied. You
+// may pass in nil for count if you do not care about the number of models. See
+// Collection.CopyTo for more information. Any errors encountered will be added
+// to the transaction and returned as an error when the transaction is executed.
+func (t *Transaction) CopyTo(c *Collection, newName string, count *int) {
+	if c == nil {
+		t.setError(newNilCollectionError("CopyTo"))
+		return
+	}
+	if !c.index {
+		t.setError(newUnindexedCollectionError("CopyTo"))
+		return
+	}
+	if newName == "" || strings.Contains(newName, ":") {
+		t.setError(fmt.Errorf("zoom: Error in CopyTo or Transaction.CopyTo: invalid collection name %q", newName))
+		return
+	}
+	if newName == c.Name() {
+		t.setError(fmt.Errorf("zoom: Error in CopyTo or Transaction.CopyTo: invalid name %q for the copy of collection %s", newName, c.Name()))
+		return
+	}
+	// Collect the suffixes for the keys which belong to the collection as a
+	// whole, i.e. the set of all ids, the field indexes (along with the hash of
+	// keys for string indexes with a custom key function), and the
+	// HyperLogLogs for distinct counts.
+	suffixes := []string{"all"}
+	enumSuffixes := []string{}
+	for _, fs := range c.spec.fields {
+		if fs.indexKind != noIndex {
+			suffixes = append(suffixes, fs.redisName)
+		}
+		if fs.indexKeyFunc != nil {
+			suffixes = append(suffixes, fs.redisName+":keys")
+		}
+		if fs.indexKind == enumIndex {
+			enumSuffixes = append(enumSuffixes, fs.redisName)
+		}
+		if fs.hll {
+			suffixes = append(suffixes, fs.redisName+":hll")
+		}
+	}
+	listNames := []string{}
+	for _, fs := range c.spec.lists {
+		listNames = append(listNames, fs.redisName)
+	}
+	args := redis.Args{c.Name(), newName, collectionNamesKey, len(suffixes)}.AddFlat(suffixes)
+	args = args.Add(len(enumSuffixes)).AddFlat(enumSuffixes).AddFlat(listNames)
+	t.Script(copyCollectionScript, args, func(reply interface{}) error {
+		copied, err := redis.Int(reply, nil)
+		if err != nil {
+			return err
+		}
+		if copied < 0 {
+			return fmt.Errorf("zoom: Error in CopyTo or Transaction.CopyTo: collection %s already has data", newName)
+		}
+		if count != nil {
+			(*count) = copied
+		}
+		return nil
+	})
+}
@@ -0,0 +1,146 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File copy_test.go tests the code for copying a collection (copy.go).
+
+package zoom
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestCopyTo(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const copyName = "indexedTestModelCopy"
+	if err := indexedTestModels.CopyTo(copyName); err != nil {
+		t.Fatalf("Unexpected error in CopyTo: %s", err.Error())
+	}
+
+	// The type is already registered for testPool, so use another pool to read
+	// the copy.
+	copyPool := NewPoolWithOptions(testPool.options)
+	defer copyPool.Close()
+	copies, err := copyPool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithIndex(true).WithName(copyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []*indexedTestModel{}
+	if err := copies.FindAll(&got); err != nil {
+		t.Fatalf("Unexpected error in FindAll: %s", err.Error())
+	}
+	if err := expectModelsToBeEqual(models, got, false); err != nil {
+		t.Error(err)
+	}
+	for _, model := range models {
+		for _, fieldName := range []string{"Int", "String", "Bool"} {
+			expectIndexExists(t, copies, model, fieldName)
+		}
+	}
+	q := copies.NewQuery().Filter("Int >", models[0].Int).Order("String")
+	if err := q.Run(&got); err != nil {
+		t.Fatalf("Unexpected error in Query.Run: %s", err.Error())
+	}
+	if err := expectModelsToBeEqual(expectedResultsForQuery(q.query, models), got, true); err != nil {
+		t.Error(err)
+	}
+	if names, err := testPool.CollectionNames(); err != nil {
+		t.Fatalf("Unexpected error in CollectionNames: %s", err.Error())
+	} else if !stringSliceContains(names, copyName) {
+		t.Errorf("Expected CollectionNames to contain %s but got %v", copyName, names)
+	}
+
+	// The copy is a snapshot, so changes to the original are not reflected.
+	if _, err := indexedTestModels.Delete(models[0].ModelId()); err != nil {
+		t.Fatal(err)
+	}
+	expectModelsExist(t, copies, Models(models[:1]))
+
+	// Copying to a collection which already has data is an error and should
+	// not change anything.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	before, err := redis.Int(conn.Do("DBSIZE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := indexedTestModels.CopyTo(copyName); err == nil {
+		t.Error("Expected an error for a destination with data but got none")
+	}
+	if after, err := redis.Int(conn.Do("DBSIZE")); err != nil {
+		t.Fatal(err)
+	} else if after != before {
+		t.Errorf("Expected a failed CopyTo not to change the database but the number of keys went from %d to %d", before, after)
+	}
+	if err := indexedTestModels.CopyTo(indexedTestModels.Name()); err == nil {
+		t.Error("Expected an error for copying a collection to itself but got none")
+	}
+	for _, name := range []string{"", "invalid:name"} {
+		if err := indexedTestModels.CopyTo(name); err == nil {
+			t.Errorf("Expected an error for copying a collection to %q but got none", name)
+		}
+	}
+}
+
+func TestCopyToWithIndexKeyFunc(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type copyVersionModel struct {
+		Version string `zoom:"index"`
+		RandomId
+	}
+	options := DefaultCollectionOptions.WithIndex(true).WithIndexKeyFunc("Version", strings.ToLower)
+	collection, err := testPool.NewCollectionWithOptions(&copyVersionModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := &copyVersionModel{Version: "V1"}
+	if err := collection.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	const copyName = "copyVersionModelCopy"
+	if err := collection.CopyTo(copyName); err != nil {
+		t.Fatalf("Unexpected error in CopyTo: %s", err.Error())
+	}
+	copyPool := NewPoolWithOptions(testPool.options)
+	defer copyPool.Close()
+	copies, err := copyPool.NewCollectionWithOptions(&copyVersionModel{}, options.WithName(copyName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The copy needs the hash of keys for the index, or else updating a model
+	// in the copy leaves the old key behind in the index.
+	model.Version = "V2"
+	if err := copies.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	for version, expected := range map[string]int{"V1": 0, "V2": 1} {
+		if count, err := copies.NewQuery().Filter("Version =", version).Count(); err != nil {
+			t.Fatalf("Unexpected error in Query.Count: %s", err.Error())
+		} else if count != expected {
+			t.Errorf("Expected %d models with Version %s in the copy but got %d", expected, version, count)
+		}
+	}
+	conn := testPool.NewConn()
+	defer conn.Close()
+	indexKey, err := copies.FieldIndexKey("Version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := redis.Int(conn.Do("ZCARD", indexKey)); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Errorf("Expected 1 member in the index for the copy but got %d", n)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File distinct.go contains code related to approximate distinct counts,
+// which are backed by a HyperLogLog for each field with the `zoom:"hll"`
+// struct tag.
+
+package zoom
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// saveDistinctValues adds commands to the transaction for adding the values of
+// the given fields to the HyperLogLog for each field, if the field has the
+// `zoom:"hll"` struct tag. Nil values are not added.
+func (t *Transaction) saveDistinctValues(mr *modelRef, fieldNames []string) {
+	for _, fs := range mr.spec.fields {
+		if !fs.hll || !stringSliceContains(fieldNames, fs.name) {
+			continue
+		}
+		// Use the same encoding as the main hash so that equal values are
+		// always counted as the same element.
+		hashArgs, err := mr.mainHashArgsForFields([]string{fs.name})
+		if err != nil {
+			t.setError(err)
+			return
+		}
+		if len(hashArgs) != 3 {
+			// The value is nil.
+			continue
+		}
+		t.Command("PFADD", redis.Args{mr.spec.distinctKey(fs), hashArgs[2]}, nil)
+	}
+}
+
+// ApproxDistinct returns the approximate number of distinct values that have
+// been saved for the given field. fieldName should be the name of a field with
+// the `zoom:"hll"` struct tag. Every time a model is saved, the value of each
+// such field is added to a HyperLogLog in Redis, and ApproxDistinct returns its
+// cardinality as reported by PFCOUNT. HyperLogLogs use a small, fixed amount of
+// memory (at most 12KB per field) no matter how many distinct values there are,
+// which makes them much cheaper than an index for high-cardinality fields.
+// The trade-off is that the count is an estimate with a standard error of
+// 0.81%. In addition, values cannot be removed from a HyperLogLog, so the
+// count includes every value that has ever been saved, even if the models with
+// that value were later deleted or changed. Only DeleteAll and Truncate reset
+// the count. ApproxDistinct returns an error if the field does not exist or does
+// not have the `zoom:"hll"` struct tag.
+func (c *Collection) ApproxDistinct(fieldName string) (int64, error) {
+	t := c.pool.NewTransaction()
+	var count int64
+	t.ApproxDistinct(c, fieldName, &count)
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// ApproxDistinct sets the value of count to the approximate number of
+// distinct values that have been saved for the given field when the
+// transaction is executed. See Collection.ApproxDistinct for more information.
+// Any errors encountered will be added to the transaction and returned as an
+// error when the transaction is executed.
+func (t *Transaction) ApproxDistinct(c *Collection, fieldName string, count *int64) {
+	if c == nil {
+		t.setError(newNilCollectionError("ApproxDistinct"))
+		return
+	}
+	fs, found := c.spec.fieldsByName[fieldName]
+	if !found {
+		t.setError(fmt.Errorf("zoom: Error in ApproxDistinct: Collection %s does not have field named %s", c.Name(), fieldName))
+		return
+	}
+	if !fs.hll {
+		t.setError(fmt.Errorf("zoom: Error in ApproxDistinct: %s does not have the `zoom:\"hll\"` struct tag", fieldName))
+		return
+	}
+	t.Command("PFCOUNT", redis.Args{c.spec.distinctKey(fs)}, func(reply interface{}) error {
+		var err error
+		*count, err = redis.Int64(reply, nil)
+		return err
+	})
+}
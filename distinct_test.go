@@ -0,0 +1,80 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File distinct_test.go tests approximate distinct counts (distinct.go).
+
+package zoom
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestApproxDistinct(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type visitModel struct {
+		Visitor string  `zoom:"hll"`
+		Page    *string `zoom:"hll"`
+		Count   int
+		RandomId
+	}
+	visits, err := testPool.NewCollectionWithOptions(&visitModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in Register: %s", err.Error())
+	}
+	expectApproxDistinct := func(fieldName string, expected int64) {
+		got, err := visits.ApproxDistinct(fieldName)
+		if err != nil {
+			t.Fatalf("Unexpected error in ApproxDistinct: %s", err.Error())
+		}
+		// Allow for a generous margin since the count is only an estimate.
+		margin := expected / 50
+		if got < expected-margin || got > expected+margin {
+			t.Errorf("Expected approximately %d distinct values for %s but got %d", expected, fieldName, got)
+		}
+	}
+	expectApproxDistinct("Visitor", 0)
+
+	// Save 1000 visits from 200 distinct visitors. Only every other visit has a
+	// page, and nil pages should not be counted.
+	tx := testPool.NewTransaction()
+	for i := 0; i < 1000; i++ {
+		model := &visitModel{Visitor: "visitor" + strconv.Itoa(i%200)}
+		if i%2 == 0 {
+			page := "page" + strconv.Itoa(i%10)
+			model.Page = &page
+		}
+		tx.Save(visits, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+	expectApproxDistinct("Visitor", 200)
+	expectApproxDistinct("Page", 5)
+
+	// DeleteAll should reset the counts.
+	if _, err := visits.DeleteAll(); err != nil {
+		t.Fatalf("Unexpected error in DeleteAll: %s", err.Error())
+	}
+	expectApproxDistinct("Visitor", 0)
+
+	// Fields without the hll struct tag should cause an error.
+	if _, err := visits.ApproxDistinct("Count"); err == nil {
+		t.Error("Expected an error for a field without the hll struct tag but got none")
+	}
+	if _, err := visits.ApproxDistinct("Foo"); err == nil {
+		t.Error("Expected an error for a field that does not exist but got none")
+	}
+
+	// Inconvertible fields cannot be counted.
+	type invalidModel struct {
+		Map map[string]string `zoom:"hll"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&invalidModel{}); err == nil {
+		t.Error("Expected error when registering struct with an inconvertible hll field")
+	}
+}
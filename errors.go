@@ -7,10 +7,28 @@
 
 package zoom
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrPoolExhausted is returned when a connection could not be taken from the
+// pool because the MaxActive limit was reached, either because Wait is false
+// or because no connection was freed within MaxConnWaitTime (see
+// PoolOptions). It is the same error that redigo returns, so you can check for
+// it with errors.Is(err, zoom.ErrPoolExhausted).
+var ErrPoolExhausted = redis.ErrPoolExhausted
+
+// ErrModelNotFound can be used with errors.Is to check whether an error is a
+// ModelNotFoundError, e.g. errors.Is(err, zoom.ErrModelNotFound). It is never
+// returned directly.
+var ErrModelNotFound = errors.New("zoom: model not found")
 
 // ModelNotFoundError is returned from Find and Query methods if a model
-// that fits the given criteria is not found.
+// that fits the given criteria is not found. It matches ErrModelNotFound.
 type ModelNotFoundError struct {
 	Collection *Collection
 	Msg        string
@@ -20,6 +38,12 @@ func (e ModelNotFoundError) Error() string {
 	return "zoom: ModelNotFoundError: " + e.Msg
 }
 
+// Is returns true if target is ErrModelNotFound, so that errors.Is can be used
+// to check for a ModelNotFoundError.
+func (e ModelNotFoundError) Is(target error) bool {
+	return target == ErrModelNotFound
+}
+
 func newModelNotFoundError(mr *modelRef) error {
 	var msg string
 	if mr.model.ModelId() != "" {
@@ -32,3 +56,67 @@ func newModelNotFoundError(mr *modelRef) error {
 		Msg:        msg,
 	}
 }
+
+// ErrCollectionNotRegistered can be used with errors.Is to check whether an
+// error is a CollectionNotRegisteredError. It is never returned directly.
+var ErrCollectionNotRegistered = errors.New("zoom: collection not registered")
+
+// CollectionNotRegisteredError is returned from Pool.Save and
+// Pool.CollectionForModel (and from NewScanModelHandler when the handler is
+// called) if no collection has been registered for the type of a model. It
+// matches ErrCollectionNotRegistered.
+type CollectionNotRegisteredError struct {
+	// Type is the Go type of the model, e.g. *main.Person.
+	Type reflect.Type
+}
+
+func (e CollectionNotRegisteredError) Error() string {
+	return fmt.Sprintf("zoom: CollectionNotRegisteredError: No collection has been registered for type %s. Call Pool.NewCollection first", e.Type)
+}
+
+// Is returns true if target is ErrCollectionNotRegistered, so that errors.Is
+// can be used to check for a CollectionNotRegisteredError.
+func (e CollectionNotRegisteredError) Is(target error) bool {
+	return target == ErrCollectionNotRegistered
+}
+
+// ScanError describes a model which could not be scanned when running a query
+// with AllowPartialResults, e.g. because one of its fields was corrupted or
+// was written by something other than Zoom.
+type ScanError struct {
+	// Id is the id of the model which could not be scanned.
+	Id string
+	// Err is the error that occurred while scanning the model.
+	Err error
+}
+
+func (e ScanError) Error() string {
+	return fmt.Sprintf("zoom: ScanError: Could not scan model with id = %s: %s", e.Id, e.Err.Error())
+}
+
+func (e ScanError) Unwrap() error {
+	return e.Err
+}
+
+// PartialResultsError is returned from Query.Run for queries with
+// AllowPartialResults if some of the models could not be scanned. The models
+// which were scanned successfully are still returned.
+type PartialResultsError struct {
+	// Errors contains an error for every model which could not be scanned, in
+	// the order the models would have been returned.
+	Errors []ScanError
+}
+
+func (e PartialResultsError) Error() string {
+	return fmt.Sprintf("zoom: PartialResultsError: Could not scan %d model(s). The first error was: %s", len(e.Errors), e.Errors[0].Error())
+}
+
+// Unwrap returns every ScanError in e, so that errors.Is and errors.As can be
+// used to inspect them.
+func (e PartialResultsError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
@@ -3,6 +3,8 @@ package zoom
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -39,6 +41,31 @@ func newModelExistsHandler(collection *Collection, modelId string) ReplyHandler
 	}
 }
 
+// newUnknownFieldsHandler returns a reply handler which will return an error
+// if the reply contains any field names which do not correspond to a field in
+// the collection's model type. It is expected to be used as the reply handler
+// for an HKEYS command.
+func newUnknownFieldsHandler(collection *Collection, modelId string) ReplyHandler {
+	return func(reply interface{}) error {
+		storedNames, err := redis.Strings(reply, nil)
+		if err != nil {
+			return err
+		}
+		knownNames := collection.spec.fieldRedisNames()
+		unknownNames := []string{}
+		for _, name := range storedNames {
+			if !stringSliceContains(knownNames, name) {
+				unknownNames = append(unknownNames, name)
+			}
+		}
+		if len(unknownNames) > 0 {
+			sort.Strings(unknownNames)
+			return fmt.Errorf("zoom: Error in Find or Transaction.Find: %s with id = %s has unknown fields: %s", collection.spec.name, modelId, strings.Join(unknownNames, ", "))
+		}
+		return nil
+	}
+}
+
 // NewScanIntHandler returns a ReplyHandler which will convert the reply to an
 // integer and set the value of i to the converted integer. The ReplyHandler
 // will return an error if there was a problem converting the reply.
@@ -168,6 +195,15 @@ func NewScanModelHandler(fieldNames []string, model Model) ReplyHandler {
 // but expects a *modelSpec as the first argument instead of a *Collection. See
 // the documentation for NewScanModelsHandler for more information.
 func newScanModelsHandler(spec *modelSpec, fieldNames []string, models interface{}) ReplyHandler {
+	return newPartialScanModelsHandler(spec, fieldNames, models, nil)
+}
+
+// newPartialScanModelsHandler works like newScanModelsHandler, except that if
+// scanErrs is not nil, a model which cannot be scanned does not stop the
+// handler. Instead, the error is appended to scanErrs and the model is left out
+// of models, so that models only contains the models which were scanned
+// successfully. If scanErrs is nil, the handler returns the first error.
+func newPartialScanModelsHandler(spec *modelSpec, fieldNames []string, models interface{}, scanErrs *[]ScanError) ReplyHandler {
 	return func(reply interface{}) error {
 		allFields, err := redis.Values(reply, nil)
 		modelsVal := reflect.ValueOf(models).Elem()
@@ -182,21 +218,33 @@ func newScanModelsHandler(spec *modelSpec, fieldNames []string, models interface
 		}
 		numFields := len(fieldNames)
 		numModels := len(allFields) / numFields
+		elemType := modelsVal.Type().Elem()
+		byValue := elemType.Kind() == reflect.Struct
+		// scanned is the number of models which have been scanned
+		// successfully, and is also the index in models for the next one.
+		scanned := 0
 		for i := 0; i < numModels; i++ {
 			start := i * numFields
 			stop := i*numFields + numFields
 			fieldValues := allFields[start:stop]
 			var modelVal reflect.Value
-			if modelsVal.Len() > i {
-				// Use the pre-existing value at index i
-				modelVal = modelsVal.Index(i)
+			if byValue {
+				// The elements of models are structs instead of pointers, so
+				// we scan into the address of the element at index scanned.
+				if modelsVal.Len() <= scanned {
+					modelsVal.Set(reflect.Append(modelsVal, reflect.Zero(elemType)))
+				}
+				modelVal = modelsVal.Index(scanned).Addr()
+			} else if modelsVal.Len() > scanned {
+				// Use the pre-existing value at index scanned
+				modelVal = modelsVal.Index(scanned)
 				if modelVal.IsNil() {
 					// If the value is nil, allocate space for it
-					modelsVal.Index(i).Set(reflect.New(spec.typ.Elem()))
+					modelsVal.Index(scanned).Set(reflect.New(spec.typ.Elem()))
 				}
 			} else {
-				// Index i is out of range of the existing slice. Create a
-				// new modelVal and append it to modelsVal
+				// Index scanned is out of range of the existing slice. Create
+				// a new modelVal and append it to modelsVal
 				modelVal = reflect.New(spec.typ.Elem())
 				modelsVal.Set(reflect.Append(modelsVal, modelVal))
 			}
@@ -205,19 +253,42 @@ func newScanModelsHandler(spec *modelSpec, fieldNames []string, models interface
 				model: modelVal.Interface().(Model),
 			}
 			if err := scanModel(fieldNames, fieldValues, mr); err != nil {
-				return err
+				if scanErrs == nil {
+					return err
+				}
+				(*scanErrs) = append(*scanErrs, ScanError{
+					Id:  scannedId(fieldNames, fieldValues),
+					Err: err,
+				})
+				// Discard whatever was partially scanned so that the next
+				// model starts from scratch.
+				modelsVal.Index(scanned).Set(reflect.Zero(elemType))
+				continue
 			}
+			scanned++
 		}
 		// Trim the slice if it is longer than the number of models we scanned
 		// in.
-		if numModels < modelsVal.Len() {
-			modelsVal.SetLen(numModels)
-			modelsVal.SetCap(numModels)
+		if scanned < modelsVal.Len() {
+			modelsVal.SetLen(scanned)
+			modelsVal.SetCap(scanned)
 		}
 		return nil
 	}
 }
 
+// scannedId returns the id in fieldValues, which is the value for the special
+// field name "-", or an empty string if there is no id.
+func scannedId(fieldNames []string, fieldValues []interface{}) string {
+	for i, fieldName := range fieldNames {
+		if fieldName == "-" {
+			id, _ := redis.String(fieldValues[i], nil)
+			return id
+		}
+	}
+	return ""
+}
+
 // NewScanModelsHandler returns a ReplyHandler which will scan the values of the
 // reply into each corresponding Model in models. models should be a pointer to
 // a slice of some concrete Model type. The type of the Models in models should
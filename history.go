@@ -0,0 +1,104 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File history.go contains code related to model history, a capped Redis list
+// for each model which stores snapshots of its previous versions (see
+// CollectionOptions.KeepHistory).
+
+package zoom
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// historyKeySuffix is appended to the key of the main hash for a model to get
+// the key for its history list.
+const historyKeySuffix = "history"
+
+// HistoryKey returns the key that identifies the list in the database that
+// stores the history for the model with the given id. See
+// CollectionOptions.KeepHistory. The history is not deleted when the model is
+// deleted, so that the last versions of deleted models can still be audited.
+// It can be deleted with DEL on this key.
+func (c *Collection) HistoryKey(id string) string {
+	return c.spec.name + ":" + id + ":" + historyKeySuffix
+}
+
+// saveHistory adds a command to the transaction which pushes a snapshot of the
+// main hash for the model with the given id onto its history list, if the
+// model exists. It must be added before any commands which change the main
+// hash. It does nothing if c does not keep history.
+func (t *Transaction) saveHistory(c *Collection, id string) {
+	if c.keepHistory <= 0 {
+		return
+	}
+	t.Script(saveHistoryScript, redis.Args{c.ModelKey(id), c.HistoryKey(id), c.keepHistory}, nil)
+}
+
+// History returns the previous versions of the model with the given id, newest
+// first. Each version is a snapshot of the main hash for the model as it was
+// stored before a save, so the keys are the names of the fields as they are
+// stored in Redis (see CollectionOptions.KeepHistory) and the values are
+// encoded as they are stored in Redis. They are not typed models, and fields
+// which were nil are missing or have the value "NULL". There is no entry for
+// the first save of a model, so the current version of a model which has been
+// saved n times is not included and at most n-1 versions are returned.
+// History returns an empty slice if there is no history for the model. It
+// returns an error if the collection does not keep history.
+func (c *Collection) History(id string) ([]map[string]string, error) {
+	if c == nil {
+		return nil, newNilCollectionError("History")
+	}
+	if c.keepHistory <= 0 {
+		return nil, fmt.Errorf("zoom: History only works for collections which keep history. To enable it, set the KeepHistory property to a positive number in CollectionOptions when calling Pool.NewCollection")
+	}
+	conn := c.pool.NewConn()
+	defer conn.Close()
+	entries, err := redis.Strings(conn.Do("LRANGE", c.HistoryKey(id), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	history := make([]map[string]string, len(entries))
+	for i, entry := range entries {
+		if history[i], err = decodeHistoryEntry(entry); err != nil {
+			return nil, fmt.Errorf("zoom: Error in History: could not decode entry %d for model %s: %s", i, id, err.Error())
+		}
+	}
+	return history, nil
+}
+
+// decodeHistoryEntry decodes a snapshot which was encoded by the save_history
+// script. The snapshot consists of alternating field names and values, each of
+// which is encoded as "<length>:<bytes>,".
+func decodeHistoryEntry(entry string) (map[string]string, error) {
+	values := []string{}
+	for len(entry) > 0 {
+		sep := strings.IndexByte(entry, ':')
+		if sep == -1 {
+			return nil, fmt.Errorf("missing length separator")
+		}
+		length, err := strconv.Atoi(entry[:sep])
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid length %q", entry[:sep])
+		}
+		end := sep + 1 + length
+		if end >= len(entry) || entry[end] != ',' {
+			return nil, fmt.Errorf("value is shorter than its length (%d)", length)
+		}
+		values = append(values, entry[sep+1:end])
+		entry = entry[end+1:]
+	}
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("field %q does not have a value", values[len(values)-1])
+	}
+	snapshot := make(map[string]string, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		snapshot[values[i]] = values[i+1]
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File history_test.go tests model history (history.go).
+
+package zoom
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type historyModel struct {
+		Name string `zoom:"index"`
+		Age  int
+		Data []byte
+		RandomId
+	}
+	options := DefaultCollectionOptions.WithIndex(true).WithKeepHistory(2)
+	collection, err := testPool.NewCollectionWithOptions(&historyModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHistory := func(id string, expected []map[string]string) {
+		t.Helper()
+		got, err := collection.History(id)
+		if err != nil {
+			t.Fatalf("Unexpected error in History: %s", err.Error())
+		}
+		if len(expected) == 0 && len(got) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("History was incorrect.\nExpected: %v\nBut got:  %v", expected, got)
+		}
+	}
+
+	// The first save has nothing to snapshot.
+	model := &historyModel{Name: "v1", Age: 1, Data: []byte("a:b,\x00c")}
+	if err := collection.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	expectHistory(model.ModelId(), nil)
+
+	// Each save pushes the previous version onto the front of the history,
+	// which is capped at KeepHistory entries. Binary values are preserved.
+	v1 := map[string]string{"Name": "v1", "Age": "1", "Data": "a:b,\x00c"}
+	model.Name, model.Age, model.Data = "v2", 2, nil
+	if err := collection.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	v2 := map[string]string{"Name": "v2", "Age": "2", "Data": ""}
+	expectHistory(model.ModelId(), []map[string]string{v1})
+	model.Name = "v3"
+	if err := collection.SaveFields([]string{"Name"}, model); err != nil {
+		t.Fatal(err)
+	}
+	v3 := map[string]string{"Name": "v3", "Age": "2", "Data": ""}
+	expectHistory(model.ModelId(), []map[string]string{v2, v1})
+	model.Age = 4
+	if saved, err := collection.SaveIf(model, "Age", "<", model.Age); err != nil {
+		t.Fatal(err)
+	} else if !saved {
+		t.Fatal("Expected SaveIf to save the model but it did not")
+	}
+	expectHistory(model.ModelId(), []map[string]string{v3, v2})
+
+	// Saves which do not change anything should not add to the history.
+	if saved, err := collection.SaveIf(model, "Age", "<", 0); err != nil {
+		t.Fatal(err)
+	} else if saved {
+		t.Fatal("Expected SaveIf not to save the model but it did")
+	}
+	if saved, err := collection.SaveIfNotExists(model); err != nil {
+		t.Fatal(err)
+	} else if saved {
+		t.Fatal("Expected SaveIfNotExists not to save the model but it did")
+	}
+	expectHistory(model.ModelId(), []map[string]string{v3, v2})
+	other := &historyModel{Name: "other"}
+	if saved, err := collection.SaveIfNotExists(other); err != nil {
+		t.Fatal(err)
+	} else if !saved {
+		t.Fatal("Expected SaveIfNotExists to save the model but it did not")
+	}
+	expectHistory(other.ModelId(), nil)
+
+	// The index should still be correct after all the saves.
+	if count, err := collection.NewQuery().Filter("Name =", "v3").Count(); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Errorf("Expected 1 model with Name v3 but got %d", count)
+	}
+
+	// The history should outlive the model.
+	if _, err := collection.Delete(model.ModelId()); err != nil {
+		t.Fatal(err)
+	}
+	expectHistory(model.ModelId(), []map[string]string{v3, v2})
+
+	// History only works for collections which keep history.
+	if _, err := indexedTestModels.History(model.ModelId()); err == nil {
+		t.Error("Expected an error for a collection without history but got none")
+	}
+	if _, err := testPool.NewCollectionWithOptions(&historyModel{}, DefaultCollectionOptions.WithKeepHistory(-1).WithName("negativeHistory")); err == nil {
+		t.Error("Expected an error for a negative KeepHistory but got none")
+	}
+}
+
+func TestDecodeHistoryEntry(t *testing.T) {
+	got, err := decodeHistoryEntry("4:Name,3:a,b,0:,3::::,")
+	if err != nil {
+		t.Fatalf("Unexpected error in decodeHistoryEntry: %s", err.Error())
+	}
+	expected := map[string]string{"Name": "a,b", "": ":::"}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected %v but got %v", expected, got)
+	}
+	for _, entry := range []string{"4:Name", "4:Name,", "x:Name,", "10:Name,1:a,"} {
+		if _, err := decodeHistoryEntry(entry); err == nil {
+			t.Errorf("Expected an error for %q but got none", entry)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File hooks.go contains code related to the global save and delete hooks for
+// a pool (see Pool.OnSave and Pool.OnDelete).
+
+package zoom
+
+// WriteHook is a function which is called after a model is written to the
+// database. collection is the name of the collection and id is the id of the
+// model. See Pool.OnSave and Pool.OnDelete.
+type WriteHook func(collection string, id string)
+
+// writeEvent is a save or delete which was added to a transaction. The hooks
+// for the event are called if the transaction is executed successfully.
+type writeEvent struct {
+	collection string
+	id         string
+	deleted    bool
+	// written, if not nil, points to a value which is set when the transaction
+	// is executed and indicates whether the write actually happened (e.g. for
+	// SaveIfNotExists). If it is nil the write always happens.
+	written *bool
+}
+
+// OnSave sets a hook which is called after every successful save of any model
+// in any collection that uses the pool, including Save, SaveFields, Upsert,
+// and the conditional saves when the condition holds. The hook is called after
+// the transaction containing the save has been executed, once for each model
+// that was saved, in the order the saves were added to the transaction. It is
+// not called if the transaction fails. The hooks are kept for the pool which
+// executes the transaction, so writes to a collection with a dedicated pool
+// (see CollectionOptions.Pool) call the hooks of the dedicated pool. Hooks are
+// called synchronously, so they should return quickly. Passing nil removes the
+// hook, which is the default.
+func (p *Pool) OnSave(hook WriteHook) {
+	p.hooksMut.Lock()
+	defer p.hooksMut.Unlock()
+	p.onSave = hook
+}
+
+// OnDelete sets a hook which is called after every successful delete of any
+// model in any collection that uses the pool, including Delete and
+// DeleteAllByIds. Like the change log, the hook is called even if the model
+// did not exist. For DeleteAll and Truncate, which delete every model in the
+// collection, the hook is called once with an empty id. See OnSave for more
+// information. Passing nil removes the hook, which is the default.
+func (p *Pool) OnDelete(hook WriteHook) {
+	p.hooksMut.Lock()
+	defer p.hooksMut.Unlock()
+	p.onDelete = hook
+}
+
+// callWriteHook calls the OnSave or OnDelete hook for the pool (if any) with
+// the given collection name and model id.
+func (p *Pool) callWriteHook(deleted bool, collection string, id string) {
+	p.hooksMut.RLock()
+	hook := p.onSave
+	if deleted {
+		hook = p.onDelete
+	}
+	p.hooksMut.RUnlock()
+	if hook != nil {
+		hook(collection, id)
+	}
+}
+
+// addWriteEvent records a save or delete for the model with the given id so
+// that the hooks are called after the transaction is executed.
+func (t *Transaction) addWriteEvent(c *Collection, op ChangeOp, modelId string) {
+	t.writes = append(t.writes, writeEvent{
+		collection: c.Name(),
+		id:         modelId,
+		deleted:    op != ChangeSave,
+	})
+}
+
+// addConditionalWriteEvents adds the write events from other, whose actions
+// are run by a script in t only if some condition holds, to t. It returns a
+// ReplyHandler for the script which expects a boolean reply indicating whether
+// the condition held and sets the value of saved (if not nil) accordingly.
+func (t *Transaction) addConditionalWriteEvents(other *Transaction, saved *bool) ReplyHandler {
+	written := t.addConditionalWrites(other)
+	scanWritten := NewScanBoolHandler(written)
+	return func(reply interface{}) error {
+		if err := scanWritten(reply); err != nil {
+			return err
+		}
+		if saved != nil {
+			(*saved) = *written
+		}
+		return nil
+	}
+}
+
+// addConditionalWrites adds the write events from other to t. The hooks for the
+// events are only called if the value pointed to by the returned bool is true
+// after the transaction is executed, so the caller must arrange for it to be
+// set.
+func (t *Transaction) addConditionalWrites(other *Transaction) *bool {
+	written := new(bool)
+	for _, event := range other.writes {
+		event.written = written
+		t.writes = append(t.writes, event)
+	}
+	return written
+}
+
+// callWriteHooks calls the hooks for all of the writes in the transaction
+// which actually happened. It should only be called after the transaction was
+// executed successfully.
+func (t *Transaction) callWriteHooks() {
+	if t.pool == nil {
+		return
+	}
+	for _, event := range t.writes {
+		if event.written != nil && !*event.written {
+			continue
+		}
+		t.pool.callWriteHook(event.deleted, event.collection, event.id)
+	}
+}
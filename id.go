@@ -0,0 +1,112 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File id.go contains code for generating ids with a configurable length and
+// alphabet (see CollectionOptions.IdLength).
+
+package zoom
+
+import (
+	"crypto/rand"
+	"fmt"
+	"reflect"
+)
+
+const (
+	// IdAlphabetBase62 contains the digits and the upper and lower case ASCII
+	// letters. It is the default alphabet for CollectionOptions.IdAlphabet.
+	//
+	// The probability that any two of n random ids collide is about
+	// n^2 / (2 * len(alphabet)^length). For example, with 62 characters there
+	// is a 1% chance of a collision after about 2 million ids of length 8,
+	// 8 billion ids of length 12, or 30 trillion ids of length 16. Ids of
+	// length 22 have about as many bits of randomness (131) as a random UUID.
+	IdAlphabetBase62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	// IdAlphabetBase58 is IdAlphabetBase62 without the characters which are
+	// easily confused with each other (0, O, I, and l). With 58 characters
+	// there is a 1% chance of a collision after about 1.6 million ids of length
+	// 8 or 5 billion ids of length 12.
+	IdAlphabetBase58 = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	// IdAlphabetURLSafe contains the 64 characters used by the URL-safe
+	// variant of base64, so ids can be used in URLs without escaping. With 64
+	// characters there is a 1% chance of a collision after about 2.3 million
+	// ids of length 8 or 10 billion ids of length 12.
+	IdAlphabetURLSafe = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+)
+
+// checkIdAlphabet returns an error if alphabet cannot be used to generate ids,
+// i.e. if it has fewer than 2 or more than 256 bytes or any repeated bytes.
+func checkIdAlphabet(alphabet string) error {
+	if len(alphabet) < 2 || len(alphabet) > 256 {
+		return fmt.Errorf("CollectionOptions.IdAlphabet must contain between 2 and 256 characters. Got %d", len(alphabet))
+	}
+	seen := [256]bool{}
+	for i := 0; i < len(alphabet); i++ {
+		if seen[alphabet[i]] {
+			return fmt.Errorf("CollectionOptions.IdAlphabet cannot contain repeated characters. Got %q", alphabet)
+		}
+		seen[alphabet[i]] = true
+	}
+	return nil
+}
+
+// generateIdFromAlphabet returns a random id with the given length, made of
+// bytes chosen uniformly at random from alphabet. Random bytes which would
+// introduce a bias towards the start of alphabet are discarded.
+func generateIdFromAlphabet(length int, alphabet string) string {
+	// Only use random bytes below the largest multiple of len(alphabet) which
+	// fits in a byte, so each character is equally likely.
+	limit := 256 - 256%len(alphabet)
+	id := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(id) < length {
+		if _, err := rand.Read(buf); err != nil {
+			// crypto/rand only fails if the operating system cannot provide
+			// random numbers, in which case there is no safe fallback.
+			panic(fmt.Errorf("zoom: could not generate a random id: %s", err.Error()))
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(id) < length {
+				id = append(id, alphabet[int(b)%len(alphabet)])
+			}
+		}
+	}
+	return string(id)
+}
+
+// newId returns a new id for a model in the collection, using the length and
+// alphabet from the options for the collection, or the default scheme used by
+// RandomId if there is no IdLength.
+func (c *Collection) newId() string {
+	if c.idLength == 0 {
+		return generateRandomId()
+	}
+	return generateIdFromAlphabet(c.idLength, c.idAlphabet)
+}
+
+// assignId sets the id of model to a new id from newId if the collection has
+// an IdLength and model does not already have an id. It can only tell whether
+// a model has an id if the model embeds RandomId or has a field with the
+// `zoom:"id"` struct tag, so other models are left alone.
+func (c *Collection) assignId(model Model) {
+	if c.idLength == 0 {
+		return
+	}
+	val := reflect.ValueOf(model)
+	if val.IsNil() {
+		return
+	}
+	var idVal reflect.Value
+	switch {
+	case c.spec.idField != nil:
+		idVal = val.Elem().FieldByName(c.spec.idField.name)
+	case c.spec.randomId != nil:
+		idVal = val.Elem().FieldByIndex(c.spec.randomId).FieldByName("Id")
+	default:
+		return
+	}
+	if idVal.String() == "" {
+		model.SetModelId(c.newId())
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File id_test.go tests the code for generating ids with a configurable length
+// and alphabet (id.go).
+
+package zoom
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIdLengthAndAlphabet(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type shortIdModel struct {
+		Name string
+		RandomId
+	}
+	options := DefaultCollectionOptions.WithIndex(true).WithIdLength(10).WithIdAlphabet(IdAlphabetBase58)
+	shortIds, err := testPool.NewCollectionWithOptions(&shortIdModel{}, options)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+	defer testPool.UnregisterCollection(shortIds.Name())
+	expectValidId := func(id string) {
+		if len(id) != 10 {
+			t.Errorf("Expected an id with 10 characters but got %q", id)
+		}
+		for _, char := range id {
+			if !strings.ContainsRune(IdAlphabetBase58, char) {
+				t.Errorf("Expected the id to only contain characters from the alphabet but got %q", id)
+			}
+		}
+	}
+
+	// Saving a model without an id should assign one from the configured
+	// alphabet, and the model should be found under that id.
+	model := &shortIdModel{Name: "Alice"}
+	if err := shortIds.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	expectValidId(model.Id)
+	expectModelExists(t, shortIds, model)
+	tx := testPool.NewTransaction()
+	reserved := tx.ReserveId(shortIds)
+	expectValidId(reserved)
+	// Existing ids should not be changed.
+	existing := &shortIdModel{Name: "Bob"}
+	existing.SetModelId("bob")
+	if err := shortIds.SaveFields([]string{"Name"}, existing); err != nil {
+		t.Fatalf("Unexpected error in SaveFields: %s", err.Error())
+	}
+	if existing.Id != "bob" {
+		t.Errorf("Expected SaveFields not to change an existing id but got %q", existing.Id)
+	}
+
+	// Models with the id struct tag should also get ids.
+	uuids, err := testPool.NewCollectionWithOptions(&uuidModel{}, DefaultCollectionOptions.WithIndex(true).WithIdLength(22))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+	defer testPool.UnregisterCollection(uuids.Name())
+	uuid := &uuidModel{Name: "Carol"}
+	if err := uuids.Save(uuid); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	if len(uuid.UUID) != 22 {
+		t.Errorf("Expected an id with 22 characters but got %q", uuid.UUID)
+	}
+	expectModelExists(t, uuids, uuid)
+
+	// Invalid options should be rejected.
+	type invalidIdModel struct {
+		RandomId
+	}
+	for _, invalid := range []CollectionOptions{
+		DefaultCollectionOptions.WithIdLength(-1),
+		DefaultCollectionOptions.WithIdLength(8).WithIdAlphabet("a"),
+		DefaultCollectionOptions.WithIdLength(8).WithIdAlphabet("abca"),
+	} {
+		if _, err := testPool.NewCollectionWithOptions(&invalidIdModel{}, invalid); err == nil {
+			t.Errorf("Expected an error for IdLength %d and IdAlphabet %q but got none", invalid.IdLength, invalid.IdAlphabet)
+		}
+	}
+}
+
+func TestGenerateIdFromAlphabet(t *testing.T) {
+	// Every character in the alphabet should be used, and the ids should be
+	// unique.
+	const alphabet = "abc"
+	seen := map[string]bool{}
+	counts := map[rune]int{}
+	for i := 0; i < 1000; i++ {
+		id := generateIdFromAlphabet(32, alphabet)
+		if len(id) != 32 {
+			t.Fatalf("Expected an id with 32 characters but got %q", id)
+		}
+		if seen[id] {
+			t.Errorf("Generated the same id twice: %q", id)
+		}
+		seen[id] = true
+		for _, char := range id {
+			counts[char]++
+		}
+	}
+	for _, char := range alphabet {
+		// Each character is expected about 10667 times.
+		if counts[char] < 10000 || counts[char] > 11300 {
+			t.Errorf("Expected %q to be used about 10667 times but it was used %d times", char, counts[char])
+		}
+	}
+	if len(counts) != len(alphabet) {
+		t.Errorf("Expected only characters from the alphabet but got %v", counts)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File import.go contains code for saving a large number of models at once and
+// building the field indexes afterwards (see Collection.Import).
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// importBatchSize is the number of models which are saved in a single
+// transaction by Import. It is also the maximum number of members which are
+// added to an index with a single command.
+const importBatchSize = 1000
+
+// Import saves all of the given models, like calling Save for each of them,
+// but defers building the field indexes until every model has been written.
+// It is intended for initial data loads of a large number of models, where
+// updating the indexes on every save is slow. Import works in two phases.
+// First it writes the main hash of each model (along with the set of all ids,
+// the change log, and any HyperLogLogs) in batches of 1000 models, each in its
+// own transaction, without touching the field indexes. Then it builds the
+// index for every indexed field in a single pass. If the collection was empty
+// when Import started, the index entries are computed from the given models
+// and added with one command per index for each batch, so no old values need
+// to be read or removed. Otherwise the indexes are rebuilt from the stored
+// values as if by calling ReindexField, which is slower.
+//
+// Import is not atomic. While it is running, queries (and Count, FindAll,
+// etc.) can see any subset of the models, and queries which filter or order by
+// an indexed field return incomplete results until the indexes have been
+// built. If the collection was not empty, that includes models which existed
+// before the import, since each index is cleared before it is rebuilt. If
+// Import returns an error, some of the models may have been saved, and calling
+// ReindexField for each indexed field repairs the indexes. Import returns the
+// number of models that were saved. All of the models must have the registered
+// type for the collection, and Import returns an error without saving anything
+// if any of them does not. Like Save, Import assigns an id to any model which
+// does not have one. It only works for indexed collections. Use zoom.Models to
+// convert a slice of a concrete type (e.g. []*Person) to []Model.
+func (c *Collection) Import(models []Model) (int, error) {
+	if c == nil {
+		return 0, newNilCollectionError("Import")
+	}
+	if !c.index {
+		return 0, newUnindexedCollectionError("Import")
+	}
+	for _, model := range models {
+		if err := c.checkModelType(model); err != nil {
+			return 0, fmt.Errorf("zoom: Error in Import: %s", err.Error())
+		}
+	}
+	if len(models) == 0 {
+		return 0, nil
+	}
+	existing := 0
+	t := c.pool.NewTransaction()
+	t.Command("SCARD", redis.Args{c.IndexKey()}, NewScanIntHandler(&existing))
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	count := 0
+	for start := 0; start < len(models); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(models) {
+			end = len(models)
+		}
+		t := c.pool.NewTransaction()
+		for _, model := range models[start:end] {
+			c.assignId(model)
+			t.saveModel(c, model, false)
+		}
+		if err := t.Exec(); err != nil {
+			return count, err
+		}
+		count = end
+	}
+	if existing == 0 {
+		return count, c.importIndexes(models)
+	}
+	for _, fs := range c.spec.fields {
+		if fs.indexKind == noIndex {
+			continue
+		}
+		if _, err := c.ReindexField(fs.name); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// importIndexes adds the given models, which have just been saved by Import,
+// to the index for each indexed field. It assumes that none of the models were
+// already in the indexes, so nothing is removed. If the same id appears more
+// than once, only the last model with that id is indexed, since it is the one
+// which was saved.
+func (c *Collection) importIndexes(models []Model) error {
+	last := make(map[string]int, len(models))
+	for i, model := range models {
+		last[model.ModelId()] = i
+	}
+	for start := 0; start < len(models); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(models) {
+			end = len(models)
+		}
+		batch := []*modelRef{}
+		for i := start; i < end; i++ {
+			if last[models[i].ModelId()] != i {
+				continue
+			}
+			batch = append(batch, &modelRef{
+				collection: c,
+				model:      models[i],
+				spec:       c.spec,
+			})
+		}
+		t := c.pool.NewTransaction()
+		for _, fs := range c.spec.fields {
+			if fs.indexKind == noIndex {
+				continue
+			}
+			if err := t.importFieldIndex(c.spec, fs, batch); err != nil {
+				return err
+			}
+		}
+		if err := t.Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importFieldIndex adds commands to the transaction which add the models in
+// mrs to the index for the field identified by fs and spec. The entries are the same as
+// the ones which are added by Save (see saveFieldIndexes), but each command
+// adds the entries for all of the models. Nil values are not indexed, and
+// neither are models which do not match the condition for a partial index.
+func (t *Transaction) importFieldIndex(spec *modelSpec, fs *fieldSpec, mrs []*modelRef) error {
+	indexKey, err := spec.fieldIndexKey(fs.name)
+	if err != nil {
+		return err
+	}
+	zaddArgs := redis.Args{indexKey}
+	keysArgs := redis.Args{indexKeysKey(indexKey)}
+	enumIds := redis.Args{indexKey}
+	sparseIds := redis.Args{indexKey}
+	enumBuckets := map[string]redis.Args{}
+	for _, mr := range mrs {
+		id := mr.model.ModelId()
+		fieldValue := mr.fieldValue(fs.name)
+		if fieldValue.Kind() == reflect.Ptr && fieldValue.IsNil() {
+			continue
+		}
+		if fs.where != nil && !fs.where.holds(mr) {
+			continue
+		}
+		switch fs.indexKind {
+		case numericIndex:
+			if err := checkExactScore(fieldValue); err != nil {
+				return fmt.Errorf("zoom: error saving index for %s.%s: %s", spec.typ.String(), fs.name, err.Error())
+			}
+			zaddArgs = append(zaddArgs, fs.numericIndexScore(fieldValue), id)
+		case booleanIndex:
+			zaddArgs = append(zaddArgs, boolScore(fieldValue), id)
+		case sparseBoolIndex:
+			if boolScore(fieldValue) == 1 {
+				sparseIds = append(sparseIds, id)
+			}
+		case stringIndex, enumIndex:
+			for fieldValue.Kind() == reflect.Ptr {
+				fieldValue = fieldValue.Elem()
+			}
+			value, err := fs.stringIndexValue(fieldValue)
+			if err != nil {
+				return err
+			}
+			if fs.indexKind == stringIndex {
+				zaddArgs = append(zaddArgs, 0, value+nullString+id)
+				keysArgs = append(keysArgs, id, value)
+				continue
+			}
+			enumIds = append(enumIds, id)
+			if _, found := enumBuckets[value]; !found {
+				enumBuckets[value] = redis.Args{enumBucketKey(indexKey, value)}
+			}
+			enumBuckets[value] = append(enumBuckets[value], id)
+		}
+	}
+	if len(zaddArgs) > 1 {
+		t.Command("ZADD", zaddArgs, nil)
+	}
+	if fs.indexKeyFunc != nil && len(keysArgs) > 1 {
+		t.Command("HSET", keysArgs, nil)
+	}
+	if len(sparseIds) > 1 {
+		t.Command("SADD", sparseIds, nil)
+	}
+	if len(enumIds) > 1 {
+		values := redis.Args{enumValuesKey(indexKey)}
+		for value, bucketArgs := range enumBuckets {
+			t.Command("SADD", bucketArgs, nil)
+			values = append(values, value)
+		}
+		t.Command("SADD", values, nil)
+		t.Command("SADD", enumIds, nil)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File import_test.go tests the code for saving many models with deferred
+// indexing (import.go).
+
+package zoom
+
+import "testing"
+
+func TestImport(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type importModel struct {
+		Position int     `zoom:"index"`
+		Name     string  `zoom:"index"`
+		Active   bool    `zoom:"index"`
+		Status   string  `zoom:"index,enum"`
+		Note     *string `zoom:"index"`
+		RandomId
+	}
+	importModels, err := testPool.NewCollectionWithOptions(&importModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectIndexesOK := func() {
+		t.Helper()
+		reports, err := importModels.VerifyIndexes()
+		if err != nil {
+			t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+		}
+		for _, report := range reports {
+			if !report.OK() {
+				t.Errorf("Expected the index for %s to be consistent but got %+v", report.FieldName, report)
+			}
+		}
+	}
+	expectCount := func(q *Query, expected int) {
+		t.Helper()
+		if count, err := q.Count(); err != nil {
+			t.Fatalf("Unexpected error in Count: %s", err.Error())
+		} else if count != expected {
+			t.Errorf("Expected %s to match %d models but got %d", q, expected, count)
+		}
+	}
+
+	// Import into an empty collection builds the indexes from the models. The
+	// number of models spans more than one batch, and the last model with a
+	// duplicate id wins.
+	note := "note"
+	models := make([]*importModel, importBatchSize+10)
+	for i := range models {
+		models[i] = &importModel{Position: i, Name: "name", Active: i%2 == 0, Status: "pending"}
+		if i%10 == 0 {
+			models[i].Status = "done"
+			models[i].Note = &note
+		}
+	}
+	duplicate := &importModel{Position: -1, Name: "duplicate", Status: "done"}
+	duplicate.Id = models[1].ModelId()
+	models = append(models, duplicate)
+	count, err := importModels.Import(Models(models))
+	if err != nil {
+		t.Fatalf("Unexpected error in Import: %s", err.Error())
+	}
+	if count != len(models) {
+		t.Errorf("Expected Import to return %d but got %d", len(models), count)
+	}
+	expectIndexesOK()
+	total := len(models) - 1
+	expectCount(importModels.NewQuery(), total)
+	expectCount(importModels.NewQuery().Filter("Position <", 0), 1)
+	expectCount(importModels.NewQuery().Filter("Position >=", 1000), 10)
+	expectCount(importModels.NewQuery().Filter("Name =", "duplicate"), 1)
+	expectCount(importModels.NewQuery().Filter("Active =", true), total/2)
+	expectCount(importModels.NewQuery().Filter("Status =", "done"), total/10+1)
+	expectCount(importModels.NewQuery().Filter("Note =", note), total/10)
+	got := &importModel{}
+	if err := importModels.Find(duplicate.Id, got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	} else if got.Name != "duplicate" {
+		t.Errorf("Expected the last model with a duplicate id to be saved but got %+v", got)
+	}
+
+	// Import into a collection which already has models rebuilds the indexes
+	// from the stored values, so the old values of updated models are removed.
+	updated := []*importModel{models[0], {Position: -2, Name: "new", Status: "new"}}
+	updated[0].Name = "updated"
+	updated[0].Status = "updated"
+	updated[0].Note = nil
+	if _, err := importModels.Import(Models(updated)); err != nil {
+		t.Fatalf("Unexpected error in Import: %s", err.Error())
+	}
+	expectIndexesOK()
+	expectCount(importModels.NewQuery(), total+1)
+	expectCount(importModels.NewQuery().Filter("Name =", "updated"), 1)
+	expectCount(importModels.NewQuery().Filter("Position <", 0), 2)
+	expectCount(importModels.NewQuery().Filter("Status =", "done"), total/10)
+	expectCount(importModels.NewQuery().Filter("Note =", note), total/10-1)
+
+	// Models of the wrong type should cause an error before anything is saved.
+	mixed := []Model{&importModel{Name: "never saved"}, &testModel{}}
+	if _, err := importModels.Import(mixed); err == nil {
+		t.Error("Expected an error for a model of the wrong type but got none")
+	}
+	expectCount(importModels.NewQuery().Filter("Name =", "never saved"), 0)
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File increment.go contains code for atomically incrementing the integer
+// fields of a model.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// IncrementFields atomically increments the fields of the model with the given
+// id by the amounts in deltas, which maps field names to amounts, and returns
+// a map of field names to the new values. The fields are incremented with
+// HINCRBY and the numeric indexes for any indexed fields are updated in the
+// same script, so other clients never see a field and its index disagree and
+// concurrent increments are never lost. Every field in deltas must be an
+// integer field (or a pointer to an integer) without a custom marshaler or the
+// hll struct tag. A field which has no stored value is treated as 0. If the
+// model does not exist, IncrementFields returns a ModelNotFoundError and
+// nothing is changed. Note that the new values are not checked against the
+// range of the field's type, so e.g. decrementing a uint field below 0 will
+// cause an error the next time the model is found.
+func (c *Collection) IncrementFields(id string, deltas map[string]int64) (map[string]int64, error) {
+	t := c.pool.NewTransaction()
+	newValues := map[string]int64{}
+	t.IncrementFields(c, id, deltas, newValues)
+	if err := t.Exec(); err != nil {
+		return nil, err
+	}
+	return newValues, nil
+}
+
+// IncrementFields atomically increments the fields of the model with the given
+// id in an existing transaction. When the transaction is executed, newValues
+// will map each field name in deltas to its new value. See
+// Collection.IncrementFields for more information. Any errors encountered will
+// be added to the transaction and returned as an error when the transaction is
+// executed.
+func (t *Transaction) IncrementFields(c *Collection, id string, deltas map[string]int64, newValues map[string]int64) {
+	if c == nil {
+		t.setError(newNilCollectionError("IncrementFields"))
+		return
+	}
+	if newValues == nil {
+		t.setError(fmt.Errorf("zoom: Error in IncrementFields or Transaction.IncrementFields: newValues map cannot be nil"))
+		return
+	}
+	if len(deltas) == 0 {
+		return
+	}
+	// Sort the field names so that the commands are always the same for the
+	// same deltas.
+	fieldNames := make([]string, 0, len(deltas))
+	for fieldName := range deltas {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	args := redis.Args{c.ModelKey(id), id, len(fieldNames)}
+	for _, fieldName := range fieldNames {
+		fs, found := c.spec.fieldsByName[fieldName]
+		if !found {
+			t.setError(fmt.Errorf("zoom: Error in IncrementFields or Transaction.IncrementFields: Collection %s does not have a field named %s", c.Name(), fieldName))
+			return
+		}
+		if err := checkIncrementField(fs); err != nil {
+			t.setError(fmt.Errorf("zoom: Error in IncrementFields or Transaction.IncrementFields: %s", err.Error()))
+			return
+		}
+		// The script does not update partial indexes, so fields which appear
+		// in the condition for one cannot be incremented either.
+		for _, other := range c.spec.fields {
+			if other.where != nil && other.where.field == fs {
+				t.setError(fmt.Errorf("zoom: Error in IncrementFields or Transaction.IncrementFields: field %s cannot be incremented because it is used in the partial index for %s (where:%s)", fs.name, other.name, other.where))
+				return
+			}
+		}
+		indexKey := ""
+		if fs.indexKind == numericIndex {
+			indexKey, _ = c.spec.fieldIndexKey(fs.name)
+		}
+		args = append(args, fs.redisName, deltas[fieldName], indexKey)
+	}
+	// The change log entry and write count should only be updated if the model
+	// exists, so the script runs them along with the increments.
+	conditional := &Transaction{}
+	if c.index {
+		conditional.incrWriteCount(c)
+	}
+	conditional.addChange(c, ChangeSave, id, fieldNames)
+	args, err := appendCommandArgs(args, conditional.actions)
+	if err != nil {
+		t.setError(fmt.Errorf("zoom: Error in IncrementFields or Transaction.IncrementFields: %s", err.Error()))
+		return
+	}
+	written := t.addConditionalWrites(conditional)
+	t.Script(incrementFieldsScript, args, func(reply interface{}) error {
+		if reply == nil {
+			msg := fmt.Sprintf("Could not find %s with id = %s", c.Name(), id)
+			return ModelNotFoundError{Collection: c, Msg: msg}
+		}
+		values, err := redis.Int64s(reply, nil)
+		if err != nil {
+			return err
+		}
+		for i, fieldName := range fieldNames {
+			newValues[fieldName] = values[i]
+		}
+		(*written) = true
+		return nil
+	})
+}
+
+// checkIncrementField returns an error if the field identified by fs cannot be
+// incremented with HINCRBY, i.e. if it is not an integer or a pointer to an
+// integer which is stored as a plain number.
+func checkIncrementField(fs *fieldSpec) error {
+	typ := fs.typ
+	if fs.kind == pointerField {
+		typ = typ.Elem()
+	}
+	switch {
+	case fs.kind != primativeField && fs.kind != pointerField,
+		fs.marshaler != noMarshaler,
+		fs.timeFormat != "":
+		return fmt.Errorf("field %s cannot be incremented because its type (%s) is not an integer", fs.name, fs.typ.String())
+	case fs.hll:
+		return fmt.Errorf("field %s cannot be incremented because it has the hll struct tag", fs.name)
+	case fs.where != nil:
+		return fmt.Errorf("field %s cannot be incremented because it has a partial index (where:%s)", fs.name, fs.where)
+	}
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return nil
+	}
+	return fmt.Errorf("field %s cannot be incremented because its type (%s) is not an integer", fs.name, fs.typ.String())
+}
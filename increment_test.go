@@ -0,0 +1,82 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File increment_test.go tests the code for incrementing fields
+// (increment.go).
+
+package zoom
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIncrementFields(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	model := &indexedPrimativesModel{Int: 10, Uint8: 3, Int64: -5}
+	if err := indexedPrimativesModels.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	got, err := indexedPrimativesModels.IncrementFields(model.ModelId(), map[string]int64{
+		"Int":   5,
+		"Uint8": 1,
+		"Int64": -10,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error in IncrementFields: %s", err.Error())
+	}
+	expected := map[string]int64{"Int": 15, "Uint8": 4, "Int64": -15}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("IncrementFields returned the wrong values.\nExpected: %v\nGot:      %v", expected, got)
+	}
+	found := &indexedPrimativesModel{}
+	if err := indexedPrimativesModels.Find(model.ModelId(), found); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if found.Int != 15 || found.Uint8 != 4 || found.Int64 != -15 {
+		t.Errorf("Fields were not incremented. Got Int = %d, Uint8 = %d, Int64 = %d", found.Int, found.Uint8, found.Int64)
+	}
+	// The numeric indexes should be updated to the new values.
+	for _, tc := range []struct {
+		filter string
+		value  interface{}
+	}{
+		{"Int =", 15},
+		{"Uint8 =", uint8(4)},
+		{"Int64 =", int64(-15)},
+	} {
+		ids, err := indexedPrimativesModels.NewQuery().Filter(tc.filter, tc.value).Ids()
+		if err != nil {
+			t.Fatalf("Unexpected error in Query.Ids: %s", err.Error())
+		}
+		if !reflect.DeepEqual([]string{model.ModelId()}, ids) {
+			t.Errorf("Expected query %s %v to return %s but got %v", tc.filter, tc.value, model.ModelId(), ids)
+		}
+	}
+
+	// A model which does not exist should cause a ModelNotFoundError and
+	// should not be created.
+	if _, err := indexedPrimativesModels.IncrementFields("missing", map[string]int64{"Int": 1}); err == nil {
+		t.Error("Expected an error for a model which does not exist but got none")
+	} else if _, ok := err.(ModelNotFoundError); !ok {
+		t.Errorf("Expected a ModelNotFoundError but got: %T: %s", err, err.Error())
+	}
+	expectKeyDoesNotExist(t, indexedPrimativesModels.ModelKey("missing"))
+
+	// Fields which are not integers should cause an error and nothing should be
+	// incremented.
+	for _, fieldName := range []string{"Float64", "String", "Bool", "Invalid"} {
+		if _, err := indexedPrimativesModels.IncrementFields(model.ModelId(), map[string]int64{"Int": 1, fieldName: 1}); err == nil {
+			t.Errorf("Expected an error for field %s but got none", fieldName)
+		}
+	}
+	if err := indexedPrimativesModels.Find(model.ModelId(), found); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if found.Int != 15 {
+		t.Errorf("Expected Int to be unchanged after an invalid increment but got %d", found.Int)
+	}
+}
@@ -7,10 +7,14 @@
 package zoom
 
 import (
+	"context"
+	"crypto/sha1"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -28,7 +32,32 @@ type query struct {
 	limit      uint
 	offset     uint
 	filters    []filter
-	err        error
+	// unindexedFilters are filters which do not use an index and instead scan
+	// the main hash for every model. See UnindexedFilter.
+	unindexedFilters []unindexedFilter
+	// filterFuncs are arbitrary predicates which are applied to the models
+	// after they have been read from the database. See FilterFunc.
+	filterFuncs []func(Model) bool
+	unordered   bool
+	// debug is an optional writer for debug output. See Query.Debug.
+	debug io.Writer
+	// batchSize is the number of models read at a time by Query.Stream. If it
+	// is 0, streamBatchSize is used. See Query.BatchSize.
+	batchSize uint
+	// cacheTTL is how long the results of Run are cached for. If it is 0, the
+	// results are not cached. See Query.Cache.
+	cacheTTL time.Duration
+	// partialResults is true if Run should return the models which could be
+	// scanned along with a PartialResultsError, instead of failing on the
+	// first scan error. See Query.AllowPartialResults.
+	partialResults bool
+	// ctx is the context for running the query, or nil to use
+	// context.Background(). See Query.WithContext.
+	ctx context.Context
+	// timeout is the time limit for each query finisher, shared by all of its
+	// round trips. If it is 0, there is no time limit. See Query.Timeout.
+	timeout time.Duration
+	err     error
 }
 
 // newQuery creates and returns a new query with the given collection. It will
@@ -54,8 +83,16 @@ func (q *query) String() string {
 	for _, filter := range q.filters {
 		result += fmt.Sprintf(".%s", filter)
 	}
+	for _, filter := range q.unindexedFilters {
+		result += fmt.Sprintf(".%s", filter)
+	}
+	for range q.filterFuncs {
+		result += ".FilterFunc(func)"
+	}
 	if q.hasOrder() {
 		result += fmt.Sprintf(".%s", q.order)
+	} else if q.unordered {
+		result += ".Unordered()"
 	}
 	if q.hasOffset() {
 		result += fmt.Sprintf(".Offset(%d)", q.offset)
@@ -75,13 +112,23 @@ type order struct {
 	fieldName string
 	redisName string
 	kind      orderKind
+	// unindexed is true if the order was specified with OrderUnindexed, in
+	// which case the models are sorted by the values in their main hashes
+	// instead of by an index. alpha is true if those values should be sorted
+	// lexicographically instead of numerically.
+	unindexed bool
+	alpha     bool
 }
 
 func (o order) String() string {
+	method := "Order"
+	if o.unindexed {
+		method = "OrderUnindexed"
+	}
 	if o.kind == ascendingOrder {
-		return fmt.Sprintf(`Order("%s")`, o.fieldName)
+		return fmt.Sprintf(`%s("%s")`, method, o.fieldName)
 	} else {
-		return fmt.Sprintf(`Order("-%s")`, o.fieldName)
+		return fmt.Sprintf(`%s("-%s")`, method, o.fieldName)
 	}
 }
 
@@ -106,16 +153,38 @@ type filter struct {
 	fieldSpec *fieldSpec
 	op        filterOp
 	value     reflect.Value
+	// negate is true if the filter was preceded by Not, in which case it
+	// matches all the models which do not satisfy the condition.
+	negate bool
 }
 
 func (f filter) String() string {
-	if f.value.Kind() == reflect.String {
-		return fmt.Sprintf(`Filter("%s %s", "%s")`, f.fieldSpec.name, f.op, f.value.String())
+	// Dereference pointers so that the underlying value is printed instead of
+	// the address.
+	value := f.value
+	for value.Kind() == reflect.Ptr {
+		value = value.Elem()
+	}
+	prefix := ""
+	if f.negate {
+		prefix = "Not()."
+	}
+	if value.Kind() == reflect.String {
+		return fmt.Sprintf(`%sFilter("%s %s", "%s")`, prefix, f.fieldSpec.name, f.op, value.String())
 	} else {
-		return fmt.Sprintf(`Filter("%s %s", %v)`, f.fieldSpec.name, f.op, f.value.Interface())
+		return fmt.Sprintf(`%sFilter("%s %s", %v)`, prefix, f.fieldSpec.name, f.op, value.Interface())
 	}
 }
 
+type unindexedFilter struct {
+	fieldSpec *fieldSpec
+	substring string
+}
+
+func (f unindexedFilter) String() string {
+	return fmt.Sprintf(`UnindexedFilter("%s contains", "%s")`, f.fieldSpec.name, f.substring)
+}
+
 type filterOp int
 
 const (
@@ -125,6 +194,7 @@ const (
 	lessOp
 	greaterOrEqualOp
 	lessOrEqualOp
+	inOp
 )
 
 func (fk filterOp) String() string {
@@ -141,6 +211,8 @@ func (fk filterOp) String() string {
 		return ">="
 	case lessOrEqualOp:
 		return "<="
+	case inOp:
+		return "in"
 	}
 	return ""
 }
@@ -176,10 +248,38 @@ func (q *query) setError(e error) {
 // is executed. When the query is executed the first error that occurred during
 // the lifetime of the query object (if any) will be returned.
 func (q *query) Order(fieldName string) {
+	fs, orderKind, ok := q.parseOrder("Order", fieldName)
+	if !ok {
+		return
+	}
+	if fs.indexKind == enumIndex {
+		q.setError(fmt.Errorf("zoom: error in Query.Order: cannot order by %s because it has an enum index, which is not sorted", fieldName))
+		return
+	}
+	if fs.indexKind == sparseBoolIndex {
+		q.setError(fmt.Errorf("zoom: error in Query.Order: cannot order by %s because it has a sparse index, which is not sorted", fieldName))
+		return
+	}
+	q.order = order{
+		fieldName: fs.name,
+		redisName: fs.redisName,
+		kind:      orderKind,
+	}
+}
+
+// parseOrder parses fieldName, which may have a "-" prefix for a descending
+// order, for the given order method (i.e. Order or OrderUnindexed). It sets an
+// error on the query and returns false if another order or Unordered has
+// already been applied to the query or the field does not exist.
+func (q *query) parseOrder(method string, fieldName string) (*fieldSpec, orderKind, bool) {
 	if q.hasOrder() {
 		// TODO: allow secondary sort orders?
-		q.setError(errors.New("zoom: error in Query.Order: previous order already specified. Only one order per query is allowed."))
-		return
+		q.setError(fmt.Errorf("zoom: error in Query.%s: previous order already specified. Only one order per query is allowed.", method))
+		return nil, 0, false
+	}
+	if q.unordered {
+		q.setError(fmt.Errorf("zoom: cannot use both %s and Unordered modifiers on a query", method))
+		return nil, 0, false
 	}
 	// Check for the presence of the "-" prefix
 	var orderKind orderKind
@@ -193,15 +293,81 @@ func (q *query) Order(fieldName string) {
 	// Get the redisName for the given fieldName
 	fs, found := q.collection.spec.fieldsByName[fieldName]
 	if !found {
-		err := fmt.Errorf("zoom: error in Query.Order: could not find field %s in type %s", fieldName, q.collection.spec.typ.String())
+		err := fmt.Errorf("zoom: error in Query.%s: could not find field %s in type %s", method, fieldName, q.collection.spec.typ.String())
 		q.setError(err)
+		return nil, 0, false
+	}
+	return fs, orderKind, true
+}
+
+// OrderUnindexed works like Order, but sorts the models by the value of a field
+// which does not need to be indexed. See Query.OrderUnindexed for more
+// information.
+func (q *query) OrderUnindexed(fieldName string) {
+	fs, orderKind, ok := q.parseOrder("OrderUnindexed", fieldName)
+	if !ok {
+		return
+	}
+	alpha, err := fs.unindexedOrderAlpha()
+	if err != nil {
+		q.setError(fmt.Errorf("zoom: error in Query.OrderUnindexed: %s", err.Error()))
 		return
 	}
 	q.order = order{
 		fieldName: fs.name,
 		redisName: fs.redisName,
 		kind:      orderKind,
+		unindexed: true,
+		alpha:     alpha,
+	}
+}
+
+// unindexedOrderAlpha returns true if the values of the field are sorted
+// lexicographically (with the ALPHA option for SORT) by OrderUnindexed, or
+// false if they are sorted numerically. It returns an error if the way the
+// field is stored cannot be sorted by SORT, i.e. if it is not a string, bool,
+// or number (or a pointer to one) or a time with a numeric TimeFormat.
+func (fs *fieldSpec) unindexedOrderAlpha() (bool, error) {
+	if (fs.kind != primativeField && fs.kind != pointerField) || fs.marshaler != noMarshaler || fs.gzip {
+		return false, fmt.Errorf("cannot order by %s because its type (%s) is not a string, bool, or number", fs.name, fs.typ.String())
+	}
+	switch fs.timeFormat {
+	case "":
+	case TimeFormatUnixNano, TimeFormatUnixMilli:
+		return false, nil
+	default:
+		return false, fmt.Errorf("cannot order by %s because its time format (%s) is not numeric", fs.name, fs.timeFormat)
+	}
+	typ := fs.typ
+	if fs.kind == pointerField {
+		typ = typ.Elem()
+	}
+	switch typ.Kind() {
+	case reflect.String:
+		return true, nil
+	case reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return false, nil
+	}
+	return false, fmt.Errorf("cannot order by %s because its type (%s) is not a string, bool, or number", fs.name, fs.typ.String())
+}
+
+// Unordered specifies that the query should not sort the models at all. By
+// default, queries which do not have an Order are sorted by id in ascending
+// lexicographical order so that the results (and in particular the results of
+// Limit and Offset) are consistent between runs. Unordered skips the sorting
+// step, which is slightly faster, but the order of the results is then up to
+// Redis and may change between runs. Unordered will set an error on the query
+// if an order has already been applied to the query. The error, same as any
+// other error that occurs during the lifetime of the query, is not returned
+// until the query is executed.
+func (q *query) Unordered() {
+	if q.hasOrder() {
+		q.setError(errors.New("zoom: cannot use both Order and Unordered modifiers on a query"))
+		return
 	}
+	q.unordered = true
 }
 
 // Limit specifies an upper limit on the number of records to return. If amount
@@ -252,9 +418,13 @@ func (q *query) Exclude(fields ...string) {
 // Filter applies a filter to the query, which will cause the query to only
 // return models with attributes matching the expression. filterString should be
 // an expression which includes a fieldName, a space, and an operator in that
-// order. Operators must be one of "=", "!=", ">", "<", ">=", or "<=". You can
-// only use Filter on fields which are indexed, i.e. those which have the
-// `zoom:"index"` struct tag. If multiple filters are applied to the same query,
+// order. Operators must be one of "=", "!=", ">", "<", ">=", "<=", or "in". You
+// can only use Filter on fields which are indexed, i.e. those which have the
+// `zoom:"index"` struct tag. The "in" operator is only supported on fields with
+// an enum index (i.e. the `zoom:"index,enum"` struct tag) and value must be a
+// slice of the type of the field. It matches models whose value for the field
+// is any of the values in the slice. Conversely, enum indexes only support the
+// "=", "!=", and "in" operators. If multiple filters are applied to the same query,
 // the query will only return models which have matches for ALL of the filters.
 // I.e. applying multiple filters is logically equivalent to combining them with
 // a AND or INTERSECT operator. Filter will set an error on the query if the
@@ -265,6 +435,11 @@ func (q *query) Exclude(fields ...string) {
 // executed the first error that occurred during the lifetime of the query
 // object (if any) will be returned.
 func (q *query) Filter(filterString string, value interface{}) {
+	// If the filter was preceded by Not, it is no longer dangling.
+	negate := q.err == errDanglingNot
+	if negate {
+		q.err = nil
+	}
 	fieldName, operator, err := splitFilterString(filterString)
 	if err != nil {
 		q.setError(err)
@@ -272,41 +447,172 @@ func (q *query) Filter(filterString string, value interface{}) {
 	}
 	// Parse the filter operator
 	filterOp, found := filterOps[operator]
+	if operator == inOp.String() {
+		// The in operator is not one of the filterOps because it does not
+		// compare two single values.
+		filterOp, found = inOp, true
+	}
 	if !found {
-		q.setError(errors.New("zoom: invalid Filter operator in fieldStr. should be one of =, !=, >, <, >=, or <=."))
+		q.setError(fmt.Errorf("zoom: error in Query.Filter: invalid operator %q in filter on %s. Should be one of =, !=, >, <, >=, <=, or in.", operator, fieldName))
 		return
 	}
-	// Get the fieldSpec for the given fieldName
+	// Get the fieldSpec for the given fieldName. If there is no such field,
+	// the name may refer to the model id.
 	fieldSpec, found := q.collection.spec.fieldsByName[fieldName]
 	if !found {
-		err := fmt.Errorf("zoom: error in Query.Order: could not find field %s in type %s", fieldName, q.collection.spec.typ.String())
+		fieldSpec, found = q.collection.spec.idFilterSpec(fieldName)
+	}
+	if !found {
+		err := fmt.Errorf("zoom: error in Query.Filter: could not find field %s in type %s", fieldName, q.collection.spec.typ.String())
 		q.setError(err)
 		return
 	}
 	// Make sure the field is an indexed field
 	if fieldSpec.indexKind == noIndex {
-		err := fmt.Errorf("zoom: filters are only allowed on indexed fields. %s.%s is not indexed. You can index it by adding the `zoom:\"index\"` struct tag.", q.collection.spec.typ.String(), fieldName)
+		err := fmt.Errorf("zoom: error in Query.Filter: filters are only allowed on indexed fields. %s.%s is not indexed. You can index it by adding the `zoom:\"index\"` struct tag.", q.collection.spec.typ.String(), fieldName)
 		q.setError(err)
 		return
 	}
+	switch {
+	case fieldSpec.indexKind == enumIndex && filterOp != equalOp && filterOp != notEqualOp && filterOp != inOp:
+		q.setError(fmt.Errorf("zoom: error in Query.Filter: invalid operator %q in filter on %s. %s.%s has an enum index, which only supports =, !=, and in.", operator, fieldName, q.collection.spec.typ.String(), fieldName))
+		return
+	case fieldSpec.indexKind == sparseBoolIndex && filterOp != equalOp && filterOp != notEqualOp:
+		q.setError(fmt.Errorf("zoom: error in Query.Filter: invalid operator %q in filter on %s. %s.%s has a sparse index, which only supports = and !=.", operator, fieldName, q.collection.spec.typ.String(), fieldName))
+		return
+	case fieldSpec.indexKind != enumIndex && filterOp == inOp:
+		q.setError(fmt.Errorf("zoom: error in Query.Filter: the in operator is only supported on fields with an enum index. You can add one to %s.%s with the `zoom:\"index,enum\"` struct tag.", q.collection.spec.typ.String(), fieldName))
+		return
+	}
 	filter := filter{
 		fieldSpec: fieldSpec,
 		op:        filterOp,
+		negate:    negate,
 	}
 	// Make sure the given value is the correct type
 	if err := filter.checkValType(value); err != nil {
 		q.setError(err)
 		return
 	}
+	if fieldSpec.indexKind == numericIndex {
+		if err := checkExactScore(reflect.ValueOf(value)); err != nil {
+			q.setError(fmt.Errorf("zoom: error in Query.Filter: invalid value for filter on %s: %s", fieldName, err.Error()))
+			return
+		}
+	}
 	filter.value = reflect.ValueOf(value)
 	q.filters = append(q.filters, filter)
 	return
 }
 
+// errDanglingNot is set on a query by Not until it is followed by a call to
+// Filter. That way, a query which ends with Not cannot be executed.
+var errDanglingNot = errors.New("zoom: error in Query.Not: Not must be followed by Filter")
+
+// Not causes the next call to Filter to be negated, i.e. the query will only
+// return models which do not match the filter. Not will set an error on the
+// query if it is not immediately followed by Filter.
+func (q *query) Not() {
+	if q.err == errDanglingNot {
+		q.err = errors.New("zoom: error in Query.Not: Not cannot be followed by another Not")
+		return
+	}
+	q.setError(errDanglingNot)
+}
+
+// UnindexedFilter applies a filter which does not require an index. Instead,
+// the filter is applied by a Lua script which reads the field from the main
+// hash of every model that matches the rest of the query criteria. This is an
+// O(N) operation, so it should only be used when the cost is acceptable (e.g.
+// for administrative searches on small collections) and never on a hot path.
+// filterString should be a field name, a space, and an operator in that order.
+// Currently the only supported operator is "contains", which only returns
+// models where the field contains value as a substring. The field must be a
+// string or a pointer to a string. If the query has a Limit and either an Order
+// or the Unordered modifier, the scan will stop as soon as enough matching
+// models have been found. UnindexedFilter will set an error on the query if the
+// arguments are improperly formatted or if the field is not a string. The
+// error, same as any other error that occurs during the lifetime of the query,
+// is not returned until the query is executed.
+func (q *query) UnindexedFilter(filterString string, value string) {
+	fieldName, operator, err := splitFilterString(filterString)
+	if err != nil {
+		q.setError(err)
+		return
+	}
+	if operator != "contains" {
+		q.setError(fmt.Errorf("zoom: error in Query.UnindexedFilter: invalid operator %q in filter on %s. Should be contains.", operator, fieldName))
+		return
+	}
+	fieldSpec, found := q.collection.spec.fieldsByName[fieldName]
+	if !found {
+		q.setError(fmt.Errorf("zoom: error in Query.UnindexedFilter: could not find field %s in type %s", fieldName, q.collection.spec.typ.String()))
+		return
+	}
+	fieldType := fieldSpec.typ
+	if fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	if fieldType.Kind() != reflect.String || fieldSpec.marshaler != noMarshaler {
+		q.setError(fmt.Errorf("zoom: error in Query.UnindexedFilter: %s.%s is not a string field", q.collection.spec.typ.String(), fieldName))
+		return
+	}
+	if fieldSpec.gzip {
+		q.setError(fmt.Errorf("zoom: error in Query.UnindexedFilter: %s.%s is compressed with gzip", q.collection.spec.typ.String(), fieldName))
+		return
+	}
+	q.unindexedFilters = append(q.unindexedFilters, unindexedFilter{
+		fieldSpec: fieldSpec,
+		substring: value,
+	})
+}
+
+// FilterFunc applies fn to every model which matches the rest of the query
+// criteria after it has been read from the database. Only models for which fn
+// returns true are included in the results. Since the limit and offset of the
+// query are applied after fn, every candidate model must be read from the
+// database. FilterFunc will set an error on the query if fn is nil.
+func (q *query) FilterFunc(fn func(Model) bool) {
+	if fn == nil {
+		q.setError(errors.New("zoom: error in Query.FilterFunc: fn cannot be nil"))
+		return
+	}
+	q.filterFuncs = append(q.filterFuncs, fn)
+}
+
+// Cache causes the results of the query to be cached in Redis for the given
+// ttl. Cache will set an error on the query if ttl is less than one
+// millisecond.
+func (q *query) Cache(ttl time.Duration) {
+	if ttl < time.Millisecond {
+		q.setError(fmt.Errorf("zoom: error in Query.Cache: ttl must be at least 1 millisecond. Got: %s", ttl))
+		return
+	}
+	q.cacheTTL = ttl
+}
+
+// runContext returns the context for a single call to a query finisher. It is
+// derived from parent with the timeout for the query (if any) applied, so
+// every round trip made by the finisher shares the same deadline. If parent is
+// nil, the context from WithContext (or context.Background()) is used. The
+// cancel function must be called when the finisher returns.
+func (q *query) runContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if parent == nil {
+		parent = q.ctx
+	}
+	if parent == nil {
+		parent = context.Background()
+	}
+	if q.timeout > 0 {
+		return context.WithTimeout(parent, q.timeout)
+	}
+	return context.WithCancel(parent)
+}
+
 func splitFilterString(filterString string) (fieldName string, operator string, err error) {
 	tokens := strings.Split(filterString, " ")
 	if len(tokens) != 2 {
-		return "", "", errors.New("zoom: too many spaces in fieldStr argument. should be a field name, a space, and an operator.")
+		return "", "", fmt.Errorf("zoom: error in Query.Filter: invalid filter string %q. Should be a field name, a space, and an operator.", filterString)
 	}
 	return tokens[0], tokens[1], nil
 }
@@ -317,13 +623,32 @@ func (filter filter) checkValType(value interface{}) error {
 	// Here we iterate through pointer indirections. This is so you can
 	// just pass in a primitive instead of a pointer to a primitive for
 	// filtering on fields which have pointer values.
+	if value == nil {
+		return fmt.Errorf("zoom: error in Query.Filter: invalid value for filter on %s. Value cannot be nil.", filter.fieldSpec.name)
+	}
 	valueType := reflect.TypeOf(value)
 	valueVal := reflect.ValueOf(value)
+	if filter.op == inOp {
+		// The value for the in operator is a slice of values, each of which
+		// must have the same type as the field.
+		if valueType.Kind() != reflect.Slice {
+			return fmt.Errorf("zoom: error in Query.Filter: invalid value for filter on %s. Value for the in operator must be a slice but got %T.", filter.fieldSpec.name, value)
+		}
+		valueType = valueType.Elem()
+		fieldType := filter.fieldSpec.typ
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if valueType != fieldType {
+			return fmt.Errorf("zoom: error in Query.Filter: invalid value for filter on %s. Type of value (%T) does not match type of field (%s).", filter.fieldSpec.name, value, fieldType.String())
+		}
+		return nil
+	}
 	for valueType.Kind() == reflect.Ptr {
 		valueType = valueType.Elem()
 		valueVal = valueVal.Elem()
 		if !valueVal.IsValid() {
-			return errors.New("zoom: invalid value for Filter. Is it a nil pointer?")
+			return fmt.Errorf("zoom: error in Query.Filter: invalid value for filter on %s. Value cannot be a nil pointer.", filter.fieldSpec.name)
 		}
 	}
 	// Also dereference the field type to reach the underlying type.
@@ -332,7 +657,7 @@ func (filter filter) checkValType(value interface{}) error {
 		fieldType = fieldType.Elem()
 	}
 	if valueType != fieldType {
-		return fmt.Errorf("zoom: invalid value for Filter on %s. Type of value (%T) does not match type of field (%s).", filter.fieldSpec.name, value, fieldType.String())
+		return fmt.Errorf("zoom: error in Query.Filter: invalid value for filter on %s. Type of value (%T) does not match type of field (%s).", filter.fieldSpec.name, value, fieldType.String())
 	}
 	return nil
 }
@@ -341,14 +666,13 @@ func (filter filter) checkValType(value interface{}) error {
 // which match the query criteria. It may also return some temporary keys which were created
 // during the process of creating the set of ids. Note that tmpKeys may contain idsKey itself,
 // so the temporary keys should not be deleted until after the ids have been read from idsKey.
-func generateIdsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interface{}, err error) {
+// Callers delete them with UNLINK at the end of the same transaction, which runs even if an
+// earlier command in the transaction failed.
+func generateIdsSet(q *query, plan *queryPlan, tx *Transaction) (idsKey string, tmpKeys []interface{}, err error) {
 	idsKey = q.collection.spec.indexKey()
 	tmpKeys = []interface{}{}
-	if q.hasOrder() {
-		fieldIndexKey, err := q.collection.spec.fieldIndexKey(q.order.fieldName)
-		if err != nil {
-			return "", nil, err
-		}
+	if q.hasIndexedOrder() {
+		fieldIndexKey := plan.orderIndexKey
 		fieldSpec := q.collection.spec.fieldsByName[q.order.fieldName]
 		if fieldSpec.indexKind == stringIndex {
 			// If the order is a string field, we need to extract the ids before
@@ -364,104 +688,129 @@ func generateIdsSet(q *query, tx *Transaction) (idsKey string, tmpKeys []interfa
 		}
 	}
 	if q.hasFilters() {
+		// Apply all of the filters in a single script, starting with the ids
+		// key from above.
 		filteredIdsKey := generateRandomKey("tmp:filter:all")
 		tmpKeys = append(tmpKeys, filteredIdsKey)
+		steps := redis.Args{}
 		for i, filter := range q.filters {
-			if i == 0 {
-				// The first time, we should intersect with the ids key from above
-				if err := intersectFilter(q, tx, filter, idsKey, filteredIdsKey); err != nil {
-					return "", tmpKeys, err
-				}
-			} else {
-				// All other times, we should intersect with the filteredIdsKey itself
-				if err := intersectFilter(q, tx, filter, filteredIdsKey, filteredIdsKey); err != nil {
-					return "", tmpKeys, err
-				}
+			step, err := filterStep(filter, plan.filterIndexKeys[i])
+			if err != nil {
+				return "", tmpKeys, err
 			}
+			steps = append(steps, step...)
 		}
+		tx.intersectFilters(idsKey, filteredIdsKey, steps)
 		idsKey = filteredIdsKey
 	}
+	for i, filter := range q.unindexedFilters {
+		destKey := generateRandomKey("tmp:filter:unindexed:" + filter.fieldSpec.redisName)
+		tmpKeys = append(tmpKeys, destKey)
+		// If this is the last step and the ids are scanned in the same order
+		// that they will be returned, we can stop scanning as soon as we have
+		// enough ids to satisfy the limit and offset.
+		maxMatches := uint(0)
+		if i == len(q.unindexedFilters)-1 && q.hasLimit() && !q.sortsById() && !q.order.unindexed && !q.hasFilterFuncs() {
+			maxMatches = q.offset + q.limit
+		}
+		tx.extractIdsBySubstring(idsKey, destKey, q.collection.Name(), filter.fieldSpec.redisName, filter.substring, maxMatches, q.order.kind == descendingOrder)
+		idsKey = destKey
+	}
+	if tx.debug != nil {
+		// Report the size of the final set of ids. The all index is a set but
+		// every other possible idsKey is a sorted set.
+		cardCommand := "ZCARD"
+		if idsKey == q.collection.spec.indexKey() {
+			cardCommand = "SCARD"
+		}
+		tx.Command(cardCommand, redis.Args{idsKey}, func(reply interface{}) error {
+			size, err := redis.Int(reply, nil)
+			if err != nil {
+				return err
+			}
+			tx.debugf("final id set %s contains %d ids", idsKey, size)
+			return nil
+		})
+	}
 	return idsKey, tmpKeys, nil
 }
 
-// intersectFilter adds commands to the query transaction which, when run, will create a
-// temporary set which contains all the ids that fit the given filter criteria. Then it will
-// intersect them with origKey and stores the result in destKey. The function will automatically
-// delete any temporary sets created since, in this case, they are guaranteed to not be needed
-// by any other transaction commands.
-func intersectFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
+// filterStep returns the arguments for the intersect_filters script (see
+// Transaction.intersectFilters) which describe the given filter. fieldIndexKey
+// is the key for the index on the field for the filter.
+func filterStep(filter filter, fieldIndexKey string) (redis.Args, error) {
+	var kind string
+	var stepArgs redis.Args
+	var err error
 	switch filter.fieldSpec.indexKind {
 	case numericIndex:
-		return intersectNumericFilter(q, tx, filter, origKey, destKey)
+		kind, stepArgs = "score", numericFilterRanges(filter)
 	case booleanIndex:
-		return intersectBoolFilter(q, tx, filter, origKey, destKey)
+		kind, stepArgs = "score", boolFilterRanges(filter)
 	case stringIndex:
-		return intersectStringFilter(q, tx, filter, origKey, destKey)
+		kind = "lex"
+		stepArgs, err = stringFilterRanges(filter)
+	case enumIndex:
+		kind, stepArgs, err = enumFilterKeys(filter, fieldIndexKey)
+	case sparseBoolIndex:
+		// The index is used directly as the set of matching ids, and the
+		// filters which match false values are handled by subtracting it.
+		kind, stepArgs = "union", redis.Args{fieldIndexKey}
+	case idIndex:
+		kind, stepArgs = "id", idFilterRemoveRanges(filter)
 	}
-	return nil
+	if err != nil {
+		return nil, err
+	}
+	negate := 0
+	if filter.negate != (filter.fieldSpec.indexKind == sparseBoolIndex && !sparseFilterMatchesTrue(filter)) {
+		negate = 1
+	}
+	args := redis.Args{kind, negate, fieldIndexKey, len(stepArgs)}
+	return append(args, stepArgs...), nil
 }
 
-// intersectNumericFilter adds commands to the query transaction which, when run, will
-// create a temporary set which contains all the ids of models which match the given
-// numeric filter criteria, then intersect those ids with origKey and store the result
-// in destKey.
-func intersectNumericFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
-	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
-	if err != nil {
-		return err
-	}
-	if filter.op == notEqualOp {
-		// Special case for not equal. We need to use two separate commands
-		valueExclusive := fmt.Sprintf("(%v", filter.value.Interface())
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-		// ZADD all ids greater than filter.value
-		tx.ExtractIdsFromFieldIndex(fieldIndexKey, filterKey, valueExclusive, "+inf")
-		// ZADD all ids less than filter.value
-		tx.ExtractIdsFromFieldIndex(fieldIndexKey, filterKey, "-inf", valueExclusive)
-		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
-	} else {
-		var min, max interface{}
-		switch filter.op {
-		case equalOp:
-			min, max = filter.value.Interface(), filter.value.Interface()
-		case lessOp:
-			min = "-inf"
-			// use "(" for exclusive
-			max = fmt.Sprintf("(%v", filter.value.Interface())
-		case greaterOp:
-			min = fmt.Sprintf("(%v", filter.value.Interface())
-			max = "+inf"
-		case lessOrEqualOp:
-			min = "-inf"
-			max = filter.value.Interface()
-		case greaterOrEqualOp:
-			min = filter.value.Interface()
-			max = "+inf"
-		}
-		// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-		tx.ExtractIdsFromFieldIndex(fieldIndexKey, filterKey, min, max)
-		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
+// sparseFilterMatchesTrue returns true if the given filter on a sparse boolean
+// index matches the models with a true value, i.e. the ids in the index. The
+// only operators for sparse indexes are = and !=.
+func sparseFilterMatchesTrue(filter filter) bool {
+	return filter.value.Bool() == (filter.op == equalOp)
+}
+
+// numericFilterRanges returns pairs of min and max scores for ZRANGEBYSCORE
+// which select the ids of models that match the given numeric filter criteria.
+func numericFilterRanges(filter filter) redis.Args {
+	// Use the numeric score of the value instead of the value itself. This way
+	// custom numeric types (e.g. enums which implement fmt.Stringer) are always
+	// formatted as numbers.
+	score := filter.fieldSpec.numericIndexScore(filter.value)
+	switch filter.op {
+	case equalOp:
+		return redis.Args{score, score}
+	case notEqualOp:
+		// Special case for not equal. We need to use two separate ranges, one
+		// for the ids greater than filter.value and one for the ids less than
+		// filter.value.
+		valueExclusive := fmt.Sprintf("(%v", score)
+		return redis.Args{valueExclusive, "+inf", "-inf", valueExclusive}
+	case lessOp:
+		// use "(" for exclusive
+		return redis.Args{"-inf", fmt.Sprintf("(%v", score)}
+	case greaterOp:
+		return redis.Args{fmt.Sprintf("(%v", score), "+inf"}
+	case lessOrEqualOp:
+		return redis.Args{"-inf", score}
+	case greaterOrEqualOp:
+		return redis.Args{score, "+inf"}
 	}
 	return nil
 }
 
-// intersectBoolFilter adds commands to the query transaction which, when run, will
-// create a temporary set which contains all the ids of models which match the given
-// bool filter criteria, then intersect those ids with origKey and store the result
-// in destKey.
-func intersectBoolFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
-	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
-	if err != nil {
-		return err
-	}
-	var min, max interface{}
+// boolFilterRanges returns a min and max score for ZRANGEBYSCORE which select
+// the ids of models that match the given bool filter criteria. False is stored
+// with a score of 0 and true with a score of 1.
+func boolFilterRanges(filter filter) redis.Args {
+	var min, max int
 	switch filter.op {
 	case equalOp:
 		if filter.value.Bool() {
@@ -510,69 +859,89 @@ func intersectBoolFilter(q *query, tx *Transaction, filter filter, origKey strin
 			min, max = 1, 1
 		}
 	}
-	// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-	filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-	tx.ExtractIdsFromFieldIndex(fieldIndexKey, filterKey, min, max)
-	// Intersect filterKey with origKey and store result in destKey
-	tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-	// Delete the temporary key
-	tx.Command("DEL", redis.Args{filterKey}, nil)
-	return nil
+	return redis.Args{min, max}
 }
 
-// intersectStringFilter adds commands to the query transaction which, when run, will
-// create a temporary set which contains all the ids of models which match the given
-// string filter criteria, then intersect those ids with origKey and store the result
-// in destKey.
-func intersectStringFilter(q *query, tx *Transaction, filter filter, origKey string, destKey string) error {
-	fieldIndexKey, err := q.collection.spec.fieldIndexKey(filter.fieldSpec.name)
+// stringFilterRanges returns pairs of min and max for ZRANGEBYLEX which select
+// the members of a string index for models that match the given string filter
+// criteria.
+func stringFilterRanges(filter filter) (redis.Args, error) {
+	valString, err := filter.fieldSpec.stringIndexValue(filter.value)
 	if err != nil {
-		return err
-	}
-	valString := filter.value.String()
-	if filter.op == notEqualOp {
-		// Special case for not equal. We need to use two separate commands
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-		// ZADD all ids greater than filter.value
-		min := "(" + valString + nullString + delString
-		tx.ExtractIdsFromStringIndex(fieldIndexKey, filterKey, min, "+")
-		// ZADD all ids less than filter.value
-		max := "(" + valString
-		tx.ExtractIdsFromStringIndex(fieldIndexKey, filterKey, "-", max)
-		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
-	} else {
-		var min, max string
-		switch filter.op {
-		case equalOp:
-			min = "[" + valString
-			max = "(" + valString + nullString + delString
-		case lessOp:
-			min = "-"
-			max = "(" + valString
-		case greaterOp:
-			min = "(" + valString + nullString + delString
-			max = "+"
-		case lessOrEqualOp:
-			min = "-"
-			max = "(" + valString + nullString + delString
-		case greaterOrEqualOp:
-			min = "[" + valString
-			max = "+"
-		}
-		// Get all the ids that fit the filter criteria and store them in a temporary key caled filterKey
-		filterKey := generateRandomKey("tmp:filter:" + fieldIndexKey)
-		tx.ExtractIdsFromStringIndex(fieldIndexKey, filterKey, min, max)
-		// Intersect filterKey with origKey and store result in destKey
-		tx.Command("ZINTERSTORE", redis.Args{destKey, 2, origKey, filterKey, "WEIGHTS", 1, 0}, nil)
-		// Delete the temporary key
-		tx.Command("DEL", redis.Args{filterKey}, nil)
+		return nil, err
+	}
+	switch filter.op {
+	case equalOp:
+		return redis.Args{"[" + valString, "(" + valString + nullString + delString}, nil
+	case notEqualOp:
+		// Special case for not equal. We need to use two separate ranges, one
+		// for the ids greater than filter.value and one for the ids less than
+		// filter.value.
+		return redis.Args{"(" + valString + nullString + delString, "+", "-", "(" + valString}, nil
+	case lessOp:
+		return redis.Args{"-", "(" + valString}, nil
+	case greaterOp:
+		return redis.Args{"(" + valString + nullString + delString, "+"}, nil
+	case lessOrEqualOp:
+		return redis.Args{"-", "(" + valString + nullString + delString}, nil
+	case greaterOrEqualOp:
+		return redis.Args{"[" + valString, "+"}, nil
+	}
+	return nil, nil
+}
+
+// idFilterRemoveRanges returns pairs of min and max for ZREMRANGEBYLEX which
+// remove the ids that do not match the given id filter criteria. The ids are
+// copied into a sorted set with a score of 0, so they are ordered
+// lexicographically.
+func idFilterRemoveRanges(filter filter) redis.Args {
+	value := filter.value.String()
+	switch filter.op {
+	case equalOp:
+		return redis.Args{"-", "(" + value, "(" + value, "+"}
+	case notEqualOp:
+		return redis.Args{"[" + value, "[" + value}
+	case lessOp:
+		return redis.Args{"[" + value, "+"}
+	case greaterOp:
+		return redis.Args{"-", "[" + value}
+	case lessOrEqualOp:
+		return redis.Args{"(" + value, "+"}
+	case greaterOrEqualOp:
+		return redis.Args{"-", "(" + value}
 	}
 	return nil
 }
 
+// enumFilterKeys returns the kind of filter step and the keys of the enum
+// buckets which select the ids of models that match the given enum filter
+// criteria. For "=" the set for the value is used directly. For "in" the sets
+// for the values are combined, and if there are no values no models match. For
+// "!=" the set for the value is subtracted from the set of all models in the
+// index, so models without a value never match.
+func enumFilterKeys(filter filter, fieldIndexKey string) (string, redis.Args, error) {
+	kind := "union"
+	values := []reflect.Value{filter.value}
+	switch filter.op {
+	case notEqualOp:
+		kind = "diff"
+	case inOp:
+		values = make([]reflect.Value, filter.value.Len())
+		for i := range values {
+			values[i] = filter.value.Index(i)
+		}
+	}
+	bucketKeys := redis.Args{}
+	for _, val := range values {
+		value, err := filter.fieldSpec.stringIndexValue(val)
+		if err != nil {
+			return "", nil, err
+		}
+		bucketKeys = append(bucketKeys, enumBucketKey(fieldIndexKey, value))
+	}
+	return kind, bucketKeys, nil
+}
+
 // fieldNames parses the includes and excludes properties to return a list of
 // field names which should be included in all find operations. If there are no
 // includes or excludes, it returns all the field names.
@@ -603,6 +972,99 @@ func (q *query) redisFieldNames() []string {
 	return redisNames
 }
 
+// checksum returns a checksum which uniquely identifies the query based on its
+// string representation. It is used to build keys for cached query results.
+func (q *query) checksum() string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(q.String())))
+}
+
+// sortArgs returns the arguments for a SORT command which will get the fields
+// in getArgs (as returned by modelSpec.sortGetArgs) for all the models with ids
+// in idsKey, while respecting the order, limit, and offset of the query. If the
+// query has no order and was not marked as unordered, the ids will be sorted
+// lexicographically.
+func (q *query) sortArgs(idsKey string, getArgs redis.Args, limit int) redis.Args {
+	if q.sortsById() {
+		return q.collection.spec.sortByIdArgsWithGets(idsKey, getArgs, limit, q.offset)
+	}
+	if q.order.unindexed {
+		return q.collection.spec.sortByFieldArgsWithGets(idsKey, getArgs, limit, q.offset, q.order)
+	}
+	return q.collection.spec.sortArgsWithGets(idsKey, getArgs, limit, q.offset, q.order.kind == descendingOrder)
+}
+
+// unlimitedSortArgs works like sortArgs but ignores the limit and offset of the
+// query, so that every model with an id in idsKey is included.
+func (q *query) unlimitedSortArgs(idsKey string, getArgs redis.Args) redis.Args {
+	if q.sortsById() {
+		return q.collection.spec.sortByIdArgsWithGets(idsKey, getArgs, 0, 0)
+	}
+	if q.order.unindexed {
+		return q.collection.spec.sortByFieldArgsWithGets(idsKey, getArgs, 0, 0, q.order)
+	}
+	return q.collection.spec.sortArgsWithGets(idsKey, getArgs, 0, 0, q.order.kind == descendingOrder)
+}
+
+// newFilterFuncsHandler returns a ReplyHandler which scans every model in the
+// reply (which should be the reply from a SORT command with unlimitedSortArgs)
+// into a new slice, removes the models which do not pass all of the filterFuncs
+// for the query, and then applies the limit and offset. Finally it calls done
+// with the remaining models, which is a slice of the registered model type. If
+// scanErrs is not nil, models which cannot be scanned are skipped and their
+// errors are appended to scanErrs.
+func (q *query) newFilterFuncsHandler(fieldNames []string, scanErrs *[]ScanError, done func(matches reflect.Value) error) ReplyHandler {
+	spec := q.collection.spec
+	return func(reply interface{}) error {
+		candidates := reflect.New(reflect.SliceOf(spec.typ))
+		if err := newPartialScanModelsHandler(spec, fieldNames, candidates.Interface(), scanErrs)(reply); err != nil {
+			return err
+		}
+		matches := reflect.MakeSlice(reflect.SliceOf(spec.typ), 0, 0)
+		skipped := uint(0)
+		for i := 0; i < candidates.Elem().Len(); i++ {
+			if q.hasLimit() && uint(matches.Len()) == q.limit {
+				break
+			}
+			modelVal := candidates.Elem().Index(i)
+			if !q.matchesFilterFuncs(modelVal.Interface().(Model)) {
+				continue
+			}
+			if skipped < q.offset {
+				skipped++
+				continue
+			}
+			matches = reflect.Append(matches, modelVal)
+		}
+		return done(matches)
+	}
+}
+
+// setModelsVal sets modelsVal, which must be a slice of the registered model
+// type or of the structs it points to, to the models in matches, which must be
+// a slice of the registered model type.
+func setModelsVal(modelsVal reflect.Value, matches reflect.Value) {
+	if modelsVal.Type() == matches.Type() {
+		modelsVal.Set(matches)
+		return
+	}
+	values := reflect.MakeSlice(modelsVal.Type(), matches.Len(), matches.Len())
+	for i := 0; i < matches.Len(); i++ {
+		values.Index(i).Set(matches.Index(i).Elem())
+	}
+	modelsVal.Set(values)
+}
+
+// matchesFilterFuncs returns true iff every one of the filterFuncs for the
+// query returns true for model.
+func (q *query) matchesFilterFuncs(model Model) bool {
+	for _, fn := range q.filterFuncs {
+		if !fn(model) {
+			return false
+		}
+	}
+	return true
+}
+
 // converts limit and offset to start and stop values for cases where redis
 // requires them. NOTE start cannot be negative, but stop can be
 func (q *query) getStartStop() (start int, stop int) {
@@ -618,10 +1080,28 @@ func (q *query) hasFilters() bool {
 	return len(q.filters) > 0
 }
 
+func (q *query) hasUnindexedFilters() bool {
+	return len(q.unindexedFilters) > 0
+}
+
+func (q *query) hasFilterFuncs() bool {
+	return len(q.filterFuncs) > 0
+}
+
 func (q *query) hasOrder() bool {
 	return q.order.fieldName != ""
 }
 
+// hasIndexedOrder returns true if the query has an order which uses an index,
+// i.e. one which was specified with Order instead of OrderUnindexed.
+func (q *query) hasIndexedOrder() bool {
+	return q.hasOrder() && !q.order.unindexed
+}
+
+func (q *query) sortsById() bool {
+	return !q.hasOrder() && !q.unordered
+}
+
 func (q *query) hasLimit() bool {
 	return q.limit != 0
 }
@@ -644,7 +1124,9 @@ func (q *query) hasError() bool {
 
 // generateRandomKey generates a random string that is more or less
 // guaranteed to be unique and then prepends the given prefix. It is
-// used to generate keys for temporary sorted sets in queries.
+// used to generate keys for temporary sorted sets in queries. Since the suffix
+// is different every time (see generateRandomId), two identical queries which
+// run at the same time never share a temporary key.
 func generateRandomKey(prefix string) string {
 	return prefix + ":" + generateRandomId()
 }
@@ -0,0 +1,184 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File list.go contains code related to list fields, i.e. fields with the
+// `zoom:"list"` struct tag, which are stored in separate Redis lists instead of
+// the main hash for the model.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Append adds value to the front of the list field identified by fieldName
+// for the model with the given id. fieldName should be the name of a field
+// with the `zoom:"list"` struct tag, and the type of value must be the same as
+// the type of the elements of the field. If the field has the "maxlen=<n>"
+// option, the oldest values are removed so that the list contains at most n
+// values. Adding the value and trimming the list happen atomically, in the same
+// transaction. List fields are only written by Append (Save and SaveFields
+// ignore them) and the newest value is always first when the list is read by
+// Find. Append does not check whether the model exists.
+func (c *Collection) Append(id string, fieldName string, value interface{}) error {
+	t := c.pool.NewTransaction()
+	t.Append(c, id, fieldName, value)
+	if err := t.Exec(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Append adds value to the front of the list field identified by fieldName
+// for the model with the given id in an existing transaction. See
+// Collection.Append for more information. Any errors encountered will be added
+// to the transaction and returned as an error when the transaction is
+// executed.
+func (t *Transaction) Append(c *Collection, id string, fieldName string, value interface{}) {
+	if c == nil {
+		t.setError(newNilCollectionError("Append"))
+		return
+	}
+	fs, found := c.spec.listField(fieldName)
+	if !found {
+		t.setError(fmt.Errorf("zoom: Error in Append or Transaction.Append: Collection %s does not have a list field named %s", c.Name(), fieldName))
+		return
+	}
+	encoded, err := encodeListElem(fs, value)
+	if err != nil {
+		t.setError(fmt.Errorf("zoom: Error in Append or Transaction.Append: %s", err.Error()))
+		return
+	}
+	key := c.spec.listKey(id, fs)
+	t.Command("LPUSH", redis.Args{key, encoded}, nil)
+	if fs.listMaxLen > 0 {
+		t.Command("LTRIM", redis.Args{key, 0, fs.listMaxLen - 1}, nil)
+	}
+}
+
+// RemoveFromList removes elements equal to value from the list field
+// identified by fieldName for the model with the given id and returns the
+// number of elements that were removed. It uses the LREM command, so the count
+// argument determines which elements are removed when value appears more than
+// once: if count is greater than 0, up to count elements are removed starting
+// with the newest (i.e. the front of the list); if count is less than 0, up to
+// -count elements are removed starting with the oldest; and if count is 0,
+// every element equal to value is removed. fieldName should be the name of a
+// field with the `zoom:"list"` struct tag, and the type of value must be the
+// same as the type of the elements of the field. Like Append, RemoveFromList
+// does not check whether the model exists.
+func (c *Collection) RemoveFromList(id string, fieldName string, value interface{}, count int) (int, error) {
+	t := c.pool.NewTransaction()
+	removed := 0
+	t.RemoveFromList(c, id, fieldName, value, count, &removed)
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// RemoveFromList removes elements equal to value from the list field
+// identified by fieldName for the model with the given id in an existing
+// transaction. If removed is not nil, it will be set to the number of elements
+// that were removed when the transaction is executed. See
+// Collection.RemoveFromList for more information. Any errors encountered will
+// be added to the transaction and returned as an error when the transaction is
+// executed.
+func (t *Transaction) RemoveFromList(c *Collection, id string, fieldName string, value interface{}, count int, removed *int) {
+	if c == nil {
+		t.setError(newNilCollectionError("RemoveFromList"))
+		return
+	}
+	fs, found := c.spec.listField(fieldName)
+	if !found {
+		t.setError(fmt.Errorf("zoom: Error in RemoveFromList or Transaction.RemoveFromList: Collection %s does not have a list field named %s", c.Name(), fieldName))
+		return
+	}
+	encoded, err := encodeListElem(fs, value)
+	if err != nil {
+		t.setError(fmt.Errorf("zoom: Error in RemoveFromList or Transaction.RemoveFromList: %s", err.Error()))
+		return
+	}
+	var handler ReplyHandler
+	if removed != nil {
+		handler = NewScanIntHandler(removed)
+	}
+	t.Command("LREM", redis.Args{c.spec.listKey(id, fs), count, encoded}, handler)
+}
+
+// encodeListElem checks that value has the same type as the elements of the
+// list field identified by fs and converts it to a value which can be passed
+// to Redis. The value is converted to its underlying kind first so that named
+// types (e.g. time.Duration) are stored as plain numbers or strings.
+func encodeListElem(fs *fieldSpec, value interface{}) (interface{}, error) {
+	elemType := fs.typ.Elem()
+	val := reflect.ValueOf(value)
+	if !val.IsValid() || val.Type() != elemType {
+		return nil, fmt.Errorf("invalid value for list field %s. Expected %s but got %T", fs.name, elemType.String(), value)
+	}
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return val.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return val.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), nil
+	case reflect.Bool:
+		return val.Bool(), nil
+	default:
+		return val.String(), nil
+	}
+}
+
+// findListFields adds commands to the transaction for reading all of the list
+// fields for the model referenced by mr and scanning them into the model. If
+// exists is not nil, the lists are only scanned if it points to true by the
+// time the replies are handled.
+func (t *Transaction) findListFields(mr *modelRef, exists *bool) {
+	for _, fs := range mr.spec.lists {
+		scanList := newScanListHandler(fs.name, mr.fieldValue(fs.name))
+		t.Command("LRANGE", redis.Args{mr.spec.listKey(mr.model.ModelId(), fs), 0, -1}, func(reply interface{}) error {
+			if exists != nil && !*exists {
+				return nil
+			}
+			return scanList(reply)
+		})
+	}
+}
+
+// newScanListHandler returns a ReplyHandler which scans the reply from an
+// LRANGE command into dest, which must be a slice of strings, numbers, or
+// bools. An empty list is scanned as a nil slice. fieldName is the name of the
+// list field, which is included in any errors.
+func newScanListHandler(fieldName string, dest reflect.Value) ReplyHandler {
+	return func(reply interface{}) error {
+		values, err := redis.ByteSlices(reply, nil)
+		if err != nil {
+			return err
+		}
+		if len(values) == 0 {
+			dest.Set(reflect.Zero(dest.Type()))
+			return nil
+		}
+		list := reflect.MakeSlice(dest.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := scanPrimativeVal(value, list.Index(i)); err != nil {
+				return fmt.Errorf("zoom: could not scan element %d of list field %s: %s", i, fieldName, err.Error())
+			}
+		}
+		dest.Set(list)
+		return nil
+	}
+}
+
+// deleteListFields adds a command to the transaction for deleting all of the
+// list fields for the model with the given id.
+func (t *Transaction) deleteListFields(c *Collection, id string) {
+	if keys := c.spec.listKeys(id); len(keys) > 0 {
+		t.Command("DEL", redis.Args{}.AddFlat(keys), nil)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File list_test.go tests list fields (list.go).
+
+package zoom
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListField(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type activityModel struct {
+		Name     string
+		Recent   []string        `zoom:"list,maxlen=3"`
+		Scores   []int           `zoom:"list" redis:"scores"`
+		Timeouts []time.Duration `zoom:"list"`
+		RandomId
+	}
+	activities, err := testPool.NewCollectionWithOptions(&activityModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+	model := &activityModel{Name: "bob", Recent: []string{"ignored"}}
+	if err := activities.Save(model); err != nil {
+		t.Fatal(err)
+	}
+
+	// Save should not store the list field in the main hash or in the list.
+	expectFieldEquals(t, activities.ModelKey(model.ModelId()), "Recent", activities.spec.fallback, nil)
+	expectKeyDoesNotExist(t, activities.spec.listKey(model.ModelId(), activities.spec.lists[0]))
+	got := &activityModel{}
+	if err := activities.Find(model.ModelId(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.Recent != nil {
+		t.Errorf("Expected Recent to be nil but got %v", got.Recent)
+	}
+
+	// Append should add values to the front of the list and cap its length.
+	for _, value := range []string{"a", "b", "c", "d"} {
+		if err := activities.Append(model.ModelId(), "Recent", value); err != nil {
+			t.Fatalf("Unexpected error in Append: %s", err.Error())
+		}
+	}
+	tx := testPool.NewTransaction()
+	tx.Append(activities, model.ModelId(), "Scores", 1)
+	tx.Append(activities, model.ModelId(), "Scores", 2)
+	tx.Append(activities, model.ModelId(), "Timeouts", 3*time.Second)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Transaction.Append: %s", err.Error())
+	}
+	got = &activityModel{Recent: []string{"old"}}
+	if err := activities.Find(model.ModelId(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	expected := &activityModel{
+		Name:     "bob",
+		Recent:   []string{"d", "c", "b"},
+		Scores:   []int{2, 1},
+		Timeouts: []time.Duration{3 * time.Second},
+		RandomId: model.RandomId,
+	}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Found model was incorrect.\nExpected: %+v\nGot:      %+v", expected, got)
+	}
+
+	// A value of the wrong type or a field which is not a list should cause an
+	// error.
+	if err := activities.Append(model.ModelId(), "Scores", "foo"); err == nil {
+		t.Error("Expected an error for a value of the wrong type but got none")
+	}
+	if err := activities.Append(model.ModelId(), "Name", "foo"); err == nil {
+		t.Error("Expected an error for a field which is not a list but got none")
+	}
+
+	// Deleting the model should delete its lists.
+	if _, err := activities.Delete(model.ModelId()); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range activities.spec.listKeys(model.ModelId()) {
+		expectKeyDoesNotExist(t, key)
+	}
+	other := &activityModel{Name: "alice"}
+	if err := activities.Save(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := activities.Append(other.ModelId(), "Recent", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := activities.DeleteAll(); err != nil {
+		t.Fatal(err)
+	}
+	expectKeyDoesNotExist(t, activities.spec.listKey(other.ModelId(), activities.spec.lists[0]))
+}
+
+func TestRemoveFromList(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type tagsModel struct {
+		Name   string
+		Tags   []string  `zoom:"list"`
+		Scores []float64 `zoom:"list"`
+		RandomId
+	}
+	tags, err := testPool.NewCollectionWithOptions(&tagsModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+	model := &tagsModel{Name: "bob"}
+	if err := tags.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	// The list is read newest first, so this results in a, b, a, c, a, b.
+	tx := testPool.NewTransaction()
+	for _, value := range []string{"b", "a", "c", "a", "b", "a"} {
+		tx.Append(tags, model.ModelId(), "Tags", value)
+	}
+	tx.Append(tags, model.ModelId(), "Scores", 1.5)
+	tx.Append(tags, model.ModelId(), "Scores", 2.25)
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Transaction.Append: %s", err.Error())
+	}
+
+	testCases := []struct {
+		value           string
+		count           int
+		expectedRemoved int
+		expectedTags    []string
+	}{
+		{value: "a", count: 1, expectedRemoved: 1, expectedTags: []string{"b", "a", "c", "a", "b"}},
+		{value: "b", count: -1, expectedRemoved: 1, expectedTags: []string{"b", "a", "c", "a"}},
+		{value: "a", count: 0, expectedRemoved: 2, expectedTags: []string{"b", "c"}},
+		{value: "missing", count: 0, expectedRemoved: 0, expectedTags: []string{"b", "c"}},
+	}
+	for _, tc := range testCases {
+		removed, err := tags.RemoveFromList(model.ModelId(), "Tags", tc.value, tc.count)
+		if err != nil {
+			t.Fatalf("Unexpected error in RemoveFromList: %s", err.Error())
+		}
+		if removed != tc.expectedRemoved {
+			t.Errorf("Expected RemoveFromList(%q, %d) to remove %d elements but got %d", tc.value, tc.count, tc.expectedRemoved, removed)
+		}
+		got := &tagsModel{}
+		if err := tags.Find(model.ModelId(), got); err != nil {
+			t.Fatalf("Unexpected error in Find: %s", err.Error())
+		}
+		if !reflect.DeepEqual(tc.expectedTags, got.Tags) {
+			t.Errorf("Wrong list after RemoveFromList(%q, %d).\nExpected: %v\nGot:      %v", tc.value, tc.count, tc.expectedTags, got.Tags)
+		}
+	}
+
+	// Numbers should be encoded the same way as in Append.
+	if removed, err := tags.RemoveFromList(model.ModelId(), "Scores", 2.25, 0); err != nil {
+		t.Fatalf("Unexpected error in RemoveFromList: %s", err.Error())
+	} else if removed != 1 {
+		t.Errorf("Expected RemoveFromList to remove 1 element but got %d", removed)
+	}
+
+	// A value of the wrong type or a field which is not a list should cause an
+	// error.
+	if _, err := tags.RemoveFromList(model.ModelId(), "Tags", 1, 0); err == nil {
+		t.Error("Expected an error for a value of the wrong type but got none")
+	}
+	if _, err := tags.RemoveFromList(model.ModelId(), "Id", "foo", 0); err == nil {
+		t.Error("Expected an error for a field which is not a list but got none")
+	}
+}
+
+func TestListFieldInvalidTags(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type indexedListModel struct {
+		Values []string `zoom:"list,index"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&indexedListModel{}); err == nil {
+		t.Error("Expected an error for an indexed list field but got none")
+	}
+	type structListModel struct {
+		Values []struct{ A int } `zoom:"list"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&structListModel{}); err == nil {
+		t.Error("Expected an error for a list of structs but got none")
+	}
+	type maxLenModel struct {
+		Values []string `zoom:"maxlen=3"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&maxLenModel{}); err == nil {
+		t.Error("Expected an error for maxlen without list but got none")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File load.go contains code for using a collection as a read-through cache
+// (see Collection.FindOrLoad).
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// loadLockTimeout is the time to live for the lock which FindOrLoad holds
+	// while the loader is running. If the client holding the lock dies, other
+	// clients can load the model after the lock expires.
+	loadLockTimeout = 10 * time.Second
+	// loadPollInterval is how long FindOrLoad waits before checking for the
+	// model again while another client holds the lock.
+	loadPollInterval = 20 * time.Millisecond
+)
+
+// FindOrLoad finds the model with the given id and scans the values into
+// model, like Find. If the model does not exist, FindOrLoad calls loader to
+// fetch it from the source of truth (e.g. another database), saves the result
+// with the given time to live (see Touch), and copies it into model. This lets
+// you use the collection as a read-through cache. The loader must return a
+// model of the registered type for the collection. Its id is set to id before
+// it is saved. If ttl is 0, the loaded model does not expire.
+//
+// To protect the source of truth from a thundering herd when many clients miss
+// the same model at once, only one client calls the loader at a time. Before
+// calling the loader, FindOrLoad acquires a lock for the id with SET NX, which
+// expires after 10 seconds in case the client dies. Other clients poll for the
+// model every 20 milliseconds until the lock is released, so they read the
+// model saved by the first client instead of calling the loader themselves. If
+// the loader takes longer than the lock timeout, another client may call it
+// too. The lock is always released once the loader returns, so if the loader
+// fails, another waiting client calls its own loader.
+//
+// If the loader returns an error, FindOrLoad returns it unchanged and nothing
+// is saved. If the loader returns a nil model and a nil error, FindOrLoad
+// returns a ModelNotFoundError. As with Touch, Redis does not remove the id of
+// an expired model from the collection index or from any field indexes.
+func (c *Collection) FindOrLoad(id string, model Model, loader func(id string) (Model, error), ttl time.Duration) error {
+	if c == nil {
+		return newNilCollectionError("FindOrLoad")
+	}
+	if loader == nil {
+		return fmt.Errorf("zoom: Error in FindOrLoad: loader cannot be nil")
+	}
+	if ttl != 0 && ttl < time.Millisecond {
+		return fmt.Errorf("zoom: Error in FindOrLoad: ttl must be 0 or at least one millisecond but got %s", ttl)
+	}
+	if err := c.checkModelType(model); err != nil {
+		return fmt.Errorf("zoom: Error in FindOrLoad: %s", err.Error())
+	}
+	lockKey := c.loadLockKey(id)
+	token := generateRandomId()
+	for {
+		if found, err := c.FindOrZero(id, model); err != nil || found {
+			return err
+		}
+		acquired := false
+		t := c.pool.NewTransaction()
+		t.Command("SET", redis.Args{lockKey, token, "NX", "PX", int64(loadLockTimeout / time.Millisecond)}, func(reply interface{}) error {
+			acquired = reply != nil
+			return nil
+		})
+		if err := t.Exec(); err != nil {
+			return err
+		}
+		if acquired {
+			return c.loadWithLock(id, model, loader, ttl, lockKey, token)
+		}
+		time.Sleep(loadPollInterval)
+	}
+}
+
+// loadWithLock calls loader and saves the model it returns for FindOrLoad.
+// The caller must hold the lock at lockKey with the given token, which is
+// released before loadWithLock returns.
+func (c *Collection) loadWithLock(id string, model Model, loader func(id string) (Model, error), ttl time.Duration, lockKey string, token string) (err error) {
+	defer func() {
+		t := c.pool.NewTransaction()
+		t.Script(releaseLockScript, redis.Args{lockKey, token}, nil)
+		if releaseErr := t.Exec(); releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+	}()
+	// Another client may have saved the model after we last checked and
+	// released the lock before we acquired it.
+	if found, err := c.FindOrZero(id, model); err != nil || found {
+		return err
+	}
+	loaded, err := loader(id)
+	if err != nil {
+		return err
+	}
+	if loaded == nil {
+		return c.newLoaderNotFoundError(id)
+	}
+	if err := c.checkModelType(loaded); err != nil {
+		return fmt.Errorf("zoom: Error in FindOrLoad: loader returned the wrong type: %s", err.Error())
+	}
+	if reflect.ValueOf(loaded).IsNil() {
+		return c.newLoaderNotFoundError(id)
+	}
+	loaded.SetModelId(id)
+	t := c.pool.NewTransaction()
+	t.Save(c, loaded)
+	if ttl != 0 {
+		t.Touch(c, id, ttl)
+	}
+	if err := t.Exec(); err != nil {
+		return err
+	}
+	reflect.ValueOf(model).Elem().Set(reflect.ValueOf(loaded).Elem())
+	return nil
+}
+
+// newLoaderNotFoundError returns a ModelNotFoundError for FindOrLoad when the
+// loader did not return a model.
+func (c *Collection) newLoaderNotFoundError(id string) error {
+	msg := fmt.Sprintf("Could not find %s with id = %s (the loader returned nil)", c.Name(), id)
+	return ModelNotFoundError{Collection: c, Msg: msg}
+}
+
+// loadLockKey returns the key for the lock which FindOrLoad holds while it
+// loads the model with the given id.
+func (c *Collection) loadLockKey(id string) string {
+	return "lock:" + c.Name() + ":" + id
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File load_test.go tests the code for using a collection as a read-through
+// cache (load.go).
+
+package zoom
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestFindOrLoad(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	var calls int32
+	loader := func(id string) (Model, error) {
+		atomic.AddInt32(&calls, 1)
+		// Sleep so that concurrent calls to FindOrLoad overlap.
+		time.Sleep(50 * time.Millisecond)
+		return &testModel{Int: 42, String: "loaded", Bool: true}, nil
+	}
+	expected := &testModel{Int: 42, String: "loaded", Bool: true}
+	expected.Id = "loadId"
+
+	// Many concurrent misses for the same id should only call the loader once.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got := &testModel{}
+			if err := testModels.FindOrLoad("loadId", got, loader, time.Minute); err != nil {
+				errs <- err
+				return
+			}
+			if !reflect.DeepEqual(expected, got) {
+				t.Errorf("Expected FindOrLoad to return %v but got %v", expected, got)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Unexpected error in FindOrLoad: %s", err.Error())
+	}
+	if calls != 1 {
+		t.Errorf("Expected the loader to be called once but it was called %d times", calls)
+	}
+	expectModelExists(t, testModels, expected)
+	expectKeyDoesNotExist(t, testModels.loadLockKey("loadId"))
+	conn := testPool.NewConn()
+	defer conn.Close()
+	if ttl, err := redis.Int64(conn.Do("PTTL", testModels.ModelKey("loadId"))); err != nil {
+		t.Fatalf("Unexpected error in PTTL: %s", err.Error())
+	} else if ttl <= 0 || ttl > int64(time.Minute/time.Millisecond) {
+		t.Errorf("Expected the loaded model to expire within a minute but got a ttl of %d ms", ttl)
+	}
+
+	// A model which exists should not be loaded.
+	got := &testModel{}
+	if err := testModels.FindOrLoad("loadId", got, loader, 0); err != nil {
+		t.Errorf("Unexpected error in FindOrLoad: %s", err.Error())
+	} else if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected FindOrLoad to return %v but got %v", expected, got)
+	}
+	if calls != 1 {
+		t.Errorf("Expected the loader not to be called for an existing model but it was called %d times", calls)
+	}
+
+	// Errors from the loader should be returned unchanged, and the lock should
+	// be released.
+	errLoad := errors.New("source of truth is down")
+	failing := func(id string) (Model, error) {
+		return nil, errLoad
+	}
+	if err := testModels.FindOrLoad("failId", &testModel{}, failing, 0); err != errLoad {
+		t.Errorf("Expected the error from the loader but got %v", err)
+	}
+	expectKeyDoesNotExist(t, testModels.ModelKey("failId"))
+	expectKeyDoesNotExist(t, testModels.loadLockKey("failId"))
+
+	// A nil model from the loader means the model does not exist.
+	missing := func(id string) (Model, error) {
+		return (*testModel)(nil), nil
+	}
+	if err := testModels.FindOrLoad("missingId", &testModel{}, missing, 0); err == nil {
+		t.Error("Expected an error when the loader returns nil but got none")
+	} else if !errors.Is(err, ErrModelNotFound) {
+		t.Errorf("Expected a ModelNotFoundError but got: %T: %s", err, err.Error())
+	}
+
+	// The loader must return the registered type.
+	wrongType := func(id string) (Model, error) {
+		return &indexedTestModel{}, nil
+	}
+	if err := testModels.FindOrLoad("wrongId", &testModel{}, wrongType, 0); err == nil {
+		t.Error("Expected an error when the loader returns the wrong type but got none")
+	}
+	expectKeyDoesNotExist(t, testModels.ModelKey("wrongId"))
+}
@@ -10,8 +10,12 @@ package zoom
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/gob"
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
 )
 
 // MarshalerUnmarshaler defines a handler for marshaling
@@ -80,3 +84,50 @@ func (jsonMarshalerUnmarshaler) Marshal(v interface{}) ([]byte, error) {
 func (jsonMarshalerUnmarshaler) Unmarshal(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
+
+// gzipValue compresses value, which should be the encoded value of a field
+// with the `zoom:"gzip"` struct tag, with gzip. value must be a string, a byte
+// slice, or a type whose underlying type is one of those.
+func gzipValue(value interface{}) ([]byte, error) {
+	var src []byte
+	switch val := reflect.ValueOf(value); val.Kind() {
+	case reflect.String:
+		src = []byte(val.String())
+	case reflect.Slice:
+		src = val.Bytes()
+	default:
+		return nil, fmt.Errorf("zoom: cannot compress value of type %T with gzip", value)
+	}
+	var buff bytes.Buffer
+	w := gzip.NewWriter(&buff)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// gzipHeader is the magic number at the start of all gzip-compressed data.
+var gzipHeader = []byte{0x1f, 0x8b}
+
+// gunzipValue decompresses data that was compressed with gzipValue. If data
+// does not start with the gzip header, it is returned as is. That way, values
+// which were stored before the `zoom:"gzip"` struct tag was added to a field
+// can still be read.
+func gunzipValue(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, gzipHeader) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("zoom: could not decompress gzip value: %s", err.Error())
+	}
+	defer r.Close()
+	result, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("zoom: could not decompress gzip value: %s", err.Error())
+	}
+	return result, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File memory_usage.go contains code for reading the amount of memory used by
+// the models in a collection and by the set of their ids.
+
+package zoom
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// memoryUsageSamples is the number of random models which are sampled by
+// ApproxMemoryUsage.
+const memoryUsageSamples = 100
+
+// MemoryUsage returns the number of bytes of memory that Redis uses to store
+// the model with the given id, as reported by the MEMORY USAGE command. It
+// includes the main hash for the model and any list fields, but not the
+// entries for the model in the indexes for the collection, which are shared
+// with every other model. It returns a ModelNotFoundError if the model does not
+// exist. MemoryUsage requires Redis version 4.0 or higher.
+func (c *Collection) MemoryUsage(id string) (int64, error) {
+	t := c.pool.NewTransaction()
+	var usage int64
+	t.MemoryUsage(c, id, &usage)
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	return usage, nil
+}
+
+// MemoryUsage reads the number of bytes of memory used by the model with the
+// given id in an existing transaction. When the transaction is executed, usage
+// will be set to the number of bytes. See Collection.MemoryUsage for more
+// information. Any errors encountered will be added to the transaction and
+// returned as an error when the transaction is executed.
+func (t *Transaction) MemoryUsage(c *Collection, id string, usage *int64) {
+	if c == nil {
+		t.setError(newNilCollectionError("MemoryUsage"))
+		return
+	}
+	if usage == nil {
+		t.setError(fmt.Errorf("zoom: Error in MemoryUsage or Transaction.MemoryUsage: usage cannot be nil"))
+		return
+	}
+	(*usage) = 0
+	t.Command("MEMORY", redis.Args{"USAGE", c.ModelKey(id)}, func(reply interface{}) error {
+		if reply == nil {
+			msg := fmt.Sprintf("Could not find %s with id = %s", c.Name(), id)
+			return ModelNotFoundError{Collection: c, Msg: msg}
+		}
+		return addMemoryUsage(reply, usage)
+	})
+	t.listMemoryUsage(c, id, usage)
+}
+
+// ApproxMemoryUsage returns an estimate of the total number of bytes of memory
+// that Redis uses to store all the models in the collection. It reads the
+// memory usage (see MemoryUsage) of up to 100 random models and multiplies the
+// average by the number of models in the collection, so it is fast even for
+// very large collections but can be inaccurate if the sizes of the models vary
+// widely. Like MemoryUsage, the estimate does not include the indexes for the
+// collection. ApproxMemoryUsage only works for indexed collections and
+// requires Redis version 4.0 or higher.
+func (c *Collection) ApproxMemoryUsage() (int64, error) {
+	if c == nil {
+		return 0, newNilCollectionError("ApproxMemoryUsage")
+	}
+	if !c.index {
+		return 0, newUnindexedCollectionError("ApproxMemoryUsage")
+	}
+	var count int
+	ids := []string{}
+	t := c.pool.NewTransaction()
+	t.Command("SCARD", redis.Args{c.IndexKey()}, NewScanIntHandler(&count))
+	t.Command("SRANDMEMBER", redis.Args{c.IndexKey(), memoryUsageSamples}, NewScanStringsHandler(&ids))
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	// Models which were deleted after the ids were read are not counted.
+	var total int64
+	var found int64
+	t = c.pool.NewTransaction()
+	for _, id := range ids {
+		t.Command("MEMORY", redis.Args{"USAGE", c.ModelKey(id)}, func(reply interface{}) error {
+			if reply == nil {
+				return nil
+			}
+			found++
+			return addMemoryUsage(reply, &total)
+		})
+		t.listMemoryUsage(c, id, &total)
+	}
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+	if found == 0 {
+		return 0, nil
+	}
+	return total * int64(count) / found, nil
+}
+
+// IdsMemoryUsage returns the number of bytes of memory that Redis uses to store
+// the set of all ids for the collection (see IndexKey), as reported by the
+// MEMORY USAGE command. For very large collections this set can use a lot of
+// memory on its own. Redis stores a set compactly as an intset if every id is
+// an integer in canonical form (e.g. "42", but not "042") and the set has no
+// more than set-max-intset-entries members (512 by default), so numeric ids
+// assigned by your application together with a higher limit can reduce the
+// cost considerably. MEMORY USAGE samples the members of large sets, so the
+// result is an estimate for them. An empty collection uses 0 bytes.
+// IdsMemoryUsage only works for indexed collections and requires Redis version
+// 4.0 or higher.
+func (c *Collection) IdsMemoryUsage() (int64, error) {
+	if c == nil {
+		return 0, newNilCollectionError("IdsMemoryUsage")
+	}
+	if !c.index {
+		return 0, newUnindexedCollectionError("IdsMemoryUsage")
+	}
+	conn := c.pool.NewConn()
+	defer conn.Close()
+	reply, err := conn.Do("MEMORY", "USAGE", c.IndexKey())
+	if err != nil {
+		return 0, err
+	}
+	if reply == nil {
+		return 0, nil
+	}
+	var usage int64
+	if err := addMemoryUsage(reply, &usage); err != nil {
+		return 0, err
+	}
+	return usage, nil
+}
+
+// listMemoryUsage adds commands to the transaction which add the memory used by
+// each list field of the model with the given id to usage. Lists which do not
+// exist use no memory.
+func (t *Transaction) listMemoryUsage(c *Collection, id string, usage *int64) {
+	for _, key := range c.spec.listKeys(id) {
+		t.Command("MEMORY", redis.Args{"USAGE", key}, func(reply interface{}) error {
+			if reply == nil {
+				return nil
+			}
+			return addMemoryUsage(reply, usage)
+		})
+	}
+}
+
+// addMemoryUsage adds the number of bytes in a reply from MEMORY USAGE to
+// usage.
+func addMemoryUsage(reply interface{}, usage *int64) error {
+	n, err := redis.Int64(reply, nil)
+	if err != nil {
+		return err
+	}
+	(*usage) += n
+	return nil
+}
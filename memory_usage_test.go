@@ -0,0 +1,84 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File memory_usage_test.go tests the code for reading the memory used by
+// models and ids (memory_usage.go).
+
+package zoom
+
+import "testing"
+
+func TestMemoryUsage(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// An empty collection should use no memory.
+	if usage, err := testModels.ApproxMemoryUsage(); err != nil {
+		t.Fatalf("Unexpected error in ApproxMemoryUsage: %s", err.Error())
+	} else if usage != 0 {
+		t.Errorf("Expected an empty collection to use 0 bytes but got %d", usage)
+	}
+
+	models, err := createAndSaveTestModels(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, model := range models {
+		usage, err := testModels.MemoryUsage(model.ModelId())
+		if err != nil {
+			t.Fatalf("Unexpected error in MemoryUsage: %s", err.Error())
+		}
+		if usage <= 0 {
+			t.Errorf("Expected a positive memory usage but got %d", usage)
+		}
+		total += usage
+	}
+	if _, err := testModels.MemoryUsage("invalidId"); err == nil {
+		t.Error("Expected an error for a model that does not exist but got none")
+	} else if _, ok := err.(ModelNotFoundError); !ok {
+		t.Errorf("Expected a ModelNotFoundError but got: %T: %s", err, err.Error())
+	}
+
+	// There are fewer models than the number of samples, so every model is
+	// sampled and the estimate should be exact.
+	approx, err := testModels.ApproxMemoryUsage()
+	if err != nil {
+		t.Fatalf("Unexpected error in ApproxMemoryUsage: %s", err.Error())
+	}
+	if approx != total {
+		t.Errorf("Expected ApproxMemoryUsage to return %d but got %d", total, approx)
+	}
+}
+
+func TestIdsMemoryUsage(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	if usage, err := indexedTestModels.IdsMemoryUsage(); err != nil {
+		t.Fatalf("Unexpected error in IdsMemoryUsage: %s", err.Error())
+	} else if usage != 0 {
+		t.Errorf("Expected an empty collection to use 0 bytes but got %d", usage)
+	}
+	if _, err := createAndSaveIndexedTestModels(5); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err := indexedTestModels.IdsMemoryUsage(); err != nil {
+		t.Fatalf("Unexpected error in IdsMemoryUsage: %s", err.Error())
+	} else if usage <= 0 {
+		t.Errorf("Expected a positive memory usage but got %d", usage)
+	}
+
+	// IdsMemoryUsage only works for indexed collections.
+	type unindexedIdsModel struct {
+		RandomId
+	}
+	unindexed, err := testPool.NewCollectionWithOptions(&unindexedIdsModel{}, DefaultCollectionOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unindexed.IdsMemoryUsage(); err == nil {
+		t.Error("Expected an error in IdsMemoryUsage for an unindexed collection but got none")
+	}
+}
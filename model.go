@@ -8,8 +8,11 @@
 package zoom
 
 import (
+	"encoding"
 	"fmt"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -54,6 +57,18 @@ type modelSpec struct {
 	fieldsByName map[string]*fieldSpec
 	fields       []*fieldSpec
 	fallback     MarshalerUnmarshaler
+	// lists contains the fields with the `zoom:"list"` struct tag. They are
+	// stored in separate Redis lists instead of the main hash, so they are not
+	// included in fields or fieldsByName. See Collection.Append.
+	lists []*fieldSpec
+	// idField is the field with the `zoom:"id"` struct tag, if any. It holds the
+	// id of the model, which is already part of the key for the main hash, so it
+	// is not included in fields or fieldsByName.
+	idField *fieldSpec
+	// randomId is the index of the embedded RandomId, if any. It is used to
+	// check whether a model has an id without calling ModelId, which would
+	// generate one.
+	randomId []int
 }
 
 // fieldSpec contains parsed information about a particular field
@@ -63,6 +78,48 @@ type fieldSpec struct {
 	redisName string
 	typ       reflect.Type
 	indexKind indexKind
+	marshaler marshalerKind
+	// timeFormat is the format used to store time.Time fields (or pointers to
+	// time.Time). It is empty for all other fields and for time.Time fields in
+	// collections without a TimeFormat, which are treated as inconvertibles.
+	timeFormat string
+	// gzip is true if the field has the `zoom:"gzip"` struct tag, in which case
+	// its encoded value is compressed with gzip before it is stored.
+	gzip bool
+	// hll is true if the field has the `zoom:"hll"` struct tag, in which case
+	// its values are added to a HyperLogLog. See Collection.ApproxDistinct.
+	hll bool
+	// listMaxLen is the maximum length of a list field (i.e. a field with the
+	// `zoom:"list"` struct tag), as specified with the "maxlen=<n>" option. A
+	// value of 0 means the length of the list is not capped.
+	listMaxLen int
+	// where is the condition for a partial index, as specified with the
+	// "where:<field>=<value>" option. It is nil if the field does not have a
+	// partial index.
+	where *indexPredicate
+	// indexKeyFunc is the custom key function for a string index, which is set
+	// with CollectionOptions.IndexKeyFuncs. It is nil for all other fields and
+	// for string indexes which are ordered by the values themselves.
+	indexKeyFunc func(string) string
+}
+
+// indexPredicate is the condition for a partial index, which is specified with
+// the "where:<field>=<value>" or "where:<field>!=<value>" option in the struct
+// tag of an indexed field (e.g. `zoom:"index,where:Status=active"`). A model is
+// only in the index for the field if the condition holds.
+type indexPredicate struct {
+	// field is the spec for the field in the condition, which may be the
+	// indexed field itself.
+	field *fieldSpec
+	// negate is true if the operator is "!=" instead of "=".
+	negate bool
+	// value is the value to compare to, encoded the same way it is stored in
+	// the main hash.
+	value string
+	// fieldName and rawValue are the name of the field and the value as they
+	// appear in the struct tag.
+	fieldName string
+	rawValue  string
 }
 
 // fieldKind is the kind of a particular field, and is either a primitive,
@@ -75,8 +132,27 @@ const (
 	inconvertibleField                  // all other types
 )
 
+// marshalerKind is the kind of marshaler implemented by the type of a primitive
+// or pointer to primitive field. If a field implements a marshaler, its value
+// is encoded and decoded with the marshaler instead of the builtin conversion.
+type marshalerKind int
+
+const (
+	noMarshaler     marshalerKind = iota
+	binaryMarshaler               // encoding.BinaryMarshaler and encoding.BinaryUnmarshaler
+	textMarshaler                 // encoding.TextMarshaler and encoding.TextUnmarshaler
+)
+
+var (
+	binaryMarshalerType   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	textMarshalerType     = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	timeType              = reflect.TypeOf(time.Time{})
+)
+
 // indexKind is the kind of an index, and is either noIndex, numericIndex,
-// stringIndex, or booleanIndex.
+// stringIndex, booleanIndex, enumIndex, sparseBoolIndex, or idIndex.
 type indexKind int
 
 const (
@@ -84,11 +160,39 @@ const (
 	numericIndex
 	stringIndex
 	booleanIndex
+	enumIndex
+	// sparseBoolIndex is a set which only contains the ids of models with a
+	// true value for a bool field (see the sparse struct tag option).
+	sparseBoolIndex
+	// idIndex is only used by filters on the model id (see idFilterSpec). It is
+	// never the index kind of a real field.
+	idIndex
 )
 
+// scriptName returns the name of the kind as it is passed to the Lua scripts
+// which read whole indexes (e.g. get_index_stats), i.e. "numeric", "string",
+// "boolean", "enum", or "sparse". It returns an empty string for noIndex and
+// idIndex.
+func (kind indexKind) scriptName() string {
+	switch kind {
+	case numericIndex:
+		return "numeric"
+	case stringIndex:
+		return "string"
+	case booleanIndex:
+		return "boolean"
+	case enumIndex:
+		return "enum"
+	case sparseBoolIndex:
+		return "sparse"
+	}
+	return ""
+}
+
 // compilesModelSpec examines typ using reflection, parses its fields,
-// and returns a modelSpec.
-func compileModelSpec(typ reflect.Type) (*modelSpec, error) {
+// and returns a modelSpec. timeFormat is the format used for time.Time fields
+// (see CollectionOptions.TimeFormat) and may be empty.
+func compileModelSpec(typ reflect.Type, timeFormat string) (*modelSpec, error) {
 	ms := &modelSpec{
 		name:         getDefaultModelSpecName(typ),
 		fieldsByName: map[string]*fieldSpec{},
@@ -111,6 +215,7 @@ func compileModelSpec(typ reflect.Type) (*modelSpec, error) {
 
 		// Skip the RandomId field
 		if field.Type == reflect.TypeOf(RandomId{}) {
+			ms.randomId = field.Index
 			continue
 		}
 
@@ -120,6 +225,12 @@ func compileModelSpec(typ reflect.Type) (*modelSpec, error) {
 		if redisTag == "-" {
 			continue // skip field
 		}
+		// Like redis:"-", the zoom:"-" tag skips a field entirely, e.g. for
+		// computed fields which should never be saved or read.
+		zoomTag := tag.Get("zoom")
+		if zoomTag == "-" {
+			continue // skip field
+		}
 		fs := &fieldSpec{name: field.Name, typ: field.Type}
 		ms.fieldsByName[fs.name] = fs
 		ms.fields = append(ms.fields, fs)
@@ -129,25 +240,113 @@ func compileModelSpec(typ reflect.Type) (*modelSpec, error) {
 			fs.redisName = fs.name
 		}
 
-		// Parse the "zoom" tag (currently only "index" is supported)
-		zoomTag := tag.Get("zoom")
+		// Parse the "zoom" tag (currently "index", "enum", "sparse", "gzip",
+		// "hll", "list", "maxlen=<n>", "name=<name>", "where:<condition>", and
+		// "id" are supported)
 		shouldIndex := false
+		isEnum := false
+		isSparse := false
+		isList := false
+		hasMaxLen := false
+		isId := false
 		if zoomTag != "" {
 			options := strings.Split(zoomTag, ",")
 			for _, op := range options {
-				switch op {
-				case "index":
+				switch {
+				case op == "id":
+					isId = true
+				case op == "-":
+					return nil, fmt.Errorf("zoom: field %s has the - struct tag, which skips the field and cannot be combined with other options", field.Name)
+				case op == "index":
 					shouldIndex = true
+				case op == "enum":
+					isEnum = true
+				case op == "sparse":
+					isSparse = true
+				case op == "gzip":
+					fs.gzip = true
+				case op == "hll":
+					fs.hll = true
+				case op == "list":
+					isList = true
+				case strings.HasPrefix(op, "maxlen="):
+					maxLen, err := strconv.Atoi(strings.TrimPrefix(op, "maxlen="))
+					if err != nil || maxLen < 1 {
+						return nil, fmt.Errorf("zoom: invalid maxlen specified in struct tag for field %s: %q", field.Name, op)
+					}
+					fs.listMaxLen = maxLen
+					hasMaxLen = true
+				case strings.HasPrefix(op, "name="):
+					name := strings.TrimPrefix(op, "name=")
+					if name == "" || name == "-" {
+						return nil, fmt.Errorf("zoom: invalid name specified in struct tag for field %s: %q", field.Name, name)
+					}
+					if redisTag != "" && redisTag != name {
+						return nil, fmt.Errorf("zoom: conflicting names specified in struct tags for field %s: %q and %q", field.Name, redisTag, name)
+					}
+					fs.redisName = name
+				case strings.HasPrefix(op, "where:"):
+					where, err := parseIndexPredicate(strings.TrimPrefix(op, "where:"))
+					if err != nil {
+						return nil, fmt.Errorf("zoom: invalid where option specified in struct tag for field %s: %s", field.Name, err.Error())
+					}
+					fs.where = where
 				default:
 					return nil, fmt.Errorf("zoom: unrecognized option specified in struct tag: %s", op)
 				}
 			}
 		}
 
+		if isId {
+			// The id is stored as part of the key, so move fs out of fields.
+			ms.fields = ms.fields[:len(ms.fields)-1]
+			delete(ms.fieldsByName, fs.name)
+			if ms.idField != nil {
+				return nil, fmt.Errorf("zoom: fields %s and %s in %s both have the id struct tag. Only one field can be the id", ms.idField.name, fs.name, typ.String())
+			}
+			if len(strings.Split(zoomTag, ",")) > 1 {
+				return nil, fmt.Errorf("zoom: field %s has the id struct tag and cannot have any other options", fs.name)
+			}
+			if field.Type.Kind() != reflect.String {
+				return nil, fmt.Errorf("zoom: field %s cannot have the id struct tag because its type (%s) is not a string", fs.name, fs.typ.String())
+			}
+			fs.kind = primativeField
+			ms.idField = fs
+			continue
+		}
+
+		// Make sure no other field is stored under the same name
+		others := append([]*fieldSpec{}, ms.fields[:len(ms.fields)-1]...)
+		for _, other := range append(others, ms.lists...) {
+			if other.redisName == fs.redisName {
+				return nil, fmt.Errorf("zoom: fields %s and %s in %s are both stored under the name %q", other.name, fs.name, typ.String(), fs.redisName)
+			}
+		}
+
+		if hasMaxLen && !isList {
+			return nil, fmt.Errorf("zoom: field %s has the maxlen option in its struct tag but is not a list", fs.name)
+		}
+		if isList {
+			// List fields are not stored in the main hash, so move fs from fields
+			// to lists.
+			ms.fields = ms.fields[:len(ms.fields)-1]
+			delete(ms.fieldsByName, fs.name)
+			if shouldIndex || isEnum || isSparse || fs.gzip || fs.hll || fs.where != nil {
+				return nil, fmt.Errorf("zoom: field %s has the list struct tag and cannot also be indexed, compressed with gzip, or have the hll struct tag", fs.name)
+			}
+			if !typeIsListElemSlice(field.Type) {
+				return nil, fmt.Errorf("zoom: field %s cannot have the list struct tag because its type (%s) is not a slice of strings, numbers, or bools", fs.name, fs.typ.String())
+			}
+			fs.kind = inconvertibleField
+			ms.lists = append(ms.lists, fs)
+			continue
+		}
+
 		// Detect the kind of the field and (if applicable) the kind of the index
 		if typeIsPrimative(field.Type) {
 			// Primitive
 			fs.kind = primativeField
+			fs.marshaler = getMarshalerKind(field.Type)
 			if shouldIndex {
 				if err := setIndexKind(fs, field.Type); err != nil {
 					return nil, err
@@ -156,19 +355,259 @@ func compileModelSpec(typ reflect.Type) (*modelSpec, error) {
 		} else if field.Type.Kind() == reflect.Ptr && typeIsPrimative(field.Type.Elem()) {
 			// Pointer to a primitive
 			fs.kind = pointerField
+			fs.marshaler = getMarshalerKind(field.Type.Elem())
 			if shouldIndex {
 				if err := setIndexKind(fs, field.Type.Elem()); err != nil {
 					return nil, err
 				}
 			}
+		} else if timeFormat != "" && (field.Type == timeType || field.Type.Kind() == reflect.Ptr && field.Type.Elem() == timeType) {
+			// time.Time or a pointer to time.Time with a custom time format
+			if field.Type == timeType {
+				fs.kind = primativeField
+			} else {
+				fs.kind = pointerField
+			}
+			fs.timeFormat = timeFormat
+			if shouldIndex {
+				if timeFormat == TimeFormatRFC3339 {
+					fs.indexKind = stringIndex
+				} else {
+					fs.indexKind = numericIndex
+				}
+			}
 		} else {
 			// All other types are considered inconvertible
 			fs.kind = inconvertibleField
 		}
+
+		if isEnum {
+			if !shouldIndex {
+				return nil, fmt.Errorf("zoom: field %s has the enum option in its struct tag but is not indexed. Use `zoom:\"index,enum\"`", fs.name)
+			}
+			if fs.indexKind != stringIndex || fs.timeFormat != "" {
+				return nil, fmt.Errorf("zoom: field %s cannot have an enum index because its type (%s) is not a string", fs.name, fs.typ.String())
+			}
+			fs.indexKind = enumIndex
+		}
+		if isSparse {
+			if !shouldIndex {
+				return nil, fmt.Errorf("zoom: field %s has the sparse option in its struct tag but is not indexed. Use `zoom:\"index,sparse\"`", fs.name)
+			}
+			if fs.indexKind != booleanIndex || fs.marshaler != noMarshaler {
+				return nil, fmt.Errorf("zoom: field %s cannot have a sparse index because its type (%s) is not a bool", fs.name, fs.typ.String())
+			}
+			if fs.where != nil {
+				// A model which is not in the index would be indistinguishable
+				// from a model with a false value.
+				return nil, fmt.Errorf("zoom: field %s cannot have both a sparse index and the where option in its struct tag", fs.name)
+			}
+			fs.indexKind = sparseBoolIndex
+		}
+		if fs.where != nil && !shouldIndex {
+			return nil, fmt.Errorf("zoom: field %s has the where option in its struct tag but is not indexed. Use `zoom:\"index,where:%s\"`", fs.name, fs.where)
+		}
+		if fs.gzip {
+			if shouldIndex {
+				return nil, fmt.Errorf("zoom: field %s cannot be both indexed and compressed with gzip", fs.name)
+			}
+			if err := checkGzipField(fs); err != nil {
+				return nil, err
+			}
+		}
+		if fs.hll {
+			if fs.kind == inconvertibleField || fs.gzip {
+				// The encoded values for these fields are not guaranteed to be the
+				// same for equal values (e.g. gob does not sort map keys), so they
+				// cannot be counted reliably.
+				return nil, fmt.Errorf("zoom: field %s cannot have the hll struct tag because its type (%s) is not a primitive or a pointer to a primitive", fs.name, fs.typ.String())
+			}
+		}
+	}
+	if ms.idField != nil {
+		if err := ms.checkIdField(); err != nil {
+			return nil, err
+		}
+	}
+	// The field in the condition for a partial index may come after the
+	// indexed field, so the conditions are resolved once all the fields have
+	// been parsed.
+	for _, fs := range ms.fields {
+		if fs.where != nil {
+			if err := ms.resolveIndexPredicate(fs); err != nil {
+				return nil, err
+			}
+		}
 	}
 	return ms, nil
 }
 
+// parseIndexPredicate parses the condition for a partial index, i.e. the part
+// of the "where:<condition>" option after the colon. The condition must be a
+// field name followed by "=" or "!=" and a value. The field is resolved later
+// by resolveIndexPredicate.
+func parseIndexPredicate(condition string) (*indexPredicate, error) {
+	where := &indexPredicate{}
+	var sep int
+	if sep = strings.Index(condition, "!="); sep != -1 {
+		where.negate = true
+		where.rawValue = condition[sep+2:]
+	} else if sep = strings.Index(condition, "="); sep != -1 {
+		where.rawValue = condition[sep+1:]
+	} else {
+		return nil, fmt.Errorf("%q must have the form <field>=<value> or <field>!=<value>", condition)
+	}
+	where.fieldName = strings.TrimSpace(condition[:sep])
+	if where.fieldName == "" {
+		return nil, fmt.Errorf("%q does not have a field name", condition)
+	}
+	return where, nil
+}
+
+// String returns the condition as it appears in the struct tag, e.g.
+// "Status=active".
+func (where *indexPredicate) String() string {
+	if where.negate {
+		return where.fieldName + "!=" + where.rawValue
+	}
+	return where.fieldName + "=" + where.rawValue
+}
+
+// resolveIndexPredicate finds the field in the condition for the partial index
+// on fs and encodes the value in the condition the same way it is stored in the
+// main hash. The field must be a string, bool, or integer (or a pointer to one)
+// which is stored without a marshaler, since other types do not have a
+// canonical encoding which can be compared.
+func (ms *modelSpec) resolveIndexPredicate(fs *fieldSpec) error {
+	where := fs.where
+	other, found := ms.fieldsByName[where.fieldName]
+	if !found {
+		return fmt.Errorf("zoom: the where option for field %s refers to %s, which is not a field in %s", fs.name, where.fieldName, ms.typ.String())
+	}
+	typ := other.typ
+	if other.kind == pointerField {
+		typ = typ.Elem()
+	}
+	if (other.kind != primativeField && other.kind != pointerField) || other.marshaler != noMarshaler || other.timeFormat != "" || other.gzip {
+		return fmt.Errorf("zoom: the where option for field %s cannot refer to %s because its type (%s) is not a string, bool, or integer", fs.name, other.name, other.typ.String())
+	}
+	var err error
+	switch typ.Kind() {
+	case reflect.String:
+		where.value = where.rawValue
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(where.rawValue); err == nil {
+			where.value = boolString(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if i, err = strconv.ParseInt(where.rawValue, 10, typ.Bits()); err == nil {
+			where.value = strconv.FormatInt(i, 10)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		if u, err = strconv.ParseUint(where.rawValue, 10, typ.Bits()); err == nil {
+			where.value = strconv.FormatUint(u, 10)
+		}
+	default:
+		return fmt.Errorf("zoom: the where option for field %s cannot refer to %s because its type (%s) is not a string, bool, or integer", fs.name, other.name, other.typ.String())
+	}
+	if err != nil {
+		return fmt.Errorf("zoom: the where option for field %s has an invalid value %q for field %s (%s)", fs.name, where.rawValue, other.name, other.typ.String())
+	}
+	where.field = other
+	return nil
+}
+
+// holds returns true iff the condition for a partial index holds for the
+// model. It compares the value of the field in the condition, encoded the same
+// way it would be stored, to the value in the condition. A nil value is never
+// equal to the value in the condition.
+func (where *indexPredicate) holds(mr *modelRef) bool {
+	val := mr.fieldValue(where.field.name)
+	equal := false
+	if val.Kind() != reflect.Ptr || !val.IsNil() {
+		for val.Kind() == reflect.Ptr {
+			val = val.Elem()
+		}
+		var encoded string
+		switch val.Kind() {
+		case reflect.String:
+			encoded = val.String()
+		case reflect.Bool:
+			encoded = boolString(val.Bool())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			encoded = strconv.FormatInt(val.Int(), 10)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			encoded = strconv.FormatUint(val.Uint(), 10)
+		}
+		equal = encoded == where.value
+	}
+	return equal != where.negate
+}
+
+// boolString returns the encoding of b in the main hash, which is the same as
+// the encoding used by redigo.
+func boolString(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// checkIdField returns an error if the ModelId and SetModelId methods of the
+// registered type do not read and write the field with the `zoom:"id"` struct
+// tag. Zoom uses the methods to get and set the id, so they must agree with the
+// field.
+func (ms *modelSpec) checkIdField() error {
+	const probe = "zoomIdFieldProbe"
+	val := reflect.New(ms.typ.Elem())
+	model, ok := val.Interface().(Model)
+	if !ok {
+		return fmt.Errorf("zoom: type %s does not implement Model", ms.typ.String())
+	}
+	model.SetModelId(probe)
+	if val.Elem().FieldByName(ms.idField.name).String() != probe || model.ModelId() != probe {
+		return fmt.Errorf("zoom: field %s in %s has the id struct tag, so the ModelId and SetModelId methods must read and write it", ms.idField.name, ms.typ.String())
+	}
+	return nil
+}
+
+// typeIsListElemSlice returns true iff typ is a slice whose elements can be
+// stored in a list field, i.e. strings, numbers, or bools.
+func typeIsListElemSlice(typ reflect.Type) bool {
+	if typ.Kind() != reflect.Slice {
+		return false
+	}
+	switch typ.Elem().Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// checkGzipField returns an error if fs has the `zoom:"gzip"` struct tag but
+// cannot be compressed. Only fields which are encoded as arbitrary bytes (i.e.
+// strings, byte slices, fields with a marshaler, and inconvertibles) can be
+// compressed.
+func checkGzipField(fs *fieldSpec) error {
+	if fs.kind == inconvertibleField || fs.marshaler != noMarshaler {
+		return nil
+	}
+	typ := fs.typ
+	if fs.kind == pointerField {
+		typ = typ.Elem()
+	}
+	if fs.timeFormat == "" && (typ.Kind() == reflect.String || typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8) {
+		return nil
+	}
+	return fmt.Errorf("zoom: field %s cannot be compressed with gzip because its type (%s) is not a string, a byte slice, or a type that is encoded as bytes", fs.name, fs.typ.String())
+}
+
 // getDefaultModelSpecName returns the default name for the given type, which is
 // simply the name of the type without the package prefix or dereference
 // operators.
@@ -197,12 +636,94 @@ func setIndexKind(fs *fieldSpec, fieldType reflect.Type) error {
 	return nil
 }
 
+// getMarshalerKind returns the kind of marshaler implemented by typ. A type is
+// only considered to implement a marshaler if a pointer to the type implements
+// both the marshaling and unmarshaling halves of the pair. Binary marshalers
+// take precedence over text marshalers.
+func getMarshalerKind(typ reflect.Type) marshalerKind {
+	ptrType := reflect.PtrTo(typ)
+	switch {
+	case ptrType.Implements(binaryMarshalerType) && ptrType.Implements(binaryUnmarshalerType):
+		return binaryMarshaler
+	case ptrType.Implements(textMarshalerType) && ptrType.Implements(textUnmarshalerType):
+		return textMarshaler
+	}
+	return noMarshaler
+}
+
+// stringIndexValue returns the string which represents val in a string index.
+// If val is a pointer, it will keep dereferencing until it reaches the
+// underlying value. For fields which implement a marshaler, the marshaled value
+// is used so that it matches the value stored in the main hash. If the field
+// has a custom key function, the key for the value is returned instead, so
+// that saving, filtering, and ordering all use the same encoding.
+func (fs *fieldSpec) stringIndexValue(val reflect.Value) (string, error) {
+	for val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	var value string
+	if fs.timeFormat != "" {
+		value = formatTime(val.Interface().(time.Time))
+	} else if fs.marshaler == noMarshaler {
+		value = val.String()
+	} else {
+		valBytes, err := marshalVal(fs.marshaler, val)
+		if err != nil {
+			return "", err
+		}
+		value = string(valBytes)
+	}
+	if fs.indexKeyFunc != nil {
+		return fs.indexKeyFunc(value), nil
+	}
+	return value, nil
+}
+
+// numericIndexScore returns the score which represents val in a numeric index.
+// If val is a pointer, it will keep dereferencing until it reaches the
+// underlying value. Unlike numericScore, it supports time.Time fields.
+func (fs *fieldSpec) numericIndexScore(val reflect.Value) float64 {
+	for val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	if fs.timeFormat != "" {
+		return timeScore(fs.timeFormat, val.Interface().(time.Time))
+	}
+	return numericScore(val)
+}
+
 // allIndexKey returns a key which is used in redis to store all the ids of every model of a
 // given type
 func (ms *modelSpec) indexKey() string {
 	return ms.name + ":all"
 }
 
+// changeLogKey returns a key which is used in redis to store a stream of
+// changes to the models of a given type.
+func (ms *modelSpec) changeLogKey() string {
+	return ms.name + ":changes"
+}
+
+// writeCountKey returns a key which is used in redis to count the number of
+// writes (saves and deletes) for a given type. Any cached data which depends on
+// the models of the given type should include the write count in its key, so
+// that it is effectively invalidated by every write.
+func (ms *modelSpec) writeCountKey() string {
+	return ms.name + ":writeCount"
+}
+
+// countCachePrefix returns the prefix for all keys which are used in redis to
+// store cached query counts for a given type.
+func (ms *modelSpec) countCachePrefix() string {
+	return ms.name + ":countCache"
+}
+
+// resultCachePrefix returns the prefix for all keys which are used in redis to
+// store cached query results for a given type.
+func (ms *modelSpec) resultCachePrefix() string {
+	return ms.name + ":resultCache"
+}
+
 // modelKey returns the key that identifies a hash in the database
 // which contains all the fields of the model corresponding to the given
 // id. It returns an error iff id is empty.
@@ -261,6 +782,97 @@ func (ms *modelSpec) fieldIndexKey(fieldName string) (string, error) {
 	return ms.name + ":" + fs.redisName, nil
 }
 
+// idFilterSpec returns a fieldSpec which can be used to filter on the model id
+// in a query, if fieldName is the name which refers to the id. That is the name
+// of the field with the `zoom:"id"` struct tag if there is one, and "Id"
+// otherwise. The second return value is false if fieldName does not refer to
+// the id. The returned fieldSpec is not part of ms and has the kind idIndex.
+func (ms *modelSpec) idFilterSpec(fieldName string) (*fieldSpec, bool) {
+	name := "Id"
+	if ms.idField != nil {
+		name = ms.idField.name
+	}
+	if fieldName != name {
+		return nil, false
+	}
+	return &fieldSpec{
+		kind:      primativeField,
+		name:      name,
+		redisName: "-",
+		typ:       reflect.TypeOf(""),
+		indexKind: idIndex,
+	}, true
+}
+
+// enumValuesKey returns the key for the set of distinct values in the enum
+// index on the field identified by fs. indexKey should be the key returned by
+// fieldIndexKey for the field, which is the set of ids of all models with a
+// value for the field.
+func enumValuesKey(indexKey string) string {
+	return indexKey + ":enum"
+}
+
+// indexKeysKey returns the key for the hash which maps the id of each model in
+// the string index identified by indexKey to its key, for string indexes with
+// a custom key function (see CollectionOptions.IndexKeyFuncs). The key cannot
+// be recomputed from the value stored in the main hash inside a Lua script, so
+// it is stored here in order to remove the old member when a model is saved or
+// deleted.
+func indexKeysKey(indexKey string) string {
+	return indexKey + ":keys"
+}
+
+// enumBucketKey returns the key for the set of ids of the models which have
+// the given value in the enum index identified by indexKey.
+func enumBucketKey(indexKey string, value string) string {
+	return indexKey + ":enum:" + value
+}
+
+// distinctKey returns the key for the HyperLogLog which is used to count the
+// distinct values of the field identified by fs. See Collection.ApproxDistinct.
+func (ms *modelSpec) distinctKey(fs *fieldSpec) string {
+	return ms.name + ":" + fs.redisName + ":hll"
+}
+
+// listField returns the spec for the list field identified by fieldName, or
+// false if there is no such list field.
+func (ms *modelSpec) listField(fieldName string) (*fieldSpec, bool) {
+	for _, fs := range ms.lists {
+		if fs.name == fieldName {
+			return fs, true
+		}
+	}
+	return nil, false
+}
+
+// listKey returns the key for the Redis list which stores the list field
+// identified by fs for the model with the given id.
+func (ms *modelSpec) listKey(id string, fs *fieldSpec) string {
+	return ms.name + ":" + id + ":" + fs.redisName
+}
+
+// listKeys returns the keys for all of the list fields for the model with the
+// given id.
+func (ms *modelSpec) listKeys(id string) []string {
+	keys := []string{}
+	for _, fs := range ms.lists {
+		keys = append(keys, ms.listKey(id, fs))
+	}
+	return keys
+}
+
+// distinctKeys returns the keys for all of the HyperLogLogs for the fields of
+// ms which have the `zoom:"hll"` struct tag.
+func (ms *modelSpec) distinctKeys() []string {
+	keys := []string{}
+	for _, fs := range ms.fields {
+		if fs.hll {
+			keys = append(keys, ms.distinctKey(fs))
+		}
+	}
+	return keys
+}
+
 // sortArgs returns arguments that can be used to get all the fields in includeFields
 // for all the models which have corresponding ids in setKey. Any fields not in
 // includeFields will not be included in the arguments and will not be retrieved from
@@ -270,20 +882,88 @@ func (ms *modelSpec) fieldIndexKey(fieldName string) (string, error) {
 // use they "BY nosort" option, so if a specific order is required, the setKey should be
 // a sorted set.
 func (ms *modelSpec) sortArgs(idsKey string, redisFieldNames []string, limit int, offset uint, reverse bool) redis.Args {
-	args := redis.Args{idsKey, "BY", "nosort"}
+	return ms.sortArgsWithGets(idsKey, ms.sortGetArgs(redisFieldNames), limit, offset, reverse)
+}
+
+// sortArgsWithGets works like sortArgs but takes the GET arguments, as
+// returned by sortGetArgs, instead of the redis names of the fields. It allows
+// the GET arguments to be reused. See queryPlan.
+func (ms *modelSpec) sortArgsWithGets(idsKey string, getArgs redis.Args, limit int, offset uint, reverse bool) redis.Args {
+	args := make(redis.Args, 0, len(getArgs)+7)
+	args = append(args, idsKey, "BY", "nosort")
+	args = append(args, getArgs...)
+	args = appendSortLimitArgs(args, limit, offset)
+	if reverse {
+		args = append(args, "DESC")
+	} else {
+		args = append(args, "ASC")
+	}
+	return args
+}
+
+// sortByIdArgs works like sortArgs, except that instead of using the "BY nosort"
+// option, the arguments cause Redis to sort the ids in ascending lexicographical
+// order. It is used to give a consistent order to the results of queries which
+// do not have an order.
+func (ms *modelSpec) sortByIdArgs(idsKey string, redisFieldNames []string, limit int, offset uint) redis.Args {
+	return ms.sortByIdArgsWithGets(idsKey, ms.sortGetArgs(redisFieldNames), limit, offset)
+}
+
+// sortByIdArgsWithGets works like sortByIdArgs but takes the GET arguments, as
+// returned by sortGetArgs, instead of the redis names of the fields.
+func (ms *modelSpec) sortByIdArgsWithGets(idsKey string, getArgs redis.Args, limit int, offset uint) redis.Args {
+	args := make(redis.Args, 0, len(getArgs)+6)
+	args = append(args, idsKey)
+	args = append(args, getArgs...)
+	args = appendSortLimitArgs(args, limit, offset)
+	return append(args, "ASC", "ALPHA")
+}
+
+// sortByFieldArgsWithGets works like sortArgsWithGets, except that instead of
+// using the "BY nosort" option, the arguments cause Redis to sort the ids by
+// the value of the field for the given order in the main hash for each model.
+// It is used by Query.OrderUnindexed. The ALPHA option is added if o.alpha is
+// true.
+func (ms *modelSpec) sortByFieldArgsWithGets(idsKey string, getArgs redis.Args, limit int, offset uint, o order) redis.Args {
+	args := make(redis.Args, 0, len(getArgs)+8)
+	args = append(args, idsKey, "BY", ms.name+":*->"+o.redisName)
+	args = append(args, getArgs...)
+	args = appendSortLimitArgs(args, limit, offset)
+	if o.kind == descendingOrder {
+		args = append(args, "DESC")
+	} else {
+		args = append(args, "ASC")
+	}
+	if o.alpha {
+		args = append(args, "ALPHA")
+	}
+	return args
+}
+
+// sortGetArgs returns the GET arguments for a SORT command which will get the
+// given fields and the id for every model. They are shared by sortArgs and
+// sortByIdArgs. Only the given fields are read, so queries with Include or
+// Exclude never read the other fields of the main hashes. The reply from the
+// SORT command is a flat list with len(redisFieldNames)+1 values for each
+// model: the values of the fields in the given order (nil for fields which
+// have no stored value), followed by the id. This is the shape expected by
+// newScanModelsHandler when it is given the corresponding field names followed
+// by "-".
+func (ms *modelSpec) sortGetArgs(redisFieldNames []string) redis.Args {
+	args := make(redis.Args, 0, 2*len(redisFieldNames)+2)
 	for _, fieldName := range redisFieldNames {
 		args = append(args, "GET", ms.name+":*->"+fieldName)
 	}
 	// We always want to get the id
-	args = append(args, "GET", "#")
+	return append(args, "GET", "#")
+}
+
+// appendSortLimitArgs appends the LIMIT option for a SORT command to args if
+// limit or offset are not 0.
+func appendSortLimitArgs(args redis.Args, limit int, offset uint) redis.Args {
 	if !(limit == 0 && offset == 0) {
 		args = append(args, "LIMIT", offset, limit)
 	}
-	if reverse {
-		args = append(args, "DESC")
-	} else {
-		args = append(args, "ASC")
-	}
 	return args
 }
 
@@ -297,20 +977,20 @@ func (spec *modelSpec) checkModelType(model Model) error {
 }
 
 // checkModelsType returns an error iff models is not a pointer to a slice of models of the
-// registered type that corresponds to modelSpec.
+// registered type that corresponds to modelSpec. The elements of the slice may either be
+// pointers to structs of the registered type (e.g. *[]*Person) or the structs themselves
+// (e.g. *[]Person).
 func (spec *modelSpec) checkModelsType(models interface{}) error {
-	if reflect.TypeOf(models).Kind() != reflect.Ptr {
-		return fmt.Errorf("models should be a pointer to a slice or array of models")
+	modelsType := reflect.TypeOf(models)
+	if modelsType == nil || modelsType.Kind() != reflect.Ptr || modelsType.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("models should be a pointer to a slice of models but got %T", models)
 	}
-	modelsVal := reflect.ValueOf(models).Elem()
-	elemType := modelsVal.Type().Elem()
-	switch {
-	case !typeIsSliceOrArray(modelsVal.Type()):
-		return fmt.Errorf("models should be a pointer to a slice or array of models")
-	case !typeIsPointerToStruct(elemType):
-		return fmt.Errorf("the elements in models should be pointers to structs")
-	case elemType != spec.typ:
-		return fmt.Errorf("models were the wrong type. Expected slice or array of %s but got %T", spec.typ.String(), models)
+	if reflect.ValueOf(models).IsNil() {
+		return fmt.Errorf("models should be a non-nil pointer to a slice of models")
+	}
+	elemType := modelsType.Elem().Elem()
+	if elemType != spec.typ && elemType != spec.typ.Elem() {
+		return fmt.Errorf("models were the wrong type. Expected a pointer to a slice of %s or %s but got %T", spec.typ.String(), spec.typ.Elem().String(), models)
 	}
 	return nil
 }
@@ -359,9 +1039,15 @@ func (mr *modelRef) mainHashArgs() (redis.Args, error) {
 }
 
 // mainHashArgsForFields is like mainHashArgs but only returns the hash
-// fields which match the given fieldNames.
+// fields which match the given fieldNames. The fields are sorted by their
+// redis names, so that the args (and the order of the fields in a dump of the
+// hash) are the same for every save, regardless of the struct layout.
 func (mr *modelRef) mainHashArgsForFields(fieldNames []string) (redis.Args, error) {
-	args := redis.Args{mr.key()}
+	type hashField struct {
+		name  string
+		value interface{}
+	}
+	hashFields := []hashField{}
 	ms := mr.spec
 	for _, fs := range ms.fields {
 		// Skip fields whose names do not appear in fieldNames.
@@ -369,30 +1055,55 @@ func (mr *modelRef) mainHashArgsForFields(fieldNames []string) (redis.Args, erro
 			continue
 		}
 		fieldVal := mr.fieldValue(fs.name)
+		var value interface{}
 		switch fs.kind {
 		case primativeField:
-			// Add a special case for time.Duration. By default, the redigo driver
-			// will fall back to fmt.Sprintf, but we want to save it as an int64 in
-			// this case.
-			if fs.typ == reflect.TypeOf(time.Duration(0)) {
-				args = args.Add(fs.redisName, int64(fieldVal.Interface().(time.Duration)))
+			if fs.timeFormat != "" {
+				timeVal, err := encodeTime(fs.timeFormat, fieldVal.Interface().(time.Time))
+				if err != nil {
+					return nil, err
+				}
+				value = timeVal
+			} else if fs.marshaler != noMarshaler {
+				// If the type implements a marshaler, let it encode the value.
+				valBytes, err := marshalVal(fs.marshaler, fieldVal)
+				if err != nil {
+					return nil, err
+				}
+				value = valBytes
+			} else if fs.typ == reflect.TypeOf(time.Duration(0)) {
+				// Add a special case for time.Duration. By default, the redigo driver
+				// will fall back to fmt.Sprintf, but we want to save it as an int64 in
+				// this case.
+				value = int64(fieldVal.Interface().(time.Duration))
 			} else {
-				args = args.Add(fs.redisName, fieldVal.Interface())
+				value = fieldVal.Interface()
 			}
 		case pointerField:
-			if !fieldVal.IsNil() {
-				args = args.Add(fs.redisName, fieldVal.Elem().Interface())
+			if fieldVal.IsNil() {
+				// Nil values are represented by the absence of the field in the
+				// hash. See nilFieldRedisNames.
+				continue
+			} else if fs.timeFormat != "" {
+				timeVal, err := encodeTime(fs.timeFormat, fieldVal.Elem().Interface().(time.Time))
+				if err != nil {
+					return nil, err
+				}
+				value = timeVal
+			} else if fs.marshaler != noMarshaler {
+				valBytes, err := marshalVal(fs.marshaler, fieldVal.Elem())
+				if err != nil {
+					return nil, err
+				}
+				value = valBytes
 			} else {
-				args = args.Add(fs.redisName, "NULL")
+				value = fieldVal.Elem().Interface()
 			}
 		case inconvertibleField:
-			switch fieldVal.Type().Kind() {
-			// For nilable types that are nil store NULL
-			case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
-				if fieldVal.IsNil() {
-					args = args.Add(fs.redisName, "NULL")
-					continue
-				}
+			if fieldIsNil(fieldVal) {
+				// Nil values are represented by the absence of the field in the
+				// hash. See nilFieldRedisNames.
+				continue
 			}
 			// For inconvertibles, that are not nil, convert the value to bytes
 			// using the gob package.
@@ -400,8 +1111,54 @@ func (mr *modelRef) mainHashArgsForFields(fieldNames []string) (redis.Args, erro
 			if err != nil {
 				return nil, err
 			}
-			args = args.Add(fs.redisName, valBytes)
+			value = valBytes
+		}
+		if fs.gzip {
+			compressed, err := gzipValue(value)
+			if err != nil {
+				return nil, err
+			}
+			value = compressed
 		}
+		hashFields = append(hashFields, hashField{name: fs.redisName, value: value})
+	}
+	sort.Slice(hashFields, func(i, j int) bool {
+		return hashFields[i].name < hashFields[j].name
+	})
+	args := make(redis.Args, 1, 1+2*len(hashFields))
+	args[0] = mr.key()
+	for _, field := range hashFields {
+		args = append(args, field.name, field.value)
 	}
 	return args, nil
 }
+
+// nilFieldRedisNames returns the redis names of the fields in fieldNames which
+// currently have nil values. Nil values are not stored in the main hash, so
+// the returned fields should be removed from the hash (typically with HDEL) when
+// the model is saved. That way, a nil value can be distinguished from a non-nil
+// zero value (e.g. a pointer to an empty string) when the model is read back.
+// The one exception is when all of the fields are nil. See saveMainHash. Like
+// the args returned by mainHashArgsForFields, the names are sorted.
+func (mr *modelRef) nilFieldRedisNames(fieldNames []string) []string {
+	names := []string{}
+	for _, fs := range mr.spec.fields {
+		if !stringSliceContains(fieldNames, fs.name) {
+			continue
+		}
+		if fs.kind != primativeField && fieldIsNil(mr.fieldValue(fs.name)) {
+			names = append(names, fs.redisName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fieldIsNil returns true iff val is of a nilable kind and is nil.
+func fieldIsNil(val reflect.Value) bool {
+	switch val.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		return val.IsNil()
+	}
+	return false
+}
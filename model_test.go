@@ -320,7 +320,7 @@ func TestCompileModelSpec(t *testing.T) {
 		},
 	}
 	for _, tc := range testCases {
-		gotSpec, err := compileModelSpec(reflect.TypeOf(tc.model))
+		gotSpec, err := compileModelSpec(reflect.TypeOf(tc.model), "")
 		if err != nil {
 			t.Error("Error compiling model spec: ", err.Error())
 			continue
@@ -334,3 +334,33 @@ func TestCompileModelSpec(t *testing.T) {
 		}
 	}
 }
+
+func TestMainHashArgsSorted(t *testing.T) {
+	type unsortedModel struct {
+		Zebra  string
+		Apple  int
+		Mango  *string `redis:"banana"`
+		Kiwi   *int
+		Cherry bool
+		RandomId
+	}
+	spec, err := compileModelSpec(reflect.TypeOf(&unsortedModel{}), "")
+	if err != nil {
+		t.Fatalf("Unexpected error in compileModelSpec: %s", err.Error())
+	}
+	mango := "yellow"
+	model := &unsortedModel{Zebra: "z", Apple: 1, Mango: &mango, Cherry: true}
+	model.SetModelId("id")
+	mr := &modelRef{model: model, spec: spec}
+	args, err := mr.mainHashArgs()
+	if err != nil {
+		t.Fatalf("Unexpected error in mainHashArgs: %s", err.Error())
+	}
+	expected := []interface{}{"unsortedModel:id", "Apple", 1, "Cherry", true, "Zebra", "z", "banana", "yellow"}
+	if !reflect.DeepEqual(expected, []interface{}(args)) {
+		t.Errorf("Expected the hash args to be sorted by field name.\nExpected: %v\nGot:      %v", expected, args)
+	}
+	if got := mr.nilFieldRedisNames(spec.fieldNames()); !reflect.DeepEqual([]string{"Kiwi"}, got) {
+		t.Errorf("Expected the nil fields to be [Kiwi] but got %v", got)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File multi_get.go contains code for finding models from several collections
+// by id in a single transaction (see Pool.MultiGet).
+
+package zoom
+
+import (
+	"fmt"
+)
+
+// MultiGet finds any number of models, which may belong to different
+// collections, by id in a single transaction and reports an error for each of
+// them separately. It is useful for assembling a page from several related
+// models whose ids are already known, e.g. a user along with their settings
+// and subscription, in one round trip. Create a MultiGet with Pool.MultiGet,
+// add a model to find with Find, and then call Exec.
+type MultiGet struct {
+	pool  *Pool
+	items []multiGetItem
+}
+
+// multiGetItem is a single model to find in a MultiGet.
+type multiGetItem struct {
+	collection *Collection
+	id         string
+	model      Model
+	found      bool
+	err        error
+}
+
+// MultiGet returns a new MultiGet for the pool. All of the collections used
+// with it must store their models in the same database as the pool, i.e. they
+// must not have a dedicated pool (see CollectionOptions.Pool).
+func (p *Pool) MultiGet() *MultiGet {
+	return &MultiGet{pool: p}
+}
+
+// Find adds the model with the given id in collection c to m. When m is
+// executed, the model will be scanned into model, which should be a pointer to
+// a struct of the registered type for c. Find returns m so that calls can be
+// chained together. Any errors are not reported until Exec is called.
+func (m *MultiGet) Find(c *Collection, id string, model Model) *MultiGet {
+	item := multiGetItem{
+		collection: c,
+		id:         id,
+		model:      model,
+	}
+	if c == nil {
+		item.err = newNilCollectionError("MultiGet.Find")
+	} else if err := c.checkModelType(model); err != nil {
+		item.err = fmt.Errorf("zoom: Error in MultiGet.Find: %s", err.Error())
+	} else if c.pool != m.pool {
+		item.err = fmt.Errorf("zoom: Error in MultiGet.Find: Collection %s does not use the pool for the MultiGet", c.Name())
+	}
+	m.items = append(m.items, item)
+	return m
+}
+
+// Exec finds all of the models which were added to m in a single transaction
+// and scans each of them into its destination. The first return value contains
+// an error for each call to Find, in the order the calls were made. The error
+// is nil if the model was found and scanned successfully. If the model does
+// not exist, it is a ModelNotFoundError (which matches ErrModelNotFound) and
+// the destination is set to its zero value. If Find was called with invalid
+// arguments (e.g. a model of the wrong type), it is the error describing the
+// problem and the destination is not touched. The second return value is
+// non-nil if the transaction as a whole failed (e.g. because of a connection
+// error or a model which could not be scanned), in which case the first return
+// value is nil.
+func (m *MultiGet) Exec() ([]error, error) {
+	t := m.pool.NewTransaction()
+	for i := range m.items {
+		item := &m.items[i]
+		if item.err != nil {
+			continue
+		}
+		t.FindOrZero(item.collection, item.id, item.model, &item.found)
+	}
+	if err := t.Exec(); err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(m.items))
+	for i, item := range m.items {
+		if item.err != nil {
+			errs[i] = item.err
+		} else if !item.found {
+			errs[i] = ModelNotFoundError{
+				Collection: item.collection,
+				Msg:        fmt.Sprintf("Could not find %s with id = %s", item.collection.Name(), item.id),
+			}
+		}
+	}
+	return errs, nil
+}
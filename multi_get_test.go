@@ -0,0 +1,82 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File multi_get_test.go tests the code for finding models from several
+// collections in one transaction (multi_get.go).
+
+package zoom
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMultiGet(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveTestModels(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexedModels, err := createAndSaveIndexedTestModels(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotModels := []*testModel{{}, {}, {Int: 5}}
+	gotIndexed := &indexedTestModel{}
+	wrongType := &testModel{Int: 7}
+	errs, err := testPool.MultiGet().
+		Find(testModels, models[0].ModelId(), gotModels[0]).
+		Find(indexedTestModels, indexedModels[0].ModelId(), gotIndexed).
+		Find(testModels, "missing", gotModels[2]).
+		Find(indexedTestModels, indexedModels[0].ModelId(), wrongType).
+		Find(testModels, models[1].ModelId(), gotModels[1]).
+		Exec()
+	if err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+	if len(errs) != 5 {
+		t.Fatalf("Expected 5 errors (one per Find) but got %d", len(errs))
+	}
+
+	// Each destination should get the right model.
+	for i, j := range []int{0, 4} {
+		if errs[j] != nil {
+			t.Errorf("Unexpected error for Find #%d: %s", j, errs[j].Error())
+		}
+		if !reflect.DeepEqual(models[i], gotModels[i]) {
+			t.Errorf("Wrong model for Find #%d.\nExpected: %+v\nGot:      %+v", j, models[i], gotModels[i])
+		}
+	}
+	if errs[1] != nil {
+		t.Errorf("Unexpected error for Find #1: %s", errs[1].Error())
+	}
+	if !reflect.DeepEqual(indexedModels[0], gotIndexed) {
+		t.Errorf("Wrong model for Find #1.\nExpected: %+v\nGot:      %+v", indexedModels[0], gotIndexed)
+	}
+
+	// Missing models and invalid arguments should be reported per item.
+	if !errors.Is(errs[2], ErrModelNotFound) {
+		t.Errorf("Expected ErrModelNotFound for Find #2 but got %v", errs[2])
+	}
+	if !reflect.DeepEqual(&testModel{}, gotModels[2]) {
+		t.Errorf("Expected the model for a missing id to be zeroed but got %+v", gotModels[2])
+	}
+	if errs[3] == nil || errors.Is(errs[3], ErrModelNotFound) {
+		t.Errorf("Expected a type error for Find #3 but got %v", errs[3])
+	}
+	if wrongType.Int != 7 {
+		t.Errorf("Expected the model with the wrong type not to be touched but got %+v", wrongType)
+	}
+
+	// An empty MultiGet should not be an error.
+	if errs, err := testPool.MultiGet().Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	} else if len(errs) != 0 {
+		t.Errorf("Expected no errors but got %v", errs)
+	}
+}
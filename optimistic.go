@@ -0,0 +1,96 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File optimistic.go contains code for retrying transactions which use
+// optimistic locking (see Transaction.Watch and Pool.WithOptimisticRetry).
+
+package zoom
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultOptimisticBackoffBase is the base delay used by the default
+	// backoff for WithOptimisticRetry.
+	DefaultOptimisticBackoffBase = 5 * time.Millisecond
+	// DefaultOptimisticBackoffMax is the maximum delay used by the default
+	// backoff for WithOptimisticRetry.
+	DefaultOptimisticBackoffMax = 500 * time.Millisecond
+)
+
+// ExponentialBackoff returns a backoff function which can be used for
+// PoolOptions.OptimisticBackoff. Before the nth retry it waits for a random
+// duration between 0 and base * 2^(n-1), capped at max ("full jitter"). The
+// jitter keeps clients which conflicted with each other from retrying in
+// lockstep and conflicting again.
+func ExponentialBackoff(base, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		delay := max
+		if attempt < 1 {
+			attempt = 1
+		}
+		// Stop doubling once the delay passes max to avoid overflow.
+		if shift := uint(attempt - 1); shift < 32 {
+			if d := base << shift; d > 0 && d < max {
+				delay = d
+			}
+		}
+		if delay <= 0 {
+			return 0
+		}
+		return time.Duration(rand.Int63n(int64(delay) + 1))
+	}
+}
+
+// defaultOptimisticBackoff is used when PoolOptions.OptimisticBackoff is nil.
+var defaultOptimisticBackoff = ExponentialBackoff(DefaultOptimisticBackoffBase, DefaultOptimisticBackoffMax)
+
+// WithOptimisticRetry runs fn with a new transaction and then executes the
+// transaction. fn should call tx.Watch for the keys its writes depend on,
+// read their current values, and then add the writes to tx. If the
+// transaction is aborted with ErrOptimisticLock because a watched key was
+// modified, WithOptimisticRetry waits according to
+// PoolOptions.OptimisticBackoff and runs fn again with a fresh transaction,
+// so the values are re-read and re-watched on every attempt. It makes at most
+// maxAttempts attempts, after which it returns an error wrapping
+// ErrOptimisticLock (check for it with errors.Is). Any other error returned
+// by fn or by Exec is returned immediately without retrying, and the
+// transaction is discarded if fn fails. Since fn may be called more than
+// once, it should not have side effects outside of tx.
+func (p *Pool) WithOptimisticRetry(maxAttempts int, fn func(tx *Transaction) error) error {
+	if maxAttempts < 1 {
+		return fmt.Errorf("zoom: Error in WithOptimisticRetry: maxAttempts must be at least 1 but got %d", maxAttempts)
+	}
+	if fn == nil {
+		return fmt.Errorf("zoom: Error in WithOptimisticRetry: fn cannot be nil")
+	}
+	backoff := p.options.OptimisticBackoff
+	if backoff == nil {
+		backoff = defaultOptimisticBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			atomic.AddUint64(&p.transactionRetries, 1)
+		}
+		tx := p.NewTransaction()
+		if err := fn(tx); err != nil {
+			tx.conn.Close()
+			return err
+		}
+		err := tx.Exec()
+		if err != ErrOptimisticLock {
+			return err
+		}
+		if attempt == maxAttempts {
+			return fmt.Errorf("zoom: Error in WithOptimisticRetry: giving up after %d attempts: %w", maxAttempts, err)
+		}
+		if delay := backoff(attempt); delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File optimistic_test.go tests the code for retrying transactions which use
+// optimistic locking (optimistic.go).
+
+package zoom
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestWithOptimisticRetry(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	var backoffs []int
+	options := testPool.options.WithOptimisticBackoff(func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return 0
+	})
+	pool := NewPoolWithOptions(options)
+	defer pool.Close()
+	conn := pool.NewConn()
+	defer conn.Close()
+	const key = "optimisticRetryKey"
+	if _, err := conn.Do("SET", key, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// incr doubles the value of key with a check-and-set. conflicts is the
+	// number of attempts for which another client modifies the key between
+	// the read and the write.
+	calls := 0
+	incr := func(conflicts int) func(tx *Transaction) error {
+		return func(tx *Transaction) error {
+			calls++
+			if err := tx.Watch(key); err != nil {
+				return err
+			}
+			value, err := redis.Int(conn.Do("GET", key))
+			if err != nil {
+				return err
+			}
+			if calls <= conflicts {
+				if _, err := conn.Do("INCR", key); err != nil {
+					return err
+				}
+				value++
+			}
+			tx.Command("SET", redis.Args{key, value * 2}, nil)
+			return nil
+		}
+	}
+
+	// A single conflict should be retried with a fresh read.
+	if err := pool.WithOptimisticRetry(3, incr(1)); err != nil {
+		t.Fatalf("Unexpected error in WithOptimisticRetry: %s", err.Error())
+	}
+	if calls != 2 {
+		t.Errorf("Expected fn to be called 2 times but got %d", calls)
+	}
+	if got, err := redis.Int(conn.Do("GET", key)); err != nil {
+		t.Fatal(err)
+	} else if got != 4 {
+		t.Errorf("Expected value to be 4 but got %d", got)
+	}
+	if len(backoffs) != 1 || backoffs[0] != 1 {
+		t.Errorf("Expected the backoff to be called for attempt 1 but got %v", backoffs)
+	}
+	if stats := pool.Stats(); stats.TransactionRetries != 1 || stats.OptimisticConflicts != 1 {
+		t.Errorf("Expected 1 retry and 1 conflict but got %+v", stats)
+	}
+
+	// Conflicting on every attempt should give up after maxAttempts.
+	calls = 0
+	err := pool.WithOptimisticRetry(3, incr(3))
+	if err == nil {
+		t.Fatal("Expected an error when every attempt conflicts but got none")
+	}
+	if !errors.Is(err, ErrOptimisticLock) {
+		t.Errorf("Expected the error to wrap ErrOptimisticLock but got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("Expected fn to be called 3 times but got %d", calls)
+	}
+
+	// Errors from fn should be returned without retrying.
+	calls = 0
+	fnErr := errors.New("fn failed")
+	if err := pool.WithOptimisticRetry(3, func(tx *Transaction) error {
+		calls++
+		if err := tx.Watch(key); err != nil {
+			return err
+		}
+		return fnErr
+	}); err != fnErr {
+		t.Errorf("Expected the error from fn but got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected fn to be called 1 time but got %d", calls)
+	}
+
+	if err := pool.WithOptimisticRetry(0, incr(0)); err == nil {
+		t.Error("Expected an error for maxAttempts = 0 but got none")
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	base := 10 * time.Millisecond
+	max := 50 * time.Millisecond
+	backoff := ExponentialBackoff(base, max)
+	for attempt := 1; attempt <= 100; attempt++ {
+		limit := max
+		if attempt <= 3 {
+			limit = base << uint(attempt-1)
+		}
+		for i := 0; i < 20; i++ {
+			if delay := backoff(attempt); delay < 0 || delay > limit {
+				t.Errorf("Expected delay for attempt %d to be between 0 and %s but got %s", attempt, limit, delay)
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File orphans.go contains code for finding and repairing orphaned models,
+// i.e. models whose main hash exists but whose id is missing from the set of
+// all ids.
+
+package zoom
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// FindOrphans returns the ids of the orphaned models in the collection, sorted
+// lexicographically. A model is orphaned if its main hash exists in the
+// database but its id is not in the set of all ids (see IndexKey), e.g. after a
+// partial failure or a manual change in the database. Orphaned models are
+// invisible to queries, Count, and FindAll, but they still use memory. Like
+// VerifyIndexes, FindOrphans is a diagnostic tool and it never modifies
+// anything. Use RepairOrphans to add the orphaned models back to the
+// collection. The keys are found with SCAN (with the TYPE option, which
+// requires Redis 6.0 or higher, and the COUNT hint from PoolOptions.ScanCount)
+// and checked against the set of all ids in batches, so FindOrphans does not
+// block Redis, but it is O(N) in the number of keys in the database and models
+// which are saved or deleted while it is running may be reported incorrectly.
+// It only works for indexed collections.
+func (c *Collection) FindOrphans() ([]string, error) {
+	if c == nil {
+		return nil, newNilCollectionError("FindOrphans")
+	}
+	if !c.index {
+		return nil, newUnindexedCollectionError("FindOrphans")
+	}
+	return c.findOrphans()
+}
+
+// findOrphans does the actual work for FindOrphans and RepairOrphans. Apart
+// from the main hashes for models, the only hashes with the collection prefix
+// are the hashes of keys for string indexes with a custom key function (see
+// indexKeysKey). Those are skipped, and the id for every other hash is the rest
+// of its key after the prefix.
+func (c *Collection) findOrphans() ([]string, error) {
+	auxiliaryKeys, err := c.auxiliaryHashKeys()
+	if err != nil {
+		return nil, err
+	}
+	conn := c.pool.NewConn()
+	defer conn.Close()
+	prefix := c.Name() + ":"
+	orphans := []string{}
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", escapeGlob(prefix)+"*", "COUNT", c.pool.scanCount(), "TYPE", "hash"))
+		if err != nil {
+			return nil, err
+		}
+		var scanned []string
+		if _, err := redis.Scan(values, &cursor, &scanned); err != nil {
+			return nil, err
+		}
+		keys := scanned[:0]
+		for _, key := range scanned {
+			if !auxiliaryKeys[key] {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			isMember := make([]bool, len(keys))
+			t := c.pool.NewTransaction()
+			for i, key := range keys {
+				t.Command("SISMEMBER", redis.Args{c.IndexKey(), key[len(prefix):]}, NewScanBoolHandler(&isMember[i]))
+			}
+			if err := t.Exec(); err != nil {
+				return nil, err
+			}
+			for i, key := range keys {
+				if !isMember[i] {
+					orphans = append(orphans, key[len(prefix):])
+				}
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	// SCAN can return the same key more than once.
+	sort.Strings(orphans)
+	unique := orphans[:0]
+	for i, id := range orphans {
+		if i == 0 || id != orphans[i-1] {
+			unique = append(unique, id)
+		}
+	}
+	return unique, nil
+}
+
+// auxiliaryHashKeys returns the keys of the hashes with the collection prefix
+// which do not belong to a model, i.e. the hashes of keys for the string
+// indexes with a custom key function.
+func (c *Collection) auxiliaryHashKeys() (map[string]bool, error) {
+	keys := map[string]bool{}
+	for _, fs := range c.spec.fields {
+		if fs.indexKind != stringIndex || fs.indexKeyFunc == nil {
+			continue
+		}
+		indexKey, err := c.spec.fieldIndexKey(fs.name)
+		if err != nil {
+			return nil, err
+		}
+		keys[indexKeysKey(indexKey)] = true
+	}
+	return keys, nil
+}
+
+// RepairOrphans finds the orphaned models in the collection (see FindOrphans)
+// and adds them back to the collection. For each orphaned model, the id is
+// added to the set of all ids and the indexes for all of its fields are
+// rebuilt from the values stored in its main hash, so that it is visible to
+// queries again. Nothing else about the model is changed, and hooks, history,
+// and the change log are not touched. The models are repaired in batches, each
+// in its own transaction, so the operation as a whole is not atomic. An orphan
+// which is deleted before its batch is repaired is skipped. RepairOrphans
+// returns the ids of the models which were repaired, sorted lexicographically.
+// It only works for indexed collections.
+func (c *Collection) RepairOrphans() ([]string, error) {
+	if c == nil {
+		return nil, newNilCollectionError("RepairOrphans")
+	}
+	if !c.index {
+		return nil, newUnindexedCollectionError("RepairOrphans")
+	}
+	orphans, err := c.findOrphans()
+	if err != nil {
+		return nil, err
+	}
+	repaired := []string{}
+	for start := 0; start < len(orphans); start += reindexBatchSize {
+		end := start + reindexBatchSize
+		if end > len(orphans) {
+			end = len(orphans)
+		}
+		batch := orphans[start:end]
+		models := make([]Model, len(batch))
+		found := make([]bool, len(batch))
+		t := c.pool.NewTransaction()
+		for i, id := range batch {
+			models[i] = reflect.New(c.spec.typ.Elem()).Interface().(Model)
+			t.FindOrZero(c, id, models[i], &found[i])
+		}
+		if err := t.Exec(); err != nil {
+			return repaired, err
+		}
+		t = c.pool.NewTransaction()
+		ids := redis.Args{c.IndexKey()}
+		for i, model := range models {
+			if !found[i] {
+				continue
+			}
+			t.saveFieldIndexes(&modelRef{
+				collection: c,
+				model:      model,
+				spec:       c.spec,
+			})
+			ids = append(ids, model.ModelId())
+		}
+		if len(ids) == 1 {
+			continue
+		}
+		t.Command("SADD", ids, nil)
+		t.incrWriteCount(c)
+		if err := t.Exec(); err != nil {
+			return repaired, err
+		}
+		for _, id := range ids[1:] {
+			repaired = append(repaired, id.(string))
+		}
+	}
+	return repaired, nil
+}
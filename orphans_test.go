@@ -0,0 +1,170 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File orphans_test.go tests the code for finding and repairing orphaned
+// models (orphans.go).
+
+package zoom
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFindAndRepairOrphans(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type orphanModel struct {
+		Name  string   `zoom:"index"`
+		Score int      `zoom:"index"`
+		Tags  []string `zoom:"list"`
+		RandomId
+	}
+	options := DefaultCollectionOptions.WithIndex(true).WithKeepHistory(1)
+	collection, err := testPool.NewCollectionWithOptions(&orphanModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := make([]*orphanModel, 5)
+	for i := range models {
+		models[i] = &orphanModel{Name: randomString(), Score: i}
+		if err := collection.Save(models[i]); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		// The list and the history are not hashes, so they should never be
+		// mistaken for models.
+		if err := collection.Append(models[i].ModelId(), "Tags", "a"); err != nil {
+			t.Fatalf("Unexpected error in Append: %s", err.Error())
+		}
+		if err := collection.Save(models[i]); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	if orphans, err := collection.FindOrphans(); err != nil {
+		t.Fatalf("Unexpected error in FindOrphans: %s", err.Error())
+	} else if len(orphans) != 0 {
+		t.Errorf("Expected no orphans but got %v", orphans)
+	}
+
+	// Simulate a partial failure by removing some of the models from the set
+	// of all ids and from one of the indexes.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	expected := []string{models[1].ModelId(), models[3].ModelId()}
+	sort.Strings(expected)
+	scoreKey, err := collection.FieldIndexKey("Score")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range expected {
+		if _, err := conn.Do("SREM", collection.IndexKey(), id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Do("ZREM", scoreKey, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if orphans, err := collection.FindOrphans(); err != nil {
+		t.Fatalf("Unexpected error in FindOrphans: %s", err.Error())
+	} else if !reflect.DeepEqual(expected, orphans) {
+		t.Errorf("Wrong orphans.\nExpected: %v\nGot:      %v", expected, orphans)
+	}
+	if count, err := collection.Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if count != len(models)-len(expected) {
+		t.Errorf("Expected orphans to be invisible to Count but got %d", count)
+	}
+
+	// RepairOrphans should make the models visible to queries again.
+	if repaired, err := collection.RepairOrphans(); err != nil {
+		t.Fatalf("Unexpected error in RepairOrphans: %s", err.Error())
+	} else if !reflect.DeepEqual(expected, repaired) {
+		t.Errorf("Wrong repaired ids.\nExpected: %v\nGot:      %v", expected, repaired)
+	}
+	if orphans, err := collection.FindOrphans(); err != nil {
+		t.Fatalf("Unexpected error in FindOrphans: %s", err.Error())
+	} else if len(orphans) != 0 {
+		t.Errorf("Expected no orphans after repairing but got %v", orphans)
+	}
+	reports, err := collection.VerifyIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+	}
+	for _, report := range reports {
+		if !report.OK() {
+			t.Errorf("Expected the index for %s to be consistent but got %+v", report.FieldName, report)
+		}
+	}
+	if count, err := collection.NewQuery().Filter("Score >=", 1).Filter("Score <=", 3).Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if count != 3 {
+		t.Errorf("Expected 3 models to match the query but got %d", count)
+	}
+
+	// Both methods only work for indexed collections.
+	type unindexedOrphanModel struct {
+		RandomId
+	}
+	unindexed, err := testPool.NewCollectionWithOptions(&unindexedOrphanModel{}, DefaultCollectionOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unindexed.FindOrphans(); err == nil {
+		t.Error("Expected an error in FindOrphans for an unindexed collection but got none")
+	}
+	if _, err := unindexed.RepairOrphans(); err == nil {
+		t.Error("Expected an error in RepairOrphans for an unindexed collection but got none")
+	}
+}
+
+func TestFindOrphansWithIndexKeyFunc(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type orphanVersionModel struct {
+		Version string `zoom:"index"`
+		RandomId
+	}
+	options := DefaultCollectionOptions.WithIndex(true).WithIndexKeyFunc("Version", strings.ToLower)
+	collection, err := testPool.NewCollectionWithOptions(&orphanVersionModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := &orphanVersionModel{Version: "V1"}
+	if err := collection.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+
+	// The hash of keys for the index has the collection prefix, but it is not
+	// a model and should never be reported as an orphan.
+	if orphans, err := collection.FindOrphans(); err != nil {
+		t.Fatalf("Unexpected error in FindOrphans: %s", err.Error())
+	} else if len(orphans) != 0 {
+		t.Errorf("Expected no orphans but got %v", orphans)
+	}
+	conn := testPool.NewConn()
+	defer conn.Close()
+	if _, err := conn.Do("SREM", collection.IndexKey(), model.ModelId()); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{model.ModelId()}
+	if orphans, err := collection.FindOrphans(); err != nil {
+		t.Fatalf("Unexpected error in FindOrphans: %s", err.Error())
+	} else if !reflect.DeepEqual(expected, orphans) {
+		t.Errorf("Wrong orphans.\nExpected: %v\nGot:      %v", expected, orphans)
+	}
+	if repaired, err := collection.RepairOrphans(); err != nil {
+		t.Fatalf("Unexpected error in RepairOrphans: %s", err.Error())
+	} else if !reflect.DeepEqual(expected, repaired) {
+		t.Errorf("Wrong repaired ids.\nExpected: %v\nGot:      %v", expected, repaired)
+	}
+	if count, err := collection.Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if count != 1 {
+		t.Errorf("Expected Count to be 1 after repairing but got %d", count)
+	}
+}
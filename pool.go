@@ -9,7 +9,12 @@
 package zoom
 
 import (
+	"context"
+	"fmt"
 	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -18,15 +23,30 @@ import (
 // Pool represents a pool of connections. Each pool connects
 // to one database and manages its own set of registered models.
 type Pool struct {
+	// optimisticConflicts and transactionRetries are counters which are
+	// reported by Stats. They must only be accessed atomically, and are kept at
+	// the start of the struct so that they are 64-bit aligned on 32-bit
+	// platforms.
+	optimisticConflicts uint64
+	transactionRetries  uint64
 	// options is the fully parsed conifg, with defaults filling in any
 	// blanks from the poolConfig passed into NewPool.
 	options PoolOptions
 	// redisPool is a redis.Pool
 	redisPool *redis.Pool
-	// modelTypeToSpec maps a registered model type to a modelSpec
+	// modelTypeToSpec maps a registered model type to a modelSpec. It and the
+	// other registration maps are protected by registryMut.
 	modelTypeToSpec map[reflect.Type]*modelSpec
 	// modelNameToSpec maps a registered model name to a modelSpec
 	modelNameToSpec map[string]*modelSpec
+	// modelNameToCollection maps a registered model name to a Collection
+	modelNameToCollection map[string]*Collection
+	registryMut           sync.RWMutex
+	// onSave and onDelete are the hooks set with OnSave and OnDelete. They are
+	// protected by hooksMut.
+	onSave   WriteHook
+	onDelete WriteHook
+	hooksMut sync.RWMutex
 }
 
 // DefaultPoolOptions is the default set of options for a Pool.
@@ -54,7 +74,10 @@ type PoolOptions struct {
 	// A value of 0 means unlimited.
 	MaxActive int
 	// MaxIdle is the maximum number of idle connections the pool will keep. A
-	// value of 0 means unlimited.
+	// value of 0 means unlimited. Idle connections are always reused in LIFO
+	// order (the most recently returned connection first), which is fixed by
+	// the underlying redigo pool. Under bursty load this keeps a few
+	// connections warm and lets the rest time out (see IdleTimeout).
 	MaxIdle int
 	// Network to use.
 	Network string
@@ -64,9 +87,72 @@ type PoolOptions struct {
 	Password string
 	// Wait indicates whether or not the pool should wait for a free connection
 	// if the MaxActive limit has been reached. If Wait is false and the
-	// MaxActive limit is reached, Zoom will return an error indicating that the
-	// pool is exhausted.
+	// MaxActive limit is reached, Zoom will return ErrPoolExhausted.
 	Wait bool
+	// MaxConnWaitTime is the maximum amount of time to wait for a free
+	// connection when Wait is true and the MaxActive limit has been reached.
+	// If no connection is freed in time, Zoom stops waiting and returns
+	// ErrPoolExhausted, so that e.g. request handlers can fail fast and shed
+	// load instead of piling up. A value of 0, which is the default, means to
+	// wait forever. MaxConnWaitTime has no effect if Wait is false or
+	// MaxActive is 0.
+	MaxConnWaitTime time.Duration
+	// ReadTimeout is the maximum amount of time to wait for a reply to a
+	// command (including EXEC and scripts) before giving up and returning an
+	// error. WriteTimeout is the maximum amount of time to wait while writing a
+	// command to the connection. Neither affects how long Zoom waits for a new
+	// connection to be dialed. A value of 0, which is the default, means no
+	// timeout. Note that blocking commands (e.g. BLPOP or XREAD with BLOCK)
+	// will fail if they block for longer than ReadTimeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// DialFunc, if not nil, is used to create all new connections for the pool
+	// instead of Zoom's internal dialing logic. It can be used to connect through
+	// a proxy or to fully customize the net.Dialer or TLS configuration. If
+	// DialFunc is set, the Network, Address, Password, Database, ReadTimeout, and
+	// WriteTimeout options are ignored, and DialFunc is responsible for
+	// authenticating and selecting the database (if needed). The underlying redigo
+	// pool does not accept a context when dialing, so DialFunc is always called
+	// with context.Background().
+	DialFunc func(ctx context.Context) (redis.Conn, error)
+	// AutoRegister, if true, causes Pool.Save and Pool.CollectionForModel to
+	// register a new collection with DefaultCollectionOptions the first time
+	// they see a model type which has not been registered, instead of returning
+	// a CollectionNotRegisteredError. It is convenient for quick scripts, but it
+	// is off by default because registration compiles a spec for the type with
+	// reflection (once per type), the collection cannot be given any other
+	// options afterwards, and a typo in the type silently creates a new
+	// collection.
+	AutoRegister bool
+	// FlushEvery, if greater than 0, causes Transaction.Exec to flush the
+	// connection after every FlushEvery commands and scripts between MULTI and
+	// EXEC, instead of writing them all before EXEC is sent. Flushing does
+	// not commit anything: Redis queues the commands on its side until EXEC
+	// arrives, and the replies are still read and passed to the reply handlers
+	// after EXEC, so the transaction is exactly as atomic as before. It bounds
+	// the amount of unsent data held by connections which buffer everything
+	// until Flush (e.g. some connections returned by DialFunc) and lets Redis
+	// start parsing a very large transaction (e.g. one which saves thousands
+	// of models) while the rest is still being written. Note that the actions
+	// themselves are still kept in memory until Exec returns, and Redis keeps a
+	// small QUEUED reply for each command in its output buffer until EXEC. A
+	// value of 0, which is the default, means to only flush when EXEC is sent.
+	FlushEvery int
+	// OptimisticBackoff, if not nil, returns how long WithOptimisticRetry
+	// should wait before the given attempt, where attempt is 1 for the first
+	// retry, 2 for the second, and so on. The default (nil) is
+	// ExponentialBackoff(DefaultOptimisticBackoffBase,
+	// DefaultOptimisticBackoffMax). A function which always returns 0 retries
+	// immediately.
+	OptimisticBackoff func(attempt int) time.Duration
+	// ScanCount is the COUNT hint passed to SCAN and SSCAN by the operations
+	// which iterate over the keyspace or the set of all ids for a collection,
+	// i.e. Truncate, FindOrphans, RepairOrphans, and RenameCollection. Larger
+	// values mean fewer round trips, but more work for Redis in each call.
+	// COUNT is only a hint, so a call may return more or fewer keys. A value
+	// of 0, which is the default, means to use 1000. Stream and RunWith do not
+	// use SCAN (see Query.BatchSize).
+	ScanCount int
 }
 
 // WithAddress returns a new copy of the options with the Address property set
@@ -125,6 +211,77 @@ func (options PoolOptions) WithWait(wait bool) PoolOptions {
 	return options
 }
 
+// WithMaxConnWaitTime returns a new copy of the options with the
+// MaxConnWaitTime property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithMaxConnWaitTime(timeout time.Duration) PoolOptions {
+	options.MaxConnWaitTime = timeout
+	return options
+}
+
+// WithReadTimeout returns a new copy of the options with the ReadTimeout
+// property set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithReadTimeout(timeout time.Duration) PoolOptions {
+	options.ReadTimeout = timeout
+	return options
+}
+
+// WithWriteTimeout returns a new copy of the options with the WriteTimeout
+// property set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithWriteTimeout(timeout time.Duration) PoolOptions {
+	options.WriteTimeout = timeout
+	return options
+}
+
+// WithDialFunc returns a new copy of the options with the DialFunc property set
+// to the given value. It does not mutate the original options.
+func (options PoolOptions) WithDialFunc(dialFunc func(ctx context.Context) (redis.Conn, error)) PoolOptions {
+	options.DialFunc = dialFunc
+	return options
+}
+
+// WithAutoRegister returns a new copy of the options with the AutoRegister
+// property set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithAutoRegister(autoRegister bool) PoolOptions {
+	options.AutoRegister = autoRegister
+	return options
+}
+
+// WithScanCount returns a new copy of the options with the ScanCount property
+// set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithScanCount(scanCount int) PoolOptions {
+	options.ScanCount = scanCount
+	return options
+}
+
+// defaultScanCount is the COUNT hint for SCAN and SSCAN if
+// PoolOptions.ScanCount is 0.
+const defaultScanCount = 1000
+
+// scanCount returns the COUNT hint for SCAN and SSCAN (see
+// PoolOptions.ScanCount).
+func (p *Pool) scanCount() int {
+	if p.options.ScanCount > 0 {
+		return p.options.ScanCount
+	}
+	return defaultScanCount
+}
+
+// WithFlushEvery returns a new copy of the options with the FlushEvery
+// property set to the given value. It does not mutate the original options.
+func (options PoolOptions) WithFlushEvery(flushEvery int) PoolOptions {
+	options.FlushEvery = flushEvery
+	return options
+}
+
+// WithOptimisticBackoff returns a new copy of the options with the
+// OptimisticBackoff property set to the given value. It does not mutate the
+// original options.
+func (options PoolOptions) WithOptimisticBackoff(backoff func(attempt int) time.Duration) PoolOptions {
+	options.OptimisticBackoff = backoff
+	return options
+}
+
 // NewPool creates and returns a new pool using the given address to connect to
 // Redis. All the other options will be set to their default values, which can
 // be found in DefaultPoolOptions.
@@ -137,9 +294,10 @@ func NewPool(address string) *Pool {
 // methods of DefaultOptions to change the options you want to change.
 func NewPoolWithOptions(options PoolOptions) *Pool {
 	pool := &Pool{
-		options:         options,
-		modelTypeToSpec: map[reflect.Type]*modelSpec{},
-		modelNameToSpec: map[string]*modelSpec{},
+		options:               options,
+		modelTypeToSpec:       map[reflect.Type]*modelSpec{},
+		modelNameToSpec:       map[string]*modelSpec{},
+		modelNameToCollection: map[string]*Collection{},
 	}
 	pool.redisPool = &redis.Pool{
 		MaxIdle:     options.MaxIdle,
@@ -147,7 +305,13 @@ func NewPoolWithOptions(options PoolOptions) *Pool {
 		IdleTimeout: options.IdleTimeout,
 		Wait:        options.Wait,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial(options.Network, options.Address)
+			if options.DialFunc != nil {
+				return options.DialFunc(context.Background())
+			}
+			c, err := redis.Dial(options.Network, options.Address,
+				redis.DialReadTimeout(options.ReadTimeout),
+				redis.DialWriteTimeout(options.WriteTimeout),
+			)
 			if err != nil {
 				return nil, err
 			}
@@ -169,13 +333,325 @@ func NewPoolWithOptions(options PoolOptions) *Pool {
 	return pool
 }
 
+// PoolStats contains statistics about a pool. It is returned by Pool.Stats.
+type PoolStats struct {
+	// ActiveCount is the number of connections in the pool, including idle
+	// connections and connections in use.
+	ActiveCount int
+	// IdleCount is the number of idle connections in the pool.
+	IdleCount int
+	// OptimisticConflicts is the number of transactions which were aborted
+	// because a watched key was modified by another client (e.g. by a
+	// concurrent Upsert for the same value).
+	OptimisticConflicts uint64
+	// TransactionRetries is the number of times an operation (Upsert or
+	// WithOptimisticRetry) retried a transaction after a conflict.
+	TransactionRetries uint64
+}
+
+// Stats returns statistics about the pool. The counters are cumulative from
+// the time the pool was created and are updated atomically, so Stats is cheap
+// and safe to call concurrently (e.g. to periodically report metrics). Note
+// that the counters are kept for the pool which created the transaction, so
+// operations on a collection with a dedicated pool (see
+// CollectionOptions.Pool) are counted in the dedicated pool.
+func (p *Pool) Stats() PoolStats {
+	redisStats := p.redisPool.Stats()
+	return PoolStats{
+		ActiveCount:         redisStats.ActiveCount,
+		IdleCount:           redisStats.IdleCount,
+		OptimisticConflicts: atomic.LoadUint64(&p.optimisticConflicts),
+		TransactionRetries:  atomic.LoadUint64(&p.transactionRetries),
+	}
+}
+
+// RegisteredCollections returns all the collections that have been created
+// for the pool via NewCollection or NewCollectionWithOptions, sorted by name.
+// It is useful for building generic tools (e.g. for exporting data or
+// administration) which need to operate on every collection.
+func (p *Pool) RegisteredCollections() []*Collection {
+	p.registryMut.RLock()
+	defer p.registryMut.RUnlock()
+	collections := make([]*Collection, 0, len(p.modelNameToCollection))
+	for _, collection := range p.modelNameToCollection {
+		collections = append(collections, collection)
+	}
+	sort.Slice(collections, func(i, j int) bool {
+		return collections[i].Name() < collections[j].Name()
+	})
+	return collections
+}
+
+// CountAll returns the number of models in each indexed collection that has
+// been registered with the pool, keyed by the name of the collection. The
+// counts for all of the collections are read in a single transaction, so it
+// takes one round trip no matter how many collections there are, which makes
+// it useful for e.g. an overview page on a dashboard. Like Collection.Count,
+// each count is the size of the set of all ids for the collection, so it
+// reflects the ids which are stored and nothing else. Any application-level
+// state such as a "deleted" flag on a model is not taken into account, and
+// models which have expired (see Collection.Touch) are still counted.
+// Collections which are not indexed do not keep a set of ids and are not
+// included, and neither are collections which have data in the database but
+// were never registered in the current process (see CollectionNames).
+func (p *Pool) CountAll() (map[string]int, error) {
+	collections := []*Collection{}
+	for _, collection := range p.RegisteredCollections() {
+		if collection.index {
+			collections = append(collections, collection)
+		}
+	}
+	counts := make([]int, len(collections))
+	t := p.NewTransaction()
+	for i, collection := range collections {
+		t.Count(collection, &counts[i])
+	}
+	if err := t.Exec(); err != nil {
+		return nil, err
+	}
+	result := make(map[string]int, len(collections))
+	for i, collection := range collections {
+		result[collection.Name()] = counts[i]
+	}
+	return result, nil
+}
+
+// collectionNamesKey is the key for a set which contains the name of every
+// collection which has had a model saved in it. It does not contain a colon, so
+// it cannot conflict with any of the keys for a collection.
+const collectionNamesKey = "zoomCollections"
+
+// CollectionNames returns the names of all the collections which have data in
+// the database, sorted by name. Unlike RegisteredCollections, it includes
+// collections which were never created in the current process, so it can be
+// used by generic tools (e.g. for administration) which do not import the
+// packages that declare every model. It reads a set which Zoom maintains
+// instead of scanning the keyspace. A collection is added to the set whenever a
+// model in it is saved, and is only removed by Truncate. So a collection whose
+// models were deleted with Delete or DeleteAll (or which expired, see
+// Collection.Touch) is still included.
+func (p *Pool) CollectionNames() ([]string, error) {
+	conn := p.NewConn()
+	defer conn.Close()
+	names, err := redis.Strings(conn.Do("SMEMBERS", collectionNamesKey))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// addCollectionName adds a command to the transaction which adds the name of c
+// to the set of collection names. See Pool.CollectionNames.
+func (t *Transaction) addCollectionName(c *Collection) {
+	t.Command("SADD", redis.Args{collectionNamesKey, c.Name()}, nil)
+}
+
+// CollectionForName returns the collection for the pool with the given name.
+// The second return value is false if no collection with the given name has
+// been created for the pool.
+func (p *Pool) CollectionForName(name string) (*Collection, bool) {
+	p.registryMut.RLock()
+	defer p.registryMut.RUnlock()
+	collection, found := p.modelNameToCollection[name]
+	return collection, found
+}
+
+// CollectionForModel returns the collection for the pool which was registered
+// with the type of model. If no collection has been registered for the type, it
+// returns a CollectionNotRegisteredError, unless the AutoRegister option is set
+// for the pool, in which case a collection is registered with
+// DefaultCollectionOptions (see NewCollection) and returned.
+func (p *Pool) CollectionForModel(model Model) (*Collection, error) {
+	typ := reflect.TypeOf(model)
+	if collection, found := p.collectionForType(typ); found {
+		return collection, nil
+	}
+	if typ == nil || !p.options.AutoRegister || !typeIsPointerToStruct(typ) {
+		return nil, CollectionNotRegisteredError{Type: typ}
+	}
+	collection, err := p.NewCollection(model)
+	if err != nil {
+		// Another goroutine may have registered the type in the meantime.
+		if collection, found := p.collectionForType(typ); found {
+			return collection, nil
+		}
+		return nil, err
+	}
+	return collection, nil
+}
+
+// collectionForType returns the collection for the pool which was registered
+// with the given type. The second return value is false if there is none.
+func (p *Pool) collectionForType(typ reflect.Type) (*Collection, bool) {
+	p.registryMut.RLock()
+	defer p.registryMut.RUnlock()
+	spec, found := p.modelTypeToSpec[typ]
+	if !found {
+		return nil, false
+	}
+	collection, found := p.modelNameToCollection[spec.name]
+	return collection, found
+}
+
+// Save writes a model to the database in the collection which was registered
+// with its type, as if by calling Save on that collection (see
+// Collection.Save). It is useful for generic code which does not have a
+// reference to the collection. If no collection has been registered for the
+// type of model, Save returns a CollectionNotRegisteredError, which names the
+// type, unless the AutoRegister option is set for the pool (see
+// CollectionForModel).
+func (p *Pool) Save(model Model) error {
+	collection, err := p.CollectionForModel(model)
+	if err != nil {
+		return err
+	}
+	return collection.Save(model)
+}
+
 // NewConn gets a connection from the pool and returns it.
 // It can be used for directly interacting with the database. See
 // http://godoc.org/github.com/garyburd/redigo/redis for full documentation
 // on the redis.Conn type. You must call Close on any connections after you are
-// done using them. Failure to call Close can cause a resource leak.
+// done using them. Failure to call Close can cause a resource leak. If there
+// was an error getting a connection (e.g. ErrPoolExhausted), NewConn still
+// returns a connection, but all of its methods return the error.
 func (p *Pool) NewConn() redis.Conn {
-	return p.redisPool.Get()
+	return p.newConn(context.Background())
+}
+
+// newConn works like NewConn, but stops waiting for a connection when ctx is
+// done, in which case all of the methods of the returned connection return
+// ctx.Err(). The connection itself is not affected by ctx.
+func (p *Pool) newConn(ctx context.Context) redis.Conn {
+	if !p.options.Wait || p.options.MaxActive == 0 {
+		return p.redisPool.Get()
+	}
+	waitCtx := ctx
+	if p.options.MaxConnWaitTime > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, p.options.MaxConnWaitTime)
+		defer cancel()
+	}
+	conn, err := p.redisPool.GetContext(waitCtx)
+	if err != nil && ctx.Err() != nil {
+		return errorConn{ctx.Err()}
+	}
+	if err == context.DeadlineExceeded {
+		return errorConn{ErrPoolExhausted}
+	}
+	return conn
+}
+
+// errorConn is a connection which returns err from all of its methods. It is
+// returned by NewConn when there was an error getting a connection.
+type errorConn struct {
+	err error
+}
+
+func (ec errorConn) Close() error                                   { return nil }
+func (ec errorConn) Err() error                                     { return ec.err }
+func (ec errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, ec.err }
+func (ec errorConn) Send(string, ...interface{}) error              { return ec.err }
+func (ec errorConn) Flush() error                                   { return ec.err }
+func (ec errorConn) Receive() (interface{}, error)                  { return nil, ec.err }
+
+func (ec errorConn) DoWithTimeout(time.Duration, string, ...interface{}) (interface{}, error) {
+	return nil, ec.err
+}
+func (ec errorConn) ReceiveWithTimeout(time.Duration) (interface{}, error) { return nil, ec.err }
+
+// deadlineConn is a connection which applies a single deadline to all of the
+// commands sent on it, by using the time remaining until the deadline as the
+// read timeout for each one. Once the deadline has passed, Do and Receive
+// return context.DeadlineExceeded without using the connection. It is used
+// for transactions with a context (see Query.WithContext), and requires the
+// underlying connection to support timeouts (see redis.ConnWithTimeout).
+type deadlineConn struct {
+	redis.Conn
+	deadline time.Time
+}
+
+func (dc deadlineConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	remaining := time.Until(dc.deadline)
+	if remaining <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	return redis.DoWithTimeout(dc.Conn, remaining, commandName, args...)
+}
+
+func (dc deadlineConn) Receive() (interface{}, error) {
+	remaining := time.Until(dc.deadline)
+	if remaining <= 0 {
+		return nil, context.DeadlineExceeded
+	}
+	return redis.ReceiveWithTimeout(dc.Conn, remaining)
+}
+
+// ServerTime returns the current time according to the Redis server, using
+// the TIME command. It is useful when you need timestamps that are consistent
+// across many application servers, whose clocks may not be perfectly in sync.
+// ServerTime does not cache anything, so each call results in a round trip to
+// the database.
+func (p *Pool) ServerTime() (time.Time, error) {
+	conn := p.NewConn()
+	defer conn.Close()
+	reply, err := redis.Int64s(conn.Do("TIME"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(reply) != 2 {
+		return time.Time{}, fmt.Errorf("zoom: error in ServerTime: expected 2 values in reply from TIME but got %d", len(reply))
+	}
+	// The reply consists of the unix time in seconds and the number of
+	// microseconds that have elapsed in the current second.
+	return time.Unix(reply[0], reply[1]*int64(time.Microsecond)), nil
+}
+
+// HealthCheck verifies that the pool can connect to Redis and that Redis is
+// able to run the Lua scripts Zoom depends on. It is intended to be used for
+// readiness or liveness probes. HealthCheck performs the following checks in
+// order:
+//
+//  1. Gets a connection from the pool, waiting no longer than ctx allows.
+//  2. Sends a PING command.
+//  3. Runs a trivial script with EVAL to make sure scripting is enabled.
+//  4. Loads all of Zoom's scripts with SCRIPT LOAD to make sure they parse.
+//
+// If any of the checks fail, HealthCheck returns an error which identifies the
+// check that failed. ctx is checked between each step, so HealthCheck will also
+// return an error if ctx is done before all the checks have finished.
+func (p *Pool) HealthCheck(ctx context.Context) error {
+	conn, err := p.redisPool.GetContext(ctx)
+	if err != nil {
+		return fmt.Errorf("zoom: health check failed: could not get a connection: %s", err.Error())
+	}
+	defer conn.Close()
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("zoom: health check failed: %s", err.Error())
+	}
+	if pong, err := redis.String(conn.Do("PING")); err != nil {
+		return fmt.Errorf("zoom: health check failed: error in PING: %s", err.Error())
+	} else if pong != "PONG" {
+		return fmt.Errorf("zoom: health check failed: expected PONG in reply to PING but got %s", pong)
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("zoom: health check failed: %s", err.Error())
+	}
+	if reply, err := redis.Int(conn.Do("EVAL", "return 1", 0)); err != nil {
+		return fmt.Errorf("zoom: health check failed: error in EVAL: %s", err.Error())
+	} else if reply != 1 {
+		return fmt.Errorf("zoom: health check failed: expected 1 in reply to EVAL but got %d", reply)
+	}
+	for _, script := range allScripts {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("zoom: health check failed: %s", err.Error())
+		}
+		if err := script.Load(conn); err != nil {
+			return fmt.Errorf("zoom: health check failed: error in SCRIPT LOAD: %s", err.Error())
+		}
+	}
+	return nil
 }
 
 // Close closes the pool. It should be run whenever the pool is no longer
@@ -0,0 +1,646 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File pool_test.go tests the code in pool.go
+
+package zoom
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestServerTime(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	before := time.Now()
+	serverTime, err := testPool.ServerTime()
+	if err != nil {
+		t.Fatalf("Unexpected error in ServerTime: %s", err.Error())
+	}
+	// The test database is typically running on the same machine, so the server
+	// time should be very close to the local time.
+	if diff := serverTime.Sub(before); diff < -time.Second || diff > time.Second {
+		t.Errorf("Server time was not close to local time. Local: %s, Server: %s", before, serverTime)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	if err := testPool.HealthCheck(context.Background()); err != nil {
+		t.Errorf("Unexpected error in HealthCheck: %s", err.Error())
+	}
+
+	// A context which is already done should cause an error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := testPool.HealthCheck(ctx); err == nil {
+		t.Error("Expected an error in HealthCheck with a canceled context but got none")
+	}
+
+	// A pool which cannot connect should cause an error
+	badPool := NewPool("localhost:1")
+	defer badPool.Close()
+	if err := badPool.HealthCheck(context.Background()); err == nil {
+		t.Error("Expected an error in HealthCheck with a bad address but got none")
+	}
+}
+
+func TestRegisteredCollections(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	collections := testPool.RegisteredCollections()
+	for _, expected := range []*Collection{testModels, indexedTestModels, indexedPrimativesModels, indexedPointersModels} {
+		found := false
+		for _, collection := range collections {
+			if collection == expected {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Expected RegisteredCollections to contain %s", expected.Name())
+		}
+	}
+	for i := 1; i < len(collections); i++ {
+		if collections[i-1].Name() > collections[i].Name() {
+			t.Errorf("Expected RegisteredCollections to be sorted by name but %s came before %s", collections[i-1].Name(), collections[i].Name())
+		}
+	}
+
+	if collection, found := testPool.CollectionForName(indexedTestModels.Name()); !found {
+		t.Errorf("Expected to find collection named %s", indexedTestModels.Name())
+	} else if collection != indexedTestModels {
+		t.Errorf("CollectionForName returned the wrong collection. Expected %s but got %s", indexedTestModels.Name(), collection.Name())
+	}
+	if _, found := testPool.CollectionForName("notRegistered"); found {
+		t.Error("Expected to not find a collection named notRegistered")
+	}
+}
+
+func TestCountAll(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use a separate pool so that only the collections below are registered.
+	pool := NewPoolWithOptions(testPool.options)
+	defer pool.Close()
+	type countAllModel struct {
+		Name string
+		RandomId
+	}
+	type emptyCountAllModel struct {
+		RandomId
+	}
+	type unindexedCountAllModel struct {
+		RandomId
+	}
+	options := DefaultCollectionOptions.WithIndex(true)
+	counted, err := pool.NewCollectionWithOptions(&countAllModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := pool.NewCollectionWithOptions(&emptyCountAllModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unindexed, err := pool.NewCollectionWithOptions(&unindexedCountAllModel{}, DefaultCollectionOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := counted.Save(&countAllModel{Name: randomString()}); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	if err := unindexed.Save(&unindexedCountAllModel{}); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+
+	// Unindexed collections should not be included.
+	expected := map[string]int{counted.Name(): 3, empty.Name(): 0}
+	if got, err := pool.CountAll(); err != nil {
+		t.Fatalf("Unexpected error in CountAll: %s", err.Error())
+	} else if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wrong counts.\nExpected: %v\nGot:      %v", expected, got)
+	}
+}
+
+func TestCollectionNames(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	if names, err := testPool.CollectionNames(); err != nil {
+		t.Fatalf("Unexpected error in CollectionNames: %s", err.Error())
+	} else if len(names) != 0 {
+		t.Errorf("Expected no collection names for an empty database but got %v", names)
+	}
+	if _, err := createAndSaveTestModels(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createAndSaveIndexedTestModels(1); err != nil {
+		t.Fatal(err)
+	}
+	// Saving more models in the same collection should not add duplicates.
+	if _, err := createAndSaveIndexedTestModels(1); err != nil {
+		t.Fatal(err)
+	}
+	names, err := testPool.CollectionNames()
+	if err != nil {
+		t.Fatalf("Unexpected error in CollectionNames: %s", err.Error())
+	}
+	expected := []string{indexedTestModels.Name(), testModels.Name()}
+	if testModels.Name() < indexedTestModels.Name() {
+		expected = []string{testModels.Name(), indexedTestModels.Name()}
+	}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf("CollectionNames was incorrect.\nExpected: %v\nGot:      %v", expected, names)
+	}
+
+	// Truncate should remove the collection name.
+	if err := indexedTestModels.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := testPool.CollectionNames(); err != nil {
+		t.Fatalf("Unexpected error in CollectionNames: %s", err.Error())
+	} else if !reflect.DeepEqual([]string{testModels.Name()}, names) {
+		t.Errorf("Expected only %s after Truncate but got %v", testModels.Name(), names)
+	}
+	// The next write after Truncate should add the name again.
+	if _, err := createAndSaveIndexedTestModels(1); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := testPool.CollectionNames(); err != nil {
+		t.Fatalf("Unexpected error in CollectionNames: %s", err.Error())
+	} else if !reflect.DeepEqual(expected, names) {
+		t.Errorf("Expected %v after saving again but got %v", expected, names)
+	}
+}
+
+func TestPoolSave(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Save should find the collection for a registered type.
+	model := &indexedTestModel{Int: 42}
+	if err := testPool.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	found := &indexedTestModel{}
+	if err := indexedTestModels.Find(model.ModelId(), found); err != nil {
+		t.Fatalf("Expected the model to be saved in its collection but got: %s", err.Error())
+	}
+
+	// Unregistered types should cause a typed error which names the type.
+	type autoRegisterModel struct {
+		Name string
+		RandomId
+	}
+	err := testPool.Save(&autoRegisterModel{Name: "a"})
+	var notRegistered CollectionNotRegisteredError
+	if !errors.Is(err, ErrCollectionNotRegistered) || !errors.As(err, &notRegistered) {
+		t.Fatalf("Expected a CollectionNotRegisteredError but got %v", err)
+	}
+	if notRegistered.Type != reflect.TypeOf(&autoRegisterModel{}) {
+		t.Errorf("Expected the error to name the type %T but got %s", &autoRegisterModel{}, notRegistered.Type)
+	}
+	if err := NewScanModelHandler([]string{"Name"}, &autoRegisterModel{})(nil); !errors.Is(err, ErrCollectionNotRegistered) {
+		t.Errorf("Expected a CollectionNotRegisteredError from NewScanModelHandler but got %v", err)
+	}
+
+	// With AutoRegister, the type should be registered with the default
+	// options the first time it is saved.
+	autoPool := NewPoolWithOptions(testPool.options.WithAutoRegister(true))
+	defer autoPool.Close()
+	saved := &autoRegisterModel{Name: "b"}
+	if err := autoPool.Save(saved); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	collection, err := autoPool.CollectionForModel(&autoRegisterModel{})
+	if err != nil {
+		t.Fatalf("Unexpected error in CollectionForModel: %s", err.Error())
+	}
+	if collection.Name() != "autoRegisterModel" {
+		t.Errorf("Expected the collection to be named autoRegisterModel but got %s", collection.Name())
+	}
+	got := &autoRegisterModel{}
+	if err := collection.Find(saved.ModelId(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	} else if !reflect.DeepEqual(saved, got) {
+		t.Errorf("Expected %+v but got %+v", saved, got)
+	}
+	if err := autoPool.Save(nil); !errors.Is(err, ErrCollectionNotRegistered) {
+		t.Errorf("Expected a CollectionNotRegisteredError for a nil model but got %v", err)
+	}
+}
+
+func TestDialFunc(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	dialCount := 0
+	dialFunc := func(ctx context.Context) (redis.Conn, error) {
+		dialCount++
+		conn, err := redis.Dial(*network, *address)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Do("SELECT", *database); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	// The address is invalid, so the pool can only connect if DialFunc is used.
+	options := DefaultPoolOptions.WithAddress("localhost:1").WithDialFunc(dialFunc)
+	pool := NewPoolWithOptions(options)
+	defer pool.Close()
+	if err := pool.HealthCheck(context.Background()); err != nil {
+		t.Fatalf("Unexpected error in HealthCheck: %s", err.Error())
+	}
+	if dialCount != 1 {
+		t.Errorf("Expected DialFunc to be called once but got %d", dialCount)
+	}
+
+	// Errors from DialFunc should be returned
+	dialErr := errors.New("dial error")
+	failingPool := NewPoolWithOptions(DefaultPoolOptions.WithDialFunc(func(ctx context.Context) (redis.Conn, error) {
+		return nil, dialErr
+	}))
+	defer failingPool.Close()
+	conn := failingPool.NewConn()
+	defer conn.Close()
+	if err := conn.Err(); err != dialErr {
+		t.Errorf("Expected error from DialFunc but got: %v", err)
+	}
+}
+
+// flushCountingConn is a redis.Conn which counts the number of times Flush is
+// called.
+type flushCountingConn struct {
+	redis.Conn
+	flushes *int
+}
+
+func (c flushCountingConn) Flush() error {
+	(*c.flushes)++
+	return c.Conn.Flush()
+}
+
+func TestFlushEvery(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	flushes := 0
+	options := testPool.options.WithFlushEvery(5).WithDialFunc(func(ctx context.Context) (redis.Conn, error) {
+		conn, err := redis.Dial(*network, *address)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Do("SELECT", *database); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return flushCountingConn{Conn: conn, flushes: &flushes}, nil
+	})
+	pool := NewPoolWithOptions(options)
+	defer pool.Close()
+
+	// The replies should still be passed to the handlers after EXEC.
+	const numCommands = 12
+	values := make([]int, numCommands)
+	tx := pool.NewTransaction()
+	for i := range values {
+		tx.Command("INCRBY", redis.Args{"flushEvery", 1}, NewScanIntHandler(&values[i]))
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Unexpected error in Exec: %s", err.Error())
+	}
+	for i, value := range values {
+		if value != i+1 {
+			t.Errorf("Expected reply %d to be %d but got %d", i, i+1, value)
+		}
+	}
+	// The connection should have been flushed after the 5th and 10th commands.
+	// Sending EXEC flushes the rest.
+	if flushes != 2 {
+		t.Errorf("Expected 2 flushes before EXEC but got %d", flushes)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	options := testPool.options.WithReadTimeout(50 * time.Millisecond).WithWriteTimeout(time.Second)
+	pool := NewPoolWithOptions(options)
+	defer pool.Close()
+	conn := pool.NewConn()
+	defer conn.Close()
+	// Dialing and fast commands should not be affected.
+	if _, err := conn.Do("PING"); err != nil {
+		t.Fatalf("Unexpected error in PING: %s", err.Error())
+	}
+	// A command which blocks for longer than the read timeout should fail
+	// without waiting for the reply.
+	start := time.Now()
+	if _, err := conn.Do("BLPOP", "readTimeoutKey", 1); err == nil {
+		t.Error("Expected an error for a command which blocks longer than the read timeout but got none")
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected the command to time out after 50ms but it took %s", elapsed)
+	}
+}
+
+func TestMaxConnWaitTime(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	options := testPool.options.WithMaxActive(1).WithWait(true).WithMaxConnWaitTime(50 * time.Millisecond)
+	pool := NewPoolWithOptions(options)
+	defer pool.Close()
+	conn := pool.NewConn()
+	if _, err := conn.Do("PING"); err != nil {
+		t.Fatalf("Unexpected error in PING: %s", err.Error())
+	}
+	// While the only connection is in use, getting another one should fail
+	// with ErrPoolExhausted after MaxConnWaitTime instead of blocking.
+	start := time.Now()
+	if err := pool.NewTransaction().Exec(); err == nil {
+		t.Error("Expected an error when the pool is exhausted but got none")
+	} else if !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("Expected ErrPoolExhausted but got: %T: %s", err, err.Error())
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("Expected to stop waiting after 50ms but it took %s", elapsed)
+	}
+	// Once the connection is released, it should be reused.
+	conn.Close()
+	conn = pool.NewConn()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		t.Errorf("Unexpected error in PING after the connection was released: %s", err.Error())
+	}
+
+	// Without Wait, the pool should return ErrPoolExhausted immediately.
+	noWait := NewPoolWithOptions(testPool.options.WithMaxActive(1).WithWait(false))
+	defer noWait.Close()
+	held := noWait.NewConn()
+	defer held.Close()
+	if _, err := held.Do("PING"); err != nil {
+		t.Fatalf("Unexpected error in PING: %s", err.Error())
+	}
+	if _, err := noWait.NewConn().Do("PING"); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("Expected ErrPoolExhausted but got %v", err)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use a separate pool so that the counters are not affected by other tests.
+	pool := NewPoolWithOptions(testPool.options)
+	defer pool.Close()
+	stats := pool.Stats()
+	if stats.OptimisticConflicts != 0 || stats.TransactionRetries != 0 {
+		t.Errorf("Expected counters for a new pool to be 0 but got %+v", stats)
+	}
+
+	// Modify a watched key from another connection to cause a conflict.
+	tx := pool.NewTransaction()
+	if err := tx.Watch("poolStatsKey"); err != nil {
+		t.Fatal(err)
+	}
+	conn := pool.NewConn()
+	defer conn.Close()
+	if _, err := conn.Do("SET", "poolStatsKey", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Command("SET", redis.Args{"poolStatsKey", "tx"}, nil)
+	if err := tx.Exec(); err != ErrOptimisticLock {
+		t.Errorf("Expected ErrOptimisticLock but got %v", err)
+	}
+	stats = pool.Stats()
+	if stats.OptimisticConflicts != 1 {
+		t.Errorf("Expected OptimisticConflicts to be 1 but got %d", stats.OptimisticConflicts)
+	}
+	if stats.TransactionRetries != 0 {
+		t.Errorf("Expected TransactionRetries to be 0 but got %d", stats.TransactionRetries)
+	}
+	if stats.ActiveCount < 1 {
+		t.Errorf("Expected ActiveCount to be at least 1 but got %d", stats.ActiveCount)
+	}
+
+	// Every conflict in a concurrent Upsert should be retried.
+	collection, err := pool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			_, err := collection.Upsert("String", "stats", &indexedTestModel{Int: i, String: "stats"})
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Unexpected error in Upsert: %s", err.Error())
+		}
+	}
+	stats = pool.Stats()
+	if stats.TransactionRetries != stats.OptimisticConflicts-1 {
+		t.Errorf("Expected TransactionRetries to be %d but got %d", stats.OptimisticConflicts-1, stats.TransactionRetries)
+	}
+}
+
+func TestPoolHooks(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use a separate pool so that the hooks do not affect other tests.
+	pool := NewPoolWithOptions(testPool.options)
+	defer pool.Close()
+	collection, err := pool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saves, deletes []string
+	pool.OnSave(func(name, id string) {
+		if name != collection.Name() {
+			t.Errorf("Expected collection name %s but got %s", collection.Name(), name)
+		}
+		saves = append(saves, id)
+	})
+	pool.OnDelete(func(name, id string) {
+		deletes = append(deletes, id)
+	})
+
+	models := createIndexedTestModels(3)
+	tx := pool.NewTransaction()
+	for _, model := range models {
+		tx.Save(collection, model)
+	}
+	if len(saves) != 0 {
+		t.Errorf("Expected OnSave not to be called before Exec but got %v", saves)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{models[0].ModelId(), models[1].ModelId(), models[2].ModelId()}
+	if !reflect.DeepEqual(expected, saves) {
+		t.Errorf("Expected saves %v but got %v", expected, saves)
+	}
+
+	// Hooks should only be called for conditional saves which happened.
+	saves = nil
+	if saved, err := collection.SaveIfNotExists(models[0]); err != nil {
+		t.Fatal(err)
+	} else if saved {
+		t.Error("Expected SaveIfNotExists to return false for an existing model")
+	}
+	newModel := createIndexedTestModels(1)[0]
+	if _, err := collection.SaveIfNotExists(newModel); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{newModel.ModelId()}; !reflect.DeepEqual(expected, saves) {
+		t.Errorf("Expected saves %v but got %v", expected, saves)
+	}
+
+	// Hooks should not be called if the transaction fails.
+	saves = nil
+	tx = pool.NewTransaction()
+	tx.Save(collection, models[0])
+	tx.Command("NOTACOMMAND", nil, nil)
+	if err := tx.Exec(); err == nil {
+		t.Error("Expected an error for an invalid command but got none")
+	}
+	if len(saves) != 0 {
+		t.Errorf("Expected OnSave not to be called for a failed transaction but got %v", saves)
+	}
+
+	if _, err := collection.Delete(models[0].ModelId()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collection.DeleteAll(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{models[0].ModelId(), ""}; !reflect.DeepEqual(expected, deletes) {
+		t.Errorf("Expected deletes %v but got %v", expected, deletes)
+	}
+
+	// Removing the hooks should make them no-ops again.
+	pool.OnSave(nil)
+	saves = nil
+	if err := collection.Save(models[1]); err != nil {
+		t.Fatal(err)
+	}
+	if len(saves) != 0 {
+		t.Errorf("Expected no saves after removing the hook but got %v", saves)
+	}
+}
+
+// scanRecordingConn is a redis.Conn which records the COUNT argument of every
+// SCAN and SSCAN command.
+type scanRecordingConn struct {
+	redis.Conn
+	counts map[string][]interface{}
+}
+
+func (c scanRecordingConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	if commandName == "SCAN" || commandName == "SSCAN" {
+		for i := 0; i < len(args)-1; i++ {
+			if args[i] == "COUNT" {
+				c.counts[commandName] = append(c.counts[commandName], args[i+1])
+			}
+		}
+	}
+	return c.Conn.Do(commandName, args...)
+}
+
+func TestScanCount(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	counts := map[string][]interface{}{}
+	options := testPool.options.WithScanCount(2).WithDialFunc(func(ctx context.Context) (redis.Conn, error) {
+		conn, err := redis.Dial(*network, *address)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Do("SELECT", *database); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return scanRecordingConn{Conn: conn, counts: counts}, nil
+	})
+	pool := NewPoolWithOptions(options)
+	defer pool.Close()
+
+	type scanCountModel struct {
+		Name string
+		RandomId
+	}
+	// A type can only be registered once per pool, so the renamed collection
+	// uses a copy of the type.
+	type renamedScanCountModel scanCountModel
+	const oldName, newName = "scanCountOld", "scanCountNew"
+	olds, err := pool.NewCollectionWithOptions(&scanCountModel{}, DefaultCollectionOptions.WithIndex(true).WithName(oldName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const numModels = 5
+	for i := 0; i < numModels; i++ {
+		if err := olds.Save(&scanCountModel{Name: randomString()}); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	if orphans, err := olds.FindOrphans(); err != nil {
+		t.Fatalf("Unexpected error in FindOrphans: %s", err.Error())
+	} else if len(orphans) != 0 {
+		t.Errorf("Expected no orphans but got %v", orphans)
+	}
+	if err := pool.RenameCollection(oldName, newName); err != nil {
+		t.Fatalf("Unexpected error in RenameCollection: %s", err.Error())
+	}
+	news, err := pool.NewCollectionWithOptions(&renamedScanCountModel{}, DefaultCollectionOptions.WithIndex(true).WithName(newName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, err := news.Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if count != numModels {
+		t.Errorf("Expected %d models after renaming but got %d", numModels, count)
+	}
+	if err := news.Truncate(); err != nil {
+		t.Fatalf("Unexpected error in Truncate: %s", err.Error())
+	}
+	if count, err := news.Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if count != 0 {
+		t.Errorf("Expected 0 models after Truncate but got %d", count)
+	}
+
+	// Every SCAN and SSCAN should have used the COUNT hint from the options.
+	for _, command := range []string{"SCAN", "SSCAN"} {
+		if len(counts[command]) == 0 {
+			t.Errorf("Expected at least one %s command but got none", command)
+		}
+		for _, count := range counts[command] {
+			if count != 2 {
+				t.Errorf("Expected %s to use COUNT 2 but got %v", command, count)
+			}
+		}
+	}
+}
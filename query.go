@@ -1,5 +1,18 @@
 package zoom
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
 // Query represents a query which will retrieve some models from
 // the database. A Query may consist of one or more query modifiers
 // (e.g. Filter or Order) and may be executed with a query finisher
@@ -25,7 +38,10 @@ func (collection *Collection) NewQuery() *Query {
 // constructor. By default, the records are sorted by ascending order by the
 // given field. To sort by descending order, put a negative sign before the
 // field name. Zoom can only sort by fields which have been indexed, i.e. those
-// which have the `zoom:"index"` struct tag. Only one order may be specified per
+// which have the `zoom:"index"` struct tag. Only models which are in the index
+// are returned, so models which have not been indexed yet (e.g. during a
+// migration which adds the index) are left out until they are saved again or
+// the field is reindexed. Only one order may be specified per query.
 // Order will set an error on the query if the fieldName is invalid, if another
 // order has already been applied to the query, or if the fieldName specified
 // does not correspond to an indexed field. The error, same as any other error
@@ -36,6 +52,46 @@ func (q *Query) Order(fieldName string) *Query {
 	return q
 }
 
+// OrderUnindexed specifies a field by which to sort the models, like Order,
+// except that the field does not need to be indexed. It is meant for occasional
+// sorts on fields which are rarely sorted, where keeping an index up to date on
+// every save would not be worth it. The models are sorted by Redis with the
+// SORT command and a BY pattern which reads the field from the main hash of
+// every model (e.g. SORT <ids> BY <collection>:*->fieldName), using the ALPHA
+// option for string fields and a numeric sort for bool, number, and time fields
+// with a numeric TimeFormat. Other types cause an error. As with Order, put a
+// negative sign before the field name to sort in descending order. Models with
+// no value for the field (e.g. a nil pointer) are sorted as if the value was 0,
+// or first for string fields. Models with the same numeric value are sorted by
+// id, but models with the same string value are returned in an unspecified
+// order.
+//
+// WARNING: Unlike Order, which reads an index which is already sorted,
+// OrderUnindexed makes Redis look up the field for every model which matches
+// the filters and then sort them on every run of the query. That is O(n log n)
+// in the number of matching models and can block Redis on large collections,
+// even if the query has a small Limit. Add an index to the field instead if
+// you sort by it often. Only one order may be specified per query, so
+// OrderUnindexed will set an error on the query if another order has already
+// been applied or if the field does not exist.
+func (q *Query) OrderUnindexed(fieldName string) *Query {
+	q.query.OrderUnindexed(fieldName)
+	return q
+}
+
+// Unordered specifies that the models should not be sorted at all. By default,
+// queries without an Order are sorted by id so that the results are consistent
+// between runs, which is important when paging through results with Limit and
+// Offset. Unordered skips the sort for a small speed boost, at the cost of the
+// results being in whatever order Redis returns them. Unordered will set an
+// error on the query if an order has already been applied to the query. The
+// error, same as any other error that occurs during the lifetime of the query,
+// is not returned until the query is executed.
+func (q *Query) Unordered() *Query {
+	q.query.Unordered()
+	return q
+}
+
 // Limit specifies an upper limit on the number of models to return. If amount
 // is 0, no limit will be applied and any number of models may be returned. The
 // default value is 0.
@@ -85,32 +141,378 @@ func (q *Query) Exclude(fields ...string) *Query {
 // ">", "<", ">=", or "<=". You can only use Filter on fields which are indexed,
 // i.e. those which have the `zoom:"index"` struct tag. If multiple filters are
 // applied to the same query, the query will only return models which have
-// matches for *all* of the filters. Filter will set an error on the query if
+// matches for *all* of the filters. Models which are missing from the index for
+// the field (e.g. models which were saved before the index was added and have
+// not been reindexed yet) never match the filter. They are simply left out of
+// the results instead of causing an error. Filter will set an error on the query if
 // the arguments are improperly formated, if the field you are attempting to
 // filter is not indexed, or if the type of value does not match the type of the
 // field. The error, same as any other error that occurs during the lifetime of
 // the query, is not returned until the query is executed.
+//
+// You can also filter on the model id by using the name of the field with the
+// `zoom:"id"` struct tag, or "Id" if there is no such field (and no other field
+// named Id). For example: Filter("Id >=", "1000"). The value must be a string,
+// and ids are compared lexicographically, so sequential ids should be
+// zero-padded to the same length. The ids are stored in an unordered set, so a
+// filter on the id copies every id in the collection into a temporary sorted
+// set when the query is run, which is O(N) in the size of the collection.
 func (q *Query) Filter(filterString string, value interface{}) *Query {
 	q.query.Filter(filterString, value)
 	return q
 }
 
+// Not negates the Filter modifier which immediately follows it, so that the
+// query only returns models which do not match that filter. For example,
+// Not().Filter("Status =", "active") returns all the models whose Status is
+// not "active", including models which have a nil value for Status and are
+// therefore not in the index at all. Not only applies to the next Filter, and
+// any other filters on the query are combined with it as usual. Under the hood,
+// the ids which match the filter are subtracted from the ids matching the rest
+// of the query criteria, preserving their order, so negated filters can be
+// combined with Order, Limit, and Offset. Not requires Redis version 6.2 or
+// higher. Not will set an error on the query if it is not followed by Filter,
+// or if it is called twice in a row. The error, same as any other error that
+// occurs during the lifetime of the query, is not returned until the query is
+// executed.
+func (q *Query) Not() *Query {
+	q.query.Not()
+	return q
+}
+
+// UnindexedFilter applies a filter which does not require an index, for
+// example UnindexedFilter("Description contains", "urgent") would only return
+// models where the Description field contains the substring "urgent". Currently
+// "contains" is the only supported operator, and the field must be a string or
+// a pointer to a string. Unlike Filter, UnindexedFilter works by running a Lua
+// script which reads the field from the main hash of every model that matches
+// the rest of the query criteria. That makes it an O(N) operation where N is the
+// number of candidate models, and it can block Redis for a long time on large
+// collections. It is intended for things like administrative searches where
+// speed is not important. If the query has a Limit and either an Order or the
+// Unordered modifier, the scan stops as soon as enough matching models have been
+// found, which can be used to bound its cost. UnindexedFilter will set an error
+// on the query if the arguments are improperly formatted or if the field is not
+// a string. The error, same as any other error that occurs during the lifetime
+// of the query, is not returned until the query is executed.
+func (q *Query) UnindexedFilter(filterString string, value string) *Query {
+	q.query.UnindexedFilter(filterString, value)
+	return q
+}
+
+// FilterFunc applies an arbitrary predicate to the models, for conditions which
+// cannot be expressed with Filter or UnindexedFilter. fn is called for every
+// model which matches the rest of the query criteria after it has been read
+// from the database, and only models for which fn returns true are included in
+// the results. The Limit and Offset modifiers are applied after fn, so only
+// matching models count toward the limit. This means that every candidate
+// model is read from the database (including the fields selected with Include
+// or Exclude, which are the only fields fn can inspect), no matter what the
+// limit is. To keep the cost down, use FilterFunc together with Filter to
+// narrow down the candidates with an index first. Queries with FilterFunc can
+// be finished with Run, RunOne, Count, or Ids, but not with StoreIds, Stream,
+// or CachedCount, since those rely on Redis to read or store the ids. FilterFunc
+// will set an error on the query if fn is nil.
+func (q *Query) FilterFunc(fn func(Model) bool) *Query {
+	q.query.FilterFunc(fn)
+	return q
+}
+
+// Debug causes the query to write a description of every Redis command and
+// script it issues to w, along with the time each one took, when it is
+// executed by a query finisher such as Run or Count. Scripts are identified by
+// the name of the .lua file they were generated from, and the size of the final
+// set of ids matching the query criteria is reported before any models are
+// read. Since most queries run inside a single MULTI/EXEC transaction, the
+// timing reported for the EXEC command covers all of the commands in the
+// transaction. Debug output is off by default, and is only enabled for this
+// query. Errors from w are ignored. It is intended for development and should
+// not normally be used in production.
+func (q *Query) Debug(w io.Writer) *Query {
+	q.debug = w
+	return q
+}
+
+// BatchSize specifies the number of models which are read from the database
+// in each round trip when the query is executed with Stream or RunWith. Larger batches
+// mean fewer round trips at the cost of holding more models in memory at once.
+// If size is 0, the default batch size of 100 is used. For SampleStream, it is
+// the number of ids which are read in each round trip instead, and the default
+// is 1000. The final batch may
+// contain fewer models than size. BatchSize does not affect which models are
+// returned or the order in which they are returned, and has no effect on the
+// other query finishers.
+func (q *Query) BatchSize(size uint) *Query {
+	q.batchSize = size
+	return q
+}
+
+// Cache causes Run to cache the results of the query (i.e. the fields of all
+// the models it returns) in Redis for the given ttl. Subsequent calls to Run
+// for an identical query with Cache will read the cached results instead of
+// running the query again until the ttl expires. Like CachedCount, the key for
+// the cached results includes the write count for the collection, so every
+// save or delete made through Zoom invalidates all of the cached results for
+// the collection at once. This invalidation is coarse-grained: a write to any
+// model in the collection invalidates every cached query, even if it could not
+// have changed the results, so Cache is most useful for collections which are
+// read much more often than they are written. Changes that are made without
+// Zoom (e.g. by running Redis commands directly) will not invalidate the cache,
+// and will not be reflected until the ttl expires. Cache only affects Run. It
+// cannot be combined with FilterFunc, since the predicates cannot be part of
+// the cache key. Cache will set an error on the query if ttl is less than one
+// millisecond.
+func (q *Query) Cache(ttl time.Duration) *Query {
+	q.query.Cache(ttl)
+	return q
+}
+
+// AllowPartialResults causes Run to skip any models which cannot be scanned,
+// e.g. because a field holds a value which is not valid for its type after the
+// data was corrupted or written by a different program. By default, Run is all
+// or nothing: it returns the first scan error and the contents of models are
+// unspecified. With AllowPartialResults, Run scans all the other models into
+// models as usual and then returns a PartialResultsError which has a ScanError
+// (including the model id) for each model that was skipped. Unless the query
+// has a FilterFunc, Limit and Offset are applied before the models are scanned,
+// so fewer models than the limit may be returned.
+// AllowPartialResults is intended for dealing with legacy or corrupt data, and
+// only affects Run.
+func (q *Query) AllowPartialResults() *Query {
+	q.partialResults = true
+	return q
+}
+
+// WithContext sets the context for running the query. If ctx is canceled or
+// its deadline passes while a query finisher (e.g. Run or Count) is running,
+// the finisher stops and returns ctx.Err(). Only the deadline can interrupt a
+// round trip to the database which is already in progress. Cancellation is
+// checked before each round trip and while waiting for a connection from the
+// pool. Any temporary sets created by the query are deleted when it stops
+// early. Stream uses the context which is passed to it instead. WithContext
+// will set an error on the query if ctx is nil.
+func (q *Query) WithContext(ctx context.Context) *Query {
+	if ctx == nil {
+		q.setError(fmt.Errorf("zoom: error in Query.WithContext: ctx cannot be nil"))
+		return q
+	}
+	q.ctx = ctx
+	return q
+}
+
+// Timeout sets a time limit for each query finisher (e.g. Run or Count). The
+// limit is a single budget for the whole finisher, not for each command.
+// Waiting for a connection from the pool, creating and combining the temporary
+// sets of ids for filters and orders, and reading the models all share the same
+// deadline. Finishers which make more than one round trip (e.g. Stream,
+// RunWith, or Run with Cache) also share it. If the deadline passes, the
+// finisher stops and returns context.DeadlineExceeded. Any temporary sets which
+// were created are deleted with UNLINK on a new connection in the background.
+// The deadline starts when the finisher is called, so the same query can be run
+// more than once. It is combined with any deadline from WithContext, and the
+// earlier deadline wins. If d is 0, the query has no time limit, which is the
+// default. Timeout requires connections which support read timeouts, which
+// includes all the connections created by redigo. Timeout will set an error on
+// the query if d is negative.
+func (q *Query) Timeout(d time.Duration) *Query {
+	if d < 0 {
+		q.setError(fmt.Errorf("zoom: error in Query.Timeout: d cannot be negative. Got: %s", d))
+		return q
+	}
+	q.timeout = d
+	return q
+}
+
+// newTransaction returns a new transaction which inherits the debug writer of
+// the query. The transaction respects ctx (see newTransactionContext), which
+// should come from runContext.
+func (q *Query) newTransaction(ctx context.Context) *Transaction {
+	tx := q.pool.newTransactionContext(ctx)
+	tx.debug = q.debug
+	return tx
+}
+
+// Err returns the first error that occurred during the lifetime of the query
+// (if any). Query modifiers such as Filter and Order validate their arguments
+// immediately, so Err can be used to check for invalid queries before they are
+// run. Query finishers such as Run will return the same error without touching
+// the database.
+func (q *Query) Err() error {
+	return q.err
+}
+
 // Run executes the query and scans the results into models. The type of models
-// should be a pointer to a slice of Models. If no models fit the criteria, Run
+// should be a pointer to a slice of Models (e.g. *[]*Person) or a pointer to a
+// slice of the structs they point to (e.g. *[]Person), in which case the
+// structs are populated directly. If no models fit the criteria, Run
 // will set the length of models to 0 but will *not* return an error. Run will
 // return the first error that occurred during the lifetime of the query (if
-// any), or if models is the wrong type.
+// any), or if models is the wrong type. All of the commands for the query,
+// including creating and deleting any temporary sets, are sent on a single
+// connection in one MULTI/EXEC transaction, so concurrent queries never see
+// each other's intermediate results.
 func (q *Query) Run(models interface{}) error {
-	tx := q.pool.NewTransaction()
-	newTransactionalQuery(q.query, tx).Run(models)
+	if q.hasError() {
+		return q.err
+	}
+	ctx, cancel := q.runContext(nil)
+	defer cancel()
+	scanErrs := q.newScanErrors()
+	if q.cacheTTL > 0 {
+		if err := q.runCached(ctx, models, scanErrs); err != nil {
+			return err
+		}
+		return newPartialResultsError(scanErrs)
+	}
+	tx := q.newTransaction(ctx)
+	newTransactionalQuery(q.query, tx).run(models, nil, scanErrs)
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	return newPartialResultsError(scanErrs)
+}
+
+// newScanErrors returns a pointer to a slice for collecting the errors for
+// models which could not be scanned if the query has AllowPartialResults, or
+// nil if every scan error should be returned immediately.
+func (q *Query) newScanErrors() *[]ScanError {
+	if !q.partialResults {
+		return nil
+	}
+	return &[]ScanError{}
+}
+
+// newPartialResultsError returns a PartialResultsError for the errors in
+// scanErrs, or nil if there were none.
+func newPartialResultsError(scanErrs *[]ScanError) error {
+	if scanErrs == nil || len(*scanErrs) == 0 {
+		return nil
+	}
+	return PartialResultsError{Errors: *scanErrs}
+}
+
+// runCached does the actual work for Run if the query has a Cache modifier. It
+// reads the cached results if there are any, and otherwise runs the query and
+// caches the results. Scan errors are handled as in Run.
+func (q *Query) runCached(ctx context.Context, models interface{}, scanErrs *[]ScanError) error {
+	if q.hasFilterFuncs() {
+		return fmt.Errorf("zoom: error in Query.Run: queries with FilterFunc cannot be cached")
+	}
+	if err := q.collection.spec.checkModelsType(models); err != nil {
+		return err
+	}
+	// Attempt to read the cached results.
+	var cacheKey string
+	var cached []byte
+	tx := q.newTransaction(ctx)
+	tx.getCachedResults(q.collection.spec, q.checksum(), func(reply interface{}) error {
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := redis.Scan(values, &cacheKey); err != nil {
+			return err
+		}
+		if values[1] == nil {
+			return nil
+		}
+		cached, err = redis.Bytes(values[1], nil)
+		return err
+	})
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	if cached != nil {
+		reply, err := decodeCachedReply(cached)
+		if err != nil {
+			return err
+		}
+		return newPartialScanModelsHandler(q.collection.spec, append(q.fieldNames(), "-"), models, scanErrs)(reply)
+	}
+	// There were no cached results. Run the query, keeping the raw reply so
+	// that we can cache it.
+	tx = q.newTransaction(ctx)
+	newTransactionalQuery(q.query, tx).run(models, func(reply interface{}) error {
+		var err error
+		cached, err = encodeCachedReply(reply)
+		return err
+	}, scanErrs)
+	if err := tx.Exec(); err != nil {
+		return err
+	}
+	tx = q.newTransaction(ctx)
+	tx.Command("SET", redis.Args{cacheKey, cached, "PX", int64(q.cacheTTL / time.Millisecond)}, nil)
 	return tx.Exec()
 }
 
+// encodeCachedReply encodes reply, which should be the reply from the SORT
+// command used to run a query, into a single string so that it can be cached.
+// Nil values (which represent nil fields) are preserved.
+func encodeCachedReply(reply interface{}) ([]byte, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	byteValues := make([][]byte, len(values))
+	for i, value := range values {
+		if value == nil {
+			continue
+		}
+		if byteValues[i], err = redis.Bytes(value, nil); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(byteValues)
+}
+
+// decodeCachedReply is the inverse of encodeCachedReply. It returns a reply
+// which can be passed to the same handler as the original reply.
+func decodeCachedReply(cached []byte) (interface{}, error) {
+	byteValues := [][]byte{}
+	if err := json.Unmarshal(cached, &byteValues); err != nil {
+		return nil, fmt.Errorf("zoom: could not decode cached query results: %s", err.Error())
+	}
+	values := make([]interface{}, len(byteValues))
+	for i, value := range byteValues {
+		if value != nil {
+			values[i] = value
+		}
+	}
+	return values, nil
+}
+
+// RunPageSorted is like Run, but also returns the total number of models which
+// match the query criteria, ignoring Limit and Offset. It is intended for
+// paginated lists (e.g. leaderboards) which need both a page of models and the
+// total number of models to render. The page and the total are read in the
+// same transaction, so they are always consistent with each other and only one
+// round trip is needed instead of calling Run and Count separately. The query
+// must have an Order, and RunPageSorted returns an error for queries with a
+// FilterFunc.
+func (q *Query) RunPageSorted(models interface{}) (total int, err error) {
+	if q.hasError() {
+		return 0, q.err
+	}
+	ctx, cancel := q.runContext(nil)
+	defer cancel()
+	tx := q.newTransaction(ctx)
+	newTransactionalQuery(q.query, tx).RunPageSorted(models, &total)
+	if err := tx.Exec(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
 // RunOne is exactly like Run but finds only the first model that fits the query
 // criteria and scans the values into model. If no model fits the criteria,
 // RunOne *will* return a ModelNotFoundError.
 func (q *Query) RunOne(model Model) error {
-	tx := q.pool.NewTransaction()
+	if q.hasError() {
+		return q.err
+	}
+	ctx, cancel := q.runContext(nil)
+	defer cancel()
+	tx := q.newTransaction(ctx)
 	newTransactionalQuery(q.query, tx).RunOne(model)
 	return tx.Exec()
 }
@@ -119,7 +521,18 @@ func (q *Query) RunOne(model Model) error {
 // actually retrieving the models themselves. Count will also return the first
 // error that occurred during the lifetime of the query (if any).
 func (q *Query) Count() (int, error) {
-	tx := q.pool.NewTransaction()
+	if q.hasError() {
+		return 0, q.err
+	}
+	ctx, cancel := q.runContext(nil)
+	defer cancel()
+	return q.count(ctx)
+}
+
+// count does the actual work for Count, using the given context (see
+// runContext).
+func (q *Query) count(ctx context.Context) (int, error) {
+	tx := q.newTransaction(ctx)
 	var count int
 	newTransactionalQuery(q.query, tx).Count(&count)
 	if err := tx.Exec(); err != nil {
@@ -128,11 +541,432 @@ func (q *Query) Count() (int, error) {
 	return count, nil
 }
 
+// Distinct returns the distinct values of the given field for the models that
+// match the query criteria. fieldName should be the name of an indexed field as
+// it appears in the struct definition, and is typically used for things like
+// populating the options of a filter dropdown in a UI. The values are formatted
+// as strings and sorted: numerically for numeric fields (e.g. "2", "10", "10.5"),
+// as "false" and "true" for boolean fields, and lexicographically for string
+// and enum fields. Numeric values are the scores in the index, so e.g. the
+// values for a time.Time field are timestamps rather than formatted times.
+// Models with a nil value for the field are not included, except for fields
+// with a sparse index, where a nil value counts as false. If the query has no
+// filters, limit, or offset, Distinct reads the index directly (for enum
+// indexes, just the set of values). Otherwise the ids which match the query
+// criteria (respecting Limit and Offset, in the query's order) are stored in a
+// temporary list and the value is looked up for each of them, which is O(N) in
+// the number of matching models. Distinct will return an error if the field
+// does not exist or is not indexed, or if the query has a FilterFunc. Include
+// and Exclude have no effect on Distinct.
+func (q *Query) Distinct(fieldName string) ([]string, error) {
+	if q.hasError() {
+		return nil, q.err
+	}
+	ctx, cancel := q.runContext(nil)
+	defer cancel()
+	tx := q.newTransaction(ctx)
+	values := []string{}
+	newTransactionalQuery(q.query, tx).Distinct(fieldName, &values)
+	if err := tx.Exec(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// CachedCount works like Count, but caches the count in Redis for the given
+// ttl. Subsequent calls to CachedCount for an identical query will read the
+// cached count instead of running the query again until the ttl expires. The
+// cached count is invalidated whenever Zoom saves or deletes a model in the
+// collection, so in most cases it is never stale. However, changes that are made
+// without Zoom (e.g. by running Redis commands directly) will not invalidate the
+// cached count, and will not be reflected by CachedCount until the ttl expires.
+// In other words, ttl is the upper bound on how long CachedCount can return a
+// stale count. ttl must be at least one millisecond. CachedCount trades
+// accuracy for speed, and is useful for expensive queries which are run often.
+func (q *Query) CachedCount(ttl time.Duration) (int, error) {
+	if q.hasError() {
+		return 0, q.err
+	}
+	if q.hasFilterFuncs() {
+		return 0, fmt.Errorf("zoom: error in Query.CachedCount: queries with FilterFunc cannot be cached")
+	}
+	if ttl < time.Millisecond {
+		return 0, fmt.Errorf("zoom: error in Query.CachedCount: ttl must be at least 1 millisecond. Got: %s", ttl)
+	}
+	ctx, cancel := q.runContext(nil)
+	defer cancel()
+	// Attempt to read the cached count.
+	var cacheKey string
+	var count int
+	found := false
+	tx := q.newTransaction(ctx)
+	tx.getCachedCount(q.collection.spec, q.checksum(), func(reply interface{}) error {
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := redis.Scan(values, &cacheKey); err != nil {
+			return err
+		}
+		if values[1] == nil {
+			return nil
+		}
+		found = true
+		count, err = redis.Int(values[1], nil)
+		return err
+	})
+	if err := tx.Exec(); err != nil {
+		return 0, err
+	}
+	if found {
+		return count, nil
+	}
+	// There was no cached count. Run the query to get the actual count and
+	// then cache it.
+	count, err := q.count(ctx)
+	if err != nil {
+		return 0, err
+	}
+	tx = q.newTransaction(ctx)
+	tx.Command("SET", redis.Args{cacheKey, count, "PX", int64(ttl / time.Millisecond)}, nil)
+	if err := tx.Exec(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// streamBatchSize is the default number of models which are read from the
+// database at a time by Query.Stream. It can be changed with Query.BatchSize.
+const streamBatchSize = 100
+
+// Stream executes the query and sends the resulting models on the returned
+// channel one at a time, which makes it possible to process very large result
+// sets with a bounded amount of memory. Stream first stores the ids of all the
+// models matching the query criteria in a temporary list in Redis (exactly as
+// StoreIds would). Then it reads the models in batches, respecting the Order,
+// Limit, Offset, Include, and Exclude modifiers of the query. Only the fields
+// selected by Include and Exclude are read from the database (with a single
+// SORT ... GET command per batch), and the other fields of each model are left
+// as zero values, which keeps memory and bandwidth low when only a few fields
+// are needed. Because the ids are stored before any models are read, the
+// results reflect the state of the database when Stream was called. However,
+// the fields of each model are read when its batch is read.
+//
+// Both channels are closed when Stream is done, i.e. when all the models have
+// been sent, when an error occurs, or when ctx is done. At most one error will
+// be sent on the error channel, including the error from ctx if it is done
+// before all the models have been sent. The models channel is unbuffered, so
+// callers should drain it before reading from the error channel. The temporary
+// list is deleted when Stream is done.
+func (q *Query) Stream(ctx context.Context) (<-chan Model, <-chan error) {
+	models := make(chan Model)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(models)
+		if err := q.stream(ctx, models); err != nil {
+			errs <- err
+		}
+	}()
+	return models, errs
+}
+
+// stream does the actual work for Stream. It sends models on the given channel
+// until there are no more models or an error occurs.
+func (q *Query) stream(ctx context.Context, models chan<- Model) error {
+	if q.hasError() {
+		return q.err
+	}
+	if q.hasFilterFuncs() {
+		return fmt.Errorf("zoom: error in Query.Stream: queries with FilterFunc cannot be streamed")
+	}
+	ctx, cancel := q.runContext(ctx)
+	defer cancel()
+	idsKey := generateRandomKey("tmp:stream:" + q.collection.Name())
+	if err := q.storeIds(ctx, idsKey); err != nil {
+		return err
+	}
+	defer func() {
+		conn := q.pool.NewConn()
+		defer conn.Close()
+		_, _ = conn.Do("UNLINK", idsKey)
+	}()
+	spec := q.collection.spec
+	fieldNames := append(q.fieldNames(), "-")
+	redisFieldNames := q.redisFieldNames()
+	batchSize := q.batchSize
+	if batchSize == 0 {
+		batchSize = streamBatchSize
+	}
+	for offset := uint(0); ; offset += batchSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch := reflect.New(reflect.SliceOf(spec.typ))
+		tx := q.newTransaction(ctx)
+		// The ids in idsKey are already in the correct order, so we use the
+		// "BY nosort" option to preserve it.
+		sortArgs := spec.sortArgs(idsKey, redisFieldNames, int(batchSize), offset, false)
+		tx.Command("SORT", sortArgs, newScanModelsHandler(spec, fieldNames, batch.Interface()))
+		if err := tx.Exec(); err != nil {
+			return err
+		}
+		batchLen := batch.Elem().Len()
+		for i := 0; i < batchLen; i++ {
+			select {
+			case models <- batch.Elem().Index(i).Interface().(Model):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if uint(batchLen) < batchSize {
+			return nil
+		}
+	}
+}
+
+// RunWith executes the query and, for each resulting model, calls alloc to get
+// a model to scan the fields into and then passes the model to consume. It is
+// meant for very large result sets, where allocating a slice and a new struct
+// for every model would put a lot of pressure on the garbage collector. For
+// example, alloc can get a model from a sync.Pool and consume can put it back
+// when it is done. Like Stream, RunWith first stores the ids of the matching
+// models in a temporary list and then reads the models in batches (see
+// BatchSize), respecting all the modifiers of the query.
+//
+// The model returned by alloc must be a non-nil pointer of the registered type
+// for the collection. RunWith only sets the fields which are read by the query
+// (see Include and Exclude). Nilable fields without a value are set to nil, but
+// other fields without a value are left untouched, so a reused model should be
+// reset to its zero value before alloc returns it. The model is only used by
+// RunWith until consume returns, so consume may keep it or return it to a pool.
+// Models are passed to consume one at a time, in order, on the calling
+// goroutine. If consume returns an error, RunWith stops and returns the error.
+// The temporary list is deleted before RunWith returns.
+func (q *Query) RunWith(alloc func() Model, consume func(Model) error) error {
+	if q.hasError() {
+		return q.err
+	}
+	if alloc == nil || consume == nil {
+		return fmt.Errorf("zoom: error in Query.RunWith: alloc and consume cannot be nil")
+	}
+	if q.hasFilterFuncs() {
+		return fmt.Errorf("zoom: error in Query.RunWith: queries with FilterFunc cannot be run with RunWith")
+	}
+	ctx, cancel := q.runContext(nil)
+	defer cancel()
+	idsKey := generateRandomKey("tmp:runWith:" + q.collection.Name())
+	if err := q.storeIds(ctx, idsKey); err != nil {
+		return err
+	}
+	defer func() {
+		conn := q.pool.NewConn()
+		defer conn.Close()
+		_, _ = conn.Do("UNLINK", idsKey)
+	}()
+	spec := q.collection.spec
+	fieldNames := append(q.fieldNames(), "-")
+	redisFieldNames := q.redisFieldNames()
+	batchSize := q.batchSize
+	if batchSize == 0 {
+		batchSize = streamBatchSize
+	}
+	for offset := uint(0); ; offset += batchSize {
+		var allFields []interface{}
+		tx := q.newTransaction(ctx)
+		// The ids in idsKey are already in the correct order, so we use the
+		// "BY nosort" option to preserve it.
+		sortArgs := spec.sortArgs(idsKey, redisFieldNames, int(batchSize), offset, false)
+		tx.Command("SORT", sortArgs, func(reply interface{}) error {
+			var err error
+			allFields, err = redis.Values(reply, nil)
+			if err == redis.ErrNil {
+				return nil
+			}
+			return err
+		})
+		if err := tx.Exec(); err != nil {
+			return err
+		}
+		numFields := len(fieldNames)
+		numModels := len(allFields) / numFields
+		for i := 0; i < numModels; i++ {
+			model := alloc()
+			if err := spec.checkModelType(model); err != nil {
+				return fmt.Errorf("zoom: error in Query.RunWith: %s", err.Error())
+			}
+			if reflect.ValueOf(model).IsNil() {
+				return fmt.Errorf("zoom: error in Query.RunWith: alloc returned a nil model")
+			}
+			mr := &modelRef{
+				spec:  spec,
+				model: model,
+			}
+			if err := scanModel(fieldNames, allFields[i*numFields:(i+1)*numFields], mr); err != nil {
+				return err
+			}
+			if err := consume(model); err != nil {
+				return err
+			}
+		}
+		if uint(numModels) < batchSize {
+			return nil
+		}
+	}
+}
+
+// ExportJSON executes the query and writes each resulting model to w as a
+// line of JSON (i.e. newline-delimited JSON), encoded with encoding/json. It
+// is meant for exporting the results of a filtered query, e.g. for an "export"
+// button in an admin UI. Like Stream, ExportJSON first stores the ids of the
+// matching models in a temporary list and then reads the models in batches
+// (see BatchSize), respecting the Order, Limit, Offset, Include, and Exclude
+// modifiers of the query, so only one batch of models is held in memory at a
+// time and each model is written as soon as it is read. The same model value
+// is reused for every line. Fields which are not selected by Include or
+// Exclude are not read from the database and are encoded as zero values, so
+// add `json:",omitempty"` to the struct tags of those fields to leave them out
+// of the output. ExportJSON stops and returns the error if w returns an error
+// or a model cannot be encoded. Queries with FilterFunc cannot be exported.
+func (q *Query) ExportJSON(w io.Writer) error {
+	if q.hasError() {
+		return q.err
+	}
+	if q.hasFilterFuncs() {
+		return fmt.Errorf("zoom: error in Query.ExportJSON: queries with FilterFunc cannot be exported")
+	}
+	enc := json.NewEncoder(w)
+	model := reflect.New(q.collection.spec.typ.Elem())
+	zero := reflect.Zero(q.collection.spec.typ.Elem())
+	return q.RunWith(func() Model {
+		model.Elem().Set(zero)
+		return model.Interface().(Model)
+	}, func(m Model) error {
+		return enc.Encode(m)
+	})
+}
+
+// sampleBatchSize is the default number of ids which are read from the
+// database at a time by Query.SampleStream. It can be changed with
+// Query.BatchSize.
+const sampleBatchSize = 1000
+
+// SampleStream executes the query and returns n of the resulting models chosen
+// uniformly at random, without reading every matching model. Like Stream,
+// SampleStream first stores the ids of all the models matching the query
+// criteria in a temporary list in Redis (exactly as StoreIds would), so the
+// sample is taken from the results after all of the modifiers (including
+// Limit and Offset) have been applied. Then it reads the ids in batches (see
+// BatchSize) and picks the sample with reservoir sampling, and finally reads
+// only the n chosen models, with the fields selected by Include and Exclude.
+//
+// SampleStream makes a single pass over the stored ids, reading each id
+// exactly once, so every matching model has the same chance of being
+// included, and it only holds n ids in memory at a time, no matter how many
+// models match. (The ids are not read with SSCAN or ZSCAN directly, since they
+// can return the same id more than once, which would bias the sample.) The
+// models are returned in the order in which they appear in the results of the
+// query. If fewer than n models match the query, all of them are returned.
+// The models in the returned slice are pointers of the registered type for the
+// collection. Queries with FilterFunc cannot be sampled. The temporary lists
+// are deleted before SampleStream returns.
+func (q *Query) SampleStream(n int) ([]Model, error) {
+	if q.hasError() {
+		return nil, q.err
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("zoom: error in Query.SampleStream: n cannot be negative. Got: %d", n)
+	}
+	if q.hasFilterFuncs() {
+		return nil, fmt.Errorf("zoom: error in Query.SampleStream: queries with FilterFunc cannot be sampled")
+	}
+	if n == 0 {
+		return []Model{}, nil
+	}
+	ctx, cancel := q.runContext(nil)
+	defer cancel()
+	idsKey := generateRandomKey("tmp:sample:" + q.collection.Name())
+	sampleKey := generateRandomKey("tmp:sample:" + q.collection.Name())
+	if err := q.storeIds(ctx, idsKey); err != nil {
+		return nil, err
+	}
+	defer func() {
+		conn := q.pool.NewConn()
+		defer conn.Close()
+		_, _ = conn.Do("UNLINK", idsKey, sampleKey)
+	}()
+	batchSize := int(q.batchSize)
+	if batchSize == 0 {
+		batchSize = sampleBatchSize
+	}
+
+	// Pick the sample with reservoir sampling (Algorithm R). Each slot in the
+	// reservoir remembers the position of its id, so that the sample can be
+	// returned in the order of the query results.
+	type sampled struct {
+		position int
+		id       string
+	}
+	reservoir := make([]sampled, 0, n)
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	seen := 0
+	for start := 0; ; start += batchSize {
+		var ids []string
+		tx := q.newTransaction(ctx)
+		tx.Command("LRANGE", redis.Args{idsKey, start, start + batchSize - 1}, NewScanStringsHandler(&ids))
+		if err := tx.Exec(); err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if len(reservoir) < n {
+				reservoir = append(reservoir, sampled{position: seen, id: id})
+			} else if j := random.Intn(seen + 1); j < n {
+				reservoir[j] = sampled{position: seen, id: id}
+			}
+			seen++
+		}
+		if len(ids) < batchSize {
+			break
+		}
+	}
+	if len(reservoir) == 0 {
+		return []Model{}, nil
+	}
+	sort.Slice(reservoir, func(i, j int) bool {
+		return reservoir[i].position < reservoir[j].position
+	})
+
+	// Read the chosen models, preserving the order of the ids.
+	spec := q.collection.spec
+	ids := redis.Args{sampleKey}
+	for _, s := range reservoir {
+		ids = append(ids, s.id)
+	}
+	models := reflect.New(reflect.SliceOf(spec.typ))
+	tx := q.newTransaction(ctx)
+	tx.Command("RPUSH", ids, nil)
+	sortArgs := spec.sortArgs(sampleKey, q.redisFieldNames(), 0, 0, false)
+	tx.Command("SORT", sortArgs, newScanModelsHandler(spec, append(q.fieldNames(), "-"), models.Interface()))
+	if err := tx.Exec(); err != nil {
+		return nil, err
+	}
+	results := make([]Model, models.Elem().Len())
+	for i := range results {
+		results[i] = models.Elem().Index(i).Interface().(Model)
+	}
+	return results, nil
+}
+
 // Ids returns only the ids of the models without actually retrieving the
 // models themselves. Ids will return the first error that occurred during the
 // lifetime of the query (if any).
 func (q *Query) Ids() ([]string, error) {
-	tx := q.pool.NewTransaction()
+	if q.hasError() {
+		return nil, q.err
+	}
+	ctx, cancel := q.runContext(nil)
+	defer cancel()
+	tx := q.newTransaction(ctx)
 	ids := []string{}
 	newTransactionalQuery(q.query, tx).Ids(&ids)
 	if err := tx.Exec(); err != nil {
@@ -147,7 +981,18 @@ func (q *Query) Ids() ([]string, error) {
 // the query includes an Order modifier. StoreIds will return the first error
 // that occurred during the lifetime of the query (if any).
 func (q *Query) StoreIds(destKey string) error {
-	tx := q.pool.NewTransaction()
+	if q.hasError() {
+		return q.err
+	}
+	ctx, cancel := q.runContext(nil)
+	defer cancel()
+	return q.storeIds(ctx, destKey)
+}
+
+// storeIds does the actual work for StoreIds, using the given context (see
+// runContext).
+func (q *Query) storeIds(ctx context.Context, destKey string) error {
+	tx := q.newTransaction(ctx)
 	newTransactionalQuery(q.query, tx).StoreIds(destKey)
 	return tx.Exec()
 }
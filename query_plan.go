@@ -0,0 +1,156 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File query_plan.go contains code for compiling the parts of a query which
+// depend only on its structure, and for caching the result.
+
+package zoom
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// maxQueryPlans is the maximum number of query plans which are cached for each
+// collection. Queries with a new structure are still compiled once the limit
+// is reached, but their plans are not cached.
+const maxQueryPlans = 1000
+
+// idGetArgs are the GET arguments for a SORT command which only gets the ids
+// of the models.
+var idGetArgs = redis.Args{"GET", "#"}
+
+// queryPlan contains everything needed to run a query which depends only on
+// the structure of the query (i.e. the fields and operators of the filters,
+// the order, the includes and excludes, and whether there is a limit or
+// offset) and not on any literal values (i.e. the values for the filters and
+// the amounts for the limit and offset). It is computed once for each distinct
+// structure and cached by the collection, and the literal values are
+// substituted when the query is run. A queryPlan must not be modified after it
+// has been created, since it may be shared by many queries.
+type queryPlan struct {
+	// fieldNames are the names of the fields which should be scanned into the
+	// models, followed by "-" for the id. It has no spare capacity, so it is
+	// safe to append to.
+	fieldNames []string
+	// getArgs are the GET arguments for a SORT command which gets the fields in
+	// fieldNames.
+	getArgs redis.Args
+	// orderIndexKey is the key for the index on the order field, if any.
+	orderIndexKey string
+	// filterIndexKeys are the keys for the indexes on the filters, in the same
+	// order as the filters.
+	filterIndexKeys []string
+}
+
+// newQueryPlan compiles and returns a new plan for q.
+func newQueryPlan(q *query) (*queryPlan, error) {
+	spec := q.collection.spec
+	fieldNames := append(q.fieldNames(), "-")
+	plan := &queryPlan{
+		fieldNames:      fieldNames[:len(fieldNames):len(fieldNames)],
+		getArgs:         spec.sortGetArgs(q.redisFieldNames()),
+		filterIndexKeys: make([]string, len(q.filters)),
+	}
+	if q.hasIndexedOrder() {
+		orderIndexKey, err := spec.fieldIndexKey(q.order.fieldName)
+		if err != nil {
+			return nil, err
+		}
+		plan.orderIndexKey = orderIndexKey
+	}
+	for i, filter := range q.filters {
+		if filter.fieldSpec.indexKind == idIndex {
+			// Filters on the id use the set of all ids.
+			plan.filterIndexKeys[i] = spec.indexKey()
+			continue
+		}
+		filterIndexKey, err := spec.fieldIndexKey(filter.fieldSpec.name)
+		if err != nil {
+			return nil, err
+		}
+		plan.filterIndexKeys[i] = filterIndexKey
+	}
+	return plan, nil
+}
+
+// planKey returns a string which identifies the structure of q, ignoring any
+// literal values. Two queries with the same planKey have the same plan.
+func (q *query) planKey() string {
+	var key strings.Builder
+	for _, filter := range q.filters {
+		if filter.negate {
+			key.WriteByte('!')
+		}
+		key.WriteString(filter.fieldSpec.name)
+		key.WriteByte(' ')
+		key.WriteString(filter.op.String())
+		key.WriteByte(',')
+	}
+	key.WriteByte('|')
+	if q.hasOrder() {
+		if q.order.unindexed {
+			key.WriteByte('~')
+		}
+		if q.order.kind == descendingOrder {
+			key.WriteByte('-')
+		}
+		key.WriteString(q.order.fieldName)
+	} else if q.unordered {
+		key.WriteByte('*')
+	}
+	key.WriteByte('|')
+	if q.hasOffset() {
+		key.WriteByte('o')
+	}
+	if q.hasLimit() {
+		key.WriteByte('l')
+	}
+	key.WriteByte('|')
+	switch {
+	case q.hasIncludes():
+		key.WriteByte('+')
+		key.WriteString(strconv.Itoa(len(q.includes)))
+		for _, name := range q.includes {
+			key.WriteByte(',')
+			key.WriteString(name)
+		}
+	case q.hasExcludes():
+		key.WriteByte('-')
+		key.WriteString(strconv.Itoa(len(q.excludes)))
+		for _, name := range q.excludes {
+			key.WriteByte(',')
+			key.WriteString(name)
+		}
+	}
+	return key.String()
+}
+
+// plan returns the plan for q. If there is already a plan for a query with the
+// same structure in the cache for the collection, it is reused.
+func (q *query) plan() (*queryPlan, error) {
+	c := q.collection
+	key := q.planKey()
+	c.plansMut.RLock()
+	plan, found := c.plans[key]
+	c.plansMut.RUnlock()
+	if found {
+		return plan, nil
+	}
+	plan, err := newQueryPlan(q)
+	if err != nil {
+		return nil, err
+	}
+	c.plansMut.Lock()
+	if c.plans == nil {
+		c.plans = map[string]*queryPlan{}
+	}
+	if len(c.plans) < maxQueryPlans {
+		c.plans[key] = plan
+	}
+	c.plansMut.Unlock()
+	return plan, nil
+}
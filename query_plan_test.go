@@ -0,0 +1,57 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File query_plan_test.go tests the caching of query plans (query_plan.go).
+
+package zoom
+
+import "testing"
+
+func TestQueryPlanCache(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatalf("Unexpected error saving models: %s", err.Error())
+	}
+
+	// Queries with the same structure but different values should share a plan
+	// and still return the correct results.
+	q1 := indexedTestModels.NewQuery().Filter("Int >", 3).Order("-String").Limit(3).Include("Int")
+	q2 := indexedTestModels.NewQuery().Filter("Int >", 7).Order("-String").Limit(5).Include("Int")
+	plan1, err := q1.plan()
+	if err != nil {
+		t.Fatalf("Unexpected error in plan: %s", err.Error())
+	}
+	plan2, err := q2.plan()
+	if err != nil {
+		t.Fatalf("Unexpected error in plan: %s", err.Error())
+	}
+	if plan1 != plan2 {
+		t.Error("Expected queries with the same structure to share a plan")
+	}
+	testQuery(t, q1, models)
+	testQuery(t, q2, models)
+
+	// Queries with a different structure should not share a plan.
+	differentQueries := []*Query{
+		indexedTestModels.NewQuery().Filter("Int <", 3).Order("-String").Limit(3).Include("Int"),
+		indexedTestModels.NewQuery().Not().Filter("Int >", 3).Order("-String").Limit(3).Include("Int"),
+		indexedTestModels.NewQuery().Filter("Int >", 3).Order("String").Limit(3).Include("Int"),
+		indexedTestModels.NewQuery().Filter("Int >", 3).Order("-String").Include("Int"),
+		indexedTestModels.NewQuery().Filter("Int >", 3).Order("-String").Limit(3).Include("Bool"),
+		indexedTestModels.NewQuery().Filter("Int >", 3).Order("-String").Limit(3).Exclude("Int"),
+	}
+	for _, q := range differentQueries {
+		plan, err := q.plan()
+		if err != nil {
+			t.Fatalf("Unexpected error in plan: %s", err.Error())
+		}
+		if plan == plan1 {
+			t.Errorf("Expected %s not to share a plan with %s", q, q1)
+		}
+		testQuery(t, q, models)
+	}
+}
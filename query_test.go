@@ -7,11 +7,19 @@
 package zoom
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/rand"
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -65,6 +73,30 @@ func TestQueryLimitAndOffset(t *testing.T) {
 	}
 }
 
+func TestQueryDefaultOrder(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without an order, paging through the results with Limit and Offset
+	// should be consistent.
+	for _, o := range []uint{0, 3, 6, 9} {
+		q := indexedTestModels.NewQuery().Limit(3).Offset(o)
+		testQuery(t, q, models)
+		filteredQuery := indexedTestModels.NewQuery().Filter("Int >=", 0).Limit(3).Offset(o)
+		testQuery(t, filteredQuery, models)
+	}
+	// Unordered queries should return the same models in any order.
+	testQuery(t, indexedTestModels.NewQuery().Unordered(), models)
+	// Using Order and Unordered on the same query should cause an error.
+	if _, err := indexedTestModels.NewQuery().Order("Int").Unordered().Ids(); err == nil {
+		t.Error("Expected an error when using both Order and Unordered but got none")
+	}
+}
+
 func TestQueryIncludeAndExclude(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
@@ -72,205 +104,1595 @@ func TestQueryIncludeAndExclude(t *testing.T) {
 	models, err := createAndSaveIndexedTestModels(2)
 	if err != nil {
 		t.Error(err)
-		t.FailNow()
+		t.FailNow()
+	}
+	fields := [][]string{
+		[]string{},
+		[]string{"Int"},
+		[]string{"Int", "Bool", "String"},
+	}
+	for _, fs := range fields {
+		includeQuery := indexedTestModels.NewQuery().Include(fs...)
+		testQuery(t, includeQuery, models)
+		excludeQuery := indexedTestModels.NewQuery().Exclude(fs...)
+		testQuery(t, excludeQuery, models)
+	}
+}
+
+func TestQueryFilterInt(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Test queries with filters using all possible operators and a
+	// few different filter values.
+	filterValues := []interface{}{-10, 0, 99999999, models[0].Int}
+	for _, val := range filterValues {
+		for op, _ := range filterOps {
+			q := indexedTestModels.NewQuery().Filter("Int "+op, val)
+			testQuery(t, q, models)
+		}
+	}
+}
+
+func TestQueryFilterBool(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Test queries with filters using all possible operators and a
+	// few different filter values.
+	filterValues := []interface{}{true, false}
+	for _, val := range filterValues {
+		for op, _ := range filterOps {
+			q := indexedTestModels.NewQuery().Filter("Bool "+op, val)
+			testQuery(t, q, models)
+		}
+	}
+}
+
+func TestQueryFilterString(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Create some models with tricky String values
+	models := createIndexedTestModels(10)
+	models[1].String = models[0].String + " "
+	models[2].String = models[0].String[:len(models[0].String)-1]
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+
+	// Test queries with filters using all possible operators and a
+	// few different filter values.
+	filterValues := []interface{}{"a", "AbCdE", models[0].String, incrementString(models[0].String), decrementString(models[0].String), models[0].String + " ", models[0].String[:len(models[0].String)-1]}
+	for _, val := range filterValues {
+		for op, _ := range filterOps {
+			q := indexedTestModels.NewQuery().Filter("String "+op, val)
+			testQuery(t, q, models)
+		}
+	}
+}
+
+func TestQueryFilterId(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use sequential ids, including some which only differ in their length.
+	models := createIndexedTestModels(10)
+	for i, model := range models {
+		model.SetModelId(fmt.Sprintf("%04d", 995+i))
+	}
+	models[9].SetModelId("1000a")
+	tx := testPool.NewTransaction()
+	for _, model := range models {
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatalf("Error executing transaction: %s", err.Error())
+	}
+
+	filterValues := []interface{}{"1000", "0999", "0994", "2000", "1000a", "10"}
+	for _, val := range filterValues {
+		for op := range filterOps {
+			testQuery(t, indexedTestModels.NewQuery().Filter("Id "+op, val), models)
+			testQuery(t, indexedTestModels.NewQuery().Not().Filter("Id "+op, val).Order("-Int"), models)
+			testQuery(t, indexedTestModels.NewQuery().Filter("Id "+op, val).Filter("Bool =", true).Order("String").Limit(3), models)
+		}
+	}
+
+	// The value must be a string.
+	if err := indexedTestModels.NewQuery().Filter("Id >", 1000).Err(); err == nil {
+		t.Error("Expected an error for a filter on the id with an int value but got none")
+	}
+}
+
+func TestQueryFilterErrors(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	testCases := []struct {
+		filterString  string
+		value         interface{}
+		expectedInErr string
+	}{
+		{"Int", 1, "Int"},
+		{"Int ==", 1, "Int"},
+		{"Foo =", 1, "Foo"},
+		{"Int =", "one", "Int"},
+		{"Int =", nil, "Int"},
+		{"Int =", (*int)(nil), "Int"},
+	}
+	for _, tc := range testCases {
+		q := indexedTestModels.NewQuery().Filter(tc.filterString, tc.value)
+		// The error should be available immediately
+		err := q.Err()
+		if err == nil {
+			t.Errorf("Expected an error for Filter(%q, %v) but got none", tc.filterString, tc.value)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.expectedInErr) {
+			t.Errorf("Expected error for Filter(%q, %v) to contain %q but got: %s", tc.filterString, tc.value, tc.expectedInErr, err.Error())
+		}
+		// Further modifiers should not change the error
+		q.Filter("Bool =", "not a bool")
+		if q.Err() != err {
+			t.Errorf("Expected the first error to be kept but got: %s", q.Err())
+		}
+		// Finishers should return the same error
+		if _, gotErr := q.Ids(); gotErr != err {
+			t.Errorf("Expected Ids to return %v but got %v", err, gotErr)
+		}
+	}
+
+	// Filters on fields which are not indexed should also cause an error
+	q := testModels.NewQuery().Filter("Int =", 1)
+	if err := q.Err(); err == nil {
+		t.Error("Expected an error for a filter on an unindexed field but got none")
+	} else if !strings.Contains(err.Error(), "Int is not indexed") {
+		t.Errorf("Expected error to say that Int is not indexed but got: %s", err.Error())
+	}
+}
+
+func TestQueryUnindexedFilter(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*indexedTestModel{}
+	tx := testPool.NewTransaction()
+	for i, str := range []string{"apple", "pineapple", "grape", "applesauce", "banana", "crabapple"} {
+		model := &indexedTestModel{
+			Int:    i,
+			String: str,
+			Bool:   i%2 == 0,
+		}
+		models = append(models, model)
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	queries := []*Query{
+		indexedTestModels.NewQuery().UnindexedFilter("String contains", "apple"),
+		indexedTestModels.NewQuery().UnindexedFilter("String contains", "a").UnindexedFilter("String contains", "p"),
+		indexedTestModels.NewQuery().UnindexedFilter("String contains", "apple").Filter("Bool =", true),
+		indexedTestModels.NewQuery().UnindexedFilter("String contains", "apple").Order("Int").Limit(2),
+		indexedTestModels.NewQuery().UnindexedFilter("String contains", "apple").Order("-Int").Limit(2).Offset(1),
+		indexedTestModels.NewQuery().UnindexedFilter("String contains", "apple").Order("String").Limit(3),
+		indexedTestModels.NewQuery().UnindexedFilter("String contains", "apple").Limit(2),
+		indexedTestModels.NewQuery().UnindexedFilter("String contains", "%a"),
+		indexedTestModels.NewQuery().UnindexedFilter("String contains", "kiwi"),
+	}
+	for _, q := range queries {
+		testQuery(t, q, models)
+	}
+
+	// Invalid unindexed filters should cause an error
+	if err := indexedTestModels.NewQuery().UnindexedFilter("String like", "apple").Err(); err == nil {
+		t.Error("Expected an error for an invalid operator but got none")
+	}
+	if err := indexedTestModels.NewQuery().UnindexedFilter("Int contains", "1").Err(); err == nil {
+		t.Error("Expected an error for a non-string field but got none")
+	}
+}
+
+func TestQueryDoubleFilters(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create some test queries to filter the models
+	fieldNames := []string{"Int", "Bool", "String"}
+	filterValues := []interface{}{models[0].Int, true, models[0].String}
+	for i, f1 := range fieldNames {
+		v1 := filterValues[i]
+		for j, f2 := range fieldNames {
+			v2 := filterValues[j]
+			for o1, _ := range filterOps {
+				for o2, _ := range filterOps {
+					if f1 == f2 && o1 == o2 {
+						// no sense in doing the same filter twice
+						continue
+					}
+					q := indexedTestModels.NewQuery().Filter(f1+" "+o1, v1).Filter(f2+" "+o2, v2)
+					testQuery(t, q, models)
+				}
+			}
+		}
+	}
+}
+
+func TestQueryCombos(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Iterate over many different combinations of filters and orders to create
+	// and test different queries
+	fieldNames := []string{"Int", "Bool", "String"}
+	filterValues := []interface{}{models[0].Int, true, models[0].String}
+	limits := []uint{0, 1, 5, 9, 10}
+	offsets := []uint{0, 1, 5, 9, 10}
+	for i, filterField := range fieldNames {
+		filterVal := filterValues[i]
+		for filterOp, _ := range filterOps {
+			for _, orderField := range fieldNames {
+				for _, orderPrefix := range []string{"", "-"} {
+					for _, offset := range offsets {
+						for _, limit := range limits {
+							q := indexedTestModels.NewQuery()
+							q.Filter(filterField+" "+filterOp, filterVal).Order(orderPrefix + orderField).Limit(limit).Offset(offset)
+							testQuery(t, q, models)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestQueryConcurrent(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Run many different queries at the same time. Each query creates its own
+	// temporary sets, which should never be seen or deleted by another query.
+	queries := []*Query{}
+	for filterOp := range filterOps {
+		for _, orderPrefix := range []string{"", "-"} {
+			q := indexedTestModels.NewQuery().Filter("Int "+filterOp, models[0].Int).Filter("Bool =", true).Order(orderPrefix + "String")
+			queries = append(queries, q)
+		}
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		for _, q := range queries {
+			wg.Add(1)
+			go func(q *Query) {
+				defer wg.Done()
+				got := []*indexedTestModel{}
+				if err := q.Run(&got); err != nil {
+					t.Errorf("Unexpected error in Run: %s", err.Error())
+					return
+				}
+				expected := expectedResultsForQuery(q.query, models)
+				if err := expectModelsToBeEqual(expected, got, true); err != nil {
+					t.Errorf("testQueryRun failed for query %s\n%s", q, err.Error())
+				}
+			}(q)
+		}
+	}
+	wg.Wait()
+	checkForLeakedTmpKeys(t, queries[0].query)
+}
+
+func TestQueryConcurrentIdentical(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Run the same query from many goroutines at once. If the temporary keys
+	// for the filters were predictable, the queries would overwrite or delete
+	// each other's sets and return the wrong results.
+	q := indexedTestModels.NewQuery().Filter("Int >=", models[0].Int).Filter("String <", models[1].String).Filter("Bool =", false).Order("-Int")
+	expected := expectedResultsForQuery(q.query, models)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				got := []*indexedTestModel{}
+				if err := q.Run(&got); err != nil {
+					t.Errorf("Unexpected error in Run: %s", err.Error())
+					return
+				}
+				if err := expectModelsToBeEqual(expected, got, true); err != nil {
+					t.Errorf("testQueryRun failed for query %s\n%s", q, err.Error())
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	checkForLeakedTmpKeys(t, q.query)
+}
+
+func TestQueryNot(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Negate each kind of filter, both on its own and combined with a regular
+	// filter, and make sure the results can still be ordered and limited.
+	fieldNames := []string{"Int", "Bool", "String"}
+	filterValues := []interface{}{models[0].Int, true, models[0].String}
+	for i, filterField := range fieldNames {
+		filterVal := filterValues[i]
+		for filterOp := range filterOps {
+			for _, orderField := range []string{"", "Int", "-String"} {
+				q := indexedTestModels.NewQuery().Not().Filter(filterField+" "+filterOp, filterVal)
+				if orderField != "" {
+					q.Order(orderField)
+				}
+				testQuery(t, q, models)
+				testQuery(t, q.Limit(3).Offset(1), models)
+			}
+			q := indexedTestModels.NewQuery().Filter("Bool =", false).Not().Filter(filterField+" "+filterOp, filterVal)
+			testQuery(t, q, models)
+		}
+	}
+
+	// Not should only apply to the filter which immediately follows it.
+	q := indexedTestModels.NewQuery().Not().Filter("Int =", models[0].Int).Filter("String =", models[1].String)
+	testQuery(t, q, models)
+
+	// Not must be followed by exactly one Filter.
+	if err := indexedTestModels.NewQuery().Not().Err(); err == nil {
+		t.Error("Expected an error for a query ending with Not but got none")
+	}
+	if err := indexedTestModels.NewQuery().Not().Not().Filter("Int =", 0).Err(); err == nil {
+		t.Error("Expected an error for Not followed by Not but got none")
+	}
+	if _, err := indexedTestModels.NewQuery().Not().Count(); err == nil {
+		t.Error("Expected an error in Count for a query ending with Not but got none")
+	}
+}
+
+func TestQueryHalfIndexed(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Simulate a rolling deploy which adds an indexed field. The old version
+	// of the model has no Score field, and the new version is registered with
+	// the same name in a separate pool.
+	type oldHalfIndexedModel struct {
+		Name string
+		RandomId
+	}
+	type newHalfIndexedModel struct {
+		Name  string
+		Score int    `zoom:"index"`
+		Title string `zoom:"index"`
+		RandomId
+	}
+	options := DefaultCollectionOptions.WithIndex(true).WithName("halfIndexedModel")
+	oldModels, err := testPool.NewCollectionWithOptions(&oldHalfIndexedModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := NewPoolWithOptions(testPool.options)
+	defer pool.Close()
+	newModels, err := pool.NewCollectionWithOptions(&newHalfIndexedModel{}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := oldModels.Save(&oldHalfIndexedModel{Name: "old"}); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	indexed := []string{}
+	for i := 0; i < 2; i++ {
+		model := &newHalfIndexedModel{Name: "new", Score: i + 1, Title: "title"}
+		if err := newModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		indexed = append(indexed, model.ModelId())
+	}
+	sort.Strings(indexed)
+
+	// Queries which use the new index should only return the indexed models,
+	// and Count should agree with Run.
+	for _, q := range []*Query{
+		newModels.NewQuery().Filter("Score >=", 0),
+		newModels.NewQuery().Filter("Score !=", 100),
+		newModels.NewQuery().Filter("Title !=", "other"),
+		newModels.NewQuery().Order("Score"),
+		newModels.NewQuery().Order("-Title"),
+		newModels.NewQuery().Order("Score").Limit(10),
+		newModels.NewQuery().Filter("Score >", 0).Order("Title"),
+	} {
+		got := []*newHalfIndexedModel{}
+		if err := q.Run(&got); err != nil {
+			t.Fatalf("Unexpected error in Run for %s: %s", q, err.Error())
+		}
+		gotIds := make([]string, len(got))
+		for i, model := range got {
+			gotIds[i] = model.ModelId()
+		}
+		sort.Strings(gotIds)
+		if !reflect.DeepEqual(indexed, gotIds) {
+			t.Errorf("Wrong results for %s.\nExpected: %v\nGot:      %v", q, indexed, gotIds)
+		}
+		if count, err := q.Count(); err != nil {
+			t.Fatalf("Unexpected error in Count for %s: %s", q, err.Error())
+		} else if count != len(indexed) {
+			t.Errorf("Expected Count for %s to be %d but got %d", q, len(indexed), count)
+		}
+		checkForLeakedTmpKeys(t, q.query)
+	}
+
+	// Queries which don't use the new index still see every model, and so
+	// does Not, which subtracts the matching models from all of them.
+	for _, q := range []*Query{
+		newModels.NewQuery(),
+		newModels.NewQuery().Not().Filter("Score =", 100),
+	} {
+		if count, err := q.Count(); err != nil {
+			t.Fatalf("Unexpected error in Count for %s: %s", q, err.Error())
+		} else if count != 5 {
+			t.Errorf("Expected Count for %s to be 5 but got %d", q, count)
+		}
+	}
+}
+
+func TestQueryRunOne(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*indexedTestModel{}
+	tx := testPool.NewTransaction()
+	for i := 0; i < 5; i++ {
+		model := &indexedTestModel{
+			Int:    i,
+			String: strconv.Itoa(i),
+		}
+		models = append(models, model)
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		query         *Query
+		expectedModel *indexedTestModel
+		shouldErr     bool
+	}{
+		{
+			query:         indexedTestModels.NewQuery().Filter("String =", models[0].String),
+			expectedModel: models[0],
+			shouldErr:     false,
+		},
+		{
+			query:         indexedTestModels.NewQuery().Filter("Int =", models[1].Int),
+			expectedModel: models[1],
+			shouldErr:     false,
+		},
+		{
+			query:         indexedTestModels.NewQuery().Filter("String =", models[0].String).Filter("Int =", models[1].Int),
+			expectedModel: nil,
+			shouldErr:     true,
+		},
+	}
+
+	for i, tc := range testCases {
+		gotModel := &indexedTestModel{}
+		err := tc.query.RunOne(gotModel)
+		switch tc.shouldErr {
+		case true:
+			if err == nil {
+				t.Errorf("Error in test case %d: Expected an error but got none.", i)
+			}
+		case false:
+			if err != nil {
+				t.Errorf("Unexpected error in test case %d: %s", i, err.Error())
+			}
+			if !reflect.DeepEqual(gotModel, tc.expectedModel) {
+				t.Errorf("Error in test case %d: model was incorrect.\nExpected: %v\n     Got: %v", i, tc.expectedModel, gotModel)
+			}
+		}
+	}
+}
+
+func TestQueryFilterFunc(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models := []*indexedTestModel{}
+	tx := testPool.NewTransaction()
+	for i := 0; i < 10; i++ {
+		model := &indexedTestModel{
+			Int:    i,
+			String: strconv.Itoa(i),
+		}
+		models = append(models, model)
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	divisibleByThree := func(m Model) bool {
+		return m.(*indexedTestModel).Int%3 == 0
+	}
+
+	testCases := []struct {
+		query    *Query
+		expected []*indexedTestModel
+	}{
+		{
+			query:    indexedTestModels.NewQuery().Order("Int").FilterFunc(divisibleByThree),
+			expected: []*indexedTestModel{models[0], models[3], models[6], models[9]},
+		},
+		{
+			query:    indexedTestModels.NewQuery().Order("Int").FilterFunc(divisibleByThree).Limit(2).Offset(1),
+			expected: []*indexedTestModel{models[3], models[6]},
+		},
+		{
+			query:    indexedTestModels.NewQuery().Filter("Int >=", 4).Order("-Int").FilterFunc(divisibleByThree),
+			expected: []*indexedTestModel{models[9], models[6]},
+		},
+		{
+			query:    indexedTestModels.NewQuery().UnindexedFilter("String contains", "9").FilterFunc(divisibleByThree).Order("Int").Limit(1),
+			expected: []*indexedTestModel{models[9]},
+		},
+		{
+			query: indexedTestModels.NewQuery().FilterFunc(func(Model) bool {
+				return false
+			}),
+			expected: []*indexedTestModel{},
+		},
+	}
+	for i, tc := range testCases {
+		got := []*indexedTestModel{}
+		if err := tc.query.Run(&got); err != nil {
+			t.Errorf("Unexpected error in test case %d: %s", i, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Error in test case %d: Run was incorrect.\nExpected: %v\n     Got: %v", i, tc.expected, got)
+		}
+		expectedIds := make([]string, len(tc.expected))
+		for j, model := range tc.expected {
+			expectedIds[j] = model.ModelId()
+		}
+		gotIds, err := tc.query.Ids()
+		if err != nil {
+			t.Errorf("Unexpected error in test case %d: %s", i, err.Error())
+		} else if !reflect.DeepEqual(gotIds, expectedIds) {
+			t.Errorf("Error in test case %d: Ids was incorrect.\nExpected: %v\n     Got: %v", i, expectedIds, gotIds)
+		}
+		count, err := tc.query.Count()
+		if err != nil {
+			t.Errorf("Unexpected error in test case %d: %s", i, err.Error())
+		} else if count != len(tc.expected) {
+			t.Errorf("Error in test case %d: Expected count to be %d but got %d", i, len(tc.expected), count)
+		}
+		gotOne := &indexedTestModel{}
+		err = tc.query.RunOne(gotOne)
+		if len(tc.expected) == 0 {
+			if _, ok := err.(ModelNotFoundError); !ok {
+				t.Errorf("Error in test case %d: Expected a ModelNotFoundError from RunOne but got: %v", i, err)
+			}
+		} else if err != nil {
+			t.Errorf("Unexpected error in test case %d: %s", i, err.Error())
+		} else if !reflect.DeepEqual(gotOne, tc.expected[0]) {
+			t.Errorf("Error in test case %d: RunOne was incorrect.\nExpected: %v\n     Got: %v", i, tc.expected[0], gotOne)
+		}
+	}
+
+	// Queries with FilterFunc cannot be used with finishers that rely on Redis
+	// to store or read the ids.
+	q := indexedTestModels.NewQuery().FilterFunc(divisibleByThree)
+	if err := q.StoreIds("filterFuncIds"); err == nil {
+		t.Error("Expected an error from StoreIds but got none")
+	}
+	if _, err := q.CachedCount(time.Minute); err == nil {
+		t.Error("Expected an error from CachedCount but got none")
+	}
+	if err := indexedTestModels.NewQuery().FilterFunc(nil).Err(); err == nil {
+		t.Error("Expected an error for a nil FilterFunc but got none")
+	}
+}
+
+func TestQueryStream(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use enough models to require more than one batch.
+	if _, err := createAndSaveIndexedTestModels(streamBatchSize + 50); err != nil {
+		t.Fatal(err)
+	}
+	queries := []*Query{
+		indexedTestModels.NewQuery(),
+		indexedTestModels.NewQuery().Order("-Int").Filter("Bool =", true),
+		indexedTestModels.NewQuery().Order("String").Offset(10).Limit(streamBatchSize).Include("String"),
+	}
+	for _, q := range queries {
+		expected := []*indexedTestModel{}
+		if err := q.Run(&expected); err != nil {
+			t.Fatal(err)
+		}
+		models, errs := q.Stream(context.Background())
+		got := []*indexedTestModel{}
+		for model := range models {
+			got = append(got, model.(*indexedTestModel))
+		}
+		if err := <-errs; err != nil {
+			t.Errorf("Unexpected error in Stream for query %s: %s", q, err.Error())
+			continue
+		}
+		if err := expectModelsToBeEqual(expected, got, true); err != nil {
+			t.Errorf("Stream returned the wrong models for query %s: %s", q, err.Error())
+		}
+		checkForLeakedTmpKeys(t, q.query)
+	}
+
+	// Canceling the context should stop the stream and cause an error.
+	ctx, cancel := context.WithCancel(context.Background())
+	q := indexedTestModels.NewQuery()
+	models, errs := q.Stream(ctx)
+	<-models
+	cancel()
+	for range models {
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("Expected context.Canceled error but got: %v", err)
+	}
+	checkForLeakedTmpKeys(t, q.query)
+}
+
+func TestQueryStreamInclude(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(streamBatchSize + 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	debug := &bytes.Buffer{}
+	q := indexedTestModels.NewQuery().Include("String").Debug(debug)
+	stream, errs := q.Stream(context.Background())
+	got := []*indexedTestModel{}
+	for model := range stream {
+		got = append(got, model.(*indexedTestModel))
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Unexpected error in Stream: %s", err.Error())
+	}
+	if err := expectModelsToBeEqual(applyIncludes(models, []string{"String"}), got, false); err != nil {
+		t.Errorf("Stream returned the wrong models: %s", err.Error())
+	}
+	// Only the included field should be read from the database.
+	for _, line := range strings.Split(debug.String(), "\n") {
+		if !strings.Contains(line, `SORT "tmp:stream:`) {
+			continue
+		}
+		if !strings.Contains(line, `->String"`) || strings.Contains(line, `->Int"`) || strings.Contains(line, `->Bool"`) {
+			t.Errorf("Expected Stream to only read the String field but got: %s", line)
+		}
+	}
+
+	// Canceling the context should still stop a stream with an Include.
+	ctx, cancel := context.WithCancel(context.Background())
+	q = indexedTestModels.NewQuery().Include("Int")
+	stream, errs = q.Stream(ctx)
+	<-stream
+	cancel()
+	for range stream {
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("Expected context.Canceled error but got: %v", err)
+	}
+	checkForLeakedTmpKeys(t, q.query)
+}
+
+func TestQueryRunValues(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isEven := func(m Model) bool {
+		return m.(*indexedTestModel).Int%2 == 0
+	}
+	queries := []*Query{
+		indexedTestModels.NewQuery().Order("Int"),
+		indexedTestModels.NewQuery().Filter("Int >", 3).Order("-String").Limit(3),
+		indexedTestModels.NewQuery().Order("Int").FilterFunc(isEven),
+		indexedTestModels.NewQuery().Filter("Int >", maxExactScore),
+	}
+	for _, q := range queries {
+		expected := []*indexedTestModel{}
+		if err := q.Run(&expected); err != nil {
+			t.Fatalf("Unexpected error in Run: %s", err.Error())
+		}
+		// Run should also allocate and populate a slice of structs, and shrink
+		// it if it is too long.
+		values := make([]indexedTestModel, 20)
+		if err := q.Run(&values); err != nil {
+			t.Fatalf("Unexpected error in Run with a slice of structs: %s", err.Error())
+		}
+		got := make([]*indexedTestModel, len(values))
+		for i := range values {
+			got[i] = &values[i]
+		}
+		if err := expectModelsToBeEqual(expected, got, true); err != nil {
+			t.Errorf("Run with a slice of structs was incorrect for query %s: %s", q, err.Error())
+		}
+	}
+	allValues := []indexedTestModel{}
+	if err := indexedTestModels.FindAll(&allValues); err != nil {
+		t.Fatalf("Unexpected error in FindAll with a slice of structs: %s", err.Error())
+	}
+	if len(allValues) != len(models) {
+		t.Errorf("Expected FindAll to find %d models but got %d", len(models), len(allValues))
+	}
+
+	// Run should return an error if models is not a pointer to a slice of the
+	// correct type.
+	value := indexedTestModel{}
+	invalid := []interface{}{
+		nil,
+		[]indexedTestModel{},
+		&value,
+		&[]testModel{},
+		&[]*testModel{},
+		(*[]indexedTestModel)(nil),
+	}
+	for _, models := range invalid {
+		if err := indexedTestModels.NewQuery().Run(models); err == nil {
+			t.Errorf("Expected an error for %T but got none", models)
+		}
+	}
+}
+
+func TestQueryRunPageSorted(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := []*Query{
+		indexedTestModels.NewQuery().Order("-Int").Limit(3),
+		indexedTestModels.NewQuery().Order("String").Offset(2).Limit(4),
+		indexedTestModels.NewQuery().Filter("Bool =", true).Order("Int").Limit(2),
+		indexedTestModels.NewQuery().Filter("Int >", maxExactScore).Order("Int").Limit(2),
+	}
+	for _, q := range queries {
+		got := []*indexedTestModel{}
+		total, err := q.RunPageSorted(&got)
+		if err != nil {
+			t.Fatalf("Unexpected error in RunPageSorted: %s", err.Error())
+		}
+		expected := expectedResultsForQuery(q.query, models)
+		if err := expectModelsToBeEqual(expected, got, true); err != nil {
+			t.Errorf("RunPageSorted returned the wrong models for query %s: %s", q, err.Error())
+		}
+		// The total should ignore the limit and offset.
+		unlimited := *q.query
+		unlimited.limit, unlimited.offset = 0, 0
+		expectedTotal := len(expectedResultsForQuery(&unlimited, models))
+		if total != expectedTotal {
+			t.Errorf("Expected RunPageSorted to return a total of %d for query %s but got %d", expectedTotal, q, total)
+		}
+		checkForLeakedTmpKeys(t, q.query)
+	}
+
+	// The query must have an order and no FilterFunc.
+	if _, err := indexedTestModels.NewQuery().Limit(2).RunPageSorted(&[]*indexedTestModel{}); err == nil {
+		t.Error("Expected an error for a query without an order but got none")
+	}
+	isEven := func(m Model) bool {
+		return m.(*indexedTestModel).Int%2 == 0
+	}
+	if _, err := indexedTestModels.NewQuery().Order("Int").FilterFunc(isEven).RunPageSorted(&[]*indexedTestModel{}); err == nil {
+		t.Error("Expected an error for a query with a FilterFunc but got none")
+	}
+}
+
+func TestQueryRunWith(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Reuse the same few structs for every model with a sync.Pool. Each model
+	// is compared to the expected results before it is returned to the pool.
+	allocated := 0
+	pool := sync.Pool{
+		New: func() interface{} {
+			allocated++
+			return &indexedTestModel{}
+		},
+	}
+	q := indexedTestModels.NewQuery().Order("-Int").Filter("Int >=", 0).BatchSize(3)
+	expected := expectedResultsForQuery(q.query, models)
+	got := []*indexedTestModel{}
+	alloc := func() Model {
+		return pool.Get().(*indexedTestModel)
+	}
+	consume := func(model Model) error {
+		copied := *(model.(*indexedTestModel))
+		got = append(got, &copied)
+		*(model.(*indexedTestModel)) = indexedTestModel{}
+		pool.Put(model)
+		return nil
+	}
+	if err := q.RunWith(alloc, consume); err != nil {
+		t.Fatalf("Unexpected error in RunWith: %s", err.Error())
+	}
+	if err := expectModelsToBeEqual(expected, got, true); err != nil {
+		t.Error(err)
+	}
+	if allocated > len(expected) {
+		t.Errorf("Expected at most %d models to be allocated but got %d", len(expected), allocated)
+	}
+	checkForLeakedTmpKeys(t, q.query)
+
+	// An error from consume should stop RunWith and be returned.
+	consumed := 0
+	stopErr := fmt.Errorf("stop")
+	err = indexedTestModels.NewQuery().BatchSize(3).RunWith(alloc, func(model Model) error {
+		consumed++
+		return stopErr
+	})
+	if err != stopErr {
+		t.Errorf("Expected RunWith to return %v but got %v", stopErr, err)
+	}
+	if consumed != 1 {
+		t.Errorf("Expected consume to be called once but it was called %d times", consumed)
+	}
+	checkForLeakedTmpKeys(t, q.query)
+
+	// alloc must return a non-nil model of the right type.
+	if err := indexedTestModels.NewQuery().RunWith(func() Model {
+		return &testModel{}
+	}, consume); err == nil {
+		t.Error("Expected an error for a model of the wrong type but got none")
+	}
+	if err := indexedTestModels.NewQuery().RunWith(func() Model {
+		return (*indexedTestModel)(nil)
+	}, consume); err == nil {
+		t.Error("Expected an error for a nil model but got none")
+	}
+}
+
+func TestQueryDistinct(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use a few repeated values for each field.
+	models := createIndexedTestModels(20)
+	tx := testPool.NewTransaction()
+	for i, model := range models {
+		model.Int = (i%4)*10 - 15
+		model.String = []string{"b", "a", "c"}[i%3]
+		tx.Save(indexedTestModels, model)
+	}
+	if err := tx.Exec(); err != nil {
+		t.Fatal(err)
+	}
+	// expectedDistinct returns the distinct values of fieldName for the models
+	// that match q, sorted the same way as Distinct.
+	expectedDistinct := func(q *Query, fieldName string) []string {
+		ints := []int{}
+		values := []string{}
+		seen := map[string]bool{}
+		for _, model := range expectedResultsForQuery(q.query, models) {
+			var value string
+			switch fieldName {
+			case "Int":
+				value = strconv.Itoa(model.Int)
+			case "String":
+				value = model.String
+			case "Bool":
+				value = strconv.FormatBool(model.Bool)
+			}
+			if seen[value] {
+				continue
+			}
+			seen[value] = true
+			if fieldName == "Int" {
+				ints = append(ints, model.Int)
+			} else {
+				values = append(values, value)
+			}
+		}
+		if fieldName == "Int" {
+			sort.Ints(ints)
+			for _, i := range ints {
+				values = append(values, strconv.Itoa(i))
+			}
+		} else {
+			sort.Strings(values)
+		}
+		return values
+	}
+	queries := []func() *Query{
+		func() *Query { return indexedTestModels.NewQuery() },
+		func() *Query { return indexedTestModels.NewQuery().Filter("Int >", -10) },
+		func() *Query { return indexedTestModels.NewQuery().Filter("String =", "a").Filter("Bool =", true) },
+		func() *Query { return indexedTestModels.NewQuery().Order("-String").Limit(5).Offset(2) },
+		func() *Query { return indexedTestModels.NewQuery().Not().Filter("String =", "c") },
+	}
+	for _, newQuery := range queries {
+		for _, fieldName := range []string{"Int", "String", "Bool"} {
+			q := newQuery()
+			got, err := q.Distinct(fieldName)
+			if err != nil {
+				t.Errorf("Unexpected error in Distinct(%q) for %s: %s", fieldName, q, err.Error())
+				continue
+			}
+			expected := expectedDistinct(q, fieldName)
+			if !reflect.DeepEqual(expected, got) {
+				t.Errorf("Distinct(%q) for %s returned the wrong values.\nExpected: %v\nGot:      %v", fieldName, q, expected, got)
+			}
+			checkForLeakedTmpKeys(t, q.query)
+		}
+	}
+
+	// Enum indexes keep a set of the distinct values. Models with nil values
+	// should not be included.
+	type distinctEnumModel struct {
+		Status   string  `zoom:"index,enum"`
+		Priority *int    `zoom:"index"`
+		Note     *string `zoom:"index"`
+		RandomId
+	}
+	enumModels, err := testPool.NewCollectionWithOptions(&distinctEnumModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, two := 1, 2
+	for _, model := range []*distinctEnumModel{
+		{Status: "open", Priority: &two},
+		{Status: "closed", Priority: &one},
+		{Status: "open"},
+		{Status: "pending", Priority: &two},
+	} {
+		if err := enumModels.Save(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		query     *Query
+		fieldName string
+		expected  []string
+	}{
+		{enumModels.NewQuery(), "Status", []string{"closed", "open", "pending"}},
+		{enumModels.NewQuery().Filter("Priority =", 2), "Status", []string{"open", "pending"}},
+		{enumModels.NewQuery(), "Priority", []string{"1", "2"}},
+		{enumModels.NewQuery().Filter("Status =", "open"), "Priority", []string{"2"}},
+		{enumModels.NewQuery(), "Note", []string{}},
+	} {
+		got, err := test.query.Distinct(test.fieldName)
+		if err != nil {
+			t.Errorf("Unexpected error in Distinct(%q) for %s: %s", test.fieldName, test.query, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(test.expected, got) {
+			t.Errorf("Distinct(%q) for %s returned the wrong values.\nExpected: %v\nGot:      %v", test.fieldName, test.query, test.expected, got)
+		}
+	}
+
+	// Fields which do not exist or are not indexed should cause an error.
+	if _, err := indexedTestModels.NewQuery().Distinct("Invalid"); err == nil {
+		t.Error("Expected an error for a field that does not exist but got none")
+	}
+	if _, err := testModels.NewQuery().Distinct("Int"); err == nil {
+		t.Error("Expected an error for a field that is not indexed but got none")
+	}
+}
+
+func TestQueryAllowPartialResults(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the Int field of one of the models so that it cannot be scanned.
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Id < models[j].Id
+	})
+	corrupt := models[2]
+	conn := testPool.NewConn()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", indexedTestModels.ModelKey(corrupt.Id), "Int", "not a number"); err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append([]*indexedTestModel{}, models[:2]...), models[3:]...)
+
+	// By default, Run should fail.
+	got := []*indexedTestModel{}
+	if err := indexedTestModels.NewQuery().Run(&got); err == nil {
+		t.Error("Expected an error from Run without AllowPartialResults but got none")
+	} else if _, ok := err.(PartialResultsError); ok {
+		t.Errorf("Expected Run without AllowPartialResults to fail, but got %s", err.Error())
+	}
+
+	expectPartialResults := func(err error) {
+		partialErr, ok := err.(PartialResultsError)
+		if !ok {
+			t.Fatalf("Expected a PartialResultsError but got %v", err)
+		}
+		if len(partialErr.Errors) != 1 {
+			t.Fatalf("Expected 1 ScanError but got %d: %v", len(partialErr.Errors), partialErr.Errors)
+		}
+		if partialErr.Errors[0].Id != corrupt.Id {
+			t.Errorf("Expected the ScanError to have Id %s but got %s", corrupt.Id, partialErr.Errors[0].Id)
+		}
+		var scanErr ScanError
+		if !errors.As(err, &scanErr) {
+			t.Error("Expected errors.As to find a ScanError in the PartialResultsError")
+		}
+	}
+	// With AllowPartialResults, the other models should be returned, including
+	// when models already has elements which are reused.
+	for _, got := range [][]*indexedTestModel{{}, {{}, {}, {}, {}, {}, {}}} {
+		err := indexedTestModels.NewQuery().AllowPartialResults().Run(&got)
+		expectPartialResults(err)
+		if err := expectModelsToBeEqual(expected, got, true); err != nil {
+			t.Error(err)
+		}
+	}
+	gotStructs := []indexedTestModel{}
+	expectPartialResults(indexedTestModels.NewQuery().AllowPartialResults().Run(&gotStructs))
+	if len(gotStructs) != len(expected) {
+		t.Errorf("Expected %d models but got %d", len(expected), len(gotStructs))
+	}
+	// Cached queries (the second one reads the cached results) and queries
+	// with FilterFunc should work the same way.
+	for _, q := range []*Query{
+		indexedTestModels.NewQuery().AllowPartialResults().Cache(time.Minute),
+		indexedTestModels.NewQuery().AllowPartialResults().Cache(time.Minute),
+		indexedTestModels.NewQuery().AllowPartialResults().FilterFunc(func(Model) bool { return true }),
+	} {
+		got := []*indexedTestModel{}
+		expectPartialResults(q.Run(&got))
+		if err := expectModelsToBeEqual(expected, got, true); err != nil {
+			t.Error(err)
+		}
+		checkForLeakedTmpKeys(t, q.query)
+	}
+}
+
+func TestQueryExportJSON(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := indexedTestModels.NewQuery().Order("Int").Filter("Int >=", 0).Offset(1).Limit(5).BatchSize(2)
+	expected := expectedResultsForQuery(q.query, models)
+	buf := &bytes.Buffer{}
+	if err := q.ExportJSON(buf); err != nil {
+		t.Fatalf("Unexpected error in ExportJSON: %s", err.Error())
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines but got %d:\n%s", len(expected), len(lines), buf.String())
+	}
+	got := []*indexedTestModel{}
+	for _, line := range lines {
+		model := &indexedTestModel{}
+		if err := json.Unmarshal([]byte(line), model); err != nil {
+			t.Fatalf("Could not decode line %q: %s", line, err.Error())
+		}
+		got = append(got, model)
+	}
+	if err := expectModelsToBeEqual(expected, got, true); err != nil {
+		t.Error(err)
 	}
-	fields := [][]string{
-		[]string{},
-		[]string{"Int"},
-		[]string{"Int", "Bool", "String"},
+	checkForLeakedTmpKeys(t, q.query)
+
+	// Fields which are not included should be zero values.
+	buf.Reset()
+	if err := indexedTestModels.NewQuery().Include("String").ExportJSON(buf); err != nil {
+		t.Fatalf("Unexpected error in ExportJSON: %s", err.Error())
 	}
-	for _, fs := range fields {
-		includeQuery := indexedTestModels.NewQuery().Include(fs...)
-		testQuery(t, includeQuery, models)
-		excludeQuery := indexedTestModels.NewQuery().Exclude(fs...)
-		testQuery(t, excludeQuery, models)
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		model := &indexedTestModel{}
+		if err := json.Unmarshal([]byte(line), model); err != nil {
+			t.Fatalf("Could not decode line %q: %s", line, err.Error())
+		}
+		if model.Int != 0 || model.Bool || model.String == "" || model.Id == "" {
+			t.Errorf("Expected only the String field and the id to be set but got %+v", model)
+		}
+	}
+
+	// Errors from the writer should be returned.
+	writeErr := errors.New("write error")
+	if err := indexedTestModels.NewQuery().ExportJSON(errorWriter{writeErr}); err != writeErr {
+		t.Errorf("Expected ExportJSON to return %v but got %v", writeErr, err)
 	}
 }
 
-func TestQueryFilterInt(t *testing.T) {
+// errorWriter is an io.Writer which always returns err.
+type errorWriter struct {
+	err error
+}
+
+func (w errorWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestQueryStreamBatchSize(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
 
-	models, err := createAndSaveIndexedTestModels(10)
+	expected, err := createAndSaveIndexedTestModels(50)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Test queries with filters using all possible operators and a
-	// few different filter values.
-	filterValues := []interface{}{-10, 0, 99999999, models[0].Int}
-	for _, val := range filterValues {
-		for op, _ := range filterOps {
-			q := indexedTestModels.NewQuery().Filter("Int "+op, val)
-			testQuery(t, q, models)
+	for _, batchSize := range []uint{1, 7, 50, 1000} {
+		debug := &bytes.Buffer{}
+		q := indexedTestModels.NewQuery().BatchSize(batchSize).Debug(debug)
+		models, errs := q.Stream(context.Background())
+		got := []*indexedTestModel{}
+		for model := range models {
+			got = append(got, model.(*indexedTestModel))
+		}
+		if err := <-errs; err != nil {
+			t.Errorf("Unexpected error in Stream with batch size %d: %s", batchSize, err.Error())
+			continue
+		}
+		if err := expectModelsToBeEqual(expected, got, false); err != nil {
+			t.Errorf("Stream with batch size %d returned the wrong models: %s", batchSize, err.Error())
+		}
+		// Each batch is read with a single SORT command on the temporary list. An
+		// extra empty batch is read when the number of models is a multiple of the
+		// batch size.
+		expectedBatches := len(expected)/int(batchSize) + 1
+		gotBatches := strings.Count(debug.String(), `zoom: SORT "tmp:stream:`)
+		if gotBatches != expectedBatches {
+			t.Errorf("Expected %d batches with batch size %d but got %d", expectedBatches, batchSize, gotBatches)
 		}
 	}
 }
 
-func TestQueryFilterBool(t *testing.T) {
+func TestQueryCachedCount(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
 
-	models, err := createAndSaveIndexedTestModels(10)
+	models, err := createAndSaveIndexedTestModels(5)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Test queries with filters using all possible operators and a
-	// few different filter values.
-	filterValues := []interface{}{true, false}
-	for _, val := range filterValues {
-		for op, _ := range filterOps {
-			q := indexedTestModels.NewQuery().Filter("Bool "+op, val)
-			testQuery(t, q, models)
+	q := indexedTestModels.NewQuery().Filter("Int >=", 0)
+	expectCachedCount := func(expected int) {
+		got, err := q.CachedCount(time.Minute)
+		if err != nil {
+			t.Fatalf("Unexpected error in CachedCount: %s", err.Error())
 		}
+		if got != expected {
+			t.Errorf("Cached count was incorrect. Expected %d but got %d", expected, got)
+		}
+	}
+	expectCachedCount(len(models))
+
+	// Remove one of the models from the index directly. This does not
+	// invalidate the cache so the old count should be returned.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	intIndexKey, err := indexedTestModels.FieldIndexKey("Int")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("ZREM", intIndexKey, models[0].ModelId()); err != nil {
+		t.Fatal(err)
+	}
+	expectCachedCount(len(models))
+
+	// Saving a model should invalidate the cache.
+	if err := indexedTestModels.Save(createIndexedTestModels(1)[0]); err != nil {
+		t.Fatal(err)
+	}
+	expectCachedCount(len(models))
+	count, err := q.Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != len(models) {
+		t.Errorf("Count was incorrect. Expected %d but got %d", len(models), count)
+	}
+
+	// Deleting a model should also invalidate the cache.
+	if _, err := indexedTestModels.Delete(models[1].ModelId()); err != nil {
+		t.Fatal(err)
+	}
+	expectCachedCount(len(models) - 1)
+
+	// A ttl shorter than one millisecond should cause an error.
+	if _, err := q.CachedCount(time.Microsecond); err == nil {
+		t.Error("Expected an error for a ttl less than one millisecond but got none")
 	}
 }
 
-func TestQueryFilterString(t *testing.T) {
+func TestQueryCache(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
 
-	// Create some models with tricky String values
-	models := createIndexedTestModels(10)
-	models[1].String = models[0].String + " "
-	models[2].String = models[0].String[:len(models[0].String)-1]
-	tx := testPool.NewTransaction()
-	for _, model := range models {
-		tx.Save(indexedTestModels, model)
+	models, err := createAndSaveIndexedTestModels(5)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err := tx.Exec(); err != nil {
-		t.Fatalf("Error executing transaction: %s", err.Error())
+	q := indexedTestModels.NewQuery().Order("Int").Cache(time.Minute)
+	expectCachedResults := func(expected []*indexedTestModel) {
+		got := []*indexedTestModel{}
+		if err := q.Run(&got); err != nil {
+			t.Fatalf("Unexpected error in Run: %s", err.Error())
+		}
+		if err := expectModelsToBeEqual(expected, got, true); err != nil {
+			t.Errorf("Cached results were incorrect: %s", err.Error())
+		}
+	}
+	expected := []*indexedTestModel{}
+	if err := indexedTestModels.NewQuery().Order("Int").Run(&expected); err != nil {
+		t.Fatal(err)
 	}
+	expectCachedResults(expected)
 
-	// Test queries with filters using all possible operators and a
-	// few different filter values.
-	filterValues := []interface{}{"a", "AbCdE", models[0].String, incrementString(models[0].String), decrementString(models[0].String), models[0].String + " ", models[0].String[:len(models[0].String)-1]}
-	for _, val := range filterValues {
-		for op, _ := range filterOps {
-			q := indexedTestModels.NewQuery().Filter("String "+op, val)
-			testQuery(t, q, models)
+	// Change one of the models directly. This does not invalidate the cache so
+	// the old results should be returned.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", indexedTestModels.ModelKey(models[0].ModelId()), "String", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	expectCachedResults(expected)
+
+	// Saving a model should invalidate the cache.
+	if err := indexedTestModels.Save(models[1]); err != nil {
+		t.Fatal(err)
+	}
+	expected = []*indexedTestModel{}
+	if err := indexedTestModels.NewQuery().Order("Int").Run(&expected); err != nil {
+		t.Fatal(err)
+	}
+	expectCachedResults(expected)
+
+	// Nil fields should be preserved in the cached results.
+	pointersModel := &indexedPointersModel{}
+	if err := indexedPointersModels.Save(pointersModel); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		got := []*indexedPointersModel{}
+		if err := indexedPointersModels.NewQuery().Cache(time.Minute).Run(&got); err != nil {
+			t.Fatalf("Unexpected error in Run: %s", err.Error())
 		}
+		if len(got) != 1 || !reflect.DeepEqual(pointersModel, got[0]) {
+			t.Errorf("Cached results were incorrect. Expected %v but got %v", []*indexedPointersModel{pointersModel}, got)
+		}
+	}
+
+	// Invalid uses of Cache should cause an error.
+	if err := indexedTestModels.NewQuery().Cache(time.Microsecond).Err(); err == nil {
+		t.Error("Expected an error for a ttl less than one millisecond but got none")
+	}
+	filterFuncQuery := indexedTestModels.NewQuery().Cache(time.Minute).FilterFunc(func(Model) bool { return true })
+	if err := filterFuncQuery.Run(&[]*indexedTestModel{}); err == nil {
+		t.Error("Expected an error for a cached query with FilterFunc but got none")
 	}
 }
 
-func TestQueryDoubleFilters(t *testing.T) {
+func TestQueryDebug(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
 
-	models, err := createAndSaveIndexedTestModels(10)
+	models, err := createAndSaveIndexedTestModels(5)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// create some test queries to filter the models
-	fieldNames := []string{"Int", "Bool", "String"}
-	filterValues := []interface{}{models[0].Int, true, models[0].String}
-	for i, f1 := range fieldNames {
-		v1 := filterValues[i]
-		for j, f2 := range fieldNames {
-			v2 := filterValues[j]
-			for o1, _ := range filterOps {
-				for o2, _ := range filterOps {
-					if f1 == f2 && o1 == o2 {
-						// no sense in doing the same filter twice
-						continue
-					}
-					q := indexedTestModels.NewQuery().Filter(f1+" "+o1, v1).Filter(f2+" "+o2, v2)
-					testQuery(t, q, models)
-				}
-			}
+	buf := &bytes.Buffer{}
+	q := indexedTestModels.NewQuery().Order("String").Filter("Int >=", 0).Debug(buf)
+	got := []*indexedTestModel{}
+	if err := q.Run(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(models) {
+		t.Errorf("Expected %d models but got %d", len(models), len(got))
+	}
+	output := buf.String()
+	for _, expected := range []string{
+		"SCRIPT extract_ids_from_string_index",
+		"SORT",
+		"EXEC",
+		"contains " + strconv.Itoa(len(models)) + " ids",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected debug output to contain %q but it did not.\nGot:\n%s", expected, output)
 		}
 	}
+
+	// Queries without a debug writer should not have any debug output.
+	buf.Reset()
+	if err := indexedTestModels.NewQuery().Run(&got); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected no debug output but got:\n%s", buf.String())
+	}
 }
 
-func TestQueryCombos(t *testing.T) {
+func TestQueryOrderUnindexed(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
 
-	models, err := createAndSaveIndexedTestModels(10)
+	type unindexedOrderModel struct {
+		Name  string
+		Score float64
+		Rank  *int
+		Group int `zoom:"index"`
+		Data  []byte
+		RandomId
+	}
+	collection, err := testPool.NewCollectionWithOptions(&unindexedOrderModel{}, DefaultCollectionOptions.WithIndex(true))
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Iterate over many different combinations of filters and orders to create
-	// and test different queries
-	fieldNames := []string{"Int", "Bool", "String"}
-	filterValues := []interface{}{models[0].Int, true, models[0].String}
-	limits := []uint{0, 1, 5, 9, 10}
-	offsets := []uint{0, 1, 5, 9, 10}
-	for i, filterField := range fieldNames {
-		filterVal := filterValues[i]
-		for filterOp, _ := range filterOps {
-			for _, orderField := range fieldNames {
-				for _, orderPrefix := range []string{"", "-"} {
-					for _, offset := range offsets {
-						for _, limit := range limits {
-							q := indexedTestModels.NewQuery()
-							q.Filter(filterField+" "+filterOp, filterVal).Order(orderPrefix + orderField).Limit(limit).Offset(offset)
-							testQuery(t, q, models)
-						}
-					}
-				}
-			}
+	one, two := 1, 2
+	models := []*unindexedOrderModel{
+		{Name: "b", Score: 10, Rank: &two, Group: 1},
+		{Name: "a10", Score: 9, Group: 2},
+		{Name: "a9", Score: 100, Rank: &one, Group: 1},
+		{Name: "c", Score: -1.5e21, Group: 2},
+		{Name: "", Score: 0.5, Rank: &one, Group: 1},
+	}
+	for _, model := range models {
+		if err := collection.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	// expectIds checks that q returns the ids of the models at the given
+	// indexes in models, in order.
+	expectIds := func(q *Query, indexes ...int) {
+		t.Helper()
+		expected := []string{}
+		for _, i := range indexes {
+			expected = append(expected, models[i].ModelId())
+		}
+		got, err := q.Ids()
+		if err != nil {
+			t.Fatalf("Unexpected error in %s: %s", q, err.Error())
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Wrong results for %s.\nExpected: %v\nGot:      %v", q, expected, got)
+		}
+		checkForLeakedTmpKeys(t, q.query)
+	}
+
+	// Strings are sorted lexicographically and numbers numerically.
+	expectIds(collection.NewQuery().OrderUnindexed("Name"), 4, 1, 2, 0, 3)
+	expectIds(collection.NewQuery().OrderUnindexed("-Name"), 3, 0, 2, 1, 4)
+	expectIds(collection.NewQuery().OrderUnindexed("Score"), 3, 4, 1, 0, 2)
+	expectIds(collection.NewQuery().OrderUnindexed("-Score").Limit(2).Offset(1), 0, 1)
+	// Nil values are sorted as 0 and ties are broken by id.
+	nilRanks := []int{1, 3}
+	sort.Slice(nilRanks, func(i, j int) bool { return models[nilRanks[i]].ModelId() < models[nilRanks[j]].ModelId() })
+	oneRanks := []int{2, 4}
+	sort.Slice(oneRanks, func(i, j int) bool { return models[oneRanks[i]].ModelId() < models[oneRanks[j]].ModelId() })
+	expectIds(collection.NewQuery().OrderUnindexed("Rank"), append(append(nilRanks, oneRanks...), 0)...)
+	// The order should apply after filters.
+	expectIds(collection.NewQuery().Filter("Group =", 1).OrderUnindexed("-Score"), 2, 0, 4)
+	expectIds(collection.NewQuery().UnindexedFilter("Name contains", "a").OrderUnindexed("Score").Limit(1), 1)
+
+	// The other finishers should respect the order too.
+	got := []*unindexedOrderModel{}
+	if err := collection.NewQuery().OrderUnindexed("Score").Run(&got); err != nil {
+		t.Fatalf("Unexpected error in Run: %s", err.Error())
+	} else if len(got) != len(models) || got[0].Name != "c" {
+		t.Errorf("Expected Run to return the models ordered by Score but got %v", got)
+	}
+	if total, err := collection.NewQuery().OrderUnindexed("Name").Limit(2).RunPageSorted(&got); err != nil {
+		t.Fatalf("Unexpected error in RunPageSorted: %s", err.Error())
+	} else if total != len(models) || len(got) != 2 || got[1].Name != "a10" {
+		t.Errorf("Expected RunPageSorted to return 2 of %d models ordered by Name but got %d and %v", len(models), total, got)
+	}
+	first := &unindexedOrderModel{}
+	if err := collection.NewQuery().OrderUnindexed("-Score").RunOne(first); err != nil {
+		t.Fatalf("Unexpected error in RunOne: %s", err.Error())
+	} else if first.Name != "a9" {
+		t.Errorf("Expected RunOne to return the model with the highest Score but got %v", first)
+	}
+	if got := collection.NewQuery().OrderUnindexed("-Score").String(); !strings.Contains(got, `OrderUnindexed("-Score")`) {
+		t.Errorf("Expected the query string to contain the order but got %s", got)
+	}
+
+	// Invalid uses of OrderUnindexed should cause an error.
+	for _, q := range []*Query{
+		collection.NewQuery().OrderUnindexed("Missing"),
+		collection.NewQuery().OrderUnindexed("Data"),
+		collection.NewQuery().Order("Group").OrderUnindexed("Name"),
+		collection.NewQuery().Unordered().OrderUnindexed("Name"),
+	} {
+		if _, err := q.Ids(); err == nil {
+			t.Errorf("Expected an error for %s but got none", q)
 		}
 	}
 }
 
-func TestQueryRunOne(t *testing.T) {
+func TestQuerySampleStream(t *testing.T) {
 	testingSetUp()
 	defer testingTearDown()
 
-	models := []*indexedTestModel{}
-	tx := testPool.NewTransaction()
-	for i := 0; i < 5; i++ {
-		model := &indexedTestModel{
-			Int:    i,
-			String: strconv.Itoa(i),
+	models := make([]*indexedTestModel, 50)
+	for i := range models {
+		models[i] = &indexedTestModel{Int: i, String: strconv.Itoa(i)}
+		if err := indexedTestModels.Save(models[i]); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
 		}
-		models = append(models, model)
-		tx.Save(indexedTestModels, model)
 	}
-	if err := tx.Exec(); err != nil {
+
+	// The sample should only contain distinct models which match the query, in
+	// the order of the query results.
+	q := indexedTestModels.NewQuery().Filter("Int >=", 10).Order("-Int").BatchSize(7)
+	sample, err := q.SampleStream(15)
+	if err != nil {
+		t.Fatalf("Unexpected error in SampleStream: %s", err.Error())
+	}
+	if len(sample) != 15 {
+		t.Fatalf("Expected 15 models but got %d", len(sample))
+	}
+	for i, model := range sample {
+		got := model.(*indexedTestModel)
+		if !reflect.DeepEqual(models[got.Int], got) {
+			t.Errorf("Sampled model was incorrect.\nExpected: %+v\nGot:      %+v", models[got.Int], got)
+		}
+		if got.Int < 10 {
+			t.Errorf("Expected only models with Int >= 10 but got %d", got.Int)
+		}
+		if i > 0 && got.Int >= sample[i-1].(*indexedTestModel).Int {
+			t.Errorf("Expected the sample to be in the order of the query but %d came after %d", got.Int, sample[i-1].(*indexedTestModel).Int)
+		}
+	}
+	checkForLeakedTmpKeys(t, q.query)
+
+	// If fewer models match than requested, all of them should be returned.
+	if sample, err := indexedTestModels.NewQuery().Filter("Int <", 3).Include("Int").SampleStream(10); err != nil {
+		t.Fatalf("Unexpected error in SampleStream: %s", err.Error())
+	} else if len(sample) != 3 {
+		t.Errorf("Expected 3 models but got %d", len(sample))
+	} else if got := sample[0].(*indexedTestModel); got.String != "" {
+		t.Errorf("Expected only the included fields to be set but got %+v", got)
+	}
+
+	// Every model should have the same chance of being picked.
+	counts := map[int]int{}
+	const trials = 400
+	for i := 0; i < trials; i++ {
+		sample, err := indexedTestModels.NewQuery().Filter("Int <", 4).SampleStream(1)
+		if err != nil {
+			t.Fatalf("Unexpected error in SampleStream: %s", err.Error())
+		}
+		counts[sample[0].(*indexedTestModel).Int]++
+	}
+	for i := 0; i < 4; i++ {
+		if counts[i] < trials/8 || counts[i] > trials*3/8 {
+			t.Errorf("Expected model %d to be picked about %d times but it was picked %d times", i, trials/4, counts[i])
+		}
+	}
+
+	if _, err := indexedTestModels.NewQuery().SampleStream(-1); err == nil {
+		t.Error("Expected an error for a negative n but got none")
+	}
+	if _, err := indexedTestModels.NewQuery().FilterFunc(func(Model) bool { return true }).SampleStream(1); err == nil {
+		t.Error("Expected an error for a query with FilterFunc but got none")
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(10)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	testCases := []struct {
-		query         *Query
-		expectedModel *indexedTestModel
-		shouldErr     bool
-	}{
-		{
-			query:         indexedTestModels.NewQuery().Filter("String =", models[0].String),
-			expectedModel: models[0],
-			shouldErr:     false,
-		},
-		{
-			query:         indexedTestModels.NewQuery().Filter("Int =", models[1].Int),
-			expectedModel: models[1],
-			shouldErr:     false,
-		},
-		{
-			query:         indexedTestModels.NewQuery().Filter("String =", models[0].String).Filter("Int =", models[1].Int),
-			expectedModel: nil,
-			shouldErr:     true,
-		},
+	// A query which finishes before the deadline should work as usual for all
+	// of the finishers.
+	testQuery(t, indexedTestModels.NewQuery().Order("-Int").Filter("Int >", 0).Timeout(time.Second), models)
+
+	// Pause the database, so that the query below cannot finish before its
+	// deadline. The connection is returned to the pool before the query is
+	// run, so the query does not need to dial a new one.
+	const pause = 300 * time.Millisecond
+	conn := testPool.NewConn()
+	if _, err := conn.Do("CLIENT", "PAUSE", int64(pause/time.Millisecond), "ALL"); err != nil {
+		t.Fatalf("Unexpected error in CLIENT PAUSE: %s", err.Error())
+	}
+	conn.Close()
+	start := time.Now()
+	got := []*indexedTestModel{}
+	err = indexedTestModels.NewQuery().Order("String").Filter("Int >", 0).Filter("Bool =", true).Timeout(50 * time.Millisecond).Run(&got)
+	elapsed := time.Since(start)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded but got: %v", err)
+	}
+	if elapsed >= pause-100*time.Millisecond {
+		t.Errorf("Expected the query to stop at its deadline but it took %s", elapsed)
+	}
+	time.Sleep(pause - elapsed + 50*time.Millisecond)
+	// The temporary sets for the query should not be left behind, and the
+	// pool should still be usable.
+	checkForLeakedTmpKeys(t, indexedTestModels.NewQuery().query)
+	if count, err := indexedTestModels.NewQuery().Count(); err != nil {
+		t.Errorf("Unexpected error in Count after a timeout: %s", err.Error())
+	} else if count != len(models) {
+		t.Errorf("Expected Count to return %d but got %d", len(models), count)
 	}
 
-	for i, tc := range testCases {
-		gotModel := &indexedTestModel{}
-		err := tc.query.RunOne(gotModel)
-		switch tc.shouldErr {
-		case true:
-			if err == nil {
-				t.Errorf("Error in test case %d: Expected an error but got none.", i)
-			}
-		case false:
-			if err != nil {
-				t.Errorf("Unexpected error in test case %d: %s", i, err.Error())
-			}
-			if !reflect.DeepEqual(gotModel, tc.expectedModel) {
-				t.Errorf("Error in test case %d: model was incorrect.\nExpected: %v\n     Got: %v", i, tc.expectedModel, gotModel)
-			}
-		}
+	// A canceled context stops the query before anything is sent.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := indexedTestModels.NewQuery().Filter("Int >", 0).WithContext(ctx).Count(); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from Count but got: %v", err)
+	}
+	if err := indexedTestModels.NewQuery().WithContext(ctx).Run(&got); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled from Run but got: %v", err)
+	}
+
+	// Invalid arguments should set an error on the query.
+	if err := indexedTestModels.NewQuery().Timeout(-time.Second).Err(); err == nil {
+		t.Error("Expected an error for a negative timeout but got none")
+	}
+	if err := indexedTestModels.NewQuery().WithContext(nil).Err(); err == nil {
+		t.Error("Expected an error for a nil context but got none")
 	}
 }
 
@@ -305,7 +1727,7 @@ func testQueryRun(t *testing.T, q *Query, expected []*indexedTestModel) {
 		t.Errorf("Unexpected error in query.Run: %s", err.Error())
 		return
 	}
-	if err := expectModelsToBeEqual(expected, got, q.hasOrder()); err != nil {
+	if err := expectModelsToBeEqual(expected, got, !q.unordered); err != nil {
 		t.Errorf("testQueryRun failed for query %s\nExpected: %#v\nGot:  %#v", q, expected, got)
 	}
 }
@@ -327,7 +1749,7 @@ func testQueryIds(t *testing.T, q *Query, expectedModels []*indexedTestModel) {
 		return
 	}
 	expected := modelIds(Models(expectedModels))
-	if q.hasOrder() {
+	if !q.unordered {
 		// Order matters
 		if !reflect.DeepEqual(expected, got) {
 			t.Errorf("testQueryIds failed for query %s\nExpected: %v\nGot:  %v", q, expected, got)
@@ -354,7 +1776,7 @@ func testQueryStoreIds(t *testing.T, q *Query, expectedModels []*indexedTestMode
 		t.Error(err)
 		return
 	}
-	if q.hasOrder() {
+	if !q.unordered {
 		// Order matters
 		if !reflect.DeepEqual(expected, got) {
 			t.Errorf("testQueryStoreIds failed for query %s\nExpected: %v\nGot:  %v", q, expected, got)
@@ -395,9 +1817,22 @@ func expectedResultsForQuery(q *query, models []*indexedTestModel) []*indexedTes
 		expected = orderedIntersectModels(applyFilter(expected, filter), expected)
 	}
 
+	// apply unindexed filters
+	for _, filter := range q.unindexedFilters {
+		filtered := []*indexedTestModel{}
+		for _, m := range expected {
+			if strings.Contains(reflect.ValueOf(m).Elem().FieldByName(filter.fieldSpec.name).String(), filter.substring) {
+				filtered = append(filtered, m)
+			}
+		}
+		expected = filtered
+	}
+
 	// apply order (if applicable)
 	if q.hasOrder() {
 		expected = applyOrder(expected, q.order)
+	} else if q.sortsById() {
+		sort.Sort(byId(expected))
 	}
 
 	// apply limit/offset
@@ -460,7 +1895,7 @@ func applyFilter(models []*indexedTestModel, filter filter) []*indexedTestModel
 			return false
 		}
 
-	case stringIndex:
+	case stringIndex, idIndex:
 		filterFunc = func(m *indexedTestModel) bool {
 			fieldVal := reflect.ValueOf(m).Elem().FieldByName(filter.fieldSpec.name).String()
 			filterVal := filter.value.String()
@@ -482,6 +1917,13 @@ func applyFilter(models []*indexedTestModel, filter filter) []*indexedTestModel
 		}
 	}
 
+	if filter.negate {
+		positiveFunc := filterFunc
+		filterFunc = func(m *indexedTestModel) bool {
+			return !positiveFunc(m)
+		}
+	}
+
 	return filterModels(models, filterFunc)
 }
 
@@ -0,0 +1,424 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File reindex.go contains code for rebuilding the index for a single field,
+// for renaming a field in the stored models, and for checking the indexes for
+// inconsistencies.
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// reindexBatchSize is the number of models whose index is rebuilt in a single
+// transaction by ReindexField. It is also the number of models which are
+// renamed in a single script by RenameField.
+const reindexBatchSize = 100
+
+// maxReindexAttempts is the maximum number of times ReindexField reads and
+// indexes a single batch of models if some of them are modified concurrently.
+const maxReindexAttempts = 10
+
+// ReindexField rebuilds the index for the given field from the values stored
+// in the database, without touching any other fields or indexes. It is useful
+// after a migration which changed a single indexed field (e.g. after adding
+// an index to an existing field or changing how it is encoded). fieldName
+// should be the name of an indexed field as it appears in the struct
+// definition. ReindexField first deletes the existing index for the field
+// and then, for every model in the collection, reads just the value of that
+// field (with HGET) and adds the model back to the index. If the field has a
+// partial index, the field in its condition is read too, and only the models
+// which match the condition are added back. The models are processed in
+// batches. The values for each batch are read and indexed in a single
+// transaction which watches the models, and the batch is retried if any of
+// them is saved or deleted in the meantime, so concurrent writes never leave a
+// stale entry in the index. The operation as a whole is not atomic, though:
+// queries that filter or order by the field may return incomplete results
+// while ReindexField is running, and it returns an error if a batch is
+// modified concurrently too many times in a row. ReindexField returns the
+// number of models that were processed. It only works for indexed collections
+// and returns an error if the field does not exist or is not indexed. Use
+// ReindexFieldWithProgress to observe or cancel the operation.
+func (c *Collection) ReindexField(fieldName string) (int, error) {
+	return c.ReindexFieldWithProgress(context.Background(), fieldName, nil)
+}
+
+// ReindexFieldWithProgress works like ReindexField, but it is intended for
+// very large collections where rebuilding the index takes a long time. If
+// progress is not nil, it is called after each batch of models has been
+// processed with the number of models processed so far and the total number
+// of models, which is the number of ids in the collection when the rebuild
+// started. It is called synchronously, so it should return quickly. ctx is
+// checked before each batch, and if it is done, ReindexFieldWithProgress stops
+// and returns the number of models processed along with ctx.Err(). In that
+// case the index only contains the models that were processed, and calling
+// ReindexField again will rebuild it from scratch.
+func (c *Collection) ReindexFieldWithProgress(ctx context.Context, fieldName string, progress func(done, total int)) (int, error) {
+	if c == nil {
+		return 0, newNilCollectionError("ReindexField")
+	}
+	if !c.index {
+		return 0, newUnindexedCollectionError("ReindexField")
+	}
+	fs, found := c.spec.fieldsByName[fieldName]
+	if !found {
+		return 0, fmt.Errorf("zoom: Error in ReindexField: Collection %s does not have field named %s", c.Name(), fieldName)
+	}
+	if fs.indexKind == noIndex {
+		return 0, fmt.Errorf("zoom: Error in ReindexField: %s.%s is not indexed", c.Name(), fieldName)
+	}
+	indexKey, err := c.spec.fieldIndexKey(fieldName)
+	if err != nil {
+		return 0, err
+	}
+
+	// Get the ids of all models and wipe the old index in the same transaction
+	// so that every model saved afterwards is indexed by Save as usual.
+	ids := []string{}
+	t := c.pool.NewTransaction()
+	t.Command("SMEMBERS", redis.Args{c.IndexKey()}, NewScanStringsHandler(&ids))
+	if fs.indexKind == enumIndex {
+		t.deleteEnumBuckets(indexKey)
+	} else {
+		t.Command("DEL", redis.Args{indexKey}, nil)
+	}
+	if fs.indexKeyFunc != nil {
+		t.Command("DEL", redis.Args{indexKeysKey(indexKey)}, nil)
+	}
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for start := 0; start < len(ids); start += reindexBatchSize {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		end := start + reindexBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+		// Read the value of the field for each model in the batch, along with
+		// the field in the condition for a partial index (if any).
+		fieldNames := []string{fieldName}
+		redisNames := redis.Args{fs.redisName}
+		if fs.where != nil && fs.where.field != fs {
+			fieldNames = append(fieldNames, fs.where.field.name)
+			redisNames = append(redisNames, fs.where.field.redisName)
+		}
+		// The values are read and the index is written in a single watched
+		// transaction, so a model which is saved in between (and has already
+		// been indexed by Save) is not added back with its old value. If that
+		// happens, the batch is read again.
+		err := c.pool.WithOptimisticRetry(maxReindexAttempts, func(t *Transaction) error {
+			mrs := make([]*modelRef, len(batch))
+			keys := make([]string, len(batch))
+			for i, id := range batch {
+				model := reflect.New(c.spec.typ.Elem()).Interface().(Model)
+				model.SetModelId(id)
+				mrs[i] = &modelRef{
+					collection: c,
+					model:      model,
+					spec:       c.spec,
+				}
+				keys[i] = mrs[i].key()
+			}
+			if err := t.Watch(keys...); err != nil {
+				return err
+			}
+			for _, key := range keys {
+				if err := t.conn.Send("HMGET", redis.Args{key}.AddFlat(redisNames)...); err != nil {
+					return err
+				}
+			}
+			if err := t.conn.Flush(); err != nil {
+				return err
+			}
+			for _, mr := range mrs {
+				reply, err := t.conn.Receive()
+				if err != nil {
+					return err
+				}
+				found := false
+				if err := newReindexFieldHandler(fieldNames, mr, &found)(reply); err != nil {
+					return err
+				}
+				// Add each model with a stored value back to the index. Nil
+				// values are not indexed, and neither are models which do not
+				// match the condition for a partial index.
+				if found && (fs.where == nil || fs.where.holds(mr)) {
+					t.saveFieldIndexesForFields([]string{fieldName}, mr)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+		count += len(batch)
+		if progress != nil {
+			progress(count, len(ids))
+		}
+	}
+	return count, nil
+}
+
+// newReindexFieldHandler returns a ReplyHandler which scans the reply from an
+// HMGET command into the given fields of mr and sets found to true if there
+// was a value for the first field. Nil values are skipped. If the value for the
+// first field is nil (i.e. the field was nil or the model has since been
+// deleted), found is left as false.
+func newReindexFieldHandler(fieldNames []string, mr *modelRef, found *bool) ReplyHandler {
+	return func(reply interface{}) error {
+		replies, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		if len(replies) != len(fieldNames) || replies[0] == nil {
+			return nil
+		}
+		for i, fieldName := range fieldNames {
+			if replies[i] == nil {
+				continue
+			}
+			if err := scanModel([]string{fieldName}, []interface{}{replies[i]}, mr); err != nil {
+				return err
+			}
+		}
+		(*found) = true
+		return nil
+	}
+}
+
+// RenameField moves the values stored under oldName to the field identified by
+// newName for every model in the collection. It is useful after renaming a
+// field in the struct definition (or changing its redis or name struct tag),
+// since the existing hashes in the database still use the old name. oldName
+// should be the old name of the field as it is stored in Redis, and newName
+// should be the name of the field as it now appears in the struct definition.
+// For each model, RenameField reads the value for oldName and, if there is one,
+// writes it under the new name and deletes the old one. Models which do not
+// have a value for oldName are skipped, and any value already stored under the
+// new name for those models is left alone. The models are processed in
+// batches, each by a single Lua script, so each model is renamed atomically but
+// the operation as a whole is not. If the field was indexed under its old name,
+// the old index is deleted (including the sets for each value of an enum
+// index), and if the field is indexed now, its index is rebuilt with
+// ReindexField once all the models have been renamed. The HyperLogLog for
+// approximate distinct counts under the old name (see ApproxDistinct) is merged
+// into the one for the new name if the field still has the hll struct tag, and
+// deleted otherwise. RenameField returns the number of models which had a
+// value for oldName. It only works for indexed collections and returns an error
+// if newName does not identify a field or if oldName is still used by another
+// field.
+func (c *Collection) RenameField(oldName string, newName string) (int, error) {
+	if c == nil {
+		return 0, newNilCollectionError("RenameField")
+	}
+	if !c.index {
+		return 0, newUnindexedCollectionError("RenameField")
+	}
+	fs, found := c.spec.fieldsByName[newName]
+	if !found {
+		return 0, fmt.Errorf("zoom: Error in RenameField: Collection %s does not have field named %s", c.Name(), newName)
+	}
+	if oldName == "" || oldName == fs.redisName {
+		return 0, fmt.Errorf("zoom: Error in RenameField: invalid old name %q for field %s, which is stored as %q", oldName, newName, fs.redisName)
+	}
+	for _, other := range append(append([]*fieldSpec{}, c.spec.fields...), c.spec.lists...) {
+		if other.redisName == oldName {
+			return 0, fmt.Errorf("zoom: Error in RenameField: the old name %q is still used by field %s", oldName, other.name)
+		}
+	}
+
+	ids := []string{}
+	t := c.pool.NewTransaction()
+	t.Command("SMEMBERS", redis.Args{c.IndexKey()}, NewScanStringsHandler(&ids))
+	if err := t.Exec(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for start := 0; start < len(ids); start += reindexBatchSize {
+		end := start + reindexBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batchCount := 0
+		t := c.pool.NewTransaction()
+		args := redis.Args{c.Name(), oldName, fs.redisName}.AddFlat(ids[start:end])
+		t.Script(renameFieldScript, args, NewScanIntHandler(&batchCount))
+		// Renaming changes the stored models, so any cached counts and results
+		// for the collection are invalidated.
+		t.incrWriteCount(c)
+		if err := t.Exec(); err != nil {
+			return count, err
+		}
+		count += batchCount
+	}
+
+	// Delete the old index, if any. Numeric, string, and boolean indexes are
+	// the only sorted sets stored under the name of a field, and enum and
+	// sparse boolean indexes are the only sets.
+	conn := c.pool.NewConn()
+	defer conn.Close()
+	oldIndexKey := c.Name() + ":" + oldName
+	typ, err := redis.String(conn.Do("TYPE", oldIndexKey))
+	if err != nil {
+		return count, err
+	}
+	if typ == "zset" {
+		// A string index with a custom key function also has a hash of keys.
+		if _, err := conn.Do("DEL", oldIndexKey, indexKeysKey(oldIndexKey)); err != nil {
+			return count, err
+		}
+	} else if typ == "set" {
+		// The keys for the values in an enum index are only known to Redis, so
+		// they are deleted by a script. A sparse boolean index is just the set.
+		isEnum, err := redis.Bool(conn.Do("EXISTS", enumValuesKey(oldIndexKey)))
+		if err != nil {
+			return count, err
+		}
+		if isEnum {
+			if _, err := deleteEnumBucketsScript.Do(conn, oldIndexKey); err != nil {
+				return count, err
+			}
+		} else if _, err := conn.Do("DEL", oldIndexKey); err != nil {
+			return count, err
+		}
+	}
+	// Move the HyperLogLog for the old name, if any. HyperLogLogs are the only
+	// strings stored under the name of a field.
+	oldDistinctKey := oldIndexKey + ":hll"
+	typ, err = redis.String(conn.Do("TYPE", oldDistinctKey))
+	if err != nil {
+		return count, err
+	}
+	if typ == "string" {
+		if fs.hll {
+			newDistinctKey := c.spec.distinctKey(fs)
+			if _, err := conn.Do("PFMERGE", newDistinctKey, newDistinctKey, oldDistinctKey); err != nil {
+				return count, err
+			}
+		}
+		if _, err := conn.Do("UNLINK", oldDistinctKey); err != nil {
+			return count, err
+		}
+	}
+	if fs.indexKind != noIndex {
+		if _, err := c.ReindexField(newName); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// IndexReport describes the inconsistencies found in the index for a single
+// field by VerifyIndexes. Each slice contains model ids, sorted
+// lexicographically, and is empty if no inconsistencies of that kind were
+// found.
+type IndexReport struct {
+	// FieldName is the name of the indexed field, as it appears in the struct
+	// definition.
+	FieldName string
+	// Orphaned contains the ids which are in the index but not in the set of
+	// all ids for the collection, e.g. because a model was deleted without
+	// removing it from the index. For partial indexes, it also contains the
+	// ids of models which are in the index but do not match its condition,
+	// and for sparse boolean indexes, the ids of models without a true value.
+	Orphaned []string
+	// Missing contains the ids of models which have a value for the field but
+	// are not in the index. Models with a nil value are never indexed, so they
+	// are not included, and neither are models which do not match the
+	// condition for a partial index. For sparse boolean indexes, only models
+	// with a true value can be missing.
+	Missing []string
+	// Duplicated contains the ids which are in the index more than once. This
+	// can only happen for string and enum indexes, where the same id can be
+	// stored with more than one value.
+	Duplicated []string
+}
+
+// OK returns true if no inconsistencies were found in the index.
+func (r IndexReport) OK() bool {
+	return len(r.Orphaned) == 0 && len(r.Missing) == 0 && len(r.Duplicated) == 0
+}
+
+// VerifyIndexes cross-checks the index for each indexed field in the
+// collection against the set of all ids and the stored models, and returns a
+// report for each field in the order that the fields appear in the struct
+// definition. It is a diagnostic tool for data integrity, e.g. after a bug or a
+// manual change in the database, and it never modifies anything. Use
+// ReindexField to repair an index with problems. Each index is checked by a
+// single Lua script which reads every member of the index and every id in the
+// collection, so VerifyIndexes is O(N) and can block Redis for a while on large
+// collections. Indexes which are updated while VerifyIndexes is running may be
+// reported as inconsistent. VerifyIndexes does not check that the values in
+// the index match the values stored in the models. It only works for indexed
+// collections.
+func (c *Collection) VerifyIndexes() ([]IndexReport, error) {
+	if c == nil {
+		return nil, newNilCollectionError("VerifyIndexes")
+	}
+	if !c.index {
+		return nil, newUnindexedCollectionError("VerifyIndexes")
+	}
+	// Allocate enough capacity up front so that the pointers passed to the
+	// reply handlers remain valid as reports grows.
+	reports := make([]IndexReport, 0, len(c.spec.fields))
+	tx := c.pool.NewTransaction()
+	for _, fs := range c.spec.fields {
+		if fs.indexKind == noIndex {
+			continue
+		}
+		indexKey, err := c.spec.fieldIndexKey(fs.name)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, IndexReport{FieldName: fs.name})
+		args := redis.Args{c.Name(), indexKey, fs.indexKind.scriptName(), fs.redisName}
+		if fs.where != nil {
+			op := "="
+			if fs.where.negate {
+				op = "!="
+			}
+			args = args.Add(fs.where.field.redisName, op, fs.where.value)
+		} else {
+			args = args.Add("", "", "")
+		}
+		tx.Script(verifyIndexScript, args, newScanIndexReportHandler(&reports[len(reports)-1]))
+	}
+	if len(reports) == 0 {
+		return reports, nil
+	}
+	if err := tx.Exec(); err != nil {
+		return nil, err
+	}
+	return reports, nil
+}
+
+// newScanIndexReportHandler returns a ReplyHandler which will scan the reply
+// from the verify_index script into report.
+func newScanIndexReportHandler(report *IndexReport) ReplyHandler {
+	return func(reply interface{}) error {
+		values, err := redis.Values(reply, nil)
+		if err != nil {
+			return err
+		}
+		for i, ids := range []*[]string{&report.Orphaned, &report.Missing, &report.Duplicated} {
+			if (*ids), err = redis.Strings(values[i], nil); err != nil {
+				return err
+			}
+			sort.Strings(*ids)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,461 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File reindex_test.go tests rebuilding the index for a single field,
+// renaming a field, and verifying the indexes (reindex.go).
+
+package zoom
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestReindexField(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use more models than fit in a single batch.
+	models, err := createAndSaveIndexedTestModels(reindexBatchSize*2 + 10)
+	if err != nil {
+		t.Fatalf("Unexpected error saving test models: %s", err.Error())
+	}
+
+	// Delete the Int index, and add a stale member to the String index.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	intIndexKey, err := indexedTestModels.spec.fieldIndexKey("Int")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringIndexKey, err := indexedTestModels.spec.fieldIndexKey("String")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("DEL", intIndexKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("ZADD", stringIndexKey, 0, "stale"+nullString+"staleId"); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := indexedTestModels.ReindexField("Int")
+	if err != nil {
+		t.Fatalf("Unexpected error in ReindexField: %s", err.Error())
+	}
+	if count != len(models) {
+		t.Errorf("Expected ReindexField to process %d models but got %d", len(models), count)
+	}
+	for _, model := range models {
+		expectIndexExists(t, indexedTestModels, model, "Int")
+	}
+	testQuery(t, indexedTestModels.NewQuery().Order("-Int"), models)
+	// The String index should not have been touched.
+	if card, err := redis.Int(conn.Do("ZCARD", stringIndexKey)); err != nil {
+		t.Fatal(err)
+	} else if card != len(models)+1 {
+		t.Errorf("Expected the String index to have %d members but got %d", len(models)+1, card)
+	}
+
+	// Reindexing the String field should remove the stale member.
+	if _, err := indexedTestModels.ReindexField("String"); err != nil {
+		t.Fatalf("Unexpected error in ReindexField: %s", err.Error())
+	}
+	if card, err := redis.Int(conn.Do("ZCARD", stringIndexKey)); err != nil {
+		t.Fatal(err)
+	} else if card != len(models) {
+		t.Errorf("Expected the String index to have %d members but got %d", len(models), card)
+	}
+	testQuery(t, indexedTestModels.NewQuery().Order("String"), models)
+
+	// Fields which do not exist cannot be reindexed.
+	if _, err := indexedTestModels.ReindexField("Invalid"); err == nil {
+		t.Error("Expected an error for a field that does not exist but got none")
+	}
+}
+
+func TestReindexFieldWithProgress(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use a number of models which does not divide evenly into batches.
+	models, err := createAndSaveIndexedTestModels(reindexBatchSize*2 + 10)
+	if err != nil {
+		t.Fatalf("Unexpected error saving test models: %s", err.Error())
+	}
+	type call struct {
+		done, total int
+	}
+	calls := []call{}
+	count, err := indexedTestModels.ReindexFieldWithProgress(context.Background(), "Int", func(done, total int) {
+		calls = append(calls, call{done, total})
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error in ReindexFieldWithProgress: %s", err.Error())
+	}
+	if count != len(models) {
+		t.Errorf("Expected ReindexFieldWithProgress to process %d models but got %d", len(models), count)
+	}
+	expected := []call{
+		{reindexBatchSize, len(models)},
+		{reindexBatchSize * 2, len(models)},
+		{len(models), len(models)},
+	}
+	if !reflect.DeepEqual(expected, calls) {
+		t.Errorf("Expected progress to be called with %v but got %v", expected, calls)
+	}
+	testQuery(t, indexedTestModels.NewQuery().Order("Int"), models)
+
+	// Canceling the context should stop after the current batch.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	count, err = indexedTestModels.ReindexFieldWithProgress(ctx, "Int", func(done, total int) {
+		cancel()
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected ReindexFieldWithProgress to return context.Canceled but got %v", err)
+	}
+	if count != reindexBatchSize {
+		t.Errorf("Expected ReindexFieldWithProgress to process %d models before stopping but got %d", reindexBatchSize, count)
+	}
+}
+
+// interleavingConn is a redis.Conn which calls before (once) the first time
+// MULTI is sent after an HMGET, i.e. between reading the values for a batch in
+// ReindexField and writing the index for them.
+type interleavingConn struct {
+	redis.Conn
+	sawHMGET *bool
+	before   *func()
+}
+
+func (c interleavingConn) Send(commandName string, args ...interface{}) error {
+	if commandName == "HMGET" {
+		(*c.sawHMGET) = true
+	}
+	if commandName == "MULTI" && *c.sawHMGET && *c.before != nil {
+		before := *c.before
+		(*c.before) = nil
+		before()
+	}
+	return c.Conn.Send(commandName, args...)
+}
+
+func TestReindexFieldConcurrentSave(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	sawHMGET := false
+	var before func()
+	options := testPool.options.WithDialFunc(func(ctx context.Context) (redis.Conn, error) {
+		conn, err := redis.Dial(*network, *address)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Do("SELECT", *database); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return interleavingConn{Conn: conn, sawHMGET: &sawHMGET, before: &before}, nil
+	})
+	pool := NewPoolWithOptions(options)
+	defer pool.Close()
+
+	type reindexRaceModel struct {
+		Score int `zoom:"index"`
+		Name  string
+		RandomId
+	}
+	collection, err := pool.NewCollectionWithOptions(&reindexRaceModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := []*reindexRaceModel{{Score: 1}, {Score: 2}, {Score: 3}}
+	for _, model := range models {
+		if err := collection.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+
+	// Save a model with a new value after its old value has been read but
+	// before the index has been written. The old value must not be put back.
+	before = func() {
+		models[0].Score = 100
+		if err := collection.Save(models[0]); err != nil {
+			t.Errorf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	if _, err := collection.ReindexField("Score"); err != nil {
+		t.Fatalf("Unexpected error in ReindexField: %s", err.Error())
+	}
+	if before != nil {
+		t.Fatal("Expected the concurrent save to run during ReindexField")
+	}
+	conn := pool.NewConn()
+	defer conn.Close()
+	indexKey, err := collection.FieldIndexKey("Score")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range models {
+		if score, err := redis.Int(conn.Do("ZSCORE", indexKey, model.ModelId())); err != nil {
+			t.Fatal(err)
+		} else if score != model.Score {
+			t.Errorf("Expected the score for %s to be %d but got %d", model.ModelId(), model.Score, score)
+		}
+	}
+	if reports, err := collection.VerifyIndexes(); err != nil {
+		t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+	} else if !reports[0].OK() {
+		t.Errorf("Expected the index to be consistent but got %+v", reports[0])
+	}
+}
+
+func TestRenameField(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(reindexBatchSize + 5)
+	if err != nil {
+		t.Fatalf("Unexpected error saving test models: %s", err.Error())
+	}
+	// Simulate models which were saved when the Int field was called OldInt.
+	// The last model has no value for the old name and should be skipped.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	renamed := models[:len(models)-1]
+	skipped := models[len(models)-1]
+	for _, model := range renamed {
+		key := indexedTestModels.ModelKey(model.ModelId())
+		if _, err := conn.Do("HSET", key, "OldInt", model.Int); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Do("HDEL", key, "Int"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	intIndexKey, err := indexedTestModels.spec.fieldIndexKey("Int")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldIndexKey := indexedTestModels.Name() + ":OldInt"
+	if _, err := conn.Do("RENAME", intIndexKey, oldIndexKey); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := indexedTestModels.RenameField("OldInt", "Int")
+	if err != nil {
+		t.Fatalf("Unexpected error in RenameField: %s", err.Error())
+	}
+	if count != len(renamed) {
+		t.Errorf("Expected RenameField to rename %d models but got %d", len(renamed), count)
+	}
+	for _, model := range models {
+		key := indexedTestModels.ModelKey(model.ModelId())
+		if exists, err := redis.Bool(conn.Do("HEXISTS", key, "OldInt")); err != nil {
+			t.Fatal(err)
+		} else if exists {
+			t.Errorf("Expected the old field to be deleted for model %s", model.ModelId())
+		}
+	}
+	if skippedInt, err := redis.Int(conn.Do("HGET", indexedTestModels.ModelKey(skipped.ModelId()), "Int")); err != nil {
+		t.Fatal(err)
+	} else if skippedInt != skipped.Int {
+		t.Errorf("Expected the skipped model to keep Int = %d but got %d", skipped.Int, skippedInt)
+	}
+	expectKeyDoesNotExist(t, oldIndexKey)
+	for _, model := range models {
+		expectIndexExists(t, indexedTestModels, model, "Int")
+	}
+	testQuery(t, indexedTestModels.NewQuery().Order("Int"), models)
+
+	// The new name must identify a field and the old name must not be in use.
+	if _, err := indexedTestModels.RenameField("OldInt", "Invalid"); err == nil {
+		t.Error("Expected an error for a field that does not exist but got none")
+	}
+	if _, err := indexedTestModels.RenameField("String", "Int"); err == nil {
+		t.Error("Expected an error for an old name that is still in use but got none")
+	}
+}
+
+func TestRenameFieldEnumAndHll(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// The old version of the model stores the field as OldStatus. The new
+	// version is registered with the same name in a separate pool, once with
+	// the hll struct tag and once without it.
+	type oldStatusModel struct {
+		OldStatus string `zoom:"index,enum,hll"`
+		RandomId
+	}
+	type newStatusModel struct {
+		Status string `zoom:"index,enum,hll"`
+		RandomId
+	}
+	type newStatusModelWithoutHll struct {
+		Status string `zoom:"index,enum"`
+		RandomId
+	}
+	for i, newModel := range []Model{&newStatusModel{}, &newStatusModelWithoutHll{}} {
+		options := DefaultCollectionOptions.WithIndex(true).WithName(fmt.Sprintf("renameStatusModel%d", i))
+		oldPool := NewPoolWithOptions(testPool.options)
+		defer oldPool.Close()
+		oldModels, err := oldPool.NewCollectionWithOptions(&oldStatusModel{}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, status := range []string{"active", "active", "inactive"} {
+			if err := oldModels.Save(&oldStatusModel{OldStatus: status}); err != nil {
+				t.Fatalf("Unexpected error in Save: %s", err.Error())
+			}
+		}
+		newPool := NewPoolWithOptions(testPool.options)
+		defer newPool.Close()
+		newModels, err := newPool.NewCollectionWithOptions(newModel, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count, err := newModels.RenameField("OldStatus", "Status"); err != nil {
+			t.Fatalf("Unexpected error in RenameField: %s", err.Error())
+		} else if count != 3 {
+			t.Errorf("Expected RenameField to rename 3 models but got %d", count)
+		}
+
+		// Nothing should be left under the old name.
+		oldIndexKey := newModels.Name() + ":OldStatus"
+		for _, key := range []string{
+			oldIndexKey,
+			enumValuesKey(oldIndexKey),
+			enumBucketKey(oldIndexKey, "active"),
+			enumBucketKey(oldIndexKey, "inactive"),
+			oldIndexKey + ":hll",
+		} {
+			expectKeyDoesNotExist(t, key)
+		}
+		if count, err := newModels.NewQuery().Filter("Status =", "active").Count(); err != nil {
+			t.Fatalf("Unexpected error in Count: %s", err.Error())
+		} else if count != 2 {
+			t.Errorf("Expected 2 active models but got %d", count)
+		}
+		newDistinctKey := newModels.Name() + ":Status:hll"
+		if newModels.spec.fieldsByName["Status"].hll {
+			if distinct, err := newModels.ApproxDistinct("Status"); err != nil {
+				t.Fatalf("Unexpected error in ApproxDistinct: %s", err.Error())
+			} else if distinct != 2 {
+				t.Errorf("Expected ApproxDistinct to return 2 but got %d", distinct)
+			}
+		} else {
+			expectKeyDoesNotExist(t, newDistinctKey)
+		}
+	}
+}
+
+func TestVerifyIndexes(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	models, err := createAndSaveIndexedTestModels(5)
+	if err != nil {
+		t.Fatalf("Unexpected error saving test models: %s", err.Error())
+	}
+	expectReports := func(c *Collection, expected []IndexReport) {
+		t.Helper()
+		got, err := c.VerifyIndexes()
+		if err != nil {
+			t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("VerifyIndexes returned the wrong reports.\nExpected: %+v\nGot:      %+v", expected, got)
+		}
+	}
+	okReports := []IndexReport{
+		{FieldName: "Int", Orphaned: []string{}, Missing: []string{}, Duplicated: []string{}},
+		{FieldName: "String", Orphaned: []string{}, Missing: []string{}, Duplicated: []string{}},
+		{FieldName: "Bool", Orphaned: []string{}, Missing: []string{}, Duplicated: []string{}},
+	}
+	expectReports(indexedTestModels, okReports)
+	for _, report := range okReports {
+		if !report.OK() {
+			t.Errorf("Expected the report for %s to be OK", report.FieldName)
+		}
+	}
+
+	// Remove a model from the Int index, add an orphaned id to it, and add a
+	// model to the String index a second time with a different value.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	intIndexKey, err := indexedTestModels.spec.fieldIndexKey("Int")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringIndexKey, err := indexedTestModels.spec.fieldIndexKey("String")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("ZREM", intIndexKey, models[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("ZADD", intIndexKey, 42, "orphanedId"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("ZADD", stringIndexKey, 0, "other"+nullString+models[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	expected := []IndexReport{
+		{FieldName: "Int", Orphaned: []string{"orphanedId"}, Missing: []string{models[0].Id}, Duplicated: []string{}},
+		{FieldName: "String", Orphaned: []string{}, Missing: []string{}, Duplicated: []string{models[1].Id}},
+		okReports[2],
+	}
+	expectReports(indexedTestModels, expected)
+	if expected[0].OK() || expected[1].OK() {
+		t.Error("Expected reports with inconsistencies not to be OK")
+	}
+	// VerifyIndexes should not have repaired anything.
+	expectReports(indexedTestModels, expected)
+
+	// ReindexField should repair the indexes.
+	for _, fieldName := range []string{"Int", "String"} {
+		if _, err := indexedTestModels.ReindexField(fieldName); err != nil {
+			t.Fatalf("Unexpected error in ReindexField: %s", err.Error())
+		}
+	}
+	expectReports(indexedTestModels, okReports)
+
+	// Enum indexes keep a set for each value, and models with a nil value
+	// should never be reported as missing.
+	type verifyEnumModel struct {
+		Status string  `zoom:"index,enum"`
+		Note   *string `zoom:"index"`
+		RandomId
+	}
+	enumModels, err := testPool.NewCollectionWithOptions(&verifyEnumModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enums := []*verifyEnumModel{{Status: "active"}, {Status: "active"}, {Status: "inactive"}}
+	for _, model := range enums {
+		if err := enumModels.Save(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statusIndexKey, err := enumModels.spec.fieldIndexKey("Status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("SADD", enumBucketKey(statusIndexKey, "inactive"), enums[0].Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("SREM", statusIndexKey, enums[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	expectReports(enumModels, []IndexReport{
+		{FieldName: "Status", Orphaned: []string{}, Missing: []string{enums[1].Id}, Duplicated: []string{enums[0].Id}},
+		{FieldName: "Note", Orphaned: []string{}, Missing: []string{}, Duplicated: []string{}},
+	})
+}
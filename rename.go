@@ -0,0 +1,150 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File rename.go contains code for renaming a collection, i.e. moving all of
+// its keys to a new collection name.
+
+package zoom
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// RenameCollection moves every key for the collection with the name oldName to
+// the corresponding key for a collection with the name newName, e.g. after
+// rebranding a collection from "users" to "members". That includes the set of
+// all ids, every field index, and the main hash, list fields, and history of
+// every model, along with the change log, write count, and caches for the
+// collection. The keys are found with SCAN (see PoolOptions.ScanCount) and the
+// keys returned by each call are renamed with RENAME in a single script, so
+// models do not need to be read or decoded and RenameCollection works for
+// collections which have not been registered with the pool. The name of the
+// collection is also replaced in the set of collection names (see
+// CollectionNames). RenameCollection returns an error if either name is invalid,
+// if there is no data for oldName, or if there is already any key for newName
+// (including the keys of an unindexed collection). Keys are never overwritten:
+// if a key for newName is written while RenameCollection is running, it stops
+// with an error, and the batches which were already renamed are not undone.
+//
+// RenameCollection is not a live operation. Each batch is renamed atomically,
+// but the operation as a whole is not, and any models which are saved under the
+// old name while it is running (or afterwards) will not be moved. It should
+// only be run during a maintenance window when nothing else is reading from or
+// writing to the collection. Afterwards, any Collection for the old name is
+// stale and the collection must be created again with the new name (see
+// CollectionOptions.Name). Entries in the change log still refer to the old
+// name, and locks held by FindOrLoad are not moved. Since the whole keyspace is
+// scanned, RenameCollection is O(N) in the number of keys in the database, not
+// just the number of models in the collection.
+func (p *Pool) RenameCollection(oldName string, newName string) error {
+	for _, name := range []string{oldName, newName} {
+		if name == "" || strings.Contains(name, ":") {
+			return fmt.Errorf("zoom: Error in RenameCollection: invalid collection name %q", name)
+		}
+	}
+	if oldName == newName {
+		return fmt.Errorf("zoom: Error in RenameCollection: the old and new names are both %q", oldName)
+	}
+	conn := p.NewConn()
+	defer conn.Close()
+
+	// Make sure there is data to move and that there is nothing in the way.
+	// The set of all ids and the set of collection names are not enough to
+	// tell whether there is data for the new name, e.g. for an unindexed
+	// collection, so look for any key with the new prefix.
+	oldPrefix, newPrefix := oldName+":", newName+":"
+	exists := func(name string, prefix string) (bool, error) {
+		isMember, err := redis.Bool(conn.Do("SISMEMBER", collectionNamesKey, name))
+		if err != nil || isMember {
+			return isMember, err
+		}
+		return p.hasKeysWithPrefix(conn, prefix)
+	}
+	if found, err := exists(oldName, oldPrefix); err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("zoom: Error in RenameCollection: collection %s does not exist", oldName)
+	}
+	if found, err := exists(newName, newPrefix); err != nil {
+		return err
+	} else if found {
+		return fmt.Errorf("zoom: Error in RenameCollection: collection %s already exists", newName)
+	}
+
+	// Rename the keys in batches. Collection names cannot contain a colon, so
+	// every key which starts with the old name and a colon belongs to the
+	// collection. Renamed keys no longer match the pattern, so they are not
+	// returned again by later calls to SCAN. The script never overwrites a key
+	// which already exists, in case one was written for the new name after
+	// the check above.
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", escapeGlob(oldPrefix)+"*", "COUNT", p.scanCount()))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			args := redis.Args{oldPrefix, newPrefix}.AddFlat(keys)
+			renamed, err := redis.Int(renameKeysScript.Do(conn, args...))
+			if err != nil {
+				return err
+			}
+			if renamed < 0 {
+				return fmt.Errorf("zoom: Error in RenameCollection: collection %s already exists", newName)
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+
+	t := p.NewTransaction()
+	t.Command("SREM", redis.Args{collectionNamesKey, oldName}, nil)
+	t.Command("SADD", redis.Args{collectionNamesKey, newName}, nil)
+	return t.Exec()
+}
+
+// hasKeysWithPrefix returns true iff there is at least one key in the database
+// which starts with prefix.
+func (p *Pool) hasKeysWithPrefix(conn redis.Conn, prefix string) (bool, error) {
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", escapeGlob(prefix)+"*", "COUNT", p.scanCount()))
+		if err != nil {
+			return false, err
+		}
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return false, err
+		}
+		if len(keys) > 0 {
+			return true, nil
+		}
+		if cursor == "0" {
+			return false, nil
+		}
+	}
+}
+
+// escapeGlob escapes the characters in s which have a special meaning in the
+// glob-style patterns used by SCAN with MATCH, so that the pattern only matches
+// s itself.
+func escapeGlob(s string) string {
+	var escaped strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File rename_test.go tests the code for renaming a collection (rename.go).
+
+package zoom
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestRenameCollection(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type renameModel struct {
+		Name   string   `zoom:"index"`
+		Score  int      `zoom:"index"`
+		Status string   `zoom:"index,enum"`
+		Tags   []string `zoom:"list"`
+		RandomId
+	}
+	const oldName, newName = "renameOld", "renameNew"
+	options := DefaultCollectionOptions.WithIndex(true).WithKeepHistory(1)
+	olds, err := testPool.NewCollectionWithOptions(&renameModel{}, options.WithName(oldName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := make([]*renameModel, 20)
+	for i := range models {
+		models[i] = &renameModel{Name: randomString(), Score: i, Status: "even"}
+		if i%2 == 1 {
+			models[i].Status = "odd"
+		}
+		if err := olds.Save(models[i]); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		for _, tag := range []string{"a", "b"} {
+			if err := olds.Append(models[i].ModelId(), "Tags", tag); err != nil {
+				t.Fatalf("Unexpected error in Append: %s", err.Error())
+			}
+		}
+		models[i].Tags = []string{"b", "a"}
+	}
+	// Save one model twice so that it has a history.
+	if err := olds.Save(models[0]); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+
+	if err := testPool.RenameCollection(oldName, newName); err != nil {
+		t.Fatalf("Unexpected error in RenameCollection: %s", err.Error())
+	}
+
+	// Every key should have been moved.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	if keys, err := redis.Strings(conn.Do("KEYS", oldName+":*")); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 0 {
+		t.Errorf("Expected no keys for %s after renaming but got %v", oldName, keys)
+	}
+	if names, err := testPool.CollectionNames(); err != nil {
+		t.Fatalf("Unexpected error in CollectionNames: %s", err.Error())
+	} else if stringSliceContains(names, oldName) || !stringSliceContains(names, newName) {
+		t.Errorf("Expected CollectionNames to contain %s instead of %s but got %v", newName, oldName, names)
+	}
+
+	// The type is already registered for testPool, so use another pool to read
+	// the renamed collection.
+	newPool := NewPoolWithOptions(testPool.options)
+	defer newPool.Close()
+	news, err := newPool.NewCollectionWithOptions(&renameModel{}, options.WithName(newName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range models {
+		got := &renameModel{}
+		if err := news.Find(model.ModelId(), got); err != nil {
+			t.Fatalf("Unexpected error in Find: %s", err.Error())
+		}
+		if !reflect.DeepEqual(model, got) {
+			t.Errorf("Model was not renamed correctly.\nExpected: %+v\nGot:      %+v", model, got)
+		}
+	}
+	reports, err := news.VerifyIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+	}
+	for _, report := range reports {
+		if !report.OK() {
+			t.Errorf("Expected the index for %s to be consistent but got %+v", report.FieldName, report)
+		}
+	}
+	if count, err := news.NewQuery().Filter("Status =", "odd").Filter("Score <", 10).Count(); err != nil {
+		t.Fatalf("Unexpected error in Count: %s", err.Error())
+	} else if count != 5 {
+		t.Errorf("Expected 5 models to match the query but got %d", count)
+	}
+	if history, err := news.History(models[0].ModelId()); err != nil {
+		t.Fatalf("Unexpected error in History: %s", err.Error())
+	} else if len(history) != 1 {
+		t.Errorf("Expected 1 history entry but got %d", len(history))
+	}
+
+	// Renaming should fail if the old collection does not exist, the new one
+	// already exists, or either name is invalid.
+	if _, err := createAndSaveIndexedTestModels(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, names := range [][2]string{
+		{oldName, "renameOther"},
+		{newName, indexedTestModels.Name()},
+		{newName, newName},
+		{newName, ""},
+		{newName, "invalid:name"},
+	} {
+		if err := testPool.RenameCollection(names[0], names[1]); err == nil {
+			t.Errorf("Expected an error renaming %q to %q but got none", names[0], names[1])
+		}
+	}
+
+	// Renaming should also fail, without overwriting anything, if the new
+	// name only has keys which are not recorded anywhere, e.g. the models of
+	// an unindexed collection.
+	const unindexedName = "renameUnindexed"
+	unindexedKey := unindexedName + ":" + models[1].ModelId()
+	if _, err := conn.Do("HSET", unindexedKey, "Name", "unindexed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testPool.RenameCollection(newName, unindexedName); err == nil {
+		t.Errorf("Expected an error renaming %q to %q but got none", newName, unindexedName)
+	}
+	if name, err := redis.String(conn.Do("HGET", unindexedKey, "Name")); err != nil {
+		t.Fatal(err)
+	} else if name != "unindexed" {
+		t.Errorf("Expected %s not to be overwritten but got Name = %q", unindexedKey, name)
+	}
+	if found, err := redis.Bool(conn.Do("EXISTS", news.ModelKey(models[1].ModelId()))); err != nil {
+		t.Fatal(err)
+	} else if !found {
+		t.Errorf("Expected %s not to be moved", news.ModelKey(models[1].ModelId()))
+	}
+}
+
+func TestRenameKeysScriptConflict(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// The script should not rename anything if any of the new keys exists,
+	// even if it did not exist when RenameCollection checked for it.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	for _, key := range []string{"scriptOld:a", "scriptOld:b", "scriptNew:b"} {
+		if _, err := conn.Do("SET", key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if renamed, err := redis.Int(renameKeysScript.Do(conn, "scriptOld:", "scriptNew:", "scriptOld:a", "scriptOld:b")); err != nil {
+		t.Fatal(err)
+	} else if renamed != -1 {
+		t.Errorf("Expected the script to return -1 for a conflict but got %d", renamed)
+	}
+	for _, key := range []string{"scriptOld:a", "scriptOld:b", "scriptNew:b"} {
+		if value, err := redis.String(conn.Do("GET", key)); err != nil {
+			t.Errorf("Expected %s to still exist but got %v", key, err)
+		} else if value != key {
+			t.Errorf("Expected %s to be %q but got %q", key, key, value)
+		}
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	if got, expected := escapeGlob(`a*b?c[d]e\f`), `a\*b\?c\[d\]e\\f`; got != expected {
+		t.Errorf("Expected %s but got %s", expected, got)
+	}
+}
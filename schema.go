@@ -0,0 +1,144 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File schema.go contains code for describing the fields and options of a
+// registered collection (see Collection.Schema).
+
+package zoom
+
+// Schema describes the shape of a registered collection, i.e. its fields and
+// the options it was created with. It is returned by Collection.Schema and is
+// intended for tooling, e.g. generating admin UIs or checking that two
+// services agree on the shape of a collection. Schema has json struct tags, so
+// it can be encoded with encoding/json. Two collections with the same Schema
+// store their models in the same format.
+type Schema struct {
+	// Name is the name of the collection (see CollectionOptions.Name).
+	Name string `json:"name"`
+	// Type is the Go type of the models in the collection, e.g. "*main.Person".
+	Type string `json:"type"`
+	// Index, ChangeLog, StrictScan, IdLength, IdAlphabet, and KeepHistory are
+	// the options the collection was created with. See CollectionOptions.
+	Index       bool   `json:"index"`
+	ChangeLog   bool   `json:"changeLog"`
+	StrictScan  bool   `json:"strictScan"`
+	IdLength    int    `json:"idLength,omitempty"`
+	IdAlphabet  string `json:"idAlphabet,omitempty"`
+	KeepHistory int    `json:"keepHistory,omitempty"`
+	// IdField is the name of the field with the `zoom:"id"` struct tag, if
+	// any.
+	IdField string `json:"idField,omitempty"`
+	// Fields describes each field which is stored in the database, in the
+	// order that they appear in the struct definition, followed by any list
+	// fields. Fields which are skipped with `zoom:"-"` and the id field are not
+	// included.
+	Fields []FieldSchema `json:"fields"`
+}
+
+// FieldSchema describes a single field of a collection. See Schema.
+type FieldSchema struct {
+	// Name is the name of the field, as it appears in the struct definition.
+	Name string `json:"name"`
+	// RedisName is the name of the field as it is stored in Redis, which can be
+	// changed with the redis struct tag.
+	RedisName string `json:"redisName"`
+	// Type is the Go type of the field, e.g. "string" or "*time.Time".
+	Type string `json:"type"`
+	// Index is the kind of index on the field, i.e. "numeric", "string",
+	// "boolean", "enum", or "sparse". It is empty if the field is not indexed.
+	Index string `json:"index,omitempty"`
+	// Where is the condition for a partial index, e.g. "Status=active", as it
+	// appears in the where option of the struct tag. It is empty if the field
+	// does not have a partial index.
+	Where string `json:"where,omitempty"`
+	// Encoding is how the value of the field is encoded, i.e. "builtin" for
+	// primitive types (and pointers to them), "binary" or "text" for types
+	// which implement encoding.BinaryMarshaler or encoding.TextMarshaler,
+	// "time" for time fields stored with a TimeFormat, "list" for list fields,
+	// whose elements are stored in a separate Redis list, or "fallback" for all
+	// other types, which use the FallbackMarshalerUnmarshaler.
+	Encoding string `json:"encoding"`
+	// TimeFormat is the format of a time field (see
+	// CollectionOptions.TimeFormat). It is empty for all other fields.
+	TimeFormat string `json:"timeFormat,omitempty"`
+	// Gzip and HLL are true if the field has the gzip or hll struct tag.
+	Gzip bool `json:"gzip,omitempty"`
+	HLL  bool `json:"hll,omitempty"`
+	// List is true if the field has the list struct tag, in which case
+	// ListMaxLen is its maximum length, or 0 if the length is not capped.
+	List       bool `json:"list,omitempty"`
+	ListMaxLen int  `json:"listMaxLen,omitempty"`
+	// Tag is the full struct tag for the field, e.g. `zoom:"index"`.
+	Tag string `json:"tag,omitempty"`
+}
+
+// Schema returns a description of the fields and options of the collection.
+// It only reads what was parsed when the collection was registered, so it does
+// not use the database.
+func (c *Collection) Schema() Schema {
+	schema := Schema{
+		Name:        c.Name(),
+		Type:        c.spec.typ.String(),
+		Index:       c.index,
+		ChangeLog:   c.changeLog,
+		StrictScan:  c.strictScan,
+		IdLength:    c.idLength,
+		IdAlphabet:  c.idAlphabet,
+		KeepHistory: c.keepHistory,
+		Fields:      make([]FieldSchema, 0, len(c.spec.fields)+len(c.spec.lists)),
+	}
+	if c.spec.idField != nil {
+		schema.IdField = c.spec.idField.name
+	}
+	for _, fs := range c.spec.fields {
+		schema.Fields = append(schema.Fields, c.fieldSchema(fs, false))
+	}
+	for _, fs := range c.spec.lists {
+		schema.Fields = append(schema.Fields, c.fieldSchema(fs, true))
+	}
+	return schema
+}
+
+// fieldSchema returns a FieldSchema which describes the field identified by fs.
+// list should be true if fs is a list field.
+func (c *Collection) fieldSchema(fs *fieldSpec, list bool) FieldSchema {
+	field := FieldSchema{
+		Name:       fs.name,
+		RedisName:  fs.redisName,
+		Type:       fs.typ.String(),
+		Index:      fs.indexKind.scriptName(),
+		Encoding:   fs.encodingName(),
+		TimeFormat: fs.timeFormat,
+		Gzip:       fs.gzip,
+		HLL:        fs.hll,
+		List:       list,
+		ListMaxLen: fs.listMaxLen,
+	}
+	if list {
+		field.Encoding = "list"
+	}
+	if fs.where != nil {
+		field.Where = fs.where.String()
+	}
+	if structField, found := c.spec.typ.Elem().FieldByName(fs.name); found {
+		field.Tag = string(structField.Tag)
+	}
+	return field
+}
+
+// encodingName returns the name of the encoding for the field as it appears in
+// FieldSchema.Encoding.
+func (fs *fieldSpec) encodingName() string {
+	switch {
+	case fs.timeFormat != "":
+		return "time"
+	case fs.marshaler == binaryMarshaler:
+		return "binary"
+	case fs.marshaler == textMarshaler:
+		return "text"
+	case fs.kind == inconvertibleField:
+		return "fallback"
+	}
+	return "builtin"
+}
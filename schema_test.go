@@ -0,0 +1,82 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File schema_test.go tests the code for describing the shape of a collection
+// (schema.go).
+
+package zoom
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// schemaModel has a variety of field types and struct tags. It uses the field
+// with the `zoom:"id"` struct tag as its id.
+type schemaModel struct {
+	Key     string `zoom:"id"`
+	Name    string `zoom:"index" redis:"name"`
+	Age     int    `zoom:"index"`
+	Status  string `zoom:"index,enum"`
+	Bio     string `zoom:"gzip"`
+	Created time.Time
+	Extra   map[string]string
+	Ignored string   `zoom:"-"`
+	Recent  []string `zoom:"list,maxlen=5"`
+}
+
+func (m *schemaModel) ModelId() string {
+	return m.Key
+}
+
+func (m *schemaModel) SetModelId(id string) {
+	m.Key = id
+}
+
+func TestSchema(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	options := DefaultCollectionOptions.WithIndex(true).WithName("schemaModel").WithTimeFormat(TimeFormatRFC3339)
+	collection, err := testPool.NewCollectionWithOptions(&schemaModel{}, options)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+
+	expected := Schema{
+		Name:    "schemaModel",
+		Type:    "*zoom.schemaModel",
+		Index:   true,
+		IdField: "Key",
+		Fields: []FieldSchema{
+			{Name: "Name", RedisName: "name", Type: "string", Index: "string", Encoding: "builtin", Tag: `zoom:"index" redis:"name"`},
+			{Name: "Age", RedisName: "Age", Type: "int", Index: "numeric", Encoding: "builtin", Tag: `zoom:"index"`},
+			{Name: "Status", RedisName: "Status", Type: "string", Index: "enum", Encoding: "builtin", Tag: `zoom:"index,enum"`},
+			{Name: "Bio", RedisName: "Bio", Type: "string", Encoding: "builtin", Gzip: true, Tag: `zoom:"gzip"`},
+			{Name: "Created", RedisName: "Created", Type: "time.Time", Encoding: "time", TimeFormat: TimeFormatRFC3339},
+			{Name: "Extra", RedisName: "Extra", Type: "map[string]string", Encoding: "fallback"},
+			{Name: "Recent", RedisName: "Recent", Type: "[]string", Encoding: "list", List: true, ListMaxLen: 5, Tag: `zoom:"list,maxlen=5"`},
+		},
+	}
+	got := collection.Schema()
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("Schema was incorrect.\nExpected: %+v\nBut got:  %+v", expected, got)
+	}
+
+	// The schema should survive a round trip through JSON, so it can be
+	// compared across services.
+	data, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("Unexpected error in json.Marshal: %s", err.Error())
+	}
+	decoded := Schema{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected error in json.Unmarshal: %s", err.Error())
+	}
+	if !reflect.DeepEqual(got, decoded) {
+		t.Errorf("Schema changed after a round trip through JSON.\nExpected: %+v\nBut got:  %+v", got, decoded)
+	}
+}
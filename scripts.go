@@ -16,6 +16,144 @@ import (
 
 var (
 	
+	copyCollectionScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- copy_collection is a lua script that takes the following arguments:
+-- 	1) The name of the source collection
+--		2) The name of the destination collection
+--		3) The key of the set of all collection names
+--		4) The number of collection-wide keys to copy, n
+--		5) n suffixes for the collection-wide keys (e.g. "all" or the name of an
+--			indexed field), which are appended to the collection name and a colon
+--		6) The number of enum indexes, e
+--		7) e suffixes for the enum indexes, as above
+--		8) The names of any list fields, as they are stored in Redis
+-- The script copies the main hash and list fields of every model in the source
+-- collection, along with the given collection-wide keys and the values and
+-- sets for each enum index, to the corresponding keys for the destination
+-- collection using COPY. It also adds the destination name to the set of all
+-- collection names and increments the write count for the destination, which
+-- invalidates any cached counts or query results. If the set of all ids or any
+-- of the collection-wide keys already exist for the destination, the script
+-- copies nothing and returns -1. Otherwise it returns the number of models that
+-- were copied.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local srcName = ARGV[1]
+local dstName = ARGV[2]
+local collectionNamesKey = ARGV[3]
+local numKeys = tonumber(ARGV[4])
+local suffixes = {}
+for i = 1, numKeys do
+	table.insert(suffixes, ARGV[4 + i])
+end
+local enumStart = 5 + numKeys
+local numEnums = tonumber(ARGV[enumStart])
+local enumSuffixes = {}
+for i = 1, numEnums do
+	table.insert(enumSuffixes, ARGV[enumStart + i])
+end
+local lists = {}
+for i = enumStart + numEnums + 1, #ARGV do
+	table.insert(lists, ARGV[i])
+end
+
+-- Make sure the destination does not have any data
+if redis.call('EXISTS', dstName .. ':all') == 1 then
+	return -1
+end
+for i, suffix in ipairs(suffixes) do
+	if redis.call('EXISTS', dstName .. ':' .. suffix) == 1 then
+		return -1
+	end
+end
+
+-- Copy the main hash and list fields for each model
+local ids = redis.call('SMEMBERS', srcName .. ':all')
+for i, id in ipairs(ids) do
+	redis.call('COPY', srcName .. ':' .. id, dstName .. ':' .. id, 'REPLACE')
+	for j, list in ipairs(lists) do
+		redis.call('COPY', srcName .. ':' .. id .. ':' .. list, dstName .. ':' .. id .. ':' .. list, 'REPLACE')
+	end
+end
+-- Copy the collection-wide keys, including the set of all ids
+for i, suffix in ipairs(suffixes) do
+	redis.call('COPY', srcName .. ':' .. suffix, dstName .. ':' .. suffix)
+end
+-- Copy the set of values and the set for each value of each enum index
+for i, suffix in ipairs(enumSuffixes) do
+	local valuesSuffix = suffix .. ':enum'
+	redis.call('COPY', srcName .. ':' .. valuesSuffix, dstName .. ':' .. valuesSuffix, 'REPLACE')
+	local values = redis.call('SMEMBERS', srcName .. ':' .. valuesSuffix)
+	for j, value in ipairs(values) do
+		redis.call('COPY', srcName .. ':' .. valuesSuffix .. ':' .. value, dstName .. ':' .. valuesSuffix .. ':' .. value, 'REPLACE')
+	end
+end
+redis.call('SADD', collectionNamesKey, dstName)
+redis.call('INCR', dstName .. ':writeCount')
+return #ids
+`)
+	deleteEnumBucketsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_enum_buckets is a lua script that takes the following arguments:
+-- 	1) The key of an enum index, i.e. the set of ids of all models in the index
+-- The script then deletes the set for each distinct value in the index, the set
+-- of distinct values, and the given set. It returns the number of keys that were
+-- deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local indexKey = ARGV[1]
+local valuesKey = indexKey .. ":enum"
+local count = 0
+local values = redis.call("SMEMBERS", valuesKey)
+for i, value in ipairs(values) do
+	count = count + redis.call("DEL", valuesKey .. ":" .. value)
+end
+count = count + redis.call("DEL", valuesKey, indexKey)
+return count
+`)
+	deleteEnumIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_enum_index is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The id of the model to be deleted from the index
+--		3) The name of the field with the enum index
+-- The script then checks if there is a value for the given field name stored in the
+-- model hash, and if there is, removes the model from the set for that value. If the
+-- set is then empty, the value is also removed from the set of distinct values.
+-- Finally, it removes the model from the set of all models in the index.
+-- NOTE: This script *must* be called before the main hash for the model is updated/deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local modelId = ARGV[2]
+local fieldName = ARGV[3]
+-- Get the old value from the existing model hash (if any)
+local modelKey = collectionName .. ":" .. modelId
+local oldValue = redis.call("HGET", modelKey, fieldName)
+local indexKey = collectionName .. ":" .. fieldName
+if oldValue ~= false then
+	-- Remove the model from the set for the old value
+	local bucketKey = indexKey .. ":enum:" .. oldValue
+	redis.call("SREM", bucketKey, modelId)
+	if redis.call("SCARD", bucketKey) == 0 then
+		redis.call("SREM", indexKey .. ":enum", oldValue)
+	end
+end
+redis.call("SREM", indexKey, modelId)
+`)
 	deleteModelsBySetIdsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
 -- license, which can be found in the LICENSE file.
@@ -23,9 +161,11 @@ var (
 -- delete_models_by_set_ids is a lua script that takes the following arguments:
 -- 	1) The key of a set of model ids
 --		2) The name of a registered model
--- The script then deletes all the models corresponding to the ids in the given
--- set. It returns the number of models that were deleted. It does not delete the
--- given set.
+--		3) Optionally, the names of any list fields for the model, as they are
+--			stored in Redis
+-- The script then deletes all the models (and their list fields) corresponding
+-- to the ids in the given set. It returns the number of models that were
+-- deleted. It does not delete the given set.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
@@ -41,6 +181,10 @@ if #ids > 0 then
 		-- Delete the main hash for each model
 		local key = collectionName .. ':' .. id
 		count = count + redis.call('DEL', key)
+		-- Delete the list fields for each model
+		for j = 3, #ARGV do
+			redis.call('DEL', key .. ':' .. ARGV[j])
+		end
 		-- Remove the model id from the set of all ids
 		-- NOTE: this is not necessarily the same as the
 		-- setName we were given
@@ -60,6 +204,9 @@ return count
 --		3) The name of the indexed string field
 -- The script then checks if there is a value for the given field name stored in the
 -- model hash, and if there is, removes the model from the index on the given field.
+-- If the index has a custom key function, the member for the model is built from
+-- the key stored in the hash at "<index key>:keys" instead, and the key is removed
+-- from that hash.
 -- NOTE: This script *must* be called before the main hash for the model is updated/deleted.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
@@ -72,11 +219,376 @@ local fieldName = ARGV[3]
 local modelKey = collectionName .. ":" .. modelId
 local oldValue = redis.call("HGET", modelKey, fieldName)
 local indexKey = collectionName .. ":" .. fieldName
-if oldValue ~= false then
+local keysKey = indexKey .. ":keys"
+local oldKey = redis.call("HGET", keysKey, modelId)
+if oldKey ~= false then
+	redis.call("ZREM", indexKey, oldKey .. "\0" .. modelId)
+	redis.call("HDEL", keysKey, modelId)
+elseif oldValue ~= false then
 	-- Remove the model from the field index
 	local oldMember = oldValue .. "\0" .. modelId
 	redis.call("ZREM", indexKey, oldMember)
 end
+`)
+	distinctValuesScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- distinct_values is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The key of a field index (a sorted set, or a set for enum and sparse
+--			indexes)
+--		3) The kind of the index. One of "numeric", "string", "boolean", "enum", or
+--			"sparse"
+--		4) The name of the indexed field, as it is stored in Redis
+--		5) The key of a list of ids, or an empty string for all the models in the
+--			index
+-- The script returns an array of the distinct values of the field for the
+-- models identified by the ids in the list (or all the models in the index),
+-- in no particular order. For numeric and boolean indexes the values are the
+-- scores in the index. For string and enum indexes they are the string values.
+-- Models which are not in the index (e.g. because their value is nil) are
+-- skipped, except for sparse indexes, where a model which is not in the index
+-- has a false value (0) and a model which is has a true value (1). Sparse
+-- indexes always need a list of ids, since the models with a false value are
+-- not in the index. Without a list of ids, enum indexes just read the set of distinct
+-- values, and other indexes read every member of the index. With a list of ids,
+-- the script looks up the value for each id, so it is O(N) where N is the
+-- number of ids.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local indexKey = ARGV[2]
+local kind = ARGV[3]
+local fieldName = ARGV[4]
+local idsKey = ARGV[5]
+local seen = {}
+local values = {}
+local function addValue(value)
+	if value and not seen[value] then
+		seen[value] = true
+		table.insert(values, value)
+	end
+end
+if idsKey == '' then
+	if kind == 'enum' then
+		return redis.call('SMEMBERS', indexKey .. ':enum')
+	end
+	local members = redis.call('ZRANGE', indexKey, 0, -1, 'WITHSCORES')
+	for i = 1, #members, 2 do
+		if kind == 'string' then
+			-- The value is everything before the last NULL character
+			local idStart = string.find(members[i], '%z[^%z]*$')
+			addValue(string.sub(members[i], 1, idStart-1))
+		else
+			addValue(members[i+1])
+		end
+	end
+	return values
+end
+for i, id in ipairs(redis.call('LRANGE', idsKey, 0, -1)) do
+	if kind == 'numeric' or kind == 'boolean' then
+		addValue(redis.call('ZSCORE', indexKey, id))
+	elseif kind == 'sparse' then
+		addValue(tostring(redis.call('SISMEMBER', indexKey, id)))
+	else
+		-- String and enum indexes use the value stored in the main hash
+		addValue(redis.call('HGET', collectionName .. ':' .. id, fieldName))
+	end
+end
+return values
+`)
+	execCommandsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- exec_commands is a lua script that takes the following arguments:
+-- 	1) Any number of commands, each of which consists of:
+-- 		a) The number of arguments for the command, including its name
+-- 		b) The name of the command
+-- 		c) The arguments for the command
+-- The script runs all of the commands in order and returns the number of
+-- commands that were run.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Iterate over the commands
+local i = 1
+local count = 0
+while i <= #ARGV do
+	local numArgs = tonumber(ARGV[i])
+	local command = {}
+	for j = 1, numArgs do
+		command[j] = ARGV[i + j]
+	end
+	redis.call(unpack(command))
+	count = count + 1
+	i = i + numArgs + 1
+end
+return count
+`)
+	execCommandsIfScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- exec_commands_if is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+-- 	2) The id of the model
+-- 	3) The name of the field to compare, as it is stored in Redis
+-- 	4) The kind of comparison, either "numeric" or "string"
+-- 	5) The comparison operator, one of "=", "!=", ">", "<", ">=", or "<="
+-- 	6) The value to compare the stored value to
+-- 	7) The number of string indexes which should be removed before running the
+-- 		commands, followed by the names of the indexed string fields
+-- 	8) The number of enum indexes which should be removed before running the
+-- 		commands, followed by the names of the fields with enum indexes
+-- 	9) The key of the list which stores the history for the model, or an empty
+-- 		string if the collection does not keep history
+-- 	10) The maximum number of entries to keep in the history
+-- 	11) Any number of commands, each of which consists of:
+-- 		a) The number of arguments for the command, including its name
+-- 		b) The name of the command
+-- 		c) The arguments for the command
+-- The script reads the stored value for the given field from the model hash and
+-- checks if "<stored value> <operator> <value>" holds. Numeric comparisons
+-- compare the values as numbers and string comparisons compare them byte by
+-- byte. If the model does not exist or does not have a stored value for the
+-- field, the condition is considered to hold. If the condition does not hold,
+-- the script returns 0 without running any of the commands. Otherwise it
+-- removes the model from the given string and enum indexes (using the old values
+-- stored in the model hash), saves a snapshot of the model hash in the history
+-- (the same way as the save_history script), runs all of the commands in
+-- order, and returns 1.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local modelId = ARGV[2]
+local fieldName = ARGV[3]
+local kind = ARGV[4]
+local op = ARGV[5]
+local value = ARGV[6]
+local numStringIndexes = tonumber(ARGV[7])
+local modelKey = collectionName .. ":" .. modelId
+
+-- compare returns -1, 0, or 1 if a is less than, equal to, or greater than b
+-- respectively. Strings are compared byte by byte so that the result does not
+-- depend on the locale.
+local function compare(a, b)
+	if kind == "numeric" then
+		a = tonumber(a)
+		b = tonumber(b)
+		if a < b then
+			return -1
+		elseif a > b then
+			return 1
+		end
+		return 0
+	end
+	local minLen = math.min(#a, #b)
+	for i = 1, minLen do
+		local x = string.byte(a, i)
+		local y = string.byte(b, i)
+		if x < y then
+			return -1
+		elseif x > y then
+			return 1
+		end
+	end
+	if #a < #b then
+		return -1
+	elseif #a > #b then
+		return 1
+	end
+	return 0
+end
+
+local oldValue = redis.call("HGET", modelKey, fieldName)
+if oldValue ~= false and (kind ~= "numeric" or tonumber(oldValue) ~= nil) then
+	local result = compare(oldValue, value)
+	local holds = false
+	if op == "=" then
+		holds = result == 0
+	elseif op == "!=" then
+		holds = result ~= 0
+	elseif op == ">" then
+		holds = result > 0
+	elseif op == "<" then
+		holds = result < 0
+	elseif op == ">=" then
+		holds = result >= 0
+	elseif op == "<=" then
+		holds = result <= 0
+	end
+	if not holds then
+		return 0
+	end
+end
+
+-- Remove the model from the string indexes. This must happen before the model
+-- hash is updated by the commands.
+for i = 1, numStringIndexes do
+	local indexedField = ARGV[7 + i]
+	local indexKey = collectionName .. ":" .. indexedField
+	local keysKey = indexKey .. ":keys"
+	local oldKey = redis.call("HGET", keysKey, modelId)
+	local oldIndexedValue = redis.call("HGET", modelKey, indexedField)
+	if oldKey ~= false then
+		-- The index has a custom key function, the same way as the
+		-- delete_string_index script.
+		redis.call("ZREM", indexKey, oldKey .. "\0" .. modelId)
+		redis.call("HDEL", keysKey, modelId)
+	elseif oldIndexedValue ~= false then
+		redis.call("ZREM", indexKey, oldIndexedValue .. "\0" .. modelId)
+	end
+end
+
+-- Remove the model from the enum indexes, the same way as the
+-- delete_enum_index script.
+local enumStart = 8 + numStringIndexes
+local numEnumIndexes = tonumber(ARGV[enumStart])
+for i = 1, numEnumIndexes do
+	local indexedField = ARGV[enumStart + i]
+	local indexKey = collectionName .. ":" .. indexedField
+	local oldIndexedValue = redis.call("HGET", modelKey, indexedField)
+	if oldIndexedValue ~= false then
+		local bucketKey = indexKey .. ":enum:" .. oldIndexedValue
+		redis.call("SREM", bucketKey, modelId)
+		if redis.call("SCARD", bucketKey) == 0 then
+			redis.call("SREM", indexKey .. ":enum", oldIndexedValue)
+		end
+	end
+	redis.call("SREM", indexKey, modelId)
+end
+
+-- Save a snapshot of the model hash in the history, the same way as the
+-- save_history script.
+local historyStart = enumStart + numEnumIndexes + 1
+local historyKey = ARGV[historyStart]
+if historyKey ~= "" then
+	local fields = redis.call("HGETALL", modelKey)
+	if #fields > 0 then
+		local parts = {}
+		for j, field in ipairs(fields) do
+			parts[j] = #field .. ":" .. field .. ","
+		end
+		redis.call("LPUSH", historyKey, table.concat(parts))
+		redis.call("LTRIM", historyKey, 0, tonumber(ARGV[historyStart + 1]) - 1)
+	end
+end
+
+-- Iterate over the commands
+local i = historyStart + 2
+while i <= #ARGV do
+	local numArgs = tonumber(ARGV[i])
+	local command = {}
+	for j = 1, numArgs do
+		command[j] = ARGV[i + j]
+	end
+	redis.call(unpack(command))
+	i = i + numArgs + 1
+end
+return 1
+`)
+	execCommandsIfNotExistsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- exec_commands_if_not_exists is a lua script that takes the following
+-- arguments:
+-- 	1) key: The key which must not exist
+-- 	2) Any number of commands, each of which consists of:
+-- 		a) The number of arguments for the command, including its name
+-- 		b) The name of the command
+-- 		c) The arguments for the command
+-- The script checks if key exists. If it does, it returns 0 without running any
+-- of the commands. Otherwise it runs all of the commands in order and returns 1.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local key = ARGV[1]
+if redis.call('EXISTS', key) == 1 then
+	return 0
+end
+-- Iterate over the commands
+local i = 2
+while i <= #ARGV do
+	local numArgs = tonumber(ARGV[i])
+	local command = {}
+	for j = 1, numArgs do
+		command[j] = ARGV[i + j]
+	end
+	redis.call(unpack(command))
+	i = i + numArgs + 1
+end
+return 1
+`)
+	extractIdsBySubstringScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- extract_ids_by_substring is a lua script that takes the following arguments:
+-- 	1) The key of a set or sorted set of model ids
+--		2) The key of a sorted set where the matching ids will be stored
+--		3) The name of a registered model
+--		4) The redis name of a string field
+--		5) The substring to search for
+--		6) The maximum number of matching ids to store (0 means unlimited)
+--		7) "1" if the ids should be scanned in reverse order, otherwise "0"
+-- The script reads the given field from the main hash of each model in the
+-- given set and stores the ids of the models where the field contains the
+-- substring in the destination sorted set. If the given set is a sorted set,
+-- the original scores are preserved, so the order of the ids is preserved as
+-- well. Otherwise each id is given a score of 0. The script stops as soon as
+-- the maximum number of matching ids has been stored. Since the script has to
+-- read the main hash of every model in the given set, it is O(N) where N is the
+-- number of ids in the set.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local setKey = ARGV[1]
+local destKey = ARGV[2]
+local collectionName = ARGV[3]
+local fieldName = ARGV[4]
+local substring = ARGV[5]
+local maxMatches = tonumber(ARGV[6])
+local reverse = ARGV[7] == '1'
+-- Get all the ids (and scores if applicable) from the set
+local ids = {}
+local scores = {}
+local setType = redis.call('TYPE', setKey)['ok']
+if setType == 'zset' then
+	local members
+	if reverse then
+		members = redis.call('ZREVRANGE', setKey, 0, -1, 'WITHSCORES')
+	else
+		members = redis.call('ZRANGE', setKey, 0, -1, 'WITHSCORES')
+	end
+	for i = 1, #members, 2 do
+		table.insert(ids, members[i])
+		table.insert(scores, members[i+1])
+	end
+elseif setType == 'set' then
+	ids = redis.call('SMEMBERS', setKey)
+end
+local count = 0
+for i, id in ipairs(ids) do
+	local value = redis.call('HGET', collectionName .. ':' .. id, fieldName)
+	-- Use plain matching so the substring is not treated as a pattern
+	if value and string.find(value, substring, 1, true) then
+		redis.call('ZADD', destKey, scores[i] or 0, id)
+		count = count + 1
+		if maxMatches > 0 and count >= maxMatches then
+			break
+		end
+	end
+end
+return count
 `)
 	extractIdsFromFieldIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
 -- Use of this source code is governed by the MIT
@@ -140,4 +652,780 @@ if #members > 0 then
 	end
 end
 `)
+	getCachedCountScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- get_cached_count is a lua script that takes the following arguments:
+-- 	1) writeCountKey: The key of the write counter for a collection
+-- 	2) cachePrefix: The prefix for all cached count (or cached result) keys for
+-- 		the collection
+-- 	3) querySum: A checksum which uniquely identifies the query
+-- The script reads the current value of the write counter and uses it to build
+-- the key for the cached count, which has the form:
+-- <cachePrefix>:<writeCount>:<querySum>. It returns a two-element array. The
+-- first element is the key for the cached count and the second element is the
+-- cached count itself, or nil if there is no cached count. The same script is
+-- used to read cached query results, which are stored as a single string.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local writeCountKey = ARGV[1]
+local cachePrefix = ARGV[2]
+local querySum = ARGV[3]
+-- Get the current write count. If the collection was never written to, the
+-- write count is 0.
+local writeCount = redis.call('GET', writeCountKey)
+if writeCount == false then
+	writeCount = '0'
+end
+local cacheKey = cachePrefix .. ':' .. writeCount .. ':' .. querySum
+return {cacheKey, redis.call('GET', cacheKey)}
+`)
+	getIndexStatsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- get_index_stats is a lua script that takes the following arguments:
+-- 	1) The key of a field index (a sorted set, or a set for enum and sparse
+--			indexes)
+--		2) The kind of the index. One of "numeric", "string", "boolean", "enum", or
+--			"sparse"
+--		3) The maximum number of buckets to return
+-- The script then reads every member of the index and returns an array
+-- with the following elements:
+-- 	1) The number of members in the index
+--		2) The number of distinct values in the index
+--		3) The lowest score in the index (or an empty string if the index is empty)
+--		4) The highest score in the index (or an empty string if the index is empty)
+-- For string, boolean, enum, and sparse indexes, the remaining elements are pairs of values and
+-- the number of members with that value, sorted by the number of members in
+-- descending order. For string indexes the value is the string value and for
+-- boolean indexes the value is the score. Enum indexes keep a set for each value,
+-- so the script reads the size of each set instead. Sparse indexes only contain
+-- the ids with a true value, so they have a single bucket with the value 1 (the
+-- same as the score for true in a boolean index). No more than the given maximum number of
+-- pairs will be returned. Since the script reads every member of the index, it is
+-- O(N) where N is the number of members in the index.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local indexKey = ARGV[1]
+local kind = ARGV[2]
+local maxBuckets = tonumber(ARGV[3])
+local members = {}
+local count = 0
+local minScore = ''
+local maxScore = ''
+local counts = {}
+local distinct = 0
+if kind == 'enum' then
+	count = redis.call('SCARD', indexKey)
+	local values = redis.call('SMEMBERS', indexKey .. ':enum')
+	for i, value in ipairs(values) do
+		counts[value] = redis.call('SCARD', indexKey .. ':enum:' .. value)
+		distinct = distinct + 1
+	end
+elseif kind == 'sparse' then
+	count = redis.call('SCARD', indexKey)
+	if count > 0 then
+		counts['1'] = count
+		distinct = 1
+	end
+else
+	members = redis.call('ZRANGE', indexKey, 0, -1, 'WITHSCORES')
+	count = #members / 2
+	if count > 0 then
+		minScore = members[2]
+		maxScore = members[#members]
+	end
+end
+-- Count the number of members for each distinct value
+for i = 1, #members, 2 do
+	local value
+	if kind == 'string' then
+		-- The value is everything before the last NULL character
+		local idStart = string.find(members[i], '%z[^%z]*$')
+		value = string.sub(members[i], 1, idStart-1)
+	else
+		value = members[i+1]
+	end
+	if counts[value] == nil then
+		counts[value] = 0
+		distinct = distinct + 1
+	end
+	counts[value] = counts[value] + 1
+end
+local result = {count, distinct, minScore, maxScore}
+if kind ~= 'numeric' then
+	-- Sort the buckets by size (largest first) and then by value
+	local buckets = {}
+	for value, n in pairs(counts) do
+		table.insert(buckets, {value, n})
+	end
+	table.sort(buckets, function(a, b)
+		if a[2] == b[2] then
+			return a[1] < b[1]
+		end
+		return a[2] > b[2]
+	end)
+	for i = 1, math.min(#buckets, maxBuckets) do
+		table.insert(result, buckets[i][1])
+		table.insert(result, buckets[i][2])
+	end
+end
+return result
+`)
+	incrementFieldsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- increment_fields is a lua script that takes the following arguments:
+-- 	1) key: The key of the main hash for the model
+-- 	2) modelId: The id of the model
+-- 	3) numFields: The number of fields to increment
+-- 	4) numFields fields, each of which consists of:
+-- 		a) The name of the field as it is stored in Redis
+-- 		b) The amount to increment the field by
+-- 		c) The key of the numeric index for the field, or an empty string if
+-- 			the field is not indexed
+-- 	5) Any number of commands, each of which consists of:
+-- 		a) The number of arguments for the command, including its name
+-- 		b) The name of the command
+-- 		c) The arguments for the command
+-- The script checks if key exists. If it does not, it returns nil without
+-- changing anything. Otherwise it increments each field with HINCRBY, updates
+-- the score for the model in the numeric index for the field (if any) to the
+-- new value, and runs all of the commands in order. It returns an array of the
+-- new values in the same order as the fields.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local key = ARGV[1]
+local modelId = ARGV[2]
+local numFields = tonumber(ARGV[3])
+if redis.call('EXISTS', key) == 0 then
+	return false
+end
+-- Iterate over the fields
+local results = {}
+local i = 4
+for n = 1, numFields do
+	local value = redis.call('HINCRBY', key, ARGV[i], ARGV[i + 1])
+	local indexKey = ARGV[i + 2]
+	if indexKey ~= '' then
+		redis.call('ZADD', indexKey, value, modelId)
+	end
+	table.insert(results, value)
+	i = i + 3
+end
+-- Iterate over the commands
+while i <= #ARGV do
+	local numArgs = tonumber(ARGV[i])
+	local command = {}
+	for j = 1, numArgs do
+		command[j] = ARGV[i + j]
+	end
+	redis.call(unpack(command))
+	i = i + numArgs + 1
+end
+return results
+`)
+	intersectFiltersScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- intersect_filters is a lua script that takes the following arguments:
+-- 	1) The key of the set or sorted set of ids to start with
+-- 	2) The key of the sorted set where the result should be stored
+-- 	3) Any number of filters, each of which consists of:
+-- 		a) The kind of filter, one of "score", "lex", "union", "diff", or "id"
+-- 		b) Whether the filter is negated, either "0" or "1"
+-- 		c) The key of the index for the field
+-- 		d) The number of arguments for the filter, n
+-- 		e) n arguments, which depend on the kind of filter:
+-- 			"score": pairs of min and max for ZRANGEBYSCORE on a numeric or
+-- 				boolean index
+-- 			"lex": pairs of min and max for ZRANGEBYLEX on a string index, where
+-- 				each member has the format <value>\0<id>
+-- 			"union": the keys of the enum buckets whose union matches, or the key
+-- 				of a sparse boolean index
+-- 			"diff": the key of an enum bucket which is subtracted from the index
+-- 			"id": pairs of min and max for ZREMRANGEBYLEX, which are removed
+-- 				from the ids in the index (i.e. the set of all ids)
+-- For each filter, the script builds the set of ids which match the filter and
+-- then intersects it with the ids from the previous step (or subtracts it if
+-- the filter is negated), keeping the scores from the starting key so that the
+-- ids can still be ordered. The result of the last step is stored in the
+-- destination key. The set for each filter is stored in a temporary key, which
+-- is deleted before the script returns. This lets a query apply all of its
+-- filters with a single command instead of several commands and temporary keys
+-- per filter.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local origKey = ARGV[1]
+local destKey = ARGV[2]
+local filterKey = destKey .. ':filter'
+
+-- zaddAll adds members to the sorted set at key. The scores only need to be
+-- distinct (which makes inserting faster than using equal scores), since they
+-- are ignored when the set is intersected. The members are added in batches to
+-- limit the number of arguments for each ZADD.
+local function zaddAll(key, members)
+	local args = {}
+	for i, member in ipairs(members) do
+		table.insert(args, i)
+		table.insert(args, member)
+		if #args >= 1000 then
+			redis.call('ZADD', key, unpack(args))
+			args = {}
+		end
+	end
+	if #args > 0 then
+		redis.call('ZADD', key, unpack(args))
+	end
+end
+
+local srcKey = origKey
+local i = 3
+while i <= #ARGV do
+	local kind = ARGV[i]
+	local negate = ARGV[i + 1] == '1'
+	local indexKey = ARGV[i + 2]
+	local n = tonumber(ARGV[i + 3])
+	local first = i + 4
+	local last = first + n - 1
+	i = last + 1
+	-- stepKey is the key of the set of ids which match the filter. A filterKey
+	-- which was never created acts as an empty set.
+	local stepKey = filterKey
+	redis.call('DEL', filterKey)
+	if kind == 'score' then
+		for j = first, last, 2 do
+			zaddAll(filterKey, redis.call('ZRANGEBYSCORE', indexKey, ARGV[j], ARGV[j + 1]))
+		end
+	elseif kind == 'lex' then
+		for j = first, last, 2 do
+			local members = redis.call('ZRANGEBYLEX', indexKey, ARGV[j], ARGV[j + 1])
+			local ids = {}
+			for k, member in ipairs(members) do
+				-- The id is everything after the last null character
+				local idStart = string.find(member, '%z[^%z]*$')
+				table.insert(ids, string.sub(member, idStart + 1))
+			end
+			zaddAll(filterKey, ids)
+		end
+	elseif kind == 'union' then
+		if n == 1 then
+			-- Use the bucket directly instead of copying it
+			stepKey = ARGV[first]
+		elseif n > 1 then
+			redis.call('ZUNIONSTORE', filterKey, n, unpack(ARGV, first, last))
+		end
+	elseif kind == 'diff' then
+		redis.call('ZDIFFSTORE', filterKey, 2, indexKey, ARGV[first])
+	elseif kind == 'id' then
+		redis.call('ZUNIONSTORE', filterKey, 1, indexKey, 'WEIGHTS', 0)
+		for j = first, last, 2 do
+			redis.call('ZREMRANGEBYLEX', filterKey, ARGV[j], ARGV[j + 1])
+		end
+	end
+	if negate then
+		redis.call('ZDIFFSTORE', destKey, 2, srcKey, stepKey)
+	else
+		redis.call('ZINTERSTORE', destKey, 2, srcKey, stepKey, 'WEIGHTS', 1, 0)
+	end
+	srcKey = destKey
+end
+redis.call('DEL', filterKey)
+`)
+	releaseLockScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- release_lock is a lua script that takes the following arguments:
+-- 	1) The key of the lock
+-- 	2) The token which was stored in the key when the lock was acquired
+-- The script deletes the lock only if it still holds the given token, so a
+-- client never releases a lock which expired and was then acquired by another
+-- client. It returns 1 if the lock was deleted and 0 otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local lockKey = ARGV[1]
+local token = ARGV[2]
+
+if redis.call('GET', lockKey) == token then
+	return redis.call('DEL', lockKey)
+end
+return 0
+`)
+	renameFieldScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- rename_field is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The old name of the field, as it is stored in Redis
+--		3) The new name of the field, as it is stored in Redis
+--		4) Any number of model ids
+-- The script then moves the value stored under the old name to the new name in
+-- the main hash for each of the given models. Models which do not have a value
+-- for the old name are skipped. It returns the number of models that had a value
+-- for the old name.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local oldName = ARGV[2]
+local newName = ARGV[3]
+local count = 0
+for i = 4, #ARGV do
+	local modelKey = collectionName .. ":" .. ARGV[i]
+	local value = redis.call("HGET", modelKey, oldName)
+	if value ~= false then
+		redis.call("HSET", modelKey, newName, value)
+		redis.call("HDEL", modelKey, oldName)
+		count = count + 1
+	end
+end
+return count
+`)
+	renameKeysScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- rename_keys is a lua script that takes the following arguments:
+-- 	1) The prefix of the keys to rename, i.e. the old collection name and a colon
+--		2) The prefix to replace it with, i.e. the new collection name and a colon
+--		3) Any number of keys which start with the old prefix
+-- The script renames each of the given keys which still exists, by replacing the
+-- old prefix with the new one. Keys which no longer exist (e.g. because they
+-- expired after they were found with SCAN) and keys which do not start with the
+-- old prefix are skipped. If any of the new keys already exists, the script
+-- renames nothing and returns -1, so existing data is never overwritten.
+-- Otherwise it returns the number of keys that were renamed.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local oldPrefix = ARGV[1]
+local newPrefix = ARGV[2]
+local renames = {}
+for i = 3, #ARGV do
+	local key = ARGV[i]
+	if string.sub(key, 1, #oldPrefix) == oldPrefix and redis.call('EXISTS', key) == 1 then
+		local newKey = newPrefix .. string.sub(key, #oldPrefix + 1)
+		if redis.call('EXISTS', newKey) == 1 then
+			return -1
+		end
+		table.insert(renames, {key, newKey})
+	end
+end
+for i, rename in ipairs(renames) do
+	redis.call('RENAMENX', rename[1], rename[2])
+end
+return #renames
+`)
+	saveHistoryScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- save_history is a lua script that takes the following arguments:
+-- 	1) The key of the main hash for a model
+-- 	2) The key of the list which stores the history for the model
+-- 	3) The maximum number of entries to keep in the history
+-- If the main hash exists, the script pushes a snapshot of it onto the front of
+-- the history list and then trims the list to the maximum number of entries.
+-- The snapshot is every field and value of the hash, in the order returned by
+-- HGETALL, with each one encoded as "<length>:<bytes>," so that binary values
+-- are preserved. It returns the new length of the list, or 0 if the hash did
+-- not exist.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = ARGV[1]
+local historyKey = ARGV[2]
+local keep = tonumber(ARGV[3])
+
+local fields = redis.call('HGETALL', modelKey)
+if #fields == 0 then
+	return 0
+end
+local parts = {}
+for i, value in ipairs(fields) do
+	parts[i] = #value .. ':' .. value .. ','
+end
+redis.call('LPUSH', historyKey, table.concat(parts))
+redis.call('LTRIM', historyKey, 0, keep - 1)
+return redis.call('LLEN', historyKey)
+`)
+	swapIdsScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- swap_ids is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The id of the first model
+--		3) The id of the second model
+--		4) The number of field indexes, n
+--		5) n field indexes, each of which consists of:
+--			a) The kind of the index. One of "numeric", "string", "boolean", "enum",
+--				or "sparse"
+--			b) The name of the indexed field, as it is stored in Redis
+--		6) The number of list fields, l
+--		7) l names of list fields, as they are stored in Redis
+--		8) Any number of commands, each of which consists of:
+--			a) The number of arguments for the command, including its name
+--			b) The name of the command
+--			c) The arguments for the command
+-- The script checks that the main hashes for both models exist. If either does
+-- not, it returns nil without changing anything. If the ids are the same, it
+-- returns 0 without changing anything. Otherwise it swaps the main hashes and
+-- list fields of the two models with RENAME, updates each field index so that
+-- each id is indexed by the value of the model it now refers to, runs all of
+-- the commands in order, and returns 1.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local idA = ARGV[2]
+local idB = ARGV[3]
+local keyA = collectionName .. ':' .. idA
+local keyB = collectionName .. ':' .. idB
+if redis.call('EXISTS', keyA) == 0 or redis.call('EXISTS', keyB) == 0 then
+	return false
+end
+if idA == idB then
+	return 0
+end
+
+-- swapKeys swaps the values of two keys, either of which may not exist
+local function swapKeys(a, b)
+	local aExists = redis.call('EXISTS', a) == 1
+	local bExists = redis.call('EXISTS', b) == 1
+	if aExists and bExists then
+		local tmpKey = 'tmp:swap:' .. a
+		redis.call('RENAME', a, tmpKey)
+		redis.call('RENAME', b, a)
+		redis.call('RENAME', tmpKey, b)
+	elseif aExists then
+		redis.call('RENAME', a, b)
+	elseif bExists then
+		redis.call('RENAME', b, a)
+	end
+end
+
+-- Update the indexes. This must happen before the main hashes are swapped,
+-- since string and enum indexes rely on the values stored in the hashes.
+local i = 4
+local numIndexes = tonumber(ARGV[i])
+for n = 1, numIndexes do
+	local kind = ARGV[i + 1]
+	local fieldName = ARGV[i + 2]
+	local indexKey = collectionName .. ':' .. fieldName
+	if kind == 'numeric' or kind == 'boolean' then
+		local scoreA = redis.call('ZSCORE', indexKey, idA)
+		local scoreB = redis.call('ZSCORE', indexKey, idB)
+		redis.call('ZREM', indexKey, idA, idB)
+		if scoreB then
+			redis.call('ZADD', indexKey, scoreB, idA)
+		end
+		if scoreA then
+			redis.call('ZADD', indexKey, scoreA, idB)
+		end
+	elseif kind == 'sparse' then
+		local inA = redis.call('SISMEMBER', indexKey, idA) == 1
+		local inB = redis.call('SISMEMBER', indexKey, idB) == 1
+		redis.call('SREM', indexKey, idA, idB)
+		if inB then
+			redis.call('SADD', indexKey, idA)
+		end
+		if inA then
+			redis.call('SADD', indexKey, idB)
+		end
+	else
+		-- Only values which are actually in the index are moved, so that
+		-- models which are not in a partial index stay out of it.
+		local valueA = redis.call('HGET', keyA, fieldName)
+		local valueB = redis.call('HGET', keyB, fieldName)
+		if kind == 'string' then
+			-- If the index has a custom key function, the members are built
+			-- from the keys stored in "<index key>:keys" instead of the values.
+			local keysKey = indexKey .. ':keys'
+			local keyed = redis.call('EXISTS', keysKey) == 1
+			if keyed then
+				valueA = redis.call('HGET', keysKey, idA)
+				valueB = redis.call('HGET', keysKey, idB)
+			end
+			if valueA and not redis.call('ZSCORE', indexKey, valueA .. '\0' .. idA) then
+				valueA = false
+			end
+			if valueB and not redis.call('ZSCORE', indexKey, valueB .. '\0' .. idB) then
+				valueB = false
+			end
+			if valueA then
+				redis.call('ZREM', indexKey, valueA .. '\0' .. idA)
+			end
+			if valueB then
+				redis.call('ZREM', indexKey, valueB .. '\0' .. idB)
+				redis.call('ZADD', indexKey, 0, valueB .. '\0' .. idA)
+			end
+			if valueA then
+				redis.call('ZADD', indexKey, 0, valueA .. '\0' .. idB)
+			end
+			if keyed then
+				redis.call('HDEL', keysKey, idA, idB)
+				if valueB then
+					redis.call('HSET', keysKey, idA, valueB)
+				end
+				if valueA then
+					redis.call('HSET', keysKey, idB, valueA)
+				end
+			end
+		elseif kind == 'enum' then
+			if valueA and redis.call('SISMEMBER', indexKey, idA) == 0 then
+				valueA = false
+			end
+			if valueB and redis.call('SISMEMBER', indexKey, idB) == 0 then
+				valueB = false
+			end
+			-- Both models keep their values, so the set of distinct values does
+			-- not change.
+			if valueA then
+				redis.call('SREM', indexKey .. ':enum:' .. valueA, idA)
+			end
+			if valueB then
+				redis.call('SREM', indexKey .. ':enum:' .. valueB, idB)
+			end
+			redis.call('SREM', indexKey, idA, idB)
+			if valueB then
+				redis.call('SADD', indexKey .. ':enum:' .. valueB, idA)
+				redis.call('SADD', indexKey, idA)
+			end
+			if valueA then
+				redis.call('SADD', indexKey .. ':enum:' .. valueA, idB)
+				redis.call('SADD', indexKey, idB)
+			end
+		end
+	end
+	i = i + 2
+end
+
+-- Swap the main hashes and list fields
+swapKeys(keyA, keyB)
+i = i + 1
+local numLists = tonumber(ARGV[i])
+for n = 1, numLists do
+	swapKeys(keyA .. ':' .. ARGV[i + n], keyB .. ':' .. ARGV[i + n])
+end
+i = i + numLists + 1
+
+-- Iterate over the commands
+while i <= #ARGV do
+	local numArgs = tonumber(ARGV[i])
+	local command = {}
+	for j = 1, numArgs do
+		command[j] = ARGV[i + j]
+	end
+	redis.call(unpack(command))
+	i = i + numArgs + 1
+end
+return 1
+`)
+	verifyIndexScript = redis.NewScript(0, `-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- verify_index is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The key of a field index (a sorted set, or a set for enum and sparse
+--			indexes)
+--		3) The kind of the index. One of "numeric", "string", "boolean", "enum", or
+--			"sparse"
+--		4) The name of the indexed field, as it is stored in Redis
+--		5) For partial indexes, the name of the field in the condition, as it is
+--			stored in Redis. An empty string if the index is not partial
+--		6) For partial indexes, the operator in the condition ("=" or "!=")
+--		7) For partial indexes, the value in the condition, encoded the same way
+--			it is stored in the main hash
+-- The script reads every member of the index and compares it to the set of all
+-- ids for the model. It does not modify anything. It returns an array with the
+-- following elements:
+-- 	1) An array of orphaned ids, which are in the index but not in the set of
+--			all ids, or which do not match the condition for a partial index
+--		2) An array of missing ids, which are in the set of all ids and have a
+--			value for the field in the main hash (and match the condition for a
+--			partial index), but are not in the index
+--		3) An array of duplicated ids, which are in the index more than once. This
+--			can only happen for string indexes (where each member includes the
+--			value) and enum indexes (where each value has its own set)
+-- For enum indexes, an id which is in the set for a value but not in the set
+-- of all ids in the index (or vice versa) is reported as missing. Sparse
+-- indexes only contain the ids of models with a true value (stored as 1 in the
+-- main hash), so an id in the index without a true value is reported as
+-- orphaned, and only the ids of models with a true value can be missing. Since the
+-- script reads every member of the index and every id in the collection, it is
+-- O(N).
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local indexKey = ARGV[2]
+local kind = ARGV[3]
+local fieldName = ARGV[4]
+local whereField = ARGV[5]
+local whereOp = ARGV[6]
+local whereValue = ARGV[7]
+local allKey = collectionName .. ':all'
+-- matches returns true if the model with the given id matches the condition
+-- for a partial index. A missing value is never equal to the value in the
+-- condition. For sparse indexes, the condition is that the value is true. It
+-- always returns true if the index is not partial or sparse.
+local function matches(id)
+	if kind == 'sparse' then
+		return redis.call('HGET', collectionName .. ':' .. id, fieldName) == '1'
+	end
+	if whereField == nil or whereField == '' then
+		return true
+	end
+	local equal = redis.call('HGET', collectionName .. ':' .. id, whereField) == whereValue
+	return equal ~= (whereOp == '!=')
+end
+-- Count the number of times each id appears in the index
+local counts = {}
+local ids = {}
+local function addId(id)
+	if counts[id] == nil then
+		counts[id] = 0
+		table.insert(ids, id)
+	end
+	counts[id] = counts[id] + 1
+end
+-- inIndex is the set of ids which are properly in the index. For enum indexes,
+-- an id has to be both in the main set for the index and in the set for one of
+-- the values.
+local inIndex = {}
+if kind == 'enum' then
+	local inMainSet = {}
+	for i, id in ipairs(redis.call('SMEMBERS', indexKey)) do
+		inMainSet[id] = true
+	end
+	local values = redis.call('SMEMBERS', indexKey .. ':enum')
+	for i, value in ipairs(values) do
+		for j, id in ipairs(redis.call('SMEMBERS', indexKey .. ':enum:' .. value)) do
+			addId(id)
+			if inMainSet[id] then
+				inIndex[id] = true
+			end
+		end
+	end
+	-- Ids which are in the main set but not in the set for any value can
+	-- still be orphans.
+	for id, _ in pairs(inMainSet) do
+		if counts[id] == nil then
+			counts[id] = 0
+			table.insert(ids, id)
+		end
+	end
+elseif kind == 'sparse' then
+	for i, id in ipairs(redis.call('SMEMBERS', indexKey)) do
+		addId(id)
+		inIndex[id] = true
+	end
+else
+	local members = redis.call('ZRANGE', indexKey, 0, -1)
+	for i, member in ipairs(members) do
+		local id = member
+		if kind == 'string' then
+			-- The id is everything after the last NULL character
+			local idStart = string.find(member, '%z[^%z]*$')
+			id = string.sub(member, idStart+1)
+		end
+		addId(id)
+		inIndex[id] = true
+	end
+end
+local orphaned = {}
+local duplicated = {}
+for i, id in ipairs(ids) do
+	if redis.call('SISMEMBER', allKey, id) == 0 or not matches(id) then
+		table.insert(orphaned, id)
+	end
+	if counts[id] > 1 then
+		table.insert(duplicated, id)
+	end
+end
+local missing = {}
+for i, id in ipairs(redis.call('SMEMBERS', allKey)) do
+	if inIndex[id] ~= true then
+		if redis.call('HEXISTS', collectionName .. ':' .. id, fieldName) == 1 and matches(id) then
+			table.insert(missing, id)
+		end
+	end
+end
+return {orphaned, missing, duplicated}
+`)
+
+	// allScripts contains all of the scripts above.
+	allScripts = []*redis.Script{
+		copyCollectionScript,
+		deleteEnumBucketsScript,
+		deleteEnumIndexScript,
+		deleteModelsBySetIdsScript,
+		deleteStringIndexScript,
+		distinctValuesScript,
+		execCommandsScript,
+		execCommandsIfScript,
+		execCommandsIfNotExistsScript,
+		extractIdsBySubstringScript,
+		extractIdsFromFieldIndexScript,
+		extractIdsFromStringIndexScript,
+		getCachedCountScript,
+		getIndexStatsScript,
+		incrementFieldsScript,
+		intersectFiltersScript,
+		releaseLockScript,
+		renameFieldScript,
+		renameKeysScript,
+		saveHistoryScript,
+		swapIdsScript,
+		verifyIndexScript,
+	}
+
+	// scriptNames maps each of the scripts above to the name of its .lua file.
+	scriptNames = map[*redis.Script]string{
+		copyCollectionScript: "copy_collection",
+		deleteEnumBucketsScript: "delete_enum_buckets",
+		deleteEnumIndexScript: "delete_enum_index",
+		deleteModelsBySetIdsScript: "delete_models_by_set_ids",
+		deleteStringIndexScript: "delete_string_index",
+		distinctValuesScript: "distinct_values",
+		execCommandsScript: "exec_commands",
+		execCommandsIfScript: "exec_commands_if",
+		execCommandsIfNotExistsScript: "exec_commands_if_not_exists",
+		extractIdsBySubstringScript: "extract_ids_by_substring",
+		extractIdsFromFieldIndexScript: "extract_ids_from_field_index",
+		extractIdsFromStringIndexScript: "extract_ids_from_string_index",
+		getCachedCountScript: "get_cached_count",
+		getIndexStatsScript: "get_index_stats",
+		incrementFieldsScript: "increment_fields",
+		intersectFiltersScript: "intersect_filters",
+		releaseLockScript: "release_lock",
+		renameFieldScript: "rename_field",
+		renameKeysScript: "rename_keys",
+		saveHistoryScript: "save_history",
+		swapIdsScript: "swap_ids",
+		verifyIndexScript: "verify_index",
+	}
 )
\ No newline at end of file
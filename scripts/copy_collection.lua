@@ -0,0 +1,80 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- copy_collection is a lua script that takes the following arguments:
+-- 	1) The name of the source collection
+--		2) The name of the destination collection
+--		3) The key of the set of all collection names
+--		4) The number of collection-wide keys to copy, n
+--		5) n suffixes for the collection-wide keys (e.g. "all" or the name of an
+--			indexed field), which are appended to the collection name and a colon
+--		6) The number of enum indexes, e
+--		7) e suffixes for the enum indexes, as above
+--		8) The names of any list fields, as they are stored in Redis
+-- The script copies the main hash and list fields of every model in the source
+-- collection, along with the given collection-wide keys and the values and
+-- sets for each enum index, to the corresponding keys for the destination
+-- collection using COPY. It also adds the destination name to the set of all
+-- collection names and increments the write count for the destination, which
+-- invalidates any cached counts or query results. If the set of all ids or any
+-- of the collection-wide keys already exist for the destination, the script
+-- copies nothing and returns -1. Otherwise it returns the number of models that
+-- were copied.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local srcName = ARGV[1]
+local dstName = ARGV[2]
+local collectionNamesKey = ARGV[3]
+local numKeys = tonumber(ARGV[4])
+local suffixes = {}
+for i = 1, numKeys do
+	table.insert(suffixes, ARGV[4 + i])
+end
+local enumStart = 5 + numKeys
+local numEnums = tonumber(ARGV[enumStart])
+local enumSuffixes = {}
+for i = 1, numEnums do
+	table.insert(enumSuffixes, ARGV[enumStart + i])
+end
+local lists = {}
+for i = enumStart + numEnums + 1, #ARGV do
+	table.insert(lists, ARGV[i])
+end
+
+-- Make sure the destination does not have any data
+if redis.call('EXISTS', dstName .. ':all') == 1 then
+	return -1
+end
+for i, suffix in ipairs(suffixes) do
+	if redis.call('EXISTS', dstName .. ':' .. suffix) == 1 then
+		return -1
+	end
+end
+
+-- Copy the main hash and list fields for each model
+local ids = redis.call('SMEMBERS', srcName .. ':all')
+for i, id in ipairs(ids) do
+	redis.call('COPY', srcName .. ':' .. id, dstName .. ':' .. id, 'REPLACE')
+	for j, list in ipairs(lists) do
+		redis.call('COPY', srcName .. ':' .. id .. ':' .. list, dstName .. ':' .. id .. ':' .. list, 'REPLACE')
+	end
+end
+-- Copy the collection-wide keys, including the set of all ids
+for i, suffix in ipairs(suffixes) do
+	redis.call('COPY', srcName .. ':' .. suffix, dstName .. ':' .. suffix)
+end
+-- Copy the set of values and the set for each value of each enum index
+for i, suffix in ipairs(enumSuffixes) do
+	local valuesSuffix = suffix .. ':enum'
+	redis.call('COPY', srcName .. ':' .. valuesSuffix, dstName .. ':' .. valuesSuffix, 'REPLACE')
+	local values = redis.call('SMEMBERS', srcName .. ':' .. valuesSuffix)
+	for j, value in ipairs(values) do
+		redis.call('COPY', srcName .. ':' .. valuesSuffix .. ':' .. value, dstName .. ':' .. valuesSuffix .. ':' .. value, 'REPLACE')
+	end
+end
+redis.call('SADD', collectionNamesKey, dstName)
+redis.call('INCR', dstName .. ':writeCount')
+return #ids
@@ -0,0 +1,22 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_enum_buckets is a lua script that takes the following arguments:
+-- 	1) The key of an enum index, i.e. the set of ids of all models in the index
+-- The script then deletes the set for each distinct value in the index, the set
+-- of distinct values, and the given set. It returns the number of keys that were
+-- deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local indexKey = ARGV[1]
+local valuesKey = indexKey .. ":enum"
+local count = 0
+local values = redis.call("SMEMBERS", valuesKey)
+for i, value in ipairs(values) do
+	count = count + redis.call("DEL", valuesKey .. ":" .. value)
+end
+count = count + redis.call("DEL", valuesKey, indexKey)
+return count
@@ -0,0 +1,33 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- delete_enum_index is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The id of the model to be deleted from the index
+--		3) The name of the field with the enum index
+-- The script then checks if there is a value for the given field name stored in the
+-- model hash, and if there is, removes the model from the set for that value. If the
+-- set is then empty, the value is also removed from the set of distinct values.
+-- Finally, it removes the model from the set of all models in the index.
+-- NOTE: This script *must* be called before the main hash for the model is updated/deleted.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local modelId = ARGV[2]
+local fieldName = ARGV[3]
+-- Get the old value from the existing model hash (if any)
+local modelKey = collectionName .. ":" .. modelId
+local oldValue = redis.call("HGET", modelKey, fieldName)
+local indexKey = collectionName .. ":" .. fieldName
+if oldValue ~= false then
+	-- Remove the model from the set for the old value
+	local bucketKey = indexKey .. ":enum:" .. oldValue
+	redis.call("SREM", bucketKey, modelId)
+	if redis.call("SCARD", bucketKey) == 0 then
+		redis.call("SREM", indexKey .. ":enum", oldValue)
+	end
+end
+redis.call("SREM", indexKey, modelId)
@@ -5,9 +5,11 @@
 -- delete_models_by_set_ids is a lua script that takes the following arguments:
 -- 	1) The key of a set of model ids
 --		2) The name of a registered model
--- The script then deletes all the models corresponding to the ids in the given
--- set. It returns the number of models that were deleted. It does not delete the
--- given set.
+--		3) Optionally, the names of any list fields for the model, as they are
+--			stored in Redis
+-- The script then deletes all the models (and their list fields) corresponding
+-- to the ids in the given set. It returns the number of models that were
+-- deleted. It does not delete the given set.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
 
@@ -23,6 +25,10 @@ if #ids > 0 then
 		-- Delete the main hash for each model
 		local key = collectionName .. ':' .. id
 		count = count + redis.call('DEL', key)
+		-- Delete the list fields for each model
+		for j = 3, #ARGV do
+			redis.call('DEL', key .. ':' .. ARGV[j])
+		end
 		-- Remove the model id from the set of all ids
 		-- NOTE: this is not necessarily the same as the
 		-- setName we were given
@@ -8,6 +8,9 @@
 --		3) The name of the indexed string field
 -- The script then checks if there is a value for the given field name stored in the
 -- model hash, and if there is, removes the model from the index on the given field.
+-- If the index has a custom key function, the member for the model is built from
+-- the key stored in the hash at "<index key>:keys" instead, and the key is removed
+-- from that hash.
 -- NOTE: This script *must* be called before the main hash for the model is updated/deleted.
 
 -- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
@@ -20,7 +23,12 @@ local fieldName = ARGV[3]
 local modelKey = collectionName .. ":" .. modelId
 local oldValue = redis.call("HGET", modelKey, fieldName)
 local indexKey = collectionName .. ":" .. fieldName
-if oldValue ~= false then
+local keysKey = indexKey .. ":keys"
+local oldKey = redis.call("HGET", keysKey, modelId)
+if oldKey ~= false then
+	redis.call("ZREM", indexKey, oldKey .. "\0" .. modelId)
+	redis.call("HDEL", keysKey, modelId)
+elseif oldValue ~= false then
 	-- Remove the model from the field index
 	local oldMember = oldValue .. "\0" .. modelId
 	redis.call("ZREM", indexKey, oldMember)
@@ -0,0 +1,69 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- distinct_values is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The key of a field index (a sorted set, or a set for enum and sparse
+--			indexes)
+--		3) The kind of the index. One of "numeric", "string", "boolean", "enum", or
+--			"sparse"
+--		4) The name of the indexed field, as it is stored in Redis
+--		5) The key of a list of ids, or an empty string for all the models in the
+--			index
+-- The script returns an array of the distinct values of the field for the
+-- models identified by the ids in the list (or all the models in the index),
+-- in no particular order. For numeric and boolean indexes the values are the
+-- scores in the index. For string and enum indexes they are the string values.
+-- Models which are not in the index (e.g. because their value is nil) are
+-- skipped, except for sparse indexes, where a model which is not in the index
+-- has a false value (0) and a model which is has a true value (1). Sparse
+-- indexes always need a list of ids, since the models with a false value are
+-- not in the index. Without a list of ids, enum indexes just read the set of distinct
+-- values, and other indexes read every member of the index. With a list of ids,
+-- the script looks up the value for each id, so it is O(N) where N is the
+-- number of ids.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local indexKey = ARGV[2]
+local kind = ARGV[3]
+local fieldName = ARGV[4]
+local idsKey = ARGV[5]
+local seen = {}
+local values = {}
+local function addValue(value)
+	if value and not seen[value] then
+		seen[value] = true
+		table.insert(values, value)
+	end
+end
+if idsKey == '' then
+	if kind == 'enum' then
+		return redis.call('SMEMBERS', indexKey .. ':enum')
+	end
+	local members = redis.call('ZRANGE', indexKey, 0, -1, 'WITHSCORES')
+	for i = 1, #members, 2 do
+		if kind == 'string' then
+			-- The value is everything before the last NULL character
+			local idStart = string.find(members[i], '%z[^%z]*$')
+			addValue(string.sub(members[i], 1, idStart-1))
+		else
+			addValue(members[i+1])
+		end
+	end
+	return values
+end
+for i, id in ipairs(redis.call('LRANGE', idsKey, 0, -1)) do
+	if kind == 'numeric' or kind == 'boolean' then
+		addValue(redis.call('ZSCORE', indexKey, id))
+	elseif kind == 'sparse' then
+		addValue(tostring(redis.call('SISMEMBER', indexKey, id)))
+	else
+		-- String and enum indexes use the value stored in the main hash
+		addValue(redis.call('HGET', collectionName .. ':' .. id, fieldName))
+	end
+end
+return values
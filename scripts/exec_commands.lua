@@ -0,0 +1,28 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- exec_commands is a lua script that takes the following arguments:
+-- 	1) Any number of commands, each of which consists of:
+-- 		a) The number of arguments for the command, including its name
+-- 		b) The name of the command
+-- 		c) The arguments for the command
+-- The script runs all of the commands in order and returns the number of
+-- commands that were run.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Iterate over the commands
+local i = 1
+local count = 0
+while i <= #ARGV do
+	local numArgs = tonumber(ARGV[i])
+	local command = {}
+	for j = 1, numArgs do
+		command[j] = ARGV[i + j]
+	end
+	redis.call(unpack(command))
+	count = count + 1
+	i = i + numArgs + 1
+end
+return count
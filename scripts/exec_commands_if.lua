@@ -0,0 +1,163 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- exec_commands_if is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+-- 	2) The id of the model
+-- 	3) The name of the field to compare, as it is stored in Redis
+-- 	4) The kind of comparison, either "numeric" or "string"
+-- 	5) The comparison operator, one of "=", "!=", ">", "<", ">=", or "<="
+-- 	6) The value to compare the stored value to
+-- 	7) The number of string indexes which should be removed before running the
+-- 		commands, followed by the names of the indexed string fields
+-- 	8) The number of enum indexes which should be removed before running the
+-- 		commands, followed by the names of the fields with enum indexes
+-- 	9) The key of the list which stores the history for the model, or an empty
+-- 		string if the collection does not keep history
+-- 	10) The maximum number of entries to keep in the history
+-- 	11) Any number of commands, each of which consists of:
+-- 		a) The number of arguments for the command, including its name
+-- 		b) The name of the command
+-- 		c) The arguments for the command
+-- The script reads the stored value for the given field from the model hash and
+-- checks if "<stored value> <operator> <value>" holds. Numeric comparisons
+-- compare the values as numbers and string comparisons compare them byte by
+-- byte. If the model does not exist or does not have a stored value for the
+-- field, the condition is considered to hold. If the condition does not hold,
+-- the script returns 0 without running any of the commands. Otherwise it
+-- removes the model from the given string and enum indexes (using the old values
+-- stored in the model hash), saves a snapshot of the model hash in the history
+-- (the same way as the save_history script), runs all of the commands in
+-- order, and returns 1.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local modelId = ARGV[2]
+local fieldName = ARGV[3]
+local kind = ARGV[4]
+local op = ARGV[5]
+local value = ARGV[6]
+local numStringIndexes = tonumber(ARGV[7])
+local modelKey = collectionName .. ":" .. modelId
+
+-- compare returns -1, 0, or 1 if a is less than, equal to, or greater than b
+-- respectively. Strings are compared byte by byte so that the result does not
+-- depend on the locale.
+local function compare(a, b)
+	if kind == "numeric" then
+		a = tonumber(a)
+		b = tonumber(b)
+		if a < b then
+			return -1
+		elseif a > b then
+			return 1
+		end
+		return 0
+	end
+	local minLen = math.min(#a, #b)
+	for i = 1, minLen do
+		local x = string.byte(a, i)
+		local y = string.byte(b, i)
+		if x < y then
+			return -1
+		elseif x > y then
+			return 1
+		end
+	end
+	if #a < #b then
+		return -1
+	elseif #a > #b then
+		return 1
+	end
+	return 0
+end
+
+local oldValue = redis.call("HGET", modelKey, fieldName)
+if oldValue ~= false and (kind ~= "numeric" or tonumber(oldValue) ~= nil) then
+	local result = compare(oldValue, value)
+	local holds = false
+	if op == "=" then
+		holds = result == 0
+	elseif op == "!=" then
+		holds = result ~= 0
+	elseif op == ">" then
+		holds = result > 0
+	elseif op == "<" then
+		holds = result < 0
+	elseif op == ">=" then
+		holds = result >= 0
+	elseif op == "<=" then
+		holds = result <= 0
+	end
+	if not holds then
+		return 0
+	end
+end
+
+-- Remove the model from the string indexes. This must happen before the model
+-- hash is updated by the commands.
+for i = 1, numStringIndexes do
+	local indexedField = ARGV[7 + i]
+	local indexKey = collectionName .. ":" .. indexedField
+	local keysKey = indexKey .. ":keys"
+	local oldKey = redis.call("HGET", keysKey, modelId)
+	local oldIndexedValue = redis.call("HGET", modelKey, indexedField)
+	if oldKey ~= false then
+		-- The index has a custom key function, the same way as the
+		-- delete_string_index script.
+		redis.call("ZREM", indexKey, oldKey .. "\0" .. modelId)
+		redis.call("HDEL", keysKey, modelId)
+	elseif oldIndexedValue ~= false then
+		redis.call("ZREM", indexKey, oldIndexedValue .. "\0" .. modelId)
+	end
+end
+
+-- Remove the model from the enum indexes, the same way as the
+-- delete_enum_index script.
+local enumStart = 8 + numStringIndexes
+local numEnumIndexes = tonumber(ARGV[enumStart])
+for i = 1, numEnumIndexes do
+	local indexedField = ARGV[enumStart + i]
+	local indexKey = collectionName .. ":" .. indexedField
+	local oldIndexedValue = redis.call("HGET", modelKey, indexedField)
+	if oldIndexedValue ~= false then
+		local bucketKey = indexKey .. ":enum:" .. oldIndexedValue
+		redis.call("SREM", bucketKey, modelId)
+		if redis.call("SCARD", bucketKey) == 0 then
+			redis.call("SREM", indexKey .. ":enum", oldIndexedValue)
+		end
+	end
+	redis.call("SREM", indexKey, modelId)
+end
+
+-- Save a snapshot of the model hash in the history, the same way as the
+-- save_history script.
+local historyStart = enumStart + numEnumIndexes + 1
+local historyKey = ARGV[historyStart]
+if historyKey ~= "" then
+	local fields = redis.call("HGETALL", modelKey)
+	if #fields > 0 then
+		local parts = {}
+		for j, field in ipairs(fields) do
+			parts[j] = #field .. ":" .. field .. ","
+		end
+		redis.call("LPUSH", historyKey, table.concat(parts))
+		redis.call("LTRIM", historyKey, 0, tonumber(ARGV[historyStart + 1]) - 1)
+	end
+end
+
+-- Iterate over the commands
+local i = historyStart + 2
+while i <= #ARGV do
+	local numArgs = tonumber(ARGV[i])
+	local command = {}
+	for j = 1, numArgs do
+		command[j] = ARGV[i + j]
+	end
+	redis.call(unpack(command))
+	i = i + numArgs + 1
+end
+return 1
@@ -0,0 +1,33 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- exec_commands_if_not_exists is a lua script that takes the following
+-- arguments:
+-- 	1) key: The key which must not exist
+-- 	2) Any number of commands, each of which consists of:
+-- 		a) The number of arguments for the command, including its name
+-- 		b) The name of the command
+-- 		c) The arguments for the command
+-- The script checks if key exists. If it does, it returns 0 without running any
+-- of the commands. Otherwise it runs all of the commands in order and returns 1.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local key = ARGV[1]
+if redis.call('EXISTS', key) == 1 then
+	return 0
+end
+-- Iterate over the commands
+local i = 2
+while i <= #ARGV do
+	local numArgs = tonumber(ARGV[i])
+	local command = {}
+	for j = 1, numArgs do
+		command[j] = ARGV[i + j]
+	end
+	redis.call(unpack(command))
+	i = i + numArgs + 1
+end
+return 1
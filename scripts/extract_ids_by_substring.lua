@@ -0,0 +1,62 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- extract_ids_by_substring is a lua script that takes the following arguments:
+-- 	1) The key of a set or sorted set of model ids
+--		2) The key of a sorted set where the matching ids will be stored
+--		3) The name of a registered model
+--		4) The redis name of a string field
+--		5) The substring to search for
+--		6) The maximum number of matching ids to store (0 means unlimited)
+--		7) "1" if the ids should be scanned in reverse order, otherwise "0"
+-- The script reads the given field from the main hash of each model in the
+-- given set and stores the ids of the models where the field contains the
+-- substring in the destination sorted set. If the given set is a sorted set,
+-- the original scores are preserved, so the order of the ids is preserved as
+-- well. Otherwise each id is given a score of 0. The script stops as soon as
+-- the maximum number of matching ids has been stored. Since the script has to
+-- read the main hash of every model in the given set, it is O(N) where N is the
+-- number of ids in the set.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local setKey = ARGV[1]
+local destKey = ARGV[2]
+local collectionName = ARGV[3]
+local fieldName = ARGV[4]
+local substring = ARGV[5]
+local maxMatches = tonumber(ARGV[6])
+local reverse = ARGV[7] == '1'
+-- Get all the ids (and scores if applicable) from the set
+local ids = {}
+local scores = {}
+local setType = redis.call('TYPE', setKey)['ok']
+if setType == 'zset' then
+	local members
+	if reverse then
+		members = redis.call('ZREVRANGE', setKey, 0, -1, 'WITHSCORES')
+	else
+		members = redis.call('ZRANGE', setKey, 0, -1, 'WITHSCORES')
+	end
+	for i = 1, #members, 2 do
+		table.insert(ids, members[i])
+		table.insert(scores, members[i+1])
+	end
+elseif setType == 'set' then
+	ids = redis.call('SMEMBERS', setKey)
+end
+local count = 0
+for i, id in ipairs(ids) do
+	local value = redis.call('HGET', collectionName .. ':' .. id, fieldName)
+	-- Use plain matching so the substring is not treated as a pattern
+	if value and string.find(value, substring, 1, true) then
+		redis.call('ZADD', destKey, scores[i] or 0, id)
+		count = count + 1
+		if maxMatches > 0 and count >= maxMatches then
+			break
+		end
+	end
+end
+return count
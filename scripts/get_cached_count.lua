@@ -0,0 +1,30 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- get_cached_count is a lua script that takes the following arguments:
+-- 	1) writeCountKey: The key of the write counter for a collection
+-- 	2) cachePrefix: The prefix for all cached count (or cached result) keys for
+-- 		the collection
+-- 	3) querySum: A checksum which uniquely identifies the query
+-- The script reads the current value of the write counter and uses it to build
+-- the key for the cached count, which has the form:
+-- <cachePrefix>:<writeCount>:<querySum>. It returns a two-element array. The
+-- first element is the key for the cached count and the second element is the
+-- cached count itself, or nil if there is no cached count. The same script is
+-- used to read cached query results, which are stored as a single string.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local writeCountKey = ARGV[1]
+local cachePrefix = ARGV[2]
+local querySum = ARGV[3]
+-- Get the current write count. If the collection was never written to, the
+-- write count is 0.
+local writeCount = redis.call('GET', writeCountKey)
+if writeCount == false then
+	writeCount = '0'
+end
+local cacheKey = cachePrefix .. ':' .. writeCount .. ':' .. querySum
+return {cacheKey, redis.call('GET', cacheKey)}
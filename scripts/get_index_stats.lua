@@ -0,0 +1,94 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- get_index_stats is a lua script that takes the following arguments:
+-- 	1) The key of a field index (a sorted set, or a set for enum and sparse
+--			indexes)
+--		2) The kind of the index. One of "numeric", "string", "boolean", "enum", or
+--			"sparse"
+--		3) The maximum number of buckets to return
+-- The script then reads every member of the index and returns an array
+-- with the following elements:
+-- 	1) The number of members in the index
+--		2) The number of distinct values in the index
+--		3) The lowest score in the index (or an empty string if the index is empty)
+--		4) The highest score in the index (or an empty string if the index is empty)
+-- For string, boolean, enum, and sparse indexes, the remaining elements are pairs of values and
+-- the number of members with that value, sorted by the number of members in
+-- descending order. For string indexes the value is the string value and for
+-- boolean indexes the value is the score. Enum indexes keep a set for each value,
+-- so the script reads the size of each set instead. Sparse indexes only contain
+-- the ids with a true value, so they have a single bucket with the value 1 (the
+-- same as the score for true in a boolean index). No more than the given maximum number of
+-- pairs will be returned. Since the script reads every member of the index, it is
+-- O(N) where N is the number of members in the index.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local indexKey = ARGV[1]
+local kind = ARGV[2]
+local maxBuckets = tonumber(ARGV[3])
+local members = {}
+local count = 0
+local minScore = ''
+local maxScore = ''
+local counts = {}
+local distinct = 0
+if kind == 'enum' then
+	count = redis.call('SCARD', indexKey)
+	local values = redis.call('SMEMBERS', indexKey .. ':enum')
+	for i, value in ipairs(values) do
+		counts[value] = redis.call('SCARD', indexKey .. ':enum:' .. value)
+		distinct = distinct + 1
+	end
+elseif kind == 'sparse' then
+	count = redis.call('SCARD', indexKey)
+	if count > 0 then
+		counts['1'] = count
+		distinct = 1
+	end
+else
+	members = redis.call('ZRANGE', indexKey, 0, -1, 'WITHSCORES')
+	count = #members / 2
+	if count > 0 then
+		minScore = members[2]
+		maxScore = members[#members]
+	end
+end
+-- Count the number of members for each distinct value
+for i = 1, #members, 2 do
+	local value
+	if kind == 'string' then
+		-- The value is everything before the last NULL character
+		local idStart = string.find(members[i], '%z[^%z]*$')
+		value = string.sub(members[i], 1, idStart-1)
+	else
+		value = members[i+1]
+	end
+	if counts[value] == nil then
+		counts[value] = 0
+		distinct = distinct + 1
+	end
+	counts[value] = counts[value] + 1
+end
+local result = {count, distinct, minScore, maxScore}
+if kind ~= 'numeric' then
+	-- Sort the buckets by size (largest first) and then by value
+	local buckets = {}
+	for value, n in pairs(counts) do
+		table.insert(buckets, {value, n})
+	end
+	table.sort(buckets, function(a, b)
+		if a[2] == b[2] then
+			return a[1] < b[1]
+		end
+		return a[2] > b[2]
+	end)
+	for i = 1, math.min(#buckets, maxBuckets) do
+		table.insert(result, buckets[i][1])
+		table.insert(result, buckets[i][2])
+	end
+end
+return result
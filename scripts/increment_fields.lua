@@ -0,0 +1,55 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- increment_fields is a lua script that takes the following arguments:
+-- 	1) key: The key of the main hash for the model
+-- 	2) modelId: The id of the model
+-- 	3) numFields: The number of fields to increment
+-- 	4) numFields fields, each of which consists of:
+-- 		a) The name of the field as it is stored in Redis
+-- 		b) The amount to increment the field by
+-- 		c) The key of the numeric index for the field, or an empty string if
+-- 			the field is not indexed
+-- 	5) Any number of commands, each of which consists of:
+-- 		a) The number of arguments for the command, including its name
+-- 		b) The name of the command
+-- 		c) The arguments for the command
+-- The script checks if key exists. If it does not, it returns nil without
+-- changing anything. Otherwise it increments each field with HINCRBY, updates
+-- the score for the model in the numeric index for the field (if any) to the
+-- new value, and runs all of the commands in order. It returns an array of the
+-- new values in the same order as the fields.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local key = ARGV[1]
+local modelId = ARGV[2]
+local numFields = tonumber(ARGV[3])
+if redis.call('EXISTS', key) == 0 then
+	return false
+end
+-- Iterate over the fields
+local results = {}
+local i = 4
+for n = 1, numFields do
+	local value = redis.call('HINCRBY', key, ARGV[i], ARGV[i + 1])
+	local indexKey = ARGV[i + 2]
+	if indexKey ~= '' then
+		redis.call('ZADD', indexKey, value, modelId)
+	end
+	table.insert(results, value)
+	i = i + 3
+end
+-- Iterate over the commands
+while i <= #ARGV do
+	local numArgs = tonumber(ARGV[i])
+	local command = {}
+	for j = 1, numArgs do
+		command[j] = ARGV[i + j]
+	end
+	redis.call(unpack(command))
+	i = i + numArgs + 1
+end
+return results
@@ -0,0 +1,109 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- intersect_filters is a lua script that takes the following arguments:
+-- 	1) The key of the set or sorted set of ids to start with
+-- 	2) The key of the sorted set where the result should be stored
+-- 	3) Any number of filters, each of which consists of:
+-- 		a) The kind of filter, one of "score", "lex", "union", "diff", or "id"
+-- 		b) Whether the filter is negated, either "0" or "1"
+-- 		c) The key of the index for the field
+-- 		d) The number of arguments for the filter, n
+-- 		e) n arguments, which depend on the kind of filter:
+-- 			"score": pairs of min and max for ZRANGEBYSCORE on a numeric or
+-- 				boolean index
+-- 			"lex": pairs of min and max for ZRANGEBYLEX on a string index, where
+-- 				each member has the format <value>\0<id>
+-- 			"union": the keys of the enum buckets whose union matches, or the key
+-- 				of a sparse boolean index
+-- 			"diff": the key of an enum bucket which is subtracted from the index
+-- 			"id": pairs of min and max for ZREMRANGEBYLEX, which are removed
+-- 				from the ids in the index (i.e. the set of all ids)
+-- For each filter, the script builds the set of ids which match the filter and
+-- then intersects it with the ids from the previous step (or subtracts it if
+-- the filter is negated), keeping the scores from the starting key so that the
+-- ids can still be ordered. The result of the last step is stored in the
+-- destination key. The set for each filter is stored in a temporary key, which
+-- is deleted before the script returns. This lets a query apply all of its
+-- filters with a single command instead of several commands and temporary keys
+-- per filter.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local origKey = ARGV[1]
+local destKey = ARGV[2]
+local filterKey = destKey .. ':filter'
+
+-- zaddAll adds members to the sorted set at key. The scores only need to be
+-- distinct (which makes inserting faster than using equal scores), since they
+-- are ignored when the set is intersected. The members are added in batches to
+-- limit the number of arguments for each ZADD.
+local function zaddAll(key, members)
+	local args = {}
+	for i, member in ipairs(members) do
+		table.insert(args, i)
+		table.insert(args, member)
+		if #args >= 1000 then
+			redis.call('ZADD', key, unpack(args))
+			args = {}
+		end
+	end
+	if #args > 0 then
+		redis.call('ZADD', key, unpack(args))
+	end
+end
+
+local srcKey = origKey
+local i = 3
+while i <= #ARGV do
+	local kind = ARGV[i]
+	local negate = ARGV[i + 1] == '1'
+	local indexKey = ARGV[i + 2]
+	local n = tonumber(ARGV[i + 3])
+	local first = i + 4
+	local last = first + n - 1
+	i = last + 1
+	-- stepKey is the key of the set of ids which match the filter. A filterKey
+	-- which was never created acts as an empty set.
+	local stepKey = filterKey
+	redis.call('DEL', filterKey)
+	if kind == 'score' then
+		for j = first, last, 2 do
+			zaddAll(filterKey, redis.call('ZRANGEBYSCORE', indexKey, ARGV[j], ARGV[j + 1]))
+		end
+	elseif kind == 'lex' then
+		for j = first, last, 2 do
+			local members = redis.call('ZRANGEBYLEX', indexKey, ARGV[j], ARGV[j + 1])
+			local ids = {}
+			for k, member in ipairs(members) do
+				-- The id is everything after the last null character
+				local idStart = string.find(member, '%z[^%z]*$')
+				table.insert(ids, string.sub(member, idStart + 1))
+			end
+			zaddAll(filterKey, ids)
+		end
+	elseif kind == 'union' then
+		if n == 1 then
+			-- Use the bucket directly instead of copying it
+			stepKey = ARGV[first]
+		elseif n > 1 then
+			redis.call('ZUNIONSTORE', filterKey, n, unpack(ARGV, first, last))
+		end
+	elseif kind == 'diff' then
+		redis.call('ZDIFFSTORE', filterKey, 2, indexKey, ARGV[first])
+	elseif kind == 'id' then
+		redis.call('ZUNIONSTORE', filterKey, 1, indexKey, 'WEIGHTS', 0)
+		for j = first, last, 2 do
+			redis.call('ZREMRANGEBYLEX', filterKey, ARGV[j], ARGV[j + 1])
+		end
+	end
+	if negate then
+		redis.call('ZDIFFSTORE', destKey, 2, srcKey, stepKey)
+	else
+		redis.call('ZINTERSTORE', destKey, 2, srcKey, stepKey, 'WEIGHTS', 1, 0)
+	end
+	srcKey = destKey
+end
+redis.call('DEL', filterKey)
@@ -32,6 +32,8 @@ var (
 type script struct {
 	// VarName is the variable name that the script will be assigned to in the generated go code.
 	VarName string
+	// Name is the name of the original .lua file without the extension.
+	Name string
 	// Src is the contents of the original .lua file.
 	Src string
 }
@@ -70,8 +72,10 @@ func findScripts(path string) ([]script, error) {
 	}
 	scripts := []script{}
 	for _, filename := range filenames {
+		name := strings.TrimSuffix(filepath.Base(filename), ".lua")
 		script := script{
-			VarName: convertUnderscoresToCamelCase(strings.TrimSuffix(filepath.Base(filename), ".lua")) + "Script",
+			VarName: convertUnderscoresToCamelCase(name) + "Script",
+			Name:    name,
 		}
 		src, err := ioutil.ReadFile(filename)
 		if err != nil {
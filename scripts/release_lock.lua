@@ -0,0 +1,21 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- release_lock is a lua script that takes the following arguments:
+-- 	1) The key of the lock
+-- 	2) The token which was stored in the key when the lock was acquired
+-- The script deletes the lock only if it still holds the given token, so a
+-- client never releases a lock which expired and was then acquired by another
+-- client. It returns 1 if the lock was deleted and 0 otherwise.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local lockKey = ARGV[1]
+local token = ARGV[2]
+
+if redis.call('GET', lockKey) == token then
+	return redis.call('DEL', lockKey)
+end
+return 0
@@ -0,0 +1,31 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- rename_field is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The old name of the field, as it is stored in Redis
+--		3) The new name of the field, as it is stored in Redis
+--		4) Any number of model ids
+-- The script then moves the value stored under the old name to the new name in
+-- the main hash for each of the given models. Models which do not have a value
+-- for the old name are skipped. It returns the number of models that had a value
+-- for the old name.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local oldName = ARGV[2]
+local newName = ARGV[3]
+local count = 0
+for i = 4, #ARGV do
+	local modelKey = collectionName .. ":" .. ARGV[i]
+	local value = redis.call("HGET", modelKey, oldName)
+	if value ~= false then
+		redis.call("HSET", modelKey, newName, value)
+		redis.call("HDEL", modelKey, oldName)
+		count = count + 1
+	end
+end
+return count
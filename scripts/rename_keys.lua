@@ -0,0 +1,35 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- rename_keys is a lua script that takes the following arguments:
+-- 	1) The prefix of the keys to rename, i.e. the old collection name and a colon
+--		2) The prefix to replace it with, i.e. the new collection name and a colon
+--		3) Any number of keys which start with the old prefix
+-- The script renames each of the given keys which still exists, by replacing the
+-- old prefix with the new one. Keys which no longer exist (e.g. because they
+-- expired after they were found with SCAN) and keys which do not start with the
+-- old prefix are skipped. If any of the new keys already exists, the script
+-- renames nothing and returns -1, so existing data is never overwritten.
+-- Otherwise it returns the number of keys that were renamed.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local oldPrefix = ARGV[1]
+local newPrefix = ARGV[2]
+local renames = {}
+for i = 3, #ARGV do
+	local key = ARGV[i]
+	if string.sub(key, 1, #oldPrefix) == oldPrefix and redis.call('EXISTS', key) == 1 then
+		local newKey = newPrefix .. string.sub(key, #oldPrefix + 1)
+		if redis.call('EXISTS', newKey) == 1 then
+			return -1
+		end
+		table.insert(renames, {key, newKey})
+	end
+end
+for i, rename in ipairs(renames) do
+	redis.call('RENAMENX', rename[1], rename[2])
+end
+return #renames
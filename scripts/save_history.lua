@@ -0,0 +1,33 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- save_history is a lua script that takes the following arguments:
+-- 	1) The key of the main hash for a model
+-- 	2) The key of the list which stores the history for the model
+-- 	3) The maximum number of entries to keep in the history
+-- If the main hash exists, the script pushes a snapshot of it onto the front of
+-- the history list and then trims the list to the maximum number of entries.
+-- The snapshot is every field and value of the hash, in the order returned by
+-- HGETALL, with each one encoded as "<length>:<bytes>," so that binary values
+-- are preserved. It returns the new length of the list, or 0 if the hash did
+-- not exist.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local modelKey = ARGV[1]
+local historyKey = ARGV[2]
+local keep = tonumber(ARGV[3])
+
+local fields = redis.call('HGETALL', modelKey)
+if #fields == 0 then
+	return 0
+end
+local parts = {}
+for i, value in ipairs(fields) do
+	parts[i] = #value .. ':' .. value .. ','
+end
+redis.call('LPUSH', historyKey, table.concat(parts))
+redis.call('LTRIM', historyKey, 0, keep - 1)
+return redis.call('LLEN', historyKey)
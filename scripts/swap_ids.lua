@@ -0,0 +1,173 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- swap_ids is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The id of the first model
+--		3) The id of the second model
+--		4) The number of field indexes, n
+--		5) n field indexes, each of which consists of:
+--			a) The kind of the index. One of "numeric", "string", "boolean", "enum",
+--				or "sparse"
+--			b) The name of the indexed field, as it is stored in Redis
+--		6) The number of list fields, l
+--		7) l names of list fields, as they are stored in Redis
+--		8) Any number of commands, each of which consists of:
+--			a) The number of arguments for the command, including its name
+--			b) The name of the command
+--			c) The arguments for the command
+-- The script checks that the main hashes for both models exist. If either does
+-- not, it returns nil without changing anything. If the ids are the same, it
+-- returns 0 without changing anything. Otherwise it swaps the main hashes and
+-- list fields of the two models with RENAME, updates each field index so that
+-- each id is indexed by the value of the model it now refers to, runs all of
+-- the commands in order, and returns 1.
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local idA = ARGV[2]
+local idB = ARGV[3]
+local keyA = collectionName .. ':' .. idA
+local keyB = collectionName .. ':' .. idB
+if redis.call('EXISTS', keyA) == 0 or redis.call('EXISTS', keyB) == 0 then
+	return false
+end
+if idA == idB then
+	return 0
+end
+
+-- swapKeys swaps the values of two keys, either of which may not exist
+local function swapKeys(a, b)
+	local aExists = redis.call('EXISTS', a) == 1
+	local bExists = redis.call('EXISTS', b) == 1
+	if aExists and bExists then
+		local tmpKey = 'tmp:swap:' .. a
+		redis.call('RENAME', a, tmpKey)
+		redis.call('RENAME', b, a)
+		redis.call('RENAME', tmpKey, b)
+	elseif aExists then
+		redis.call('RENAME', a, b)
+	elseif bExists then
+		redis.call('RENAME', b, a)
+	end
+end
+
+-- Update the indexes. This must happen before the main hashes are swapped,
+-- since string and enum indexes rely on the values stored in the hashes.
+local i = 4
+local numIndexes = tonumber(ARGV[i])
+for n = 1, numIndexes do
+	local kind = ARGV[i + 1]
+	local fieldName = ARGV[i + 2]
+	local indexKey = collectionName .. ':' .. fieldName
+	if kind == 'numeric' or kind == 'boolean' then
+		local scoreA = redis.call('ZSCORE', indexKey, idA)
+		local scoreB = redis.call('ZSCORE', indexKey, idB)
+		redis.call('ZREM', indexKey, idA, idB)
+		if scoreB then
+			redis.call('ZADD', indexKey, scoreB, idA)
+		end
+		if scoreA then
+			redis.call('ZADD', indexKey, scoreA, idB)
+		end
+	elseif kind == 'sparse' then
+		local inA = redis.call('SISMEMBER', indexKey, idA) == 1
+		local inB = redis.call('SISMEMBER', indexKey, idB) == 1
+		redis.call('SREM', indexKey, idA, idB)
+		if inB then
+			redis.call('SADD', indexKey, idA)
+		end
+		if inA then
+			redis.call('SADD', indexKey, idB)
+		end
+	else
+		-- Only values which are actually in the index are moved, so that
+		-- models which are not in a partial index stay out of it.
+		local valueA = redis.call('HGET', keyA, fieldName)
+		local valueB = redis.call('HGET', keyB, fieldName)
+		if kind == 'string' then
+			-- If the index has a custom key function, the members are built
+			-- from the keys stored in "<index key>:keys" instead of the values.
+			local keysKey = indexKey .. ':keys'
+			local keyed = redis.call('EXISTS', keysKey) == 1
+			if keyed then
+				valueA = redis.call('HGET', keysKey, idA)
+				valueB = redis.call('HGET', keysKey, idB)
+			end
+			if valueA and not redis.call('ZSCORE', indexKey, valueA .. '\0' .. idA) then
+				valueA = false
+			end
+			if valueB and not redis.call('ZSCORE', indexKey, valueB .. '\0' .. idB) then
+				valueB = false
+			end
+			if valueA then
+				redis.call('ZREM', indexKey, valueA .. '\0' .. idA)
+			end
+			if valueB then
+				redis.call('ZREM', indexKey, valueB .. '\0' .. idB)
+				redis.call('ZADD', indexKey, 0, valueB .. '\0' .. idA)
+			end
+			if valueA then
+				redis.call('ZADD', indexKey, 0, valueA .. '\0' .. idB)
+			end
+			if keyed then
+				redis.call('HDEL', keysKey, idA, idB)
+				if valueB then
+					redis.call('HSET', keysKey, idA, valueB)
+				end
+				if valueA then
+					redis.call('HSET', keysKey, idB, valueA)
+				end
+			end
+		elseif kind == 'enum' then
+			if valueA and redis.call('SISMEMBER', indexKey, idA) == 0 then
+				valueA = false
+			end
+			if valueB and redis.call('SISMEMBER', indexKey, idB) == 0 then
+				valueB = false
+			end
+			-- Both models keep their values, so the set of distinct values does
+			-- not change.
+			if valueA then
+				redis.call('SREM', indexKey .. ':enum:' .. valueA, idA)
+			end
+			if valueB then
+				redis.call('SREM', indexKey .. ':enum:' .. valueB, idB)
+			end
+			redis.call('SREM', indexKey, idA, idB)
+			if valueB then
+				redis.call('SADD', indexKey .. ':enum:' .. valueB, idA)
+				redis.call('SADD', indexKey, idA)
+			end
+			if valueA then
+				redis.call('SADD', indexKey .. ':enum:' .. valueA, idB)
+				redis.call('SADD', indexKey, idB)
+			end
+		end
+	end
+	i = i + 2
+end
+
+-- Swap the main hashes and list fields
+swapKeys(keyA, keyB)
+i = i + 1
+local numLists = tonumber(ARGV[i])
+for n = 1, numLists do
+	swapKeys(keyA .. ':' .. ARGV[i + n], keyB .. ':' .. ARGV[i + n])
+end
+i = i + numLists + 1
+
+-- Iterate over the commands
+while i <= #ARGV do
+	local numArgs = tonumber(ARGV[i])
+	local command = {}
+	for j = 1, numArgs do
+		command[j] = ARGV[i + j]
+	end
+	redis.call(unpack(command))
+	i = i + numArgs + 1
+end
+return 1
@@ -0,0 +1,133 @@
+-- Copyright 2015 Alex Browne.  All rights reserved.
+-- Use of this source code is governed by the MIT
+-- license, which can be found in the LICENSE file.
+
+-- verify_index is a lua script that takes the following arguments:
+-- 	1) The name of a registered model
+--		2) The key of a field index (a sorted set, or a set for enum and sparse
+--			indexes)
+--		3) The kind of the index. One of "numeric", "string", "boolean", "enum", or
+--			"sparse"
+--		4) The name of the indexed field, as it is stored in Redis
+--		5) For partial indexes, the name of the field in the condition, as it is
+--			stored in Redis. An empty string if the index is not partial
+--		6) For partial indexes, the operator in the condition ("=" or "!=")
+--		7) For partial indexes, the value in the condition, encoded the same way
+--			it is stored in the main hash
+-- The script reads every member of the index and compares it to the set of all
+-- ids for the model. It does not modify anything. It returns an array with the
+-- following elements:
+-- 	1) An array of orphaned ids, which are in the index but not in the set of
+--			all ids, or which do not match the condition for a partial index
+--		2) An array of missing ids, which are in the set of all ids and have a
+--			value for the field in the main hash (and match the condition for a
+--			partial index), but are not in the index
+--		3) An array of duplicated ids, which are in the index more than once. This
+--			can only happen for string indexes (where each member includes the
+--			value) and enum indexes (where each value has its own set)
+-- For enum indexes, an id which is in the set for a value but not in the set
+-- of all ids in the index (or vice versa) is reported as missing. Sparse
+-- indexes only contain the ids of models with a true value (stored as 1 in the
+-- main hash), so an id in the index without a true value is reported as
+-- orphaned, and only the ids of models with a true value can be missing. Since the
+-- script reads every member of the index and every id in the collection, it is
+-- O(N).
+
+-- IMPORTANT: If you edit this file, you must run go generate . to rewrite ../scripts.go
+
+-- Assign keys to variables for easy access
+local collectionName = ARGV[1]
+local indexKey = ARGV[2]
+local kind = ARGV[3]
+local fieldName = ARGV[4]
+local whereField = ARGV[5]
+local whereOp = ARGV[6]
+local whereValue = ARGV[7]
+local allKey = collectionName .. ':all'
+-- matches returns true if the model with the given id matches the condition
+-- for a partial index. A missing value is never equal to the value in the
+-- condition. For sparse indexes, the condition is that the value is true. It
+-- always returns true if the index is not partial or sparse.
+local function matches(id)
+	if kind == 'sparse' then
+		return redis.call('HGET', collectionName .. ':' .. id, fieldName) == '1'
+	end
+	if whereField == nil or whereField == '' then
+		return true
+	end
+	local equal = redis.call('HGET', collectionName .. ':' .. id, whereField) == whereValue
+	return equal ~= (whereOp == '!=')
+end
+-- Count the number of times each id appears in the index
+local counts = {}
+local ids = {}
+local function addId(id)
+	if counts[id] == nil then
+		counts[id] = 0
+		table.insert(ids, id)
+	end
+	counts[id] = counts[id] + 1
+end
+-- inIndex is the set of ids which are properly in the index. For enum indexes,
+-- an id has to be both in the main set for the index and in the set for one of
+-- the values.
+local inIndex = {}
+if kind == 'enum' then
+	local inMainSet = {}
+	for i, id in ipairs(redis.call('SMEMBERS', indexKey)) do
+		inMainSet[id] = true
+	end
+	local values = redis.call('SMEMBERS', indexKey .. ':enum')
+	for i, value in ipairs(values) do
+		for j, id in ipairs(redis.call('SMEMBERS', indexKey .. ':enum:' .. value)) do
+			addId(id)
+			if inMainSet[id] then
+				inIndex[id] = true
+			end
+		end
+	end
+	-- Ids which are in the main set but not in the set for any value can
+	-- still be orphans.
+	for id, _ in pairs(inMainSet) do
+		if counts[id] == nil then
+			counts[id] = 0
+			table.insert(ids, id)
+		end
+	end
+elseif kind == 'sparse' then
+	for i, id in ipairs(redis.call('SMEMBERS', indexKey)) do
+		addId(id)
+		inIndex[id] = true
+	end
+else
+	local members = redis.call('ZRANGE', indexKey, 0, -1)
+	for i, member in ipairs(members) do
+		local id = member
+		if kind == 'string' then
+			-- The id is everything after the last NULL character
+			local idStart = string.find(member, '%z[^%z]*$')
+			id = string.sub(member, idStart+1)
+		end
+		addId(id)
+		inIndex[id] = true
+	end
+end
+local orphaned = {}
+local duplicated = {}
+for i, id in ipairs(ids) do
+	if redis.call('SISMEMBER', allKey, id) == 0 or not matches(id) then
+		table.insert(orphaned, id)
+	end
+	if counts[id] > 1 then
+		table.insert(duplicated, id)
+	end
+end
+local missing = {}
+for i, id in ipairs(redis.call('SMEMBERS', allKey)) do
+	if inIndex[id] ~= true then
+		if redis.call('HEXISTS', collectionName .. ':' .. id, fieldName) == 1 and matches(id) then
+			table.insert(missing, id)
+		end
+	end
+end
+return {orphaned, missing, duplicated}
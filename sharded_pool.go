@@ -0,0 +1,620 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File sharded_pool.go contains code for manually sharding collections across
+// several independent pools.
+
+package zoom
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"strings"
+)
+
+// ShardFunc returns the index of the shard that a model with the given id
+// belongs to. The index must be between 0 and numShards - 1. A ShardFunc must
+// always return the same index for the same id and number of shards.
+type ShardFunc func(id string, numShards int) int
+
+// JumpHashShardFunc is a ShardFunc which hashes the id with FNV-1a and then
+// uses jump consistent hashing (see https://arxiv.org/abs/1406.2294) to pick a
+// shard. Jump consistent hashing spreads ids evenly across the shards, and when
+// a shard is added only about 1/numShards of the ids move to a different
+// shard. Note that Zoom does not move any existing models for you, so adding a
+// shard still requires a migration. It is the default ShardFunc for
+// NewShardedPool.
+func JumpHashShardFunc(id string, numShards int) int {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	key := h.Sum64()
+	b, j := int64(-1), int64(0)
+	for j < int64(numShards) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// ShardedPool routes the operations for each model to one of several
+// independent pools (the shards) based on the id of the model. It can be used
+// to spread a large collection across several Redis databases or servers.
+// Each shard has its own copy of every collection and stores the models which
+// hash to it, so the shards do not need to know about each other. Use the
+// NewShardedPool function to create a new ShardedPool.
+type ShardedPool struct {
+	pools     []*Pool
+	shardFunc ShardFunc
+}
+
+// NewShardedPool creates and returns a new ShardedPool which uses the given
+// pools as its shards. shardFunc is used to determine which shard a model id
+// belongs to. If shardFunc is nil, JumpHashShardFunc is used. The order of
+// pools matters: changing the order (or the number of pools) will cause some
+// ids to be routed to a different shard. NewShardedPool returns an error if
+// pools is empty or contains a nil pool.
+func NewShardedPool(pools []*Pool, shardFunc ShardFunc) (*ShardedPool, error) {
+	if len(pools) == 0 {
+		return nil, fmt.Errorf("zoom: Error in NewShardedPool: at least one pool is required")
+	}
+	for i, pool := range pools {
+		if pool == nil {
+			return nil, fmt.Errorf("zoom: Error in NewShardedPool: pool %d is nil", i)
+		}
+	}
+	if shardFunc == nil {
+		shardFunc = JumpHashShardFunc
+	}
+	return &ShardedPool{
+		pools:     append([]*Pool{}, pools...),
+		shardFunc: shardFunc,
+	}, nil
+}
+
+// Pools returns the pools which are used as shards, in order.
+func (sp *ShardedPool) Pools() []*Pool {
+	return append([]*Pool{}, sp.pools...)
+}
+
+// Shard returns the pool for the shard that a model with the given id belongs
+// to. It returns an error if the ShardFunc returned an invalid index.
+func (sp *ShardedPool) Shard(id string) (*Pool, error) {
+	i, err := sp.shardIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	return sp.pools[i], nil
+}
+
+// shardIndex returns the index of the shard that a model with the given id
+// belongs to and checks that the index is valid.
+func (sp *ShardedPool) shardIndex(id string) (int, error) {
+	i := sp.shardFunc(id, len(sp.pools))
+	if i < 0 || i >= len(sp.pools) {
+		return 0, fmt.Errorf("zoom: ShardFunc returned invalid shard %d for id %s (number of shards is %d)", i, id, len(sp.pools))
+	}
+	return i, nil
+}
+
+// NewCollection registers the type of model with every shard and returns a
+// ShardedCollection which routes operations to the appropriate shard. It uses
+// DefaultCollectionOptions. See Pool.NewCollection for more information.
+func (sp *ShardedPool) NewCollection(model Model) (*ShardedCollection, error) {
+	return sp.NewCollectionWithOptions(model, DefaultCollectionOptions)
+}
+
+// NewCollectionWithOptions is like NewCollection but uses the given options for
+// the collection on every shard. See Pool.NewCollectionWithOptions for more
+// information. The Pool option is not supported, since it would cause every
+// shard to use the same connections.
+func (sp *ShardedPool) NewCollectionWithOptions(model Model, options CollectionOptions) (*ShardedCollection, error) {
+	if options.Pool != nil {
+		return nil, fmt.Errorf("zoom: Error in ShardedPool.NewCollectionWithOptions: the Pool option is not supported for sharded collections")
+	}
+	collections := make([]*Collection, len(sp.pools))
+	for i, pool := range sp.pools {
+		collection, err := pool.NewCollectionWithOptions(model, options)
+		if err != nil {
+			return nil, err
+		}
+		collections[i] = collection
+	}
+	return &ShardedCollection{
+		pool:        sp,
+		collections: collections,
+	}, nil
+}
+
+// Close closes every pool in the ShardedPool. It returns the first error that
+// occurred (if any), but still attempts to close all of the pools.
+func (sp *ShardedPool) Close() error {
+	var firstErr error
+	for _, pool := range sp.pools {
+		if err := pool.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ShardedCollection is a collection whose models are spread across the shards
+// of a ShardedPool. Operations on a single model (e.g. Save, Find, and Delete)
+// are routed to the shard determined by the id of the model. Operations on all
+// models (e.g. FindAll, Count, and queries) are run on every shard and the
+// results are merged client-side. Use ShardedPool.NewCollection to create a
+// new ShardedCollection.
+type ShardedCollection struct {
+	pool        *ShardedPool
+	collections []*Collection
+}
+
+// Name returns the name of the collection. The name is the same on every
+// shard.
+func (sc *ShardedCollection) Name() string {
+	return sc.collections[0].Name()
+}
+
+// Collections returns the underlying collection for each shard, in the same
+// order as the pools in the ShardedPool. It can be used for any operation
+// which is not supported by ShardedCollection (e.g. transactions), as long as
+// you make sure to use the right shard for each model.
+func (sc *ShardedCollection) Collections() []*Collection {
+	return append([]*Collection{}, sc.collections...)
+}
+
+// Shard returns the underlying collection for the shard that a model with the
+// given id belongs to.
+func (sc *ShardedCollection) Shard(id string) (*Collection, error) {
+	i, err := sc.pool.shardIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	return sc.collections[i], nil
+}
+
+// Save saves the model to the shard determined by its id. If the model does
+// not have an id yet, it is assigned one first (respecting the IdLength and
+// IdAlphabet options). See Collection.Save for more information.
+func (sc *ShardedCollection) Save(model Model) error {
+	c, err := sc.shardForModel("ShardedCollection.Save", model)
+	if err != nil {
+		return err
+	}
+	return c.Save(model)
+}
+
+// SaveFields saves only the given fields of the model to the shard determined
+// by its id. Like Save, it assigns an id to the model first if needed. See
+// Collection.SaveFields for more information.
+func (sc *ShardedCollection) SaveFields(fieldNames []string, model Model) error {
+	c, err := sc.shardForModel("ShardedCollection.SaveFields", model)
+	if err != nil {
+		return err
+	}
+	return c.SaveFields(fieldNames, model)
+}
+
+// shardForModel assigns an id to model if it does not have one and returns the
+// collection for the shard that the id belongs to. The id has to be assigned
+// before the shard is picked, because ModelId for a model which embeds
+// RandomId would otherwise generate a default id and ignore the id options for
+// the collection.
+func (sc *ShardedCollection) shardForModel(method string, model Model) (*Collection, error) {
+	c := sc.collections[0]
+	if err := c.checkModelType(model); err != nil {
+		return nil, fmt.Errorf("zoom: Error in %s: %s", method, err.Error())
+	}
+	c.assignId(model)
+	return sc.Shard(model.ModelId())
+}
+
+// Find retrieves the model with the given id from the shard determined by the
+// id. See Collection.Find for more information.
+func (sc *ShardedCollection) Find(id string, model Model) error {
+	c, err := sc.Shard(id)
+	if err != nil {
+		return err
+	}
+	return c.Find(id, model)
+}
+
+// FindFields is like Find but finds and sets only the specified fields. See
+// Collection.FindFields for more information.
+func (sc *ShardedCollection) FindFields(id string, fieldNames []string, model Model) error {
+	c, err := sc.Shard(id)
+	if err != nil {
+		return err
+	}
+	return c.FindFields(id, fieldNames, model)
+}
+
+// Delete removes the model with the given id from the shard determined by the
+// id. See Collection.Delete for more information.
+func (sc *ShardedCollection) Delete(id string) (bool, error) {
+	c, err := sc.Shard(id)
+	if err != nil {
+		return false, err
+	}
+	return c.Delete(id)
+}
+
+// FindAll finds all the models on every shard and scans them into models,
+// which must be a pointer to a slice of models. The models from each shard are
+// appended in the same order as the pools in the ShardedPool. See
+// Collection.FindAll for more information.
+func (sc *ShardedCollection) FindAll(models interface{}) error {
+	return sc.fanOut(models, func(i int, shardModels interface{}) error {
+		return sc.collections[i].FindAll(shardModels)
+	})
+}
+
+// Count returns the total number of models on every shard.
+func (sc *ShardedCollection) Count() (int, error) {
+	total := 0
+	for _, c := range sc.collections {
+		count, err := c.Count()
+		if err != nil {
+			return total, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// DeleteAll deletes all the models on every shard. Each shard is deleted in a
+// separate transaction. It returns the total number of models deleted.
+func (sc *ShardedCollection) DeleteAll() (int, error) {
+	total := 0
+	for _, c := range sc.collections {
+		count, err := c.DeleteAll()
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// fanOut calls fn with the index of each shard and a pointer to a new,
+// empty slice of the same type as models, and then sets models to the results
+// from every shard appended together in shard order.
+func (sc *ShardedCollection) fanOut(models interface{}, fn func(i int, shardModels interface{}) error) error {
+	if err := sc.collections[0].checkModelsType(models); err != nil {
+		return fmt.Errorf("zoom: Error in ShardedCollection: %s", err.Error())
+	}
+	modelsVal := reflect.ValueOf(models).Elem()
+	if modelsVal.Kind() != reflect.Slice {
+		return fmt.Errorf("zoom: Error in ShardedCollection: models should be a pointer to a slice of models")
+	}
+	results := reflect.MakeSlice(modelsVal.Type(), 0, 0)
+	for i := range sc.collections {
+		shardModels := reflect.New(modelsVal.Type())
+		if err := fn(i, shardModels.Interface()); err != nil {
+			return err
+		}
+		results = reflect.AppendSlice(results, shardModels.Elem())
+	}
+	modelsVal.Set(results)
+	return nil
+}
+
+// NewQuery returns a new ShardedQuery, which runs the same query on every
+// shard and merges the results.
+func (sc *ShardedCollection) NewQuery() *ShardedQuery {
+	queries := make([]*Query, len(sc.collections))
+	for i, c := range sc.collections {
+		queries[i] = c.NewQuery()
+	}
+	return &ShardedQuery{
+		collection: sc,
+		queries:    queries,
+	}
+}
+
+// ShardedQuery is a query that runs on every shard of a ShardedCollection. The
+// query modifiers are applied to the query for each shard, and the sorted
+// results from the shards are merged client-side, so the combined results are
+// in the same order as they would be for a single Collection: by the field
+// given to Order, or by id if there is no order. Limit and Offset are applied
+// to the merged results. To make that possible, each shard returns up to
+// offset + limit models (or every matching model if there is no limit), so a
+// large offset is expensive.
+type ShardedQuery struct {
+	collection *ShardedCollection
+	queries    []*Query
+	limit      uint
+	offset     uint
+}
+
+// Order specifies a field by which to sort the models. The models from each
+// shard are sorted by Redis and then merged. See Query.Order for more
+// information.
+func (sq *ShardedQuery) Order(fieldName string) *ShardedQuery {
+	for _, q := range sq.queries {
+		q.Order(fieldName)
+	}
+	return sq
+}
+
+// Limit specifies an upper limit on the number of models to return from the
+// merged results. If amount is 0, no limit will be applied. See Query.Limit for
+// more information.
+func (sq *ShardedQuery) Limit(amount uint) *ShardedQuery {
+	sq.limit = amount
+	sq.limitShards()
+	return sq
+}
+
+// Offset specifies a starting index (inclusive) in the merged results. See
+// Query.Offset for more information.
+func (sq *ShardedQuery) Offset(amount uint) *ShardedQuery {
+	sq.offset = amount
+	sq.limitShards()
+	return sq
+}
+
+// limitShards limits the query for each shard to offset + limit models, which
+// is the most that any one shard can contribute to the merged results. The
+// offset itself is only applied after merging. If there is no limit, any
+// limit set by an earlier call to Limit is removed from each shard.
+func (sq *ShardedQuery) limitShards() {
+	shardLimit := uint(0)
+	if sq.limit != 0 {
+		shardLimit = sq.offset + sq.limit
+	}
+	for _, q := range sq.queries {
+		q.Limit(shardLimit)
+	}
+}
+
+// Include specifies one or more field names which will be read from the
+// database and scanned into the resulting models. See Query.Include for more
+// information. If the query has an order, the field for the order must be
+// included, since it is needed to merge the results.
+func (sq *ShardedQuery) Include(fields ...string) *ShardedQuery {
+	for _, q := range sq.queries {
+		q.Include(fields...)
+	}
+	return sq
+}
+
+// Exclude specifies one or more field names which will *not* be read from the
+// database and scanned. See Query.Exclude for more information. The field for
+// the order (if any) cannot be excluded.
+func (sq *ShardedQuery) Exclude(fields ...string) *ShardedQuery {
+	for _, q := range sq.queries {
+		q.Exclude(fields...)
+	}
+	return sq
+}
+
+// Filter applies a filter to the query on each shard. See Query.Filter for
+// more information.
+func (sq *ShardedQuery) Filter(filterString string, value interface{}) *ShardedQuery {
+	for _, q := range sq.queries {
+		q.Filter(filterString, value)
+	}
+	return sq
+}
+
+// Not negates the next filter. See Query.Not for more information.
+func (sq *ShardedQuery) Not() *ShardedQuery {
+	for _, q := range sq.queries {
+		q.Not()
+	}
+	return sq
+}
+
+// Err returns the first error that occurred during the lifetime of the query
+// (if any) on any of the shards.
+func (sq *ShardedQuery) Err() error {
+	for _, q := range sq.queries {
+		if err := q.Err(); err != nil {
+			return err
+		}
+	}
+	if order := sq.queries[0].query.order; order.fieldName != "" {
+		if !stringSliceContains(sq.queries[0].query.fieldNames(), order.fieldName) {
+			return fmt.Errorf("zoom: error in ShardedQuery.Order: the field %s must be included in order to merge the results", order.fieldName)
+		}
+	}
+	return nil
+}
+
+// Run executes the query on every shard and scans the merged results into
+// models, which must be a pointer to a slice of models. See the documentation
+// for ShardedQuery for more information about ordering.
+func (sq *ShardedQuery) Run(models interface{}) error {
+	if err := sq.Err(); err != nil {
+		return err
+	}
+	if err := sq.collection.collections[0].checkModelsType(models); err != nil {
+		return fmt.Errorf("zoom: Error in ShardedQuery.Run: %s", err.Error())
+	}
+	modelsVal := reflect.ValueOf(models).Elem()
+	if modelsVal.Kind() != reflect.Slice {
+		return fmt.Errorf("zoom: Error in ShardedQuery.Run: models should be a pointer to a slice of models")
+	}
+	shardResults := make([]reflect.Value, len(sq.queries))
+	for i, q := range sq.queries {
+		shardModels := reflect.New(modelsVal.Type())
+		if err := q.Run(shardModels.Interface()); err != nil {
+			return err
+		}
+		shardResults[i] = shardModels.Elem()
+	}
+	less, err := sq.modelLess()
+	if err != nil {
+		return err
+	}
+	results := reflect.MakeSlice(modelsVal.Type(), 0, 0)
+	heads := make([]int, len(shardResults))
+	skipped := uint(0)
+	for sq.limit == 0 || uint(results.Len()) < sq.limit {
+		// Pick the first model among the remaining models from each shard.
+		next := -1
+		for i, shardModels := range shardResults {
+			if heads[i] >= shardModels.Len() {
+				continue
+			}
+			if next == -1 || less(shardModels.Index(heads[i]), shardResults[next].Index(heads[next])) {
+				next = i
+			}
+		}
+		if next == -1 {
+			break
+		}
+		if skipped < sq.offset {
+			skipped++
+		} else {
+			results = reflect.Append(results, shardResults[next].Index(heads[next]))
+		}
+		heads[next]++
+	}
+	modelsVal.Set(results)
+	return nil
+}
+
+// modelLess returns a function which reports whether the first model comes
+// before the second one in the order of the query. Ties (and queries without
+// an order) are broken by id, which matches the order that Redis returns for
+// the query on each shard.
+func (sq *ShardedQuery) modelLess() (func(a, b reflect.Value) bool, error) {
+	order := sq.queries[0].query.order
+	descending := order.kind == descendingOrder
+	idLess := func(a, b reflect.Value) bool {
+		aId, bId := a.Interface().(Model).ModelId(), b.Interface().(Model).ModelId()
+		if descending {
+			return aId > bId
+		}
+		return aId < bId
+	}
+	if order.fieldName == "" {
+		return idLess, nil
+	}
+	fs := sq.collection.collections[0].spec.fieldsByName[order.fieldName]
+	// compare returns -1, 0, or 1 depending on how the values for the order
+	// field compare in the index, i.e. in ascending order.
+	var compare func(a, b reflect.Value) int
+	switch fs.indexKind {
+	case numericIndex, booleanIndex:
+		score := fs.numericIndexScore
+		if fs.indexKind == booleanIndex {
+			score = func(val reflect.Value) float64 {
+				return float64(boolScore(val))
+			}
+		}
+		compare = func(a, b reflect.Value) int {
+			aScore, bScore := score(a), score(b)
+			switch {
+			case aScore < bScore:
+				return -1
+			case aScore > bScore:
+				return 1
+			}
+			return 0
+		}
+	case stringIndex:
+		compare = func(a, b reflect.Value) int {
+			// The values were already converted when the models were saved, so
+			// an error here is not expected and the models are treated as equal.
+			aValue, aErr := fs.stringIndexValue(a)
+			bValue, bErr := fs.stringIndexValue(b)
+			if aErr != nil || bErr != nil {
+				return 0
+			}
+			return strings.Compare(aValue, bValue)
+		}
+	default:
+		return nil, fmt.Errorf("zoom: error in ShardedQuery.Order: cannot merge the results for an order on %s", order.fieldName)
+	}
+	return func(a, b reflect.Value) bool {
+		c := compare(a.Elem().FieldByName(fs.name), b.Elem().FieldByName(fs.name))
+		if c == 0 {
+			return idLess(a, b)
+		}
+		if descending {
+			return c > 0
+		}
+		return c < 0
+	}, nil
+}
+
+// Ids executes the query on every shard and returns the ids of the models that
+// match the criteria, merged in the same order as Run. If the query has an
+// order, the models themselves are read to merge the results, so Ids is no
+// cheaper than Run.
+func (sq *ShardedQuery) Ids() ([]string, error) {
+	if err := sq.Err(); err != nil {
+		return nil, err
+	}
+	if sq.queries[0].query.hasOrder() {
+		models := reflect.New(reflect.SliceOf(sq.collection.collections[0].spec.typ))
+		if err := sq.Run(models.Interface()); err != nil {
+			return nil, err
+		}
+		ids := make([]string, models.Elem().Len())
+		for i := range ids {
+			ids[i] = models.Elem().Index(i).Interface().(Model).ModelId()
+		}
+		return ids, nil
+	}
+	// Without an order, the ids from each shard are sorted by id, so they can
+	// be merged directly.
+	shardIds := make([][]string, len(sq.queries))
+	for i, q := range sq.queries {
+		ids, err := q.Ids()
+		if err != nil {
+			return nil, err
+		}
+		shardIds[i] = ids
+	}
+	allIds := []string{}
+	skipped := uint(0)
+	for sq.limit == 0 || uint(len(allIds)) < sq.limit {
+		next := -1
+		for i, ids := range shardIds {
+			if len(ids) > 0 && (next == -1 || ids[0] < shardIds[next][0]) {
+				next = i
+			}
+		}
+		if next == -1 {
+			break
+		}
+		if skipped < sq.offset {
+			skipped++
+		} else {
+			allIds = append(allIds, shardIds[next][0])
+		}
+		shardIds[next] = shardIds[next][1:]
+	}
+	return allIds, nil
+}
+
+// Count returns the total number of models on every shard that match the
+// criteria, taking Limit and Offset into account. The count for each shard is
+// already limited to offset + limit, which does not change the result.
+func (sq *ShardedQuery) Count() (int, error) {
+	if err := sq.Err(); err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, q := range sq.queries {
+		count, err := q.Count()
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	total -= int(sq.offset)
+	if total < 0 {
+		total = 0
+	}
+	if sq.limit != 0 && int(sq.limit) < total {
+		total = int(sq.limit)
+	}
+	return total, nil
+}
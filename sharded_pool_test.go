@@ -0,0 +1,342 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File sharded_pool_test.go tests manual sharding (sharded_pool.go).
+
+package zoom
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestJumpHashShardFunc(t *testing.T) {
+	numIds := 10000
+	counts := make([]int, 4)
+	for i := 0; i < numIds; i++ {
+		id := "id" + strconv.Itoa(i)
+		shard := JumpHashShardFunc(id, 4)
+		if shard < 0 || shard >= 4 {
+			t.Fatalf("JumpHashShardFunc returned invalid shard %d", shard)
+		}
+		if again := JumpHashShardFunc(id, 4); again != shard {
+			t.Fatalf("JumpHashShardFunc was not deterministic. Got %d and then %d", shard, again)
+		}
+		counts[shard]++
+		// When a shard is added, ids should only move to the new shard.
+		if newShard := JumpHashShardFunc(id, 5); newShard != shard && newShard != 4 {
+			t.Errorf("Adding a shard moved id %s from shard %d to shard %d", id, shard, newShard)
+		}
+	}
+	for shard, count := range counts {
+		if count < numIds/5 || count > numIds/3 {
+			t.Errorf("Ids were not spread evenly. Shard %d has %d of %d ids", shard, count, numIds)
+		}
+	}
+}
+
+func TestShardedPool(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use the test database and the one after it as the two shards.
+	pool0 := NewPoolWithOptions(testPool.options)
+	pool1 := NewPoolWithOptions(testPool.options.WithDatabase(testPool.options.Database + 1))
+	conn1 := pool1.NewConn()
+	defer conn1.Close()
+	if n, err := redis.Int(conn1.Do("DBSIZE")); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Skipf("Database #%d is not empty. Skipping sharding test.", testPool.options.Database+1)
+	}
+	defer conn1.Do("FLUSHDB")
+	shardedPool, err := NewShardedPool([]*Pool{pool0, pool1}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewShardedPool: %s", err.Error())
+	}
+	defer shardedPool.Close()
+	collection, err := shardedPool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+
+	models := createIndexedTestModels(20)
+	for _, model := range models {
+		if err := collection.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+
+	// Each model should only be saved on its own shard.
+	shardCounts := make([]int, 2)
+	for _, model := range models {
+		shard := JumpHashShardFunc(model.ModelId(), 2)
+		shardCounts[shard]++
+		for i, c := range collection.Collections() {
+			got := &indexedTestModel{}
+			err := c.Find(model.ModelId(), got)
+			if i == shard && err != nil {
+				t.Errorf("Expected model %s to be saved on shard %d but got error: %s", model.ModelId(), i, err.Error())
+			} else if i != shard {
+				if _, ok := err.(ModelNotFoundError); !ok {
+					t.Errorf("Expected model %s to not be saved on shard %d but got: %v", model.ModelId(), i, err)
+				}
+			}
+		}
+		got := &indexedTestModel{}
+		if err := collection.Find(model.ModelId(), got); err != nil {
+			t.Errorf("Unexpected error in Find: %s", err.Error())
+		} else if err := expectModelsToBeEqual([]*indexedTestModel{model}, []*indexedTestModel{got}, true); err != nil {
+			t.Error(err)
+		}
+	}
+	for i, c := range collection.Collections() {
+		if count, err := c.Count(); err != nil {
+			t.Fatal(err)
+		} else if count != shardCounts[i] {
+			t.Errorf("Expected shard %d to have %d models but got %d", i, shardCounts[i], count)
+		}
+	}
+
+	// FindAll, Count, and queries should combine the results from every shard.
+	if count, err := collection.Count(); err != nil {
+		t.Errorf("Unexpected error in Count: %s", err.Error())
+	} else if count != len(models) {
+		t.Errorf("Expected Count to return %d but got %d", len(models), count)
+	}
+	gotModels := []*indexedTestModel{}
+	if err := collection.FindAll(&gotModels); err != nil {
+		t.Errorf("Unexpected error in FindAll: %s", err.Error())
+	} else if err := expectModelsToBeEqual(models, gotModels, false); err != nil {
+		t.Error(err)
+	}
+	expected := []*indexedTestModel{}
+	expectedIds := []string{}
+	for _, model := range models {
+		if model.Bool {
+			expected = append(expected, model)
+			expectedIds = append(expectedIds, model.ModelId())
+		}
+	}
+	q := collection.NewQuery().Filter("Bool =", true)
+	gotModels = []*indexedTestModel{}
+	if err := q.Run(&gotModels); err != nil {
+		t.Errorf("Unexpected error in ShardedQuery.Run: %s", err.Error())
+	} else if err := expectModelsToBeEqual(expected, gotModels, false); err != nil {
+		t.Error(err)
+	}
+	if ids, err := q.Ids(); err != nil {
+		t.Errorf("Unexpected error in ShardedQuery.Ids: %s", err.Error())
+	} else {
+		sort.Strings(ids)
+		sort.Strings(expectedIds)
+		if len(ids) != len(expectedIds) {
+			t.Errorf("Expected %d ids but got %d", len(expectedIds), len(ids))
+		} else {
+			for i := range ids {
+				if ids[i] != expectedIds[i] {
+					t.Errorf("Expected ids %v but got %v", expectedIds, ids)
+					break
+				}
+			}
+		}
+	}
+	if count, err := q.Count(); err != nil {
+		t.Errorf("Unexpected error in ShardedQuery.Count: %s", err.Error())
+	} else if count != len(expected) {
+		t.Errorf("Expected ShardedQuery.Count to return %d but got %d", len(expected), count)
+	}
+	if err := collection.NewQuery().Order("Invalid").Run(&gotModels); err == nil {
+		t.Error("Expected an error for an invalid order but got none")
+	}
+
+	// Delete should remove the model from its shard.
+	if deleted, err := collection.Delete(models[0].ModelId()); err != nil {
+		t.Errorf("Unexpected error in Delete: %s", err.Error())
+	} else if !deleted {
+		t.Error("Expected Delete to return true but got false")
+	}
+	if count, err := collection.DeleteAll(); err != nil {
+		t.Errorf("Unexpected error in DeleteAll: %s", err.Error())
+	} else if count != len(models)-1 {
+		t.Errorf("Expected DeleteAll to return %d but got %d", len(models)-1, count)
+	}
+}
+
+func TestShardedQueryOrder(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Use the test database and the one after it as the two shards.
+	pool0 := NewPoolWithOptions(testPool.options)
+	pool1 := NewPoolWithOptions(testPool.options.WithDatabase(testPool.options.Database + 1))
+	conn1 := pool1.NewConn()
+	defer conn1.Close()
+	if n, err := redis.Int(conn1.Do("DBSIZE")); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Skipf("Database #%d is not empty. Skipping sharding test.", testPool.options.Database+1)
+	}
+	defer conn1.Do("FLUSHDB")
+	shardedPool, err := NewShardedPool([]*Pool{pool0, pool1}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error in NewShardedPool: %s", err.Error())
+	}
+	defer shardedPool.Close()
+	collection, err := shardedPool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+	models := createIndexedTestModels(30)
+	for _, model := range models {
+		if err := collection.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	for i, c := range collection.Collections() {
+		if count, err := c.Count(); err != nil {
+			t.Fatal(err)
+		} else if count == 0 {
+			t.Fatalf("Expected shard %d to have some models", i)
+		}
+	}
+
+	// expectOrder runs q and checks that the results are the models sorted by
+	// less (with ties broken by id), after applying offset and limit.
+	expectOrder := func(q *ShardedQuery, less func(a, b *indexedTestModel) bool, descending bool, offset, limit int) {
+		t.Helper()
+		expected := append([]*indexedTestModel{}, models...)
+		sort.Slice(expected, func(i, j int) bool {
+			a, b := expected[i], expected[j]
+			if descending {
+				a, b = b, a
+			}
+			if less(a, b) {
+				return true
+			} else if less(b, a) {
+				return false
+			}
+			return a.Id < b.Id
+		})
+		if offset > len(expected) {
+			offset = len(expected)
+		}
+		expected = expected[offset:]
+		if limit != 0 && limit < len(expected) {
+			expected = expected[:limit]
+		}
+		q.Offset(uint(offset)).Limit(uint(limit))
+		got := []*indexedTestModel{}
+		if err := q.Run(&got); err != nil {
+			t.Fatalf("Unexpected error in ShardedQuery.Run: %s", err.Error())
+		}
+		if err := expectModelsToBeEqual(expected, got, true); err != nil {
+			t.Error(err)
+		}
+		expectedIds := make([]string, len(expected))
+		for i, model := range expected {
+			expectedIds[i] = model.Id
+		}
+		if ids, err := q.Ids(); err != nil {
+			t.Fatalf("Unexpected error in ShardedQuery.Ids: %s", err.Error())
+		} else if !reflect.DeepEqual(expectedIds, ids) {
+			t.Errorf("Wrong ids.\nExpected: %v\nGot:      %v", expectedIds, ids)
+		}
+		if count, err := q.Count(); err != nil {
+			t.Fatalf("Unexpected error in ShardedQuery.Count: %s", err.Error())
+		} else if count != len(expected) {
+			t.Errorf("Expected ShardedQuery.Count to return %d but got %d", len(expected), count)
+		}
+	}
+	byId := func(a, b *indexedTestModel) bool { return false }
+	byInt := func(a, b *indexedTestModel) bool { return a.Int < b.Int }
+	byString := func(a, b *indexedTestModel) bool { return a.String < b.String }
+	byBool := func(a, b *indexedTestModel) bool { return !a.Bool && b.Bool }
+	for _, pages := range [][2]int{{0, 0}, {0, 7}, {5, 10}, {25, 10}, {40, 0}} {
+		offset, limit := pages[0], pages[1]
+		expectOrder(collection.NewQuery(), byId, false, offset, limit)
+		expectOrder(collection.NewQuery().Order("Int"), byInt, false, offset, limit)
+		expectOrder(collection.NewQuery().Order("-Int"), byInt, true, offset, limit)
+		expectOrder(collection.NewQuery().Order("String"), byString, false, offset, limit)
+		expectOrder(collection.NewQuery().Order("-Bool"), byBool, true, offset, limit)
+	}
+	// Limit(0) after Limit(n) should remove the limit from every shard again.
+	expectOrder(collection.NewQuery().Order("Int").Limit(3), byInt, false, 0, 0)
+	expectOrder(collection.NewQuery().Limit(3), byId, false, 5, 0)
+
+	// The order field is needed to merge the results.
+	if err := collection.NewQuery().Order("Int").Include("String").Run(&[]*indexedTestModel{}); err == nil {
+		t.Error("Expected an error for an order on a field which is not included but got none")
+	}
+}
+
+func TestShardedPoolInvalidShard(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	pool := NewPoolWithOptions(testPool.options)
+	shardedPool, err := NewShardedPool([]*Pool{pool}, func(id string, numShards int) int {
+		return numShards
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error in NewShardedPool: %s", err.Error())
+	}
+	defer shardedPool.Close()
+	collection, err := shardedPool.NewCollection(&indexedTestModel{})
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	if err := collection.Save(&indexedTestModel{}); err == nil {
+		t.Error("Expected an error for an invalid shard but got none")
+	}
+	if _, err := NewShardedPool(nil, nil); err == nil {
+		t.Error("Expected an error for a ShardedPool with no pools but got none")
+	}
+}
+
+func TestShardedPoolIdLength(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// Record the ids that the ShardFunc sees to make sure that the id is
+	// assigned before the shard is picked.
+	routed := []string{}
+	pool := NewPoolWithOptions(testPool.options)
+	shardedPool, err := NewShardedPool([]*Pool{pool}, func(id string, numShards int) int {
+		routed = append(routed, id)
+		return 0
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error in NewShardedPool: %s", err.Error())
+	}
+	defer shardedPool.Close()
+	collection, err := shardedPool.NewCollectionWithOptions(&indexedTestModel{}, DefaultCollectionOptions.WithIndex(true).WithIdLength(8))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+	for i, save := range []func(model Model) error{
+		collection.Save,
+		func(model Model) error {
+			return collection.SaveFields([]string{"Int"}, model)
+		},
+	} {
+		model := &indexedTestModel{Int: i}
+		if err := save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+		if len(model.ModelId()) != 8 {
+			t.Errorf("Expected an id with 8 characters but got %q", model.ModelId())
+		}
+		if got := routed[len(routed)-1]; got != model.ModelId() {
+			t.Errorf("Expected the model to be routed by its id %q but got %q", model.ModelId(), got)
+		}
+		if err := collection.Find(model.ModelId(), &indexedTestModel{}); err != nil {
+			t.Errorf("Unexpected error in Find: %s", err.Error())
+		}
+	}
+}
@@ -9,6 +9,10 @@
 package zoom
 
 import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/garyburd/redigo/redis"
@@ -58,6 +62,81 @@ func TestRedisIgnoreOption(t *testing.T) {
 	}
 }
 
+// Test that the zoom:"-" struct tag causes a field to be skipped for both saving
+// and finding, and that it cannot be indexed or combined with other options.
+func TestZoomIgnoreOption(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type computedFieldModel struct {
+		Name     string `zoom:"index"`
+		Computed int    `zoom:"-"`
+		RandomId
+	}
+	computedFieldModels, err := testPool.NewCollectionWithOptions(&computedFieldModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollection: %s", err.Error())
+	}
+	if _, found := computedFieldModels.spec.fieldsByName["Computed"]; found {
+		t.Error("Expected to not find the Computed field in the spec")
+	}
+	if !reflect.DeepEqual(computedFieldModels.FieldNames(), []string{"Name"}) {
+		t.Errorf("Expected the field names to be [Name] but got %v", computedFieldModels.FieldNames())
+	}
+
+	// The field should never be written.
+	model := &computedFieldModel{Name: "foo", Computed: 42}
+	if err := computedFieldModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	conn := testPool.NewConn()
+	defer conn.Close()
+	fields, err := redis.Strings(conn.Do("HKEYS", computedFieldModels.ModelKey(model.ModelId())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fields, []string{"Name"}) {
+		t.Errorf("Expected only the Name field to be saved but got %v", fields)
+	}
+
+	// The field should never be read, even if there is a value for it in the
+	// database.
+	if _, err := conn.Do("HSET", computedFieldModels.ModelKey(model.ModelId()), "Computed", "not a number"); err != nil {
+		t.Fatal(err)
+	}
+	got := &computedFieldModel{Computed: 7}
+	if err := computedFieldModels.Find(model.ModelId(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.Name != "foo" || got.Computed != 7 {
+		t.Errorf("Expected Find to only set the Name field but got %+v", got)
+	}
+	found := []*computedFieldModel{}
+	if err := computedFieldModels.NewQuery().Filter("Name =", "foo").Run(&found); err != nil {
+		t.Fatalf("Unexpected error in Query.Run: %s", err.Error())
+	}
+	if len(found) != 1 || found[0].Computed != 0 {
+		t.Errorf("Expected the query to return one model with a zero Computed field but got %+v", found)
+	}
+
+	// The field cannot be filtered or ordered by.
+	if err := computedFieldModels.NewQuery().Filter("Computed =", 42).Err(); err == nil {
+		t.Error("Expected an error filtering by a skipped field but got none")
+	}
+	if err := computedFieldModels.NewQuery().Order("Computed").Err(); err == nil {
+		t.Error("Expected an error ordering by a skipped field but got none")
+	}
+
+	// The - option cannot be combined with other options.
+	type invalidComputedFieldModel struct {
+		Computed int `zoom:"-,index"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&invalidComputedFieldModel{}); err == nil {
+		t.Error("Expected an error combining the - struct tag with index but got none")
+	}
+}
+
 // Test that the redis name struct tag causes a field's name in redis to be changed
 func TestRedisNameOption(t *testing.T) {
 	testingSetUp()
@@ -94,6 +173,98 @@ func TestRedisNameOption(t *testing.T) {
 	expectFieldEquals(t, modelKey, "a", customFieldModels.spec.fallback, "test")
 }
 
+// Test that the zoom name struct tag causes a field's name in redis to be
+// changed consistently for the main hash, indexes, and queries
+func TestZoomNameOption(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type zoomNameModel struct {
+		GivenName string `zoom:"name=first_name,index"`
+		Age       int    `zoom:"index,name=age"`
+		RandomId
+	}
+	zoomNameModels, err := testPool.NewCollectionWithOptions(&zoomNameModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in Register: %s", err.Error())
+	}
+	if fs := zoomNameModels.spec.fieldsByName["GivenName"]; fs.redisName != "first_name" {
+		t.Errorf("Expected fs.redisName to be `first_name` but got %s", fs.redisName)
+	}
+
+	// save some models and check redis
+	models := []*zoomNameModel{
+		{GivenName: "Alice", Age: 30},
+		{GivenName: "Bob", Age: 25},
+	}
+	for _, model := range models {
+		if err := zoomNameModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	modelKey := zoomNameModels.ModelKey(models[0].ModelId())
+	expectFieldEquals(t, modelKey, "first_name", zoomNameModels.spec.fallback, "Alice")
+	expectFieldEquals(t, modelKey, "age", zoomNameModels.spec.fallback, 30)
+	for _, fieldName := range []string{"GivenName", "Age"} {
+		expectIndexExists(t, zoomNameModels, models[0], fieldName)
+	}
+
+	// find the model
+	got := &zoomNameModel{}
+	if err := zoomNameModels.Find(models[0].ModelId(), got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if got.GivenName != "Alice" || got.Age != 30 {
+		t.Errorf("Model was not retrieved correctly. Got: %+v", got)
+	}
+
+	// run a query which orders and filters by the renamed fields
+	gotModels := []*zoomNameModel{}
+	if err := zoomNameModels.NewQuery().Order("GivenName").Filter("Age <", 30).Run(&gotModels); err != nil {
+		t.Fatalf("Unexpected error in Query.Run: %s", err.Error())
+	}
+	if len(gotModels) != 1 || gotModels[0].GivenName != "Bob" {
+		t.Errorf("Query returned the wrong models. Got: %+v", gotModels)
+	}
+
+	// delete the model and make sure the indexes were removed
+	if _, err := zoomNameModels.Delete(models[0].ModelId()); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	}
+	for _, fieldName := range []string{"GivenName", "Age"} {
+		expectIndexDoesNotExist(t, zoomNameModels, models[0], fieldName)
+	}
+}
+
+func TestDuplicateNameThrowsError(t *testing.T) {
+	testingSetUp()
+	testingTearDown()
+
+	type duplicateZoomName struct {
+		GivenName string `zoom:"name=name"`
+		Name      string `zoom:"name=name"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&duplicateZoomName{}); err == nil {
+		t.Error("Expected error when registering struct with duplicate zoom names")
+	}
+	type duplicateMixedName struct {
+		GivenName string `zoom:"name=Name"`
+		Name      string
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&duplicateMixedName{}); err == nil {
+		t.Error("Expected error when registering struct with a zoom name that matches another field")
+	}
+	type conflictingNames struct {
+		GivenName string `redis:"given" zoom:"name=first_name"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&conflictingNames{}); err == nil {
+		t.Error("Expected error when registering struct with conflicting redis and zoom names")
+	}
+}
+
 func TestInvalidOptionThrowsError(t *testing.T) {
 	testingSetUp()
 	testingTearDown()
@@ -153,6 +324,95 @@ func TestSaveIndexedPointersModel(t *testing.T) {
 	}
 }
 
+// Test that integers which cannot be represented exactly by a float64 are
+// rejected by numeric indexes instead of silently losing precision
+func TestNumericIndexPrecision(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	// 2^53 is the largest integer which can be stored without losing precision
+	model := createIndexedPrimativesModel()
+	model.Int64 = 1 << 53
+	model.Uint64 = 1 << 53
+	if err := indexedPrimativesModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	model.Int64 = -(1 << 53)
+	if err := indexedPrimativesModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	expectIndexExists(t, indexedPrimativesModels, model, "Int64")
+	expectIndexExists(t, indexedPrimativesModels, model, "Uint64")
+
+	// Anything beyond 2^53 in either direction should cause an error
+	invalidModels := []*indexedPrimativesModel{
+		createIndexedPrimativesModel(),
+		createIndexedPrimativesModel(),
+		createIndexedPrimativesModel(),
+	}
+	invalidModels[0].Int64 = 1<<53 + 1
+	invalidModels[1].Int64 = -(1<<53 + 1)
+	invalidModels[2].Uint64 = 1<<53 + 1
+	for _, invalid := range invalidModels {
+		if err := indexedPrimativesModels.Save(invalid); err == nil {
+			t.Errorf("Expected error in Save with Int64 = %d and Uint64 = %d but got none", invalid.Int64, invalid.Uint64)
+		}
+	}
+
+	// The same applies to values used in query filters
+	results := []*indexedPrimativesModel{}
+	if err := indexedPrimativesModels.NewQuery().Filter("Int64 =", int64(1<<53)).Run(&results); err != nil {
+		t.Errorf("Unexpected error in Query.Run: %s", err.Error())
+	}
+	if err := indexedPrimativesModels.NewQuery().Filter("Uint64 >", uint64(1<<53+1)).Run(&results); err == nil {
+		t.Error("Expected error in Query.Run with filter value 2^53+1 but got none")
+	}
+}
+
+// Test that numeric indexes order negative numbers and decimals numerically
+// rather than lexicographically (e.g. 9 should come before 10)
+func TestNumericIndexOrder(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	values := []float64{100.125, -9, 10, -0.25, 9, 0, -10.5, 0.5}
+	for _, value := range values {
+		model := createIndexedPrimativesModel()
+		model.Float64 = value
+		if err := indexedPrimativesModels.Save(model); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	results := []*indexedPrimativesModel{}
+	if err := indexedPrimativesModels.NewQuery().Order("Float64").Run(&results); err != nil {
+		t.Fatalf("Unexpected error in Query.Run: %s", err.Error())
+	}
+	if len(results) != len(sorted) {
+		t.Fatalf("Expected %d results but got %d", len(sorted), len(results))
+	}
+	for i, result := range results {
+		if result.Float64 != sorted[i] {
+			t.Errorf("Expected result %d to have Float64 = %v but got %v", i, sorted[i], result.Float64)
+		}
+	}
+
+	// Range filters should also compare numerically
+	if err := indexedPrimativesModels.NewQuery().Filter("Float64 >", -9.5).Filter("Float64 <", 9.5).Order("-Float64").Run(&results); err != nil {
+		t.Fatalf("Unexpected error in Query.Run: %s", err.Error())
+	}
+	expected := []float64{9, 0.5, 0, -0.25, -9}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results but got %d", len(expected), len(results))
+	}
+	for i, result := range results {
+		if result.Float64 != expected[i] {
+			t.Errorf("Expected result %d to have Float64 = %v but got %v", i, expected[i], result.Float64)
+		}
+	}
+}
+
 // Test that the indexes are removed from redis after a model with primative indexes is deleted
 func TestDeleteIndexedPrimativesModel(t *testing.T) {
 	testingSetUp()
@@ -239,3 +499,744 @@ func TestIndexAndCustomName(t *testing.T) {
 		expectIndexExists(t, customIndexModels, model, field.Name)
 	}
 }
+
+// Test that the gzip struct tag causes a field to be compressed in redis and
+// decompressed when it is read back
+func TestGzipOption(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	type gzipModel struct {
+		String  string            `zoom:"gzip"`
+		Bytes   []byte            `zoom:"gzip"`
+		Pointer *string           `zoom:"gzip"`
+		Map     map[string]string `zoom:"gzip"`
+		RandomId
+	}
+	gzipModels, err := testPool.NewCollection(&gzipModel{})
+	if err != nil {
+		t.Fatalf("Unexpected error in Register: %s", err.Error())
+	}
+	pointer := strings.Repeat("pointer ", 100)
+	model := &gzipModel{
+		String:  strings.Repeat("string ", 100),
+		Bytes:   bytes.Repeat([]byte("bytes "), 100),
+		Pointer: &pointer,
+		Map:     map[string]string{"key": strings.Repeat("value ", 100)},
+	}
+	if err := gzipModels.Save(model); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+
+	// Check the database to make sure the string field was compressed
+	conn := testPool.NewConn()
+	defer conn.Close()
+	key := gzipModels.ModelKey(model.ModelId())
+	stored, err := redis.Bytes(conn.Do("HGET", key, "String"))
+	if err != nil {
+		t.Fatalf("Unexpected error in HGET command: %s", err.Error())
+	}
+	if !bytes.HasPrefix(stored, gzipHeader) {
+		t.Errorf("Expected the stored value for String to be compressed with gzip but got: %q", stored)
+	}
+	if len(stored) >= len(model.String) {
+		t.Errorf("Expected the compressed value to be smaller than %d bytes but got %d", len(model.String), len(stored))
+	}
+
+	// Find the model and make sure all the fields were decompressed
+	found := &gzipModel{}
+	if err := gzipModels.Find(model.ModelId(), found); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if !reflect.DeepEqual(model, found) {
+		t.Errorf("Found model was incorrect.\nExpected: %+v\nGot:      %+v", model, found)
+	}
+
+	// Values which were stored without compression should still be readable
+	if _, err := conn.Do("HSET", key, "String", "uncompressed"); err != nil {
+		t.Fatalf("Unexpected error in HSET command: %s", err.Error())
+	}
+	if err := gzipModels.Find(model.ModelId(), found); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if found.String != "uncompressed" {
+		t.Errorf("Expected String to be %q but got %q", "uncompressed", found.String)
+	}
+
+	// Fields which cannot be compressed should cause an error
+	type indexedGzipModel struct {
+		String string `zoom:"index,gzip"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&indexedGzipModel{}); err == nil {
+		t.Error("Expected error when registering struct with an indexed gzip field")
+	}
+	type intGzipModel struct {
+		Int int `zoom:"gzip"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&intGzipModel{}); err == nil {
+		t.Error("Expected error when registering struct with an int gzip field")
+	}
+}
+
+// uuidModel uses the field with the `zoom:"id"` struct tag as its id instead of
+// embedding RandomId.
+type uuidModel struct {
+	UUID string `zoom:"id"`
+	Name string
+}
+
+func (m *uuidModel) ModelId() string {
+	return m.UUID
+}
+
+func (m *uuidModel) SetModelId(id string) {
+	m.UUID = id
+}
+
+// mismatchedIdModel has a field with the `zoom:"id"` struct tag, but its
+// ModelId and SetModelId methods (from RandomId) use a different field.
+type mismatchedIdModel struct {
+	UUID string `zoom:"id"`
+	RandomId
+}
+
+// twoIdsModel has two fields with the `zoom:"id"` struct tag.
+type twoIdsModel struct {
+	UUID  string `zoom:"id"`
+	Other string `zoom:"id"`
+}
+
+func (m *twoIdsModel) ModelId() string {
+	return m.UUID
+}
+
+func (m *twoIdsModel) SetModelId(id string) {
+	m.UUID = id
+}
+
+func TestIdOption(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	uuids, err := testPool.NewCollectionWithOptions(&uuidModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+	model := &uuidModel{UUID: "c0ffee", Name: "Alice"}
+	if err := uuids.Save(model); err != nil {
+		t.Fatal(err)
+	}
+	// The id field should not be stored in the main hash.
+	expectFieldEquals(t, uuids.ModelKey("c0ffee"), "Name", uuids.spec.fallback, "Alice")
+	expectFieldEquals(t, uuids.ModelKey("c0ffee"), "UUID", uuids.spec.fallback, nil)
+	got := &uuidModel{}
+	if err := uuids.Find("c0ffee", got); err != nil {
+		t.Fatalf("Unexpected error in Find: %s", err.Error())
+	}
+	if !reflect.DeepEqual(model, got) {
+		t.Errorf("Found model was incorrect.\nExpected: %+v\nGot:      %+v", model, got)
+	}
+	gotAll := []*uuidModel{}
+	if err := uuids.NewQuery().Run(&gotAll); err != nil {
+		t.Fatalf("Unexpected error in Query.Run: %s", err.Error())
+	}
+	if !reflect.DeepEqual([]*uuidModel{model}, gotAll) {
+		t.Errorf("Query.Run was incorrect.\nExpected: %+v\nGot:      %+v", []*uuidModel{model}, gotAll)
+	}
+
+	// Invalid uses of the id struct tag should cause an error.
+	if _, err := testPool.NewCollection(&mismatchedIdModel{}); err == nil {
+		t.Error("Expected an error for an id field which is not used by ModelId and SetModelId but got none")
+	}
+	if _, err := testPool.NewCollection(&twoIdsModel{}); err == nil {
+		t.Error("Expected an error for two id fields but got none")
+	}
+	type intIdModel struct {
+		Id int `zoom:"id"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&intIdModel{}); err == nil {
+		t.Error("Expected an error for an id field which is not a string but got none")
+	}
+	type indexedIdModel struct {
+		Id string `zoom:"id,index"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&indexedIdModel{}); err == nil {
+		t.Error("Expected an error for an id field with other options but got none")
+	}
+}
+
+// enumModel has a field with an enum index.
+type enumModel struct {
+	Status string `zoom:"index,enum"`
+	Count  int    `zoom:"index"`
+	RandomId
+}
+
+func TestEnumIndex(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	enums, err := testPool.NewCollectionWithOptions(&enumModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+	statuses := []string{"active", "pending", "active", "closed", "pending", "active"}
+	models := make([]*enumModel, len(statuses))
+	for i, status := range statuses {
+		models[i] = &enumModel{Status: status, Count: i}
+		if err := enums.Save(models[i]); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	indexKey, err := enums.spec.fieldIndexKey("Status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSetContains(t, enumBucketKey(indexKey, "active"), models[0].ModelId())
+	expectSetContains(t, enumValuesKey(indexKey), "closed")
+
+	// idsWhere returns the sorted ids of the models for which match is true.
+	idsWhere := func(match func(m *enumModel) bool) []string {
+		ids := []string{}
+		for _, m := range models {
+			if match(m) {
+				ids = append(ids, m.ModelId())
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	testCases := []struct {
+		q        *Query
+		expected []string
+	}{
+		{
+			q:        enums.NewQuery().Filter("Status =", "active"),
+			expected: idsWhere(func(m *enumModel) bool { return m.Status == "active" }),
+		},
+		{
+			q:        enums.NewQuery().Filter("Status !=", "active"),
+			expected: idsWhere(func(m *enumModel) bool { return m.Status != "active" }),
+		},
+		{
+			q:        enums.NewQuery().Filter("Status in", []string{"pending", "closed", "missing"}),
+			expected: idsWhere(func(m *enumModel) bool { return m.Status == "pending" || m.Status == "closed" }),
+		},
+		{
+			q:        enums.NewQuery().Not().Filter("Status in", []string{"pending", "closed"}),
+			expected: idsWhere(func(m *enumModel) bool { return m.Status == "active" }),
+		},
+		{
+			q:        enums.NewQuery().Filter("Status in", []string{}),
+			expected: []string{},
+		},
+		{
+			q:        enums.NewQuery().Filter("Status =", "active").Filter("Count >", 0),
+			expected: idsWhere(func(m *enumModel) bool { return m.Status == "active" && m.Count > 0 }),
+		},
+	}
+	for _, tc := range testCases {
+		got, err := tc.q.Ids()
+		if err != nil {
+			t.Errorf("Unexpected error in %s: %s", tc.q, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(tc.expected, got) {
+			t.Errorf("Wrong results for %s.\nExpected: %v\nGot:      %v", tc.q, tc.expected, got)
+		}
+		checkForLeakedTmpKeys(t, tc.q.query)
+	}
+
+	// Changing the value should move the model to the set for the new value
+	// and remove values which no longer have any models.
+	models[3].Status = "pending"
+	if err := enums.Save(models[3]); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	expectKeyDoesNotExist(t, enumBucketKey(indexKey, "closed"))
+	expectSetDoesNotContain(t, enumValuesKey(indexKey), "closed")
+	expectSetContains(t, enumBucketKey(indexKey, "pending"), models[3].ModelId())
+	// SaveIf should also update the index.
+	models[1].Status = "active"
+	if saved, err := enums.SaveIf(models[1], "Status", "=", "pending"); err != nil {
+		t.Fatalf("Unexpected error in SaveIf: %s", err.Error())
+	} else if !saved {
+		t.Error("Expected SaveIf to save the model but it did not")
+	}
+	expectSetDoesNotContain(t, enumBucketKey(indexKey, "pending"), models[1].ModelId())
+	expectSetContains(t, enumBucketKey(indexKey, "active"), models[1].ModelId())
+	// Deleting the model should remove it from the index.
+	if _, err := enums.Delete(models[0].ModelId()); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	}
+	expectSetDoesNotContain(t, enumBucketKey(indexKey, "active"), models[0].ModelId())
+	expectSetDoesNotContain(t, indexKey, models[0].ModelId())
+
+	stats, err := enums.IndexStats()
+	if err != nil {
+		t.Fatalf("Unexpected error in IndexStats: %s", err.Error())
+	}
+	expectedStats := IndexStats{
+		FieldName:      "Status",
+		Count:          5,
+		DistinctValues: 2,
+		Buckets:        map[string]int{"active": 3, "pending": 2},
+	}
+	if !reflect.DeepEqual(expectedStats, stats[0]) {
+		t.Errorf("Wrong IndexStats.\nExpected: %+v\nGot:      %+v", expectedStats, stats[0])
+	}
+
+	// Range operators, ordering, and the in operator on other indexes are not
+	// supported.
+	for _, q := range []*Query{
+		enums.NewQuery().Filter("Status >", "active"),
+		enums.NewQuery().Order("Status"),
+		enums.NewQuery().Filter("Count in", []int{1, 2}),
+		enums.NewQuery().Filter("Status in", "active"),
+	} {
+		if _, err := q.Ids(); err == nil {
+			t.Errorf("Expected an error for %s but got none", q)
+		}
+	}
+
+	// Truncate should remove every key used by the index.
+	if err := enums.Truncate(); err != nil {
+		t.Fatalf("Unexpected error in Truncate: %s", err.Error())
+	}
+	expectKeyDoesNotExist(t, indexKey)
+	expectKeyDoesNotExist(t, enumValuesKey(indexKey))
+	expectKeyDoesNotExist(t, enumBucketKey(indexKey, "active"))
+
+	// Invalid uses of the enum struct tag should cause an error.
+	type unindexedEnumModel struct {
+		Status string `zoom:"enum"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&unindexedEnumModel{}); err == nil {
+		t.Error("Expected an error for an enum field which is not indexed but got none")
+	}
+	type intEnumModel struct {
+		Status int `zoom:"index,enum"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&intEnumModel{}); err == nil {
+		t.Error("Expected an error for an enum field which is not a string but got none")
+	}
+}
+
+// sparseModel has fields with sparse boolean indexes.
+type sparseModel struct {
+	Premium bool  `zoom:"index,sparse"`
+	Trial   *bool `zoom:"index,sparse"`
+	Count   int   `zoom:"index"`
+	RandomId
+}
+
+func TestSparseIndex(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	sparses, err := testPool.NewCollectionWithOptions(&sparseModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+	yes, no := true, false
+	premiums := []bool{false, true, false, false, true, false}
+	trials := []*bool{&yes, nil, &no, &yes, nil, nil}
+	models := make([]*sparseModel, len(premiums))
+	for i := range models {
+		models[i] = &sparseModel{Premium: premiums[i], Trial: trials[i], Count: i}
+		if err := sparses.Save(models[i]); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	// Only the ids of models with a true value should be in the index.
+	indexKey, err := sparses.spec.fieldIndexKey("Premium")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := testPool.NewConn()
+	defer conn.Close()
+	if ids, err := redis.Strings(conn.Do("SMEMBERS", indexKey)); err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 2 {
+		t.Errorf("Expected 2 ids in the sparse index but got %v", ids)
+	}
+
+	// idsWhere returns the sorted ids of the models for which match is true.
+	idsWhere := func(match func(m *sparseModel) bool) []string {
+		ids := []string{}
+		for _, m := range models {
+			if match(m) {
+				ids = append(ids, m.ModelId())
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	isTrial := func(m *sparseModel) bool { return m.Trial != nil && *m.Trial }
+	testCases := []struct {
+		q        *Query
+		expected []string
+	}{
+		{
+			q:        sparses.NewQuery().Filter("Premium =", true),
+			expected: idsWhere(func(m *sparseModel) bool { return m.Premium }),
+		},
+		{
+			q:        sparses.NewQuery().Filter("Premium =", false),
+			expected: idsWhere(func(m *sparseModel) bool { return !m.Premium }),
+		},
+		{
+			q:        sparses.NewQuery().Filter("Premium !=", true),
+			expected: idsWhere(func(m *sparseModel) bool { return !m.Premium }),
+		},
+		{
+			q:        sparses.NewQuery().Not().Filter("Premium =", false),
+			expected: idsWhere(func(m *sparseModel) bool { return m.Premium }),
+		},
+		{
+			// Nil values count as false.
+			q:        sparses.NewQuery().Filter("Trial =", false),
+			expected: idsWhere(func(m *sparseModel) bool { return !isTrial(m) }),
+		},
+		{
+			q:        sparses.NewQuery().Filter("Premium =", false).Filter("Trial =", true).Filter("Count >", 0),
+			expected: idsWhere(func(m *sparseModel) bool { return !m.Premium && isTrial(m) && m.Count > 0 }),
+		},
+	}
+	for _, tc := range testCases {
+		got, err := tc.q.Ids()
+		if err != nil {
+			t.Errorf("Unexpected error in %s: %s", tc.q, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(tc.expected, got) {
+			t.Errorf("Wrong results for %s.\nExpected: %v\nGot:      %v", tc.q, tc.expected, got)
+		}
+		checkForLeakedTmpKeys(t, tc.q.query)
+	}
+
+	// Changing the value to false should remove the model from the index.
+	models[1].Premium = false
+	if err := sparses.Save(models[1]); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	expectSetDoesNotContain(t, indexKey, models[1].ModelId())
+	models[0].Premium = true
+	if err := sparses.Save(models[0]); err != nil {
+		t.Fatalf("Unexpected error in Save: %s", err.Error())
+	}
+	expectSetContains(t, indexKey, models[0].ModelId())
+	// Deleting the model should remove it from the index.
+	if _, err := sparses.Delete(models[4].ModelId()); err != nil {
+		t.Fatalf("Unexpected error in Delete: %s", err.Error())
+	}
+	expectSetDoesNotContain(t, indexKey, models[4].ModelId())
+	models = append(models[:4], models[5:]...)
+
+	if values, err := sparses.NewQuery().Distinct("Premium"); err != nil {
+		t.Fatalf("Unexpected error in Distinct: %s", err.Error())
+	} else if expected := []string{"false", "true"}; !reflect.DeepEqual(expected, values) {
+		t.Errorf("Wrong distinct values.\nExpected: %v\nGot:      %v", expected, values)
+	}
+	stats, err := sparses.IndexStats()
+	if err != nil {
+		t.Fatalf("Unexpected error in IndexStats: %s", err.Error())
+	}
+	expectedStats := IndexStats{
+		FieldName:      "Premium",
+		Count:          1,
+		DistinctValues: 1,
+		Buckets:        map[string]int{"true": 1},
+	}
+	if !reflect.DeepEqual(expectedStats, stats[0]) {
+		t.Errorf("Wrong IndexStats.\nExpected: %+v\nGot:      %+v", expectedStats, stats[0])
+	}
+
+	// Swapping the ids should move the entries in the index.
+	if err := sparses.SwapIds(models[0].ModelId(), models[1].ModelId()); err != nil {
+		t.Fatalf("Unexpected error in SwapIds: %s", err.Error())
+	}
+	expectSetContains(t, indexKey, models[1].ModelId())
+	expectSetDoesNotContain(t, indexKey, models[0].ModelId())
+
+	// An id in the index without a true value is orphaned, and a model with a
+	// true value which is not in the index is missing.
+	if _, err := conn.Do("SADD", indexKey, models[2].ModelId()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("SREM", indexKey, models[1].ModelId()); err != nil {
+		t.Fatal(err)
+	}
+	reports, err := sparses.VerifyIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+	}
+	expectedReport := IndexReport{
+		FieldName:  "Premium",
+		Orphaned:   []string{models[2].ModelId()},
+		Missing:    []string{models[1].ModelId()},
+		Duplicated: []string{},
+	}
+	if !reflect.DeepEqual(expectedReport, reports[0]) {
+		t.Errorf("Wrong IndexReport.\nExpected: %+v\nGot:      %+v", expectedReport, reports[0])
+	}
+	// ReindexField should repair the index.
+	if _, err := sparses.ReindexField("Premium"); err != nil {
+		t.Fatalf("Unexpected error in ReindexField: %s", err.Error())
+	}
+	if reports, err := sparses.VerifyIndexes(); err != nil {
+		t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+	} else {
+		for _, report := range reports {
+			if !report.OK() {
+				t.Errorf("Expected the index for %s to be consistent but got %+v", report.FieldName, report)
+			}
+		}
+	}
+
+	// Import should only add the models with a true value to the index.
+	if err := sparses.Truncate(); err != nil {
+		t.Fatalf("Unexpected error in Truncate: %s", err.Error())
+	}
+	if _, err := sparses.Import(Models(models)); err != nil {
+		t.Fatalf("Unexpected error in Import: %s", err.Error())
+	}
+	if got, err := sparses.NewQuery().Filter("Premium =", true).Ids(); err != nil {
+		t.Fatalf("Unexpected error in Ids: %s", err.Error())
+	} else if expected := idsWhere(func(m *sparseModel) bool { return m.Premium }); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Wrong results after Import.\nExpected: %v\nGot:      %v", expected, got)
+	}
+
+	// Range operators, the in operator, and ordering are not supported.
+	for _, q := range []*Query{
+		sparses.NewQuery().Filter("Premium >", false),
+		sparses.NewQuery().Filter("Premium in", []bool{true}),
+		sparses.NewQuery().Order("Premium"),
+	} {
+		if _, err := q.Ids(); err == nil {
+			t.Errorf("Expected an error for %s but got none", q)
+		}
+	}
+
+	// Invalid uses of the sparse struct tag should cause an error.
+	type unindexedSparseModel struct {
+		Premium bool `zoom:"sparse"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&unindexedSparseModel{}); err == nil {
+		t.Error("Expected an error for a sparse field which is not indexed but got none")
+	}
+	type stringSparseModel struct {
+		Premium string `zoom:"index,sparse"`
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&stringSparseModel{}); err == nil {
+		t.Error("Expected an error for a sparse field which is not a bool but got none")
+	}
+	type partialSparseModel struct {
+		Premium bool `zoom:"index,sparse,where:Count=1"`
+		Count   int
+		RandomId
+	}
+	if _, err := testPool.NewCollection(&partialSparseModel{}); err == nil {
+		t.Error("Expected an error for a sparse field with the where option but got none")
+	}
+}
+
+// partialIndexModel has fields with partial indexes.
+type partialIndexModel struct {
+	Name     string `zoom:"index,where:Status=active"`
+	Score    int    `zoom:"index,where:Archived!=true"`
+	Tag      string `zoom:"index,enum,where:Status=active"`
+	Status   string
+	Archived bool
+	RandomId
+}
+
+func TestPartialIndex(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	partials, err := testPool.NewCollectionWithOptions(&partialIndexModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatalf("Unexpected error in NewCollectionWithOptions: %s", err.Error())
+	}
+	models := []*partialIndexModel{
+		{Name: "a", Score: 1, Tag: "x", Status: "active"},
+		{Name: "b", Score: 2, Tag: "x", Status: "inactive"},
+		{Name: "c", Score: 3, Tag: "x", Status: "active", Archived: true},
+		{Name: "d", Score: 4, Tag: "x", Status: "inactive", Archived: true},
+	}
+	for _, m := range models {
+		if err := partials.Save(m); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	// expectIds checks that q returns the ids of the models at the given
+	// indexes in models.
+	expectIds := func(q *Query, indexes ...int) {
+		t.Helper()
+		expected := []string{}
+		for _, i := range indexes {
+			expected = append(expected, models[i].ModelId())
+		}
+		sort.Strings(expected)
+		got, err := q.Ids()
+		if err != nil {
+			t.Fatalf("Unexpected error in %s: %s", q, err.Error())
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Wrong results for %s.\nExpected: %v\nGot:      %v", q, expected, got)
+		}
+		checkForLeakedTmpKeys(t, q.query)
+	}
+	expectIndexesOK := func() {
+		t.Helper()
+		reports, err := partials.VerifyIndexes()
+		if err != nil {
+			t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+		}
+		for _, report := range reports {
+			if !report.OK() {
+				t.Errorf("Expected the index for %s to be consistent but got %+v", report.FieldName, report)
+			}
+		}
+	}
+
+	// Queries on a field with a partial index only see the models which match
+	// the condition.
+	expectIndexesOK()
+	expectIds(partials.NewQuery().Order("Name"), 0, 2)
+	expectIds(partials.NewQuery().Filter("Name >=", ""), 0, 2)
+	expectIds(partials.NewQuery().Filter("Score >", 0), 0, 1)
+	expectIds(partials.NewQuery().Filter("Tag =", "x"), 0, 2)
+	// The != operator only sees the index, but Not removes the models which
+	// match the filter from all of the models.
+	expectIds(partials.NewQuery().Filter("Name !=", "a"), 2)
+	expectIds(partials.NewQuery().Not().Filter("Name =", "a"), 1, 2, 3)
+
+	// Save should move models into and out of the index as their values change.
+	models[1].Status = "active"
+	models[0].Status = "inactive"
+	for _, m := range models[:2] {
+		if err := partials.Save(m); err != nil {
+			t.Fatalf("Unexpected error in Save: %s", err.Error())
+		}
+	}
+	expectIds(partials.NewQuery().Filter("Name >=", ""), 1, 2)
+	expectIds(partials.NewQuery().Filter("Tag =", "x"), 1, 2)
+	// So should SaveFields, which requires the indexed field and the field in
+	// its condition to be saved together.
+	models[3].Archived = false
+	if err := partials.SaveFields([]string{"Score", "Archived"}, models[3]); err != nil {
+		t.Fatalf("Unexpected error in SaveFields: %s", err.Error())
+	}
+	expectIds(partials.NewQuery().Filter("Score >", 0), 0, 1, 3)
+	if err := partials.SaveFields([]string{"Archived"}, models[3]); err == nil {
+		t.Error("Expected an error for SaveFields without the indexed field but got none")
+	}
+	// And SaveIf.
+	models[2].Status = "inactive"
+	if saved, err := partials.SaveIf(models[2], "Score", "=", 3); err != nil {
+		t.Fatalf("Unexpected error in SaveIf: %s", err.Error())
+	} else if !saved {
+		t.Error("Expected SaveIf to save the model but it did not")
+	}
+	expectIds(partials.NewQuery().Filter("Name >=", ""), 1)
+	expectIds(partials.NewQuery().Filter("Tag =", "x"), 1)
+	expectIndexesOK()
+
+	// ReindexField and Import should respect the condition.
+	if _, err := partials.ReindexField("Name"); err != nil {
+		t.Fatalf("Unexpected error in ReindexField: %s", err.Error())
+	}
+	expectIds(partials.NewQuery().Filter("Name >=", ""), 1)
+	imported := &partialIndexModel{Name: "e", Score: 5, Tag: "x", Status: "active", Archived: true}
+	if _, err := partials.Import([]Model{imported}); err != nil {
+		t.Fatalf("Unexpected error in Import: %s", err.Error())
+	}
+	models = append(models, imported)
+	expectIds(partials.NewQuery().Filter("Name >=", ""), 1, 4)
+	expectIds(partials.NewQuery().Filter("Score >", 0), 0, 1, 3)
+	expectIndexesOK()
+
+	// SwapIds should only move the entries which are in the index.
+	if err := partials.SwapIds(models[0].ModelId(), models[1].ModelId()); err != nil {
+		t.Fatalf("Unexpected error in SwapIds: %s", err.Error())
+	}
+	models[0].Id, models[1].Id = models[1].Id, models[0].Id
+	expectIds(partials.NewQuery().Filter("Name >=", ""), 1, 4)
+	expectIds(partials.NewQuery().Filter("Tag =", "x"), 1, 4)
+	expectIndexesOK()
+
+	// A model which is in the index but no longer matches the condition should
+	// be reported as orphaned.
+	conn := testPool.NewConn()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", partials.ModelKey(models[4].ModelId()), "Status", "inactive"); err != nil {
+		t.Fatal(err)
+	}
+	reports, err := partials.VerifyIndexes()
+	if err != nil {
+		t.Fatalf("Unexpected error in VerifyIndexes: %s", err.Error())
+	}
+	if expected := []string{models[4].ModelId()}; !reflect.DeepEqual(expected, reports[0].Orphaned) {
+		t.Errorf("Expected the orphaned ids for Name to be %v but got %v", expected, reports[0].Orphaned)
+	}
+
+	// Fields with partial indexes cannot be used where the index would not be
+	// kept up to date.
+	if _, err := partials.Upsert("Name", "a", &partialIndexModel{}); err == nil {
+		t.Error("Expected an error for Upsert on a partial index but got none")
+	}
+	if _, err := partials.IncrementFields(models[0].ModelId(), map[string]int64{"Score": 1}); err == nil {
+		t.Error("Expected an error for IncrementFields on a partial index but got none")
+	}
+	if schema := partials.Schema(); schema.Fields[1].Where != "Archived!=true" {
+		t.Errorf("Expected the schema for Score to have the condition Archived!=true but got %q", schema.Fields[1].Where)
+	}
+
+	// Invalid uses of the where option should cause an error.
+	type unindexedWhereModel struct {
+		Name   string `zoom:"where:Status=active"`
+		Status string
+		RandomId
+	}
+	type missingWhereFieldModel struct {
+		Name string `zoom:"index,where:Status=active"`
+		RandomId
+	}
+	type invalidWhereModel struct {
+		Name   string `zoom:"index,where:Status"`
+		Status string
+		RandomId
+	}
+	type invalidWhereValueModel struct {
+		Name     string `zoom:"index,where:Archived=maybe"`
+		Archived bool
+		RandomId
+	}
+	type floatWhereModel struct {
+		Name  string `zoom:"index,where:Score=1"`
+		Score float64
+		RandomId
+	}
+	for _, model := range []Model{
+		&unindexedWhereModel{},
+		&missingWhereFieldModel{},
+		&invalidWhereModel{},
+		&invalidWhereValueModel{},
+		&floatWhereModel{},
+	} {
+		if _, err := testPool.NewCollection(model); err == nil {
+			t.Errorf("Expected an error for %T but got none", model)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File swap.go contains code for atomically swapping the ids of two models.
+
+package zoom
+
+import (
+	"fmt"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// SwapIds atomically swaps the ids of the two models with the given ids, so
+// that afterwards idA refers to the model which was stored under idB and vice
+// versa. This is useful for things like reordering features, where the ids
+// determine the position of each model. The main hashes and list fields are
+// swapped with RENAME and every field index is updated in a single Lua script,
+// so other clients never see a state where both or neither of the models exist,
+// unlike with a naive delete and save. Any expiration set with Touch moves with
+// the model data. The write count for the collection is incremented and each
+// model gets an entry in the change log (if enabled), as if both models had
+// been saved. If either model does not exist, SwapIds returns a
+// ModelNotFoundError and nothing is changed. Swapping a model with itself does
+// nothing.
+func (c *Collection) SwapIds(idA string, idB string) error {
+	t := c.pool.NewTransaction()
+	t.SwapIds(c, idA, idB)
+	return t.Exec()
+}
+
+// SwapIds atomically swaps the ids of two models in an existing transaction.
+// See Collection.SwapIds for more information. Any errors encountered will be
+// added to the transaction and returned as an error when the transaction is
+// executed.
+func (t *Transaction) SwapIds(c *Collection, idA string, idB string) {
+	if c == nil {
+		t.setError(newNilCollectionError("SwapIds"))
+		return
+	}
+	if idA == "" || idB == "" {
+		t.setError(fmt.Errorf("zoom: Error in SwapIds or Transaction.SwapIds: ids cannot be empty"))
+		return
+	}
+	args := redis.Args{c.Name(), idA, idB}
+	indexes := redis.Args{}
+	for _, fs := range c.spec.fields {
+		if fs.indexKind != noIndex {
+			indexes = append(indexes, fs.indexKind.scriptName(), fs.redisName)
+		}
+	}
+	args = append(args, len(indexes)/2)
+	args = append(args, indexes...)
+	args = append(args, len(c.spec.lists))
+	for _, fs := range c.spec.lists {
+		args = append(args, fs.redisName)
+	}
+	// The change log entries and write count should only be updated if the
+	// models were swapped, so the script runs them along with the swap.
+	conditional := &Transaction{}
+	if c.index {
+		conditional.incrWriteCount(c)
+	}
+	conditional.addChange(c, ChangeSave, idA, c.spec.fieldNames())
+	conditional.addChange(c, ChangeSave, idB, c.spec.fieldNames())
+	args, err := appendCommandArgs(args, conditional.actions)
+	if err != nil {
+		t.setError(fmt.Errorf("zoom: Error in SwapIds or Transaction.SwapIds: %s", err.Error()))
+		return
+	}
+	written := t.addConditionalWrites(conditional)
+	t.Script(swapIdsScript, args, func(reply interface{}) error {
+		if reply == nil {
+			msg := fmt.Sprintf("Could not find %s with id = %s or id = %s", c.Name(), idA, idB)
+			return ModelNotFoundError{Collection: c, Msg: msg}
+		}
+		swapped, err := redis.Int(reply, nil)
+		if err != nil {
+			return err
+		}
+		(*written) = swapped == 1
+		return nil
+	})
+}
@@ -0,0 +1,110 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+// File swap_test.go tests the code for swapping the ids of two models
+// (swap.go).
+
+package zoom
+
+import (
+	"reflect"
+	"testing"
+)
+
+type swapModel struct {
+	Position int      `zoom:"index"`
+	Name     string   `zoom:"index"`
+	Active   bool     `zoom:"index"`
+	Status   string   `zoom:"index,enum"`
+	Note     *string  `zoom:"index"`
+	Tags     []string `zoom:"list"`
+	RandomId
+}
+
+func TestSwapIds(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	swapModels, err := testPool.NewCollectionWithOptions(&swapModel{}, DefaultCollectionOptions.WithIndex(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := "note"
+	a := &swapModel{Position: 1, Name: "a", Active: true, Status: "active", Note: &note}
+	b := &swapModel{Position: 2, Name: "b", Active: false, Status: "inactive"}
+	c := &swapModel{Position: 3, Name: "c", Active: true, Status: "active"}
+	for _, model := range []*swapModel{a, b, c} {
+		if err := swapModels.Save(model); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// List fields are only written by Append, and the newest value is first.
+	for _, tag := range []string{"x", "y"} {
+		if err := swapModels.Append(a.Id, "Tags", tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Tags = []string{"y", "x"}
+	idA, idB := a.Id, b.Id
+	if err := swapModels.SwapIds(idA, idB); err != nil {
+		t.Fatalf("Unexpected error in SwapIds: %s", err.Error())
+	}
+
+	// Each id should now refer to the data of the other model.
+	for id, expected := range map[string]*swapModel{idA: b, idB: a} {
+		got := &swapModel{}
+		if err := swapModels.Find(id, got); err != nil {
+			t.Fatalf("Unexpected error in Find: %s", err.Error())
+		}
+		expected.Id = id
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Expected model with id %s to be %+v but got %+v", id, expected, got)
+		}
+	}
+	a.Id, b.Id = idB, idA
+
+	// The indexes should be updated and consistent.
+	reports, err := swapModels.VerifyIndexes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, report := range reports {
+		if !report.OK() {
+			t.Errorf("Expected the index for %s to be consistent after SwapIds but got %+v", report.FieldName, report)
+		}
+	}
+	expectIds := func(q *Query, expected ...string) {
+		t.Helper()
+		got, err := q.Ids()
+		if err != nil {
+			t.Fatalf("Unexpected error in Query.Ids: %s", err.Error())
+		}
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Expected %s to return %v but got %v", q, expected, got)
+		}
+	}
+	expectIds(swapModels.NewQuery().Order("Position"), idB, idA, c.Id)
+	expectIds(swapModels.NewQuery().Filter("Name =", "a"), idB)
+	expectIds(swapModels.NewQuery().Filter("Active =", false), idA)
+	expectIds(swapModels.NewQuery().Filter("Status =", "inactive"), idA)
+	expectIds(swapModels.NewQuery().Filter("Note =", "note"), idB)
+
+	// Swapping with a model which does not exist should fail and change
+	// nothing.
+	if err := swapModels.SwapIds(idA, "missing"); err == nil {
+		t.Error("Expected an error swapping with a missing model but got none")
+	} else if _, ok := err.(ModelNotFoundError); !ok {
+		t.Errorf("Expected a ModelNotFoundError but got %T: %s", err, err.Error())
+	}
+	expectModelExists(t, swapModels, b)
+	expectKeyDoesNotExist(t, swapModels.ModelKey("missing"))
+
+	// Swapping a model with itself does nothing.
+	if err := swapModels.SwapIds(c.Id, c.Id); err != nil {
+		t.Fatalf("Unexpected error in SwapIds: %s", err.Error())
+	}
+	expectModelExists(t, swapModels, c)
+	expectIds(swapModels.NewQuery().Order("Position"), idB, idA, c.Id)
+	checkForLeakedTmpKeys(t, swapModels.NewQuery().query)
+}
@@ -8,7 +8,14 @@
 package zoom
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -16,11 +23,33 @@ import (
 // Transaction is an abstraction layer around a redis transaction.
 // Transactions consist of a set of actions which are either redis
 // commands or lua scripts. Transactions feature delayed execution,
-// so nothing toches the database until you call Exec.
+// so nothing toches the database until you call Exec. A single
+// transaction may include operations on any number of collections, as
+// long as they are stored in the same database as the pool which created
+// the transaction.
 type Transaction struct {
 	conn    redis.Conn
+	pool    *Pool
 	actions []*Action
 	err     error
+	// debug is an optional writer which, if not nil, receives a description of
+	// each action and how long it took when the transaction is executed. See
+	// Query.Debug.
+	debug io.Writer
+	// watching is true if WATCH has been called on the connection for the
+	// transaction. See watch.
+	watching bool
+	// writes contains the saves and deletes in the transaction, which are
+	// passed to the hooks for the pool after the transaction is executed. See
+	// Pool.OnSave and Pool.OnDelete.
+	writes []writeEvent
+	// ctx is the context for the transaction, or nil if it has none. If ctx
+	// has a deadline, it applies to every round trip in Exec. See
+	// newTransactionContext.
+	ctx context.Context
+	// tmpKeys are the temporary keys created by the transaction, which are
+	// deleted again if Exec stops because ctx is done. See unlinkTmpKeys.
+	tmpKeys []interface{}
 }
 
 // Action is a single step in a transaction and must be either a command
@@ -45,6 +74,23 @@ const (
 func (p *Pool) NewTransaction() *Transaction {
 	t := &Transaction{
 		conn: p.NewConn(),
+		pool: p,
+	}
+	return t
+}
+
+// newTransactionContext works like NewTransaction, but the transaction stops
+// waiting for a connection when ctx is done, and the deadline of ctx (if any)
+// applies to all of the round trips in Exec. If ctx is done before Exec
+// finishes, Exec returns ctx.Err().
+func (p *Pool) newTransactionContext(ctx context.Context) *Transaction {
+	t := &Transaction{
+		conn: p.newConn(ctx),
+		pool: p,
+		ctx:  ctx,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		t.conn = deadlineConn{Conn: t.conn, deadline: deadline}
 	}
 	return t
 }
@@ -57,6 +103,26 @@ func (t *Transaction) setError(err error) {
 	}
 }
 
+// ErrOptimisticLock is returned by Exec if the transaction was aborted
+// because one of the keys passed to Watch was modified by another connection.
+// None of the actions in the transaction are run in that case, so it is always
+// safe to retry (see Pool.WithOptimisticRetry).
+var ErrOptimisticLock = errors.New("zoom: transaction aborted because a watched key was modified")
+
+// Watch immediately sends the WATCH command for the given keys on the
+// connection for the transaction. If any of the keys are modified by another
+// connection before the transaction is executed, Exec will not run any of the
+// actions and will return ErrOptimisticLock. To implement a check-and-set,
+// call Watch before reading the values that your writes depend on, then add
+// the writes to the transaction and call Exec.
+func (t *Transaction) Watch(keys ...string) error {
+	if _, err := t.conn.Do("WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+		return err
+	}
+	t.watching = true
+	return nil
+}
+
 // Command adds a command action to the transaction with the given args.
 // handler will be called with the reply from this specific command when
 // the transaction is executed.
@@ -92,6 +158,39 @@ func (t *Transaction) sendAction(a *Action) error {
 	return nil
 }
 
+// debugf writes a formatted line to t.debug if it is not nil. Errors from the
+// writer are ignored since debug output is only informational.
+func (t *Transaction) debugf(format string, args ...interface{}) {
+	if t.debug == nil {
+		return
+	}
+	fmt.Fprintf(t.debug, "zoom: "+format+"\n", args...)
+}
+
+// String returns a human-readable description of a, consisting of the command
+// (or the name of the script) followed by its arguments.
+func (a *Action) String() string {
+	var name string
+	switch a.kind {
+	case CommandAction:
+		name = a.name
+	case ScriptAction:
+		name = "SCRIPT " + scriptNames[a.script]
+	}
+	args := make([]string, len(a.args))
+	for i, arg := range a.args {
+		if s, ok := arg.(string); ok {
+			args[i] = strconv.Quote(s)
+		} else {
+			args[i] = fmt.Sprint(arg)
+		}
+	}
+	if len(args) == 0 {
+		return name
+	}
+	return name + " " + strings.Join(args, " ")
+}
+
 // doAction writes a to the connection buffer and then immediately
 // flushes the buffer and reads the reply via conn.Do()
 func (t *Transaction) doAction(a *Action) (interface{}, error) {
@@ -105,8 +204,26 @@ func (t *Transaction) doAction(a *Action) (interface{}, error) {
 }
 
 // Exec executes the transaction, sequentially sending each action and
-// calling all the action handlers with the corresponding replies.
+// calling all the action handlers with the corresponding replies. If the
+// transaction contains exactly one action and is not watching any keys, the
+// action is sent on its own without MULTI/EXEC, since a single command or
+// script is already atomic. The reply and any error are the same either way.
+// For example, saving a model in an unindexed collection is a single script
+// which writes the main hash and the set of collection names (see
+// Pool.CollectionNames), so it does not use MULTI/EXEC.
 func (t *Transaction) Exec() error {
+	err := t.exec()
+	if err != nil && t.ctx != nil {
+		if ctxErr := t.contextErr(); ctxErr != nil {
+			go t.deleteTmpKeys()
+			return ctxErr
+		}
+	}
+	return err
+}
+
+// exec does the actual work for Exec.
+func (t *Transaction) exec() error {
 	// Return the connection to the pool when we are done
 	defer t.conn.Close()
 
@@ -115,11 +232,20 @@ func (t *Transaction) Exec() error {
 	if t.err != nil {
 		return t.err
 	}
+	if t.ctx != nil {
+		if err := t.contextErr(); err != nil {
+			return err
+		}
+	}
 
-	if len(t.actions) == 1 {
-		// If there is only one command, no need to use MULTI/EXEC
+	if len(t.actions) == 1 && !t.watching {
+		// If there is only one command, no need to use MULTI/EXEC. Watched
+		// keys only have an effect inside of MULTI/EXEC, so this is not
+		// possible if the transaction is watching any keys.
 		a := t.actions[0]
+		start := time.Now()
 		reply, err := t.doAction(a)
+		t.debugf("%s (%s)", a, time.Since(start))
 		if err != nil {
 			return err
 		}
@@ -133,14 +259,32 @@ func (t *Transaction) Exec() error {
 		if err := t.conn.Send("MULTI"); err != nil {
 			return err
 		}
-		for _, a := range t.actions {
+		t.debugf("MULTI")
+		flushEvery := t.pool.options.FlushEvery
+		for i, a := range t.actions {
+			t.debugf("%s", a)
 			if err := t.sendAction(a); err != nil {
 				return err
 			}
+			if flushEvery > 0 && (i+1)%flushEvery == 0 && i+1 < len(t.actions) {
+				// Redis queues the commands until EXEC, so this only bounds
+				// the amount of unsent data on the client (see
+				// PoolOptions.FlushEvery).
+				if err := t.conn.Flush(); err != nil {
+					return err
+				}
+			}
 		}
 
 		// Invoke redis driver to execute the transaction
+		start := time.Now()
 		replies, err := redis.Values(t.conn.Do("EXEC"))
+		t.debugf("EXEC %d actions (%s)", len(t.actions), time.Since(start))
+		if err == redis.ErrNil && t.watching {
+			// A nil reply to EXEC means that one of the watched keys was modified.
+			atomic.AddUint64(&t.pool.optimisticConflicts, 1)
+			return ErrOptimisticLock
+		}
 		if err != nil {
 			return err
 		}
@@ -158,9 +302,46 @@ func (t *Transaction) Exec() error {
 			}
 		}
 	}
+	t.callWriteHooks()
+	return nil
+}
+
+// contextErr returns the error from the context for the transaction if it is
+// done or its deadline has passed, and nil otherwise.
+func (t *Transaction) contextErr() error {
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := t.ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
 	return nil
 }
 
+// unlinkTmpKeys adds a command to the transaction which deletes the given
+// temporary keys with UNLINK. The keys are also remembered, so that if Exec
+// stops partway through because the context for the transaction is done, they
+// can be deleted on a different connection (see deleteTmpKeys).
+func (t *Transaction) unlinkTmpKeys(keys ...interface{}) {
+	t.tmpKeys = append(t.tmpKeys, keys...)
+	t.Command("UNLINK", redis.Args{}.Add(keys...), nil)
+}
+
+// deleteTmpKeys deletes the temporary keys for the transaction on a new
+// connection. It is called in a separate goroutine when Exec stops because the
+// context is done, in which case the UNLINK command in the transaction may not
+// have run, so that Exec can return without waiting for a database which is
+// already too slow. Errors are ignored, since any keys which remain are
+// harmless apart from their memory usage.
+func (t *Transaction) deleteTmpKeys() {
+	if len(t.tmpKeys) == 0 {
+		return
+	}
+	conn := t.pool.NewConn()
+	defer conn.Close()
+	_, _ = conn.Do("UNLINK", t.tmpKeys...)
+}
+
 //go:generate go run scripts/main.go
 
 // DeleteModelsBySetIds is a small function wrapper around a Lua script. The
@@ -170,7 +351,17 @@ func (t *Transaction) Exec() error {
 // the return value of the script. You can use the Name method of a Collection
 // to get the name.
 func (t *Transaction) DeleteModelsBySetIds(setKey string, collectionName string, handler ReplyHandler) {
-	t.Script(deleteModelsBySetIdsScript, redis.Args{setKey, collectionName}, handler)
+	t.deleteModelsBySetIds(setKey, collectionName, nil, handler)
+}
+
+// deleteModelsBySetIds works like DeleteModelsBySetIds, but also deletes the
+// given list fields for each model.
+func (t *Transaction) deleteModelsBySetIds(setKey string, collectionName string, lists []*fieldSpec, handler ReplyHandler) {
+	args := redis.Args{setKey, collectionName}
+	for _, fs := range lists {
+		args = append(args, fs.redisName)
+	}
+	t.Script(deleteModelsBySetIdsScript, args, handler)
 }
 
 // deleteStringIndex is a small function wrapper around a Lua script. The script
@@ -182,6 +373,117 @@ func (t *Transaction) deleteStringIndex(collectionName, modelId, fieldName strin
 	t.Script(deleteStringIndexScript, redis.Args{collectionName, modelId, fieldName}, nil)
 }
 
+// deleteEnumIndex is a small function wrapper around a Lua script. The script
+// will atomically remove the model with the given modelId from the enum index
+// on the given fieldName, using the value currently stored in the model hash.
+// fieldName should be the name as it is stored in Redis.
+func (t *Transaction) deleteEnumIndex(collectionName, modelId, fieldName string) {
+	t.Script(deleteEnumIndexScript, redis.Args{collectionName, modelId, fieldName}, nil)
+}
+
+// deleteEnumBuckets is a small function wrapper around a Lua script. The
+// script will atomically delete every key used by the enum index identified by
+// indexKey.
+func (t *Transaction) deleteEnumBuckets(indexKey string) {
+	t.Script(deleteEnumBucketsScript, redis.Args{indexKey}, nil)
+}
+
+// execCommands is a small function wrapper around a Lua script. The script
+// will atomically run each of the given command actions in order, so that they
+// count as a single action for Exec. If there is only one action, or if any of
+// the actions is not a command or has a handler (which the script could not
+// call), the actions are added to the transaction as they are instead.
+func (t *Transaction) execCommands(actions []*Action) {
+	combine := len(actions) > 1
+	for _, a := range actions {
+		if a.kind != CommandAction || a.handler != nil {
+			combine = false
+		}
+	}
+	if !combine {
+		t.actions = append(t.actions, actions...)
+		return
+	}
+	args, err := appendCommandArgs(redis.Args{}, actions)
+	if err != nil {
+		t.setError(fmt.Errorf("zoom: error in execCommands: %s", err.Error()))
+		return
+	}
+	t.Script(execCommandsScript, args, nil)
+}
+
+// execCommandsIfNotExists is a small function wrapper around a Lua script. The
+// script will atomically check if key exists and, if it does not, run each of
+// the given command actions in order. The reply is 1 if the commands were run
+// and 0 if key already existed. The handlers for the actions are not called,
+// and all of the actions must be commands since scripts cannot be run from
+// inside of another script.
+func (t *Transaction) execCommandsIfNotExists(key string, actions []*Action, handler ReplyHandler) {
+	args, err := appendCommandArgs(redis.Args{key}, actions)
+	if err != nil {
+		t.setError(fmt.Errorf("zoom: error in execCommandsIfNotExists: %s", err.Error()))
+		return
+	}
+	t.Script(execCommandsIfNotExistsScript, args, handler)
+}
+
+// execCommandsIf is a small function wrapper around a Lua script. The script
+// will atomically compare the value stored in fieldName (the name as it is
+// stored in Redis) for the model with the given modelId to value using op. kind
+// should be either "numeric" or "string" and determines how the values are
+// compared. If the condition holds, or if there is no stored value for the
+// field, the script removes the model from the string indexes on each of
+// stringIndexes and the enum indexes on each of enumIndexes, pushes the old
+// version of the model onto the list identified by historyKey (keeping at most
+// keepHistory entries) if historyKey is not empty, runs each of the given
+// command actions in order, and replies with 1. Otherwise the reply is 0. As
+// with execCommandsIfNotExists, the handlers for the actions are not called and
+// all of the actions must be commands.
+func (t *Transaction) execCommandsIf(collectionName, modelId, fieldName, kind string, op filterOp, value interface{}, stringIndexes []string, enumIndexes []string, historyKey string, keepHistory int, actions []*Action, handler ReplyHandler) {
+	args := redis.Args{collectionName, modelId, fieldName, kind, op.String(), value, len(stringIndexes)}
+	args = args.AddFlat(stringIndexes)
+	args = append(args, len(enumIndexes))
+	args = args.AddFlat(enumIndexes)
+	args = append(args, historyKey, keepHistory)
+	args, err := appendCommandArgs(args, actions)
+	if err != nil {
+		t.setError(fmt.Errorf("zoom: error in execCommandsIf: %s", err.Error()))
+		return
+	}
+	t.Script(execCommandsIfScript, args, handler)
+}
+
+// appendCommandArgs appends the name and arguments of each action to args in
+// the format expected by the exec_commands_if and exec_commands_if_not_exists
+// scripts. It returns an error if any of the actions is not a command.
+func appendCommandArgs(args redis.Args, actions []*Action) (redis.Args, error) {
+	for _, a := range actions {
+		if a.kind != CommandAction {
+			return nil, fmt.Errorf("action %s is not a command", a)
+		}
+		args = append(args, len(a.args)+1, a.name)
+		args = append(args, a.args...)
+	}
+	return args, nil
+}
+
+// getCachedCount is a small function wrapper around a Lua script. The script
+// will read the current write count for the collection identified by spec and
+// use it along with querySum to build the key for a cached query count. The
+// reply is a two-element array consisting of the key and the cached count (or
+// nil if there is no cached count).
+func (t *Transaction) getCachedCount(spec *modelSpec, querySum string, handler ReplyHandler) {
+	t.Script(getCachedCountScript, redis.Args{spec.writeCountKey(), spec.countCachePrefix(), querySum}, handler)
+}
+
+// getCachedResults works exactly like getCachedCount, except that the key is
+// built for cached query results instead of a cached count. The second element
+// of the reply is the encoded results (or nil if there are no cached results).
+// See Query.Cache.
+func (t *Transaction) getCachedResults(spec *modelSpec, querySum string, handler ReplyHandler) {
+	t.Script(getCachedCountScript, redis.Args{spec.writeCountKey(), spec.resultCachePrefix(), querySum}, handler)
+}
+
 // ExtractIdsFromFieldIndex is a small function wrapper around a Lua script. The
 // script will get all the ids from the sorted set identified by setKey using
 // ZRANGEBYSCORE with the given min and max, and then store them in a sorted set
@@ -192,6 +494,21 @@ func (t *Transaction) ExtractIdsFromFieldIndex(setKey string, destKey string, mi
 	t.Script(extractIdsFromFieldIndexScript, redis.Args{setKey, destKey, min, max}, nil)
 }
 
+// extractIdsBySubstring is a small function wrapper around a Lua script. The
+// script will read the field identified by fieldName from the main hash of
+// each model with an id in setKey and store the ids of the models where the
+// field contains substring in the sorted set identified by destKey. If setKey is
+// a sorted set, the scores (and therefore the order) are preserved. If
+// maxMatches is greater than 0, the script stops once that many ids have been
+// stored. If reverse is true, the ids in setKey are scanned in reverse order.
+func (t *Transaction) extractIdsBySubstring(setKey, destKey, collectionName, fieldName, substring string, maxMatches uint, reverse bool) {
+	reverseArg := "0"
+	if reverse {
+		reverseArg = "1"
+	}
+	t.Script(extractIdsBySubstringScript, redis.Args{setKey, destKey, collectionName, fieldName, substring, maxMatches, reverseArg}, nil)
+}
+
 // ExtractIdsFromStringIndex is a small function wrapper around a Lua script.
 // The script will extract the ids from a sorted set identified by setKey using
 // ZRANGEBYLEX with the given min and max, and then store them in a sorted set
@@ -206,6 +523,15 @@ func (t *Transaction) ExtractIdsFromStringIndex(setKey, destKey, min, max string
 	t.Script(extractIdsFromStringIndexScript, redis.Args{setKey, destKey, min, max}, nil)
 }
 
+// intersectFilters is a small function wrapper around a Lua script. The script
+// will apply each of the filters described by steps (see filterStep) in order,
+// starting with the ids in origKey, and store the ids which match all of them
+// in the sorted set identified by destKey. The scores from origKey are
+// preserved, so the ids can still be ordered.
+func (t *Transaction) intersectFilters(origKey, destKey string, steps redis.Args) {
+	t.Script(intersectFiltersScript, append(redis.Args{origKey, destKey}, steps...), nil)
+}
+
 func (t *Transaction) FindModelsByIdsKey(collection *Collection, idsKey string, fieldNames []string, limit uint, offset uint, reverse bool, models interface{}) {
 	if err := collection.checkModelsType(models); err != nil {
 		t.setError(fmt.Errorf("zoom: error in FindModelsByIdKey: %s", err.Error()))
@@ -1,6 +1,13 @@
 package zoom
 
-import "github.com/garyburd/redigo/redis"
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+)
 
 // TransactionalQuery represents a query which will be run inside an existing
 // transaction. A TransactionalQuery may consist of one or more query modifiers
@@ -50,6 +57,20 @@ func (q *TransactionQuery) Order(fieldName string) *TransactionQuery {
 	return q
 }
 
+// OrderUnindexed works exactly like Query.OrderUnindexed. See the
+// documentation for Query.OrderUnindexed for a full description.
+func (q *TransactionQuery) OrderUnindexed(fieldName string) *TransactionQuery {
+	q.query.OrderUnindexed(fieldName)
+	return q
+}
+
+// Unordered works exactly like Query.Unordered. See the documentation for
+// Query.Unordered for more information.
+func (q *TransactionQuery) Unordered() *TransactionQuery {
+	q.query.Unordered()
+	return q
+}
+
 // Limit works exactly like Query.Limit. See the documentation for Query.Limit
 // for more information.
 func (q *TransactionQuery) Limit(amount uint) *TransactionQuery {
@@ -85,12 +106,48 @@ func (q *TransactionQuery) Filter(filterString string, value interface{}) *Trans
 	return q
 }
 
+// Not works exactly like Query.Not. See the documentation for Query.Not for
+// more information.
+func (q *TransactionQuery) Not() *TransactionQuery {
+	q.query.Not()
+	return q
+}
+
+// Err works exactly like Query.Err. See the documentation for Query.Err for
+// more information.
+func (q *TransactionQuery) Err() error {
+	return q.err
+}
+
+// UnindexedFilter works exactly like Query.UnindexedFilter. See the
+// documentation for Query.UnindexedFilter for more information.
+func (q *TransactionQuery) UnindexedFilter(filterString string, value string) *TransactionQuery {
+	q.query.UnindexedFilter(filterString, value)
+	return q
+}
+
+// FilterFunc works exactly like Query.FilterFunc. See the documentation for
+// Query.FilterFunc for more information.
+func (q *TransactionQuery) FilterFunc(fn func(Model) bool) *TransactionQuery {
+	q.query.FilterFunc(fn)
+	return q
+}
+
 // Run will run the query and scan the results into models when the Transaction
 // is executed. It works very similarly to Query.Run, so you can check the
 // documentation for Query.Run for more information. The first error encountered
 // will be saved to the corresponding Transaction (if there is not already an
 // error for the Transaction) and returned when you call Transaction.Exec.
 func (q *TransactionQuery) Run(models interface{}) {
+	q.run(models, nil, nil)
+}
+
+// run does the actual work for Run. If onReply is not nil, it will be called
+// with the raw reply from the SORT command before the models are scanned. It
+// is only called for queries without a FilterFunc. If scanErrs is not nil,
+// models which cannot be scanned are left out of models and their errors are
+// appended to scanErrs (see newPartialScanModelsHandler).
+func (q *TransactionQuery) run(models interface{}, onReply ReplyHandler, scanErrs *[]ScanError) {
 	if q.hasError() {
 		q.tx.setError(q.err)
 		return
@@ -99,7 +156,12 @@ func (q *TransactionQuery) Run(models interface{}) {
 		q.tx.setError(err)
 		return
 	}
-	idsKey, tmpKeys, err := generateIdsSet(q.query, q.tx)
+	plan, err := q.plan()
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	idsKey, tmpKeys, err := generateIdsSet(q.query, plan, q.tx)
 	if err != nil {
 		q.tx.setError(err)
 		return
@@ -110,10 +172,80 @@ func (q *TransactionQuery) Run(models interface{}) {
 		// But in redis, -1 means unlimited
 		limit = -1
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, q.redisFieldNames(), limit, q.offset, q.order.kind == descendingOrder)
-	q.tx.Command("SORT", sortArgs, newScanModelsHandler(q.collection.spec, append(q.fieldNames(), "-"), models))
+	if q.hasFilterFuncs() {
+		sortArgs := q.unlimitedSortArgs(idsKey, plan.getArgs)
+		q.tx.Command("SORT", sortArgs, q.newFilterFuncsHandler(plan.fieldNames, scanErrs, func(matches reflect.Value) error {
+			setModelsVal(reflect.ValueOf(models).Elem(), matches)
+			return nil
+		}))
+	} else {
+		sortArgs := q.sortArgs(idsKey, plan.getArgs, limit)
+		handler := newPartialScanModelsHandler(q.collection.spec, plan.fieldNames, models, scanErrs)
+		if onReply != nil {
+			scanModels := handler
+			handler = func(reply interface{}) error {
+				if err := onReply(reply); err != nil {
+					return err
+				}
+				return scanModels(reply)
+			}
+		}
+		q.tx.Command("SORT", sortArgs, handler)
+	}
 	if len(tmpKeys) > 0 {
-		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+		q.tx.unlinkTmpKeys(tmpKeys...)
+	}
+}
+
+// RunPageSorted will run the query, scan the results into models, and set the
+// value of total to the number of models which match the query criteria
+// (ignoring Limit and Offset) when the Transaction is executed. It works very
+// similarly to Query.RunPageSorted, so you can check the documentation for
+// Query.RunPageSorted for more information. The first error encountered will be
+// saved to the corresponding Transaction (if there is not already an error for
+// the Transaction) and returned when you call Transaction.Exec.
+func (q *TransactionQuery) RunPageSorted(models interface{}, total *int) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	if !q.hasOrder() {
+		q.tx.setError(fmt.Errorf("zoom: error in Query.RunPageSorted: the query must have an Order"))
+		return
+	}
+	if q.hasFilterFuncs() {
+		q.tx.setError(fmt.Errorf("zoom: error in Query.RunPageSorted: queries with FilterFunc are not supported"))
+		return
+	}
+	if err := q.collection.spec.checkModelsType(models); err != nil {
+		q.tx.setError(err)
+		return
+	}
+	plan, err := q.plan()
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	idsKey, tmpKeys, err := generateIdsSet(q.query, plan, q.tx)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	// The query has an order, so idsKey is always a sorted set, except for
+	// queries with OrderUnindexed and no filters, which use the set of all ids.
+	cardCommand := "ZCARD"
+	if idsKey == q.collection.spec.indexKey() {
+		cardCommand = "SCARD"
+	}
+	q.tx.Command(cardCommand, redis.Args{idsKey}, NewScanIntHandler(total))
+	limit := int(q.limit)
+	if limit == 0 {
+		limit = -1
+	}
+	sortArgs := q.sortArgs(idsKey, plan.getArgs, limit)
+	q.tx.Command("SORT", sortArgs, newScanModelsHandler(q.collection.spec, plan.fieldNames, models))
+	if len(tmpKeys) > 0 {
+		q.tx.unlinkTmpKeys(tmpKeys...)
 	}
 }
 
@@ -133,15 +265,32 @@ func (q *TransactionQuery) RunOne(model Model) {
 		q.tx.setError(err)
 		return
 	}
-	idsKey, tmpKeys, err := generateIdsSet(q.query, q.tx)
+	plan, err := q.plan()
 	if err != nil {
 		q.tx.setError(err)
 		return
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, q.redisFieldNames(), 1, q.offset, q.order.kind == descendingOrder)
-	q.tx.Command("SORT", sortArgs, newScanOneModelHandler(q.query, q.collection.spec, append(q.fieldNames(), "-"), model))
+	idsKey, tmpKeys, err := generateIdsSet(q.query, plan, q.tx)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	if q.hasFilterFuncs() {
+		sortArgs := q.unlimitedSortArgs(idsKey, plan.getArgs)
+		q.tx.Command("SORT", sortArgs, q.newFilterFuncsHandler(plan.fieldNames, nil, func(matches reflect.Value) error {
+			if matches.Len() == 0 {
+				msg := fmt.Sprintf("Could not find a model with the given query criteria: %s", q)
+				return ModelNotFoundError{Msg: msg}
+			}
+			reflect.ValueOf(model).Elem().Set(matches.Index(0).Elem())
+			return nil
+		}))
+	} else {
+		sortArgs := q.sortArgs(idsKey, plan.getArgs, 1)
+		q.tx.Command("SORT", sortArgs, newScanOneModelHandler(q.query, q.collection.spec, plan.fieldNames, model))
+	}
 	if len(tmpKeys) > 0 {
-		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+		q.tx.unlinkTmpKeys(tmpKeys...)
 	}
 }
 
@@ -156,9 +305,42 @@ func (q *TransactionQuery) Count(count *int) {
 		q.tx.setError(q.err)
 		return
 	}
-	if !q.hasFilters() {
-		// Start by getting the number of models in the all index set
-		q.tx.Command("SCARD", redis.Args{q.collection.spec.indexKey()}, func(reply interface{}) error {
+	if q.hasFilterFuncs() {
+		// The models need to be read from the database in order to apply the
+		// filter funcs, so we count the models which pass them.
+		plan, err := q.plan()
+		if err != nil {
+			q.tx.setError(err)
+			return
+		}
+		idsKey, tmpKeys, err := generateIdsSet(q.query, plan, q.tx)
+		if err != nil {
+			q.tx.setError(err)
+			return
+		}
+		sortArgs := q.unlimitedSortArgs(idsKey, plan.getArgs)
+		q.tx.Command("SORT", sortArgs, q.newFilterFuncsHandler(plan.fieldNames, nil, func(matches reflect.Value) error {
+			(*count) = matches.Len()
+			return nil
+		}))
+		if len(tmpKeys) > 0 {
+			q.tx.unlinkTmpKeys(tmpKeys...)
+		}
+	} else if !q.hasFilters() && !q.hasUnindexedFilters() {
+		// Start by getting the number of models in the all index set. If the
+		// query is ordered by an index, only the models in that index are
+		// returned (e.g. while a new index is being built), so count those
+		// instead.
+		countCommand, countArgs := "SCARD", redis.Args{q.collection.spec.indexKey()}
+		if q.hasIndexedOrder() {
+			plan, err := q.plan()
+			if err != nil {
+				q.tx.setError(err)
+				return
+			}
+			countCommand, countArgs = "ZCARD", redis.Args{plan.orderIndexKey}
+		}
+		q.tx.Command(countCommand, countArgs, func(reply interface{}) error {
 			gotCount, err := redis.Int(reply, nil)
 			if err != nil {
 				return err
@@ -183,10 +365,102 @@ func (q *TransactionQuery) Count(count *int) {
 		q.StoreIds(destKey)
 		q.tx.Command("LLEN", redis.Args{destKey}, NewScanIntHandler(count))
 		// Delete the temporary destKey when we're done.
-		q.tx.Command("DEL", redis.Args{destKey}, nil)
+		q.tx.unlinkTmpKeys(destKey)
 	}
 }
 
+// Distinct will find the distinct values of the given indexed field for the
+// models that match the query criteria and set the value of values. It works
+// very similarly to Query.Distinct, so you can check the documentation for
+// Query.Distinct for more information. The first error encountered will be
+// saved to the corresponding Transaction (if there is not already an error for
+// the Transaction) and returned when you call Transaction.Exec.
+func (q *TransactionQuery) Distinct(fieldName string, values *[]string) {
+	if q.hasError() {
+		q.tx.setError(q.err)
+		return
+	}
+	if q.hasFilterFuncs() {
+		q.tx.setError(fmt.Errorf("zoom: error in Query.Distinct: queries with FilterFunc are not supported"))
+		return
+	}
+	fs, found := q.collection.spec.fieldsByName[fieldName]
+	if !found {
+		q.tx.setError(fmt.Errorf("zoom: error in Query.Distinct: could not find field %s in type %s", fieldName, q.collection.spec.typ.String()))
+		return
+	}
+	if fs.indexKind == noIndex {
+		q.tx.setError(fmt.Errorf("zoom: error in Query.Distinct: field %s in type %s is not indexed", fieldName, q.collection.spec.typ.String()))
+		return
+	}
+	indexKey, err := q.collection.spec.fieldIndexKey(fieldName)
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	args := redis.Args{q.collection.Name(), indexKey, fs.indexKind.scriptName(), fs.redisName}
+	if !q.hasFilters() && !q.hasUnindexedFilters() && !q.hasLimit() && !q.hasOffset() && fs.indexKeyFunc == nil && fs.indexKind != sparseBoolIndex {
+		// Every model is included, so the values can be read from the index
+		// directly. That doesn't work for string indexes with a custom key
+		// function, since the index contains the keys instead of the values,
+		// or for sparse boolean indexes, which do not contain the false values.
+		q.tx.Script(distinctValuesScript, args.Add(""), newScanDistinctValuesHandler(fs.indexKind, values))
+		return
+	}
+	// Otherwise, store the ids which match the query criteria and look up the
+	// value for each of them.
+	destKey := generateRandomKey("tmp:distinctDestKey")
+	q.StoreIds(destKey)
+	q.tx.Script(distinctValuesScript, args.Add(destKey), newScanDistinctValuesHandler(fs.indexKind, values))
+	q.tx.unlinkTmpKeys(destKey)
+}
+
+// newScanDistinctValuesHandler returns a ReplyHandler which will scan the reply
+// from the distinct_values script into values and sort them. Values from
+// numeric indexes are sorted numerically and values from boolean indexes are
+// converted to "false" and "true".
+func newScanDistinctValuesHandler(kind indexKind, values *[]string) ReplyHandler {
+	return func(reply interface{}) error {
+		got, err := redis.Strings(reply, nil)
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case numericIndex:
+			scores := make([]float64, len(got))
+			for i, value := range got {
+				if scores[i], err = strconv.ParseFloat(value, 64); err != nil {
+					return err
+				}
+			}
+			sort.Sort(distinctScores{values: got, scores: scores})
+		case booleanIndex, sparseBoolIndex:
+			// Boolean values are stored as scores of 0 (false) or 1 (true)
+			for i, value := range got {
+				got[i] = strconv.FormatBool(value == "1")
+			}
+			sort.Strings(got)
+		default:
+			sort.Strings(got)
+		}
+		(*values) = got
+		return nil
+	}
+}
+
+// distinctScores sorts the values from a numeric index by their scores.
+type distinctScores struct {
+	values []string
+	scores []float64
+}
+
+func (d distinctScores) Len() int           { return len(d.values) }
+func (d distinctScores) Less(i, j int) bool { return d.scores[i] < d.scores[j] }
+func (d distinctScores) Swap(i, j int) {
+	d.values[i], d.values[j] = d.values[j], d.values[i]
+	d.scores[i], d.scores[j] = d.scores[j], d.scores[i]
+}
+
 // Ids will find the ids for models matching the query criteria and set the
 // value of ids. It works very similarly to Query.Ids, so you can check the
 // documentation for Query.Ids for more information. The first error encountered
@@ -197,9 +471,15 @@ func (q *TransactionQuery) Ids(ids *[]string) {
 		q.tx.setError(q.err)
 		return
 	}
-	idsKey, tmpKeys, err := generateIdsSet(q.query, q.tx)
+	plan, err := q.plan()
 	if err != nil {
 		q.tx.setError(err)
+		return
+	}
+	idsKey, tmpKeys, err := generateIdsSet(q.query, plan, q.tx)
+	if err != nil {
+		q.tx.setError(err)
+		return
 	}
 	limit := int(q.limit)
 	if limit == 0 {
@@ -207,10 +487,23 @@ func (q *TransactionQuery) Ids(ids *[]string) {
 		// But in redis, -1 means unlimited
 		limit = -1
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, nil, limit, q.offset, q.order.kind == descendingOrder)
-	q.tx.Command("SORT", sortArgs, NewScanStringsHandler(ids))
+	if q.hasFilterFuncs() {
+		// The models need to be read from the database in order to apply the
+		// filter funcs.
+		sortArgs := q.unlimitedSortArgs(idsKey, plan.getArgs)
+		q.tx.Command("SORT", sortArgs, q.newFilterFuncsHandler(plan.fieldNames, nil, func(matches reflect.Value) error {
+			(*ids) = make([]string, matches.Len())
+			for i := range *ids {
+				(*ids)[i] = matches.Index(i).Interface().(Model).ModelId()
+			}
+			return nil
+		}))
+	} else {
+		sortArgs := q.sortArgs(idsKey, idGetArgs, limit)
+		q.tx.Command("SORT", sortArgs, NewScanStringsHandler(ids))
+	}
 	if len(tmpKeys) > 0 {
-		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+		q.tx.unlinkTmpKeys(tmpKeys...)
 	}
 }
 
@@ -225,9 +518,19 @@ func (q *TransactionQuery) StoreIds(destKey string) {
 		q.tx.setError(q.err)
 		return
 	}
-	idsKey, tmpKeys, err := generateIdsSet(q.query, q.tx)
+	if q.hasFilterFuncs() {
+		q.tx.setError(fmt.Errorf("zoom: error in StoreIds: queries with FilterFunc cannot be used with StoreIds because the ids are stored by Redis directly"))
+		return
+	}
+	plan, err := q.plan()
+	if err != nil {
+		q.tx.setError(err)
+		return
+	}
+	idsKey, tmpKeys, err := generateIdsSet(q.query, plan, q.tx)
 	if err != nil {
 		q.tx.setError(err)
+		return
 	}
 	limit := int(q.limit)
 	if limit == 0 {
@@ -235,11 +538,11 @@ func (q *TransactionQuery) StoreIds(destKey string) {
 		// But in Redis, -1 means unlimited
 		limit = -1
 	}
-	sortArgs := q.collection.spec.sortArgs(idsKey, nil, limit, q.offset, q.order.kind == descendingOrder)
+	sortArgs := q.sortArgs(idsKey, idGetArgs, limit)
 	// Append the STORE argument to cause Redis to store the results in destKey.
 	sortAndStoreArgs := append(sortArgs, "STORE", destKey)
 	q.tx.Command("SORT", sortAndStoreArgs, nil)
 	if len(tmpKeys) > 0 {
-		q.tx.Command("DEL", (redis.Args{}).Add(tmpKeys...), nil)
+		q.tx.unlinkTmpKeys(tmpKeys...)
 	}
 }
@@ -0,0 +1,347 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+// File typed_collection.go contains a thin, type-safe wrapper around
+// Collection and Query which uses generics. It requires Go 1.18 or later.
+
+package zoom
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// TypedCollection is a type-safe wrapper around a Collection for models of type
+// T, which must be a pointer to a struct (e.g. *Person). Its methods take and
+// return values of type T instead of Model or interface{}, so no type
+// assertions are needed. TypedCollection is a thin layer over Collection, so
+// the two can be used interchangeably for the same models. Use the Collection
+// method to access any methods which are not provided by TypedCollection (e.g.
+// the Transaction methods).
+type TypedCollection[T Model] struct {
+	collection *Collection
+}
+
+// NewTypedCollection registers and returns a new collection of models of type
+// T, using DefaultCollectionOptions. See Pool.NewCollection for more
+// information.
+func NewTypedCollection[T Model](pool *Pool) (*TypedCollection[T], error) {
+	return NewTypedCollectionWithOptions[T](pool, DefaultCollectionOptions)
+}
+
+// NewTypedCollectionWithOptions registers and returns a new collection of
+// models of type T with the given options. See Pool.NewCollectionWithOptions
+// for more information.
+func NewTypedCollectionWithOptions[T Model](pool *Pool, options CollectionOptions) (*TypedCollection[T], error) {
+	model, err := newTypedModel[T]()
+	if err != nil {
+		return nil, err
+	}
+	collection, err := pool.NewCollectionWithOptions(model, options)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedCollection[T]{collection: collection}, nil
+}
+
+// Typed returns a TypedCollection which wraps an existing collection. It
+// returns an error if T is not the type that the collection was registered
+// with.
+func Typed[T Model](collection *Collection) (*TypedCollection[T], error) {
+	if collection == nil {
+		return nil, newNilCollectionError("Typed")
+	}
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if typ != collection.spec.typ {
+		return nil, fmt.Errorf("zoom: Error in Typed: collection %s has type %s but got %s", collection.Name(), collection.spec.typ.String(), typ.String())
+	}
+	return &TypedCollection[T]{collection: collection}, nil
+}
+
+// newTypedModel allocates and returns a new model of type T. It returns an
+// error if T is not a pointer to a struct.
+func newTypedModel[T Model]() (T, error) {
+	var zero T
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if !typeIsPointerToStruct(typ) {
+		return zero, fmt.Errorf("zoom: type parameter for TypedCollection must be a pointer to a struct, but got %s", typ.String())
+	}
+	return reflect.New(typ.Elem()).Interface().(T), nil
+}
+
+// isNilModel returns true iff model is a nil pointer.
+func isNilModel[T Model](model T) bool {
+	val := reflect.ValueOf(model)
+	return !val.IsValid() || val.IsNil()
+}
+
+// Collection returns the underlying Collection.
+func (tc *TypedCollection[T]) Collection() *Collection {
+	return tc.collection
+}
+
+// Name returns the name of the underlying Collection.
+func (tc *TypedCollection[T]) Name() string {
+	return tc.collection.Name()
+}
+
+// Save writes the model to the database. It returns an error if model is nil.
+// See Collection.Save for more information.
+func (tc *TypedCollection[T]) Save(model T) error {
+	if isNilModel(model) {
+		return fmt.Errorf("zoom: Error in TypedCollection.Save: model is nil")
+	}
+	return tc.collection.Save(model)
+}
+
+// SaveFields saves only the given fields of the model. It returns an error if
+// model is nil. See Collection.SaveFields for more information.
+func (tc *TypedCollection[T]) SaveFields(fieldNames []string, model T) error {
+	if isNilModel(model) {
+		return fmt.Errorf("zoom: Error in TypedCollection.SaveFields: model is nil")
+	}
+	return tc.collection.SaveFields(fieldNames, model)
+}
+
+// Find returns a newly allocated model with the given id. If there was an
+// error (e.g. the model does not exist), Find returns nil and the error. See
+// Collection.Find for more information.
+func (tc *TypedCollection[T]) Find(id string) (T, error) {
+	var zero T
+	model, err := newTypedModel[T]()
+	if err != nil {
+		return zero, err
+	}
+	if err := tc.collection.Find(id, model); err != nil {
+		return zero, err
+	}
+	return model, nil
+}
+
+// FindOrZero is like Find, but if the model does not exist it returns a newly
+// allocated zero-valued model and false instead of an error. See
+// Collection.FindOrZero for more information.
+func (tc *TypedCollection[T]) FindOrZero(id string) (T, bool, error) {
+	var zero T
+	model, err := newTypedModel[T]()
+	if err != nil {
+		return zero, false, err
+	}
+	found, err := tc.collection.FindOrZero(id, model)
+	if err != nil {
+		return zero, false, err
+	}
+	return model, found, nil
+}
+
+// FindOrLoad returns a newly allocated model with the given id, calling loader
+// to fetch and save it if it does not exist. See Collection.FindOrLoad for more
+// information.
+func (tc *TypedCollection[T]) FindOrLoad(id string, loader func(id string) (T, error), ttl time.Duration) (T, error) {
+	var zero T
+	model, err := newTypedModel[T]()
+	if err != nil {
+		return zero, err
+	}
+	load := func(id string) (Model, error) {
+		loaded, err := loader(id)
+		if err != nil {
+			return nil, err
+		}
+		return loaded, nil
+	}
+	if err := tc.collection.FindOrLoad(id, model, load, ttl); err != nil {
+		return zero, err
+	}
+	return model, nil
+}
+
+// FindFields is like Find but only sets the given fields of the returned
+// model. See Collection.FindFields for more information.
+func (tc *TypedCollection[T]) FindFields(id string, fieldNames []string) (T, error) {
+	var zero T
+	model, err := newTypedModel[T]()
+	if err != nil {
+		return zero, err
+	}
+	if err := tc.collection.FindFields(id, fieldNames, model); err != nil {
+		return zero, err
+	}
+	return model, nil
+}
+
+// FindAll returns all the models in the collection. If there are no models,
+// it returns an empty slice. See Collection.FindAll for more information.
+func (tc *TypedCollection[T]) FindAll() ([]T, error) {
+	models := []T{}
+	if err := tc.collection.FindAll(&models); err != nil {
+		return nil, err
+	}
+	return models, nil
+}
+
+// Delete removes the model with the given id from the database. See
+// Collection.Delete for more information.
+func (tc *TypedCollection[T]) Delete(id string) (bool, error) {
+	return tc.collection.Delete(id)
+}
+
+// Count returns the number of models in the collection. See Collection.Count
+// for more information.
+func (tc *TypedCollection[T]) Count() (int, error) {
+	return tc.collection.Count()
+}
+
+// NewQuery returns a new TypedQuery for the collection. See
+// Collection.NewQuery for more information.
+func (tc *TypedCollection[T]) NewQuery() *TypedQuery[T] {
+	return &TypedQuery[T]{query: tc.collection.NewQuery()}
+}
+
+// TypedQuery is a type-safe wrapper around a Query for models of type T. Its
+// finishers return values of type T instead of scanning into an interface{}.
+// Use the Query method to access any modifiers which are not provided by
+// TypedQuery.
+type TypedQuery[T Model] struct {
+	query *Query
+}
+
+// Query returns the underlying Query. Any modifiers applied to it also apply
+// to the TypedQuery.
+func (tq *TypedQuery[T]) Query() *Query {
+	return tq.query
+}
+
+// Order specifies a field by which to sort the models. See Query.Order for
+// more information.
+func (tq *TypedQuery[T]) Order(fieldName string) *TypedQuery[T] {
+	tq.query.Order(fieldName)
+	return tq
+}
+
+// Limit specifies an upper limit on the number of models to return. See
+// Query.Limit for more information.
+func (tq *TypedQuery[T]) Limit(amount uint) *TypedQuery[T] {
+	tq.query.Limit(amount)
+	return tq
+}
+
+// Offset specifies a starting index from which to start counting models. See
+// Query.Offset for more information.
+func (tq *TypedQuery[T]) Offset(amount uint) *TypedQuery[T] {
+	tq.query.Offset(amount)
+	return tq
+}
+
+// Include specifies the fields which will be read from the database. See
+// Query.Include for more information.
+func (tq *TypedQuery[T]) Include(fields ...string) *TypedQuery[T] {
+	tq.query.Include(fields...)
+	return tq
+}
+
+// Exclude specifies the fields which will not be read from the database. See
+// Query.Exclude for more information.
+func (tq *TypedQuery[T]) Exclude(fields ...string) *TypedQuery[T] {
+	tq.query.Exclude(fields...)
+	return tq
+}
+
+// Filter applies a filter to the query. See Query.Filter for more information.
+func (tq *TypedQuery[T]) Filter(filterString string, value interface{}) *TypedQuery[T] {
+	tq.query.Filter(filterString, value)
+	return tq
+}
+
+// Not negates the next filter. See Query.Not for more information.
+func (tq *TypedQuery[T]) Not() *TypedQuery[T] {
+	tq.query.Not()
+	return tq
+}
+
+// AllowPartialResults causes Run to skip models which cannot be scanned. See
+// Query.AllowPartialResults for more information.
+func (tq *TypedQuery[T]) AllowPartialResults() *TypedQuery[T] {
+	tq.query.AllowPartialResults()
+	return tq
+}
+
+// Run executes the query and returns the models that fit the criteria. If no
+// models fit the criteria, Run returns an empty slice. If the query has
+// AllowPartialResults and some models could not be scanned, Run returns the
+// other models along with a PartialResultsError. See Query.Run for more
+// information.
+func (tq *TypedQuery[T]) Run() ([]T, error) {
+	models := []T{}
+	if err := tq.query.Run(&models); err != nil {
+		if _, ok := err.(PartialResultsError); ok {
+			return models, err
+		}
+		return nil, err
+	}
+	return models, nil
+}
+
+// RunPageSorted executes the query and returns the models that fit the criteria
+// along with the total number of models that fit the criteria, ignoring Limit
+// and Offset. See Query.RunPageSorted for more information.
+func (tq *TypedQuery[T]) RunPageSorted() ([]T, int, error) {
+	models := []T{}
+	total, err := tq.query.RunPageSorted(&models)
+	if err != nil {
+		return nil, 0, err
+	}
+	return models, total, nil
+}
+
+// RunWith executes the query and scans each resulting model into a model
+// returned by alloc, which is then passed to consume. See Query.RunWith for
+// more information, including the lifetime rules for the models.
+func (tq *TypedQuery[T]) RunWith(alloc func() T, consume func(T) error) error {
+	if alloc == nil || consume == nil {
+		return fmt.Errorf("zoom: error in TypedQuery.RunWith: alloc and consume cannot be nil")
+	}
+	return tq.query.RunWith(func() Model {
+		return alloc()
+	}, func(model Model) error {
+		return consume(model.(T))
+	})
+}
+
+// RunOne executes the query and returns the first model that fits the
+// criteria. If no model fits the criteria, RunOne returns nil and a
+// ModelNotFoundError. See Query.RunOne for more information.
+func (tq *TypedQuery[T]) RunOne() (T, error) {
+	var zero T
+	model, err := newTypedModel[T]()
+	if err != nil {
+		return zero, err
+	}
+	if err := tq.query.RunOne(model); err != nil {
+		return zero, err
+	}
+	return model, nil
+}
+
+// Count returns the number of models that fit the criteria. See Query.Count
+// for more information.
+func (tq *TypedQuery[T]) Count() (int, error) {
+	return tq.query.Count()
+}
+
+// Distinct returns the distinct values of the given indexed field for the
+// models that fit the criteria. See Query.Distinct for more information.
+func (tq *TypedQuery[T]) Distinct(fieldName string) ([]string, error) {
+	return tq.query.Distinct(fieldName)
+}
+
+// Ids returns the ids of the models that fit the criteria. See Query.Ids for
+// more information.
+func (tq *TypedQuery[T]) Ids() ([]string, error) {
+	return tq.query.Ids()
+}
@@ -0,0 +1,138 @@
+// Copyright 2015 Alex Browne.  All rights reserved.
+// Use of this source code is governed by the MIT
+// license, which can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+// File typed_collection_test.go tests the generic wrappers in
+// typed_collection.go.
+
+package zoom
+
+import "testing"
+
+func TestTypedCollection(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	people, err := Typed[*indexedTestModel](indexedTestModels)
+	if err != nil {
+		t.Fatalf("Unexpected error in Typed: %s", err.Error())
+	}
+	models := createIndexedTestModels(5)
+	for _, model := range models {
+		if err := people.Save(model); err != nil {
+			t.Fatalf("Unexpected error in TypedCollection.Save: %s", err.Error())
+		}
+	}
+
+	// Find should return a new model.
+	got, err := people.Find(models[0].ModelId())
+	if err != nil {
+		t.Fatalf("Unexpected error in TypedCollection.Find: %s", err.Error())
+	}
+	if err := expectModelsToBeEqual(models[:1], []*indexedTestModel{got}, true); err != nil {
+		t.Error(err)
+	}
+	gotAll, err := people.FindAll()
+	if err != nil {
+		t.Fatalf("Unexpected error in TypedCollection.FindAll: %s", err.Error())
+	}
+	if err := expectModelsToBeEqual(models, gotAll, false); err != nil {
+		t.Error(err)
+	}
+
+	// Query finishers should return typed results.
+	q := people.NewQuery().Order("Int").Filter("Bool =", true)
+	gotModels, err := q.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error in TypedQuery.Run: %s", err.Error())
+	}
+	expected := expectedResultsForQuery(q.Query().query, models)
+	if err := expectModelsToBeEqual(expected, gotModels, true); err != nil {
+		t.Error(err)
+	}
+	if len(expected) > 0 {
+		one, err := q.RunOne()
+		if err != nil {
+			t.Fatalf("Unexpected error in TypedQuery.RunOne: %s", err.Error())
+		}
+		if err := expectModelsToBeEqual(expected[:1], []*indexedTestModel{one}, true); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// RunWith should pass typed models to consume.
+	gotWith := []*indexedTestModel{}
+	if err := q.RunWith(func() *indexedTestModel {
+		return &indexedTestModel{}
+	}, func(model *indexedTestModel) error {
+		gotWith = append(gotWith, model)
+		return nil
+	}); err != nil {
+		t.Fatalf("Unexpected error in TypedQuery.RunWith: %s", err.Error())
+	}
+	if err := expectModelsToBeEqual(expected, gotWith, true); err != nil {
+		t.Error(err)
+	}
+
+	// A query with no results should return an empty, non-nil slice, and RunOne
+	// should return nil and a ModelNotFoundError.
+	empty := people.NewQuery().Filter("Int >", maxExactScore)
+	if gotModels, err := empty.Run(); err != nil {
+		t.Errorf("Unexpected error in TypedQuery.Run: %s", err.Error())
+	} else if gotModels == nil || len(gotModels) != 0 {
+		t.Errorf("Expected an empty slice but got %v", gotModels)
+	}
+	if one, err := empty.RunOne(); err == nil {
+		t.Error("Expected an error from RunOne for a query with no results but got none")
+	} else if _, ok := err.(ModelNotFoundError); !ok {
+		t.Errorf("Expected a ModelNotFoundError but got: %T: %s", err, err.Error())
+	} else if one != nil {
+		t.Errorf("Expected RunOne to return nil but got %v", one)
+	}
+}
+
+func TestTypedCollectionNil(t *testing.T) {
+	testingSetUp()
+	defer testingTearDown()
+
+	people, err := Typed[*indexedTestModel](indexedTestModels)
+	if err != nil {
+		t.Fatalf("Unexpected error in Typed: %s", err.Error())
+	}
+	// Saving a nil model should return an error instead of panicking.
+	if err := people.Save(nil); err == nil {
+		t.Error("Expected an error for a nil model but got none")
+	}
+	if err := people.SaveFields([]string{"Int"}, nil); err == nil {
+		t.Error("Expected an error for a nil model but got none")
+	}
+	// Find should return nil if the model does not exist.
+	if got, err := people.Find("invalidId"); err == nil {
+		t.Error("Expected an error for a model that does not exist but got none")
+	} else if got != nil {
+		t.Errorf("Expected Find to return nil but got %v", got)
+	}
+	// FindOrZero should return a zero-valued model instead.
+	if got, found, err := people.FindOrZero("invalidId"); err != nil {
+		t.Errorf("Unexpected error in FindOrZero: %s", err.Error())
+	} else if found {
+		t.Error("Expected FindOrZero to return false for a model that does not exist")
+	} else if got == nil || *got != (indexedTestModel{}) {
+		t.Errorf("Expected FindOrZero to return a zero-valued model but got %v", got)
+	}
+
+	// Typed should check the type of the collection, and T must be a pointer
+	// to a struct.
+	if _, err := Typed[*testModel](indexedTestModels); err == nil {
+		t.Error("Expected an error for the wrong type but got none")
+	}
+	if _, err := Typed[*indexedTestModel](nil); err == nil {
+		t.Error("Expected an error for a nil collection but got none")
+	}
+	if _, err := NewTypedCollection[Model](testPool); err == nil {
+		t.Error("Expected an error for a type parameter which is not a pointer to a struct but got none")
+	}
+}
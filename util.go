@@ -197,6 +197,34 @@ func numericScore(val reflect.Value) float64 {
 	}
 }
 
+// maxExactScore is the largest integer n such that every integer between -n and
+// n can be represented exactly by a float64 (i.e. 2^53). Sorted set scores in
+// Redis are float64s, so integers outside of this range cannot be indexed
+// without losing precision.
+const maxExactScore = 1 << 53
+
+// checkExactScore returns an error if val is an integer which cannot be
+// represented exactly by a float64, and therefore cannot be used as the score
+// in a sorted set without corrupting the order of the index. If val is a
+// pointer, it will keep dereferencing until it reaches the underlying value.
+// Floats and all other types are always considered exact.
+func checkExactScore(val reflect.Value) error {
+	for val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	switch val.Kind() {
+	case reflect.Int, reflect.Int64:
+		if integer := val.Int(); integer > maxExactScore || integer < -maxExactScore {
+			return fmt.Errorf("zoom: cannot use %d in a numeric index because it cannot be represented exactly by a float64. Numeric indexes only support integers between -2^53 and 2^53.", integer)
+		}
+	case reflect.Uint, reflect.Uint64:
+		if uinteger := val.Uint(); uinteger > maxExactScore {
+			return fmt.Errorf("zoom: cannot use %d in a numeric index because it cannot be represented exactly by a float64. Numeric indexes only support integers between -2^53 and 2^53.", uinteger)
+		}
+	}
+	return nil
+}
+
 // boolScore returns an int which is the score for val in a sorted set.
 // If val is a pointer, it will keep dereferencing until it reaches the underlying
 // value. It panics if val is not a boolean or a pointer to a boolean.
@@ -281,20 +309,18 @@ func getHardwareId() string {
 	return hardwareId
 }
 
-var counter int32 = 0
+var counter uint32 = 0
 
 // getAtomicCounter returns the base58 encoding of a counter which cycles through
 // the values in the range 0 to 11,316,495. This is the range that can be represented
 // with 4 base58 characters. The returned result will be padded with zeros such that
 // it is always 4 characters long.
 func getAtomicCounter() string {
-	atomic.AddInt32(&counter, 1)
-	if counter > 58*58*58*58-1 {
-		// Reset the counter if we're beyond what we
-		// can represent with 4 base58 characters
-		atomic.StoreInt32(&counter, 0)
-	}
-	counterBytes := base58.EncodeBig(nil, big.NewInt(int64(counter)))
+	// Use the value returned by AddUint32 instead of reading counter again, so
+	// that concurrent callers never see the same value. Wrap around if we're
+	// beyond what we can represent with 4 base58 characters.
+	value := atomic.AddUint32(&counter, 1) % (58 * 58 * 58 * 58)
+	counterBytes := base58.EncodeBig(nil, big.NewInt(int64(value)))
 	counterStr := string(counterBytes)
 	switch len(counterStr) {
 	case 0:
@@ -310,10 +336,10 @@ func getAtomicCounter() string {
 	}
 }
 
-// randomInt returns a pseudo-random int between the minimum and maximum
-// possible values.
+// randomInt returns a pseudo-random non-negative int which can be represented
+// exactly by a float64, and can therefore be stored in a numeric index.
 func randomInt() int {
-	return rand.Int()
+	return int(rand.Int63n(maxExactScore + 1))
 }
 
 // randomString returns a random string of length 16